@@ -120,6 +120,7 @@ $(STATUS_FLAGS_DIR)/imager_disk_output.flag: $(go-imager) $(image_package_cache_
 		--base-dir=$(CONFIG_BASE_DIR) \
 		--log-level=$(LOG_LEVEL) \
 		--log-file=$(LOGS_DIR)/imggen/imager.log \
+		$(if $(METRICS_DIR),--metrics-file="$(METRICS_DIR)/imager.prom") \
 		--local-repo $(local_and_external_rpm_cache) \
 		--tdnf-worker $(BUILD_DIR)/worker/worker_chroot.tar.gz \
 		--repo-file=$(imggen_local_repo) \
@@ -141,6 +142,7 @@ image: $(imager_disk_output_dir) $(imager_disk_output_files) $(go-roast) $(depen
 		--release-version $(RELEASE_VERSION) \
 		--log-level=$(LOG_LEVEL) \
 		--log-file=$(LOGS_DIR)/imggen/roast.log \
+		$(if $(METRICS_DIR),--metrics-file="$(METRICS_DIR)/roast.prom") \
 		--image-tag=$(IMAGE_TAG)
 
 $(image_external_package_cache_summary): $(cached_file) $(go-imagepkgfetcher) $(chroot_worker) $(graph_file) $(depend_CONFIG_FILE) $(CONFIG_FILE) $(validate-config)
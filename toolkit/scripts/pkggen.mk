@@ -29,16 +29,19 @@ validate-pkggen-config = $(STATUS_FLAGS_DIR)/validate-image-config-pkggen.flag
 
 # Outputs
 specs_file        = $(PKGBUILD_DIR)/specs.json
-graph_file        = $(PKGBUILD_DIR)/graph.dot
-cached_file       = $(PKGBUILD_DIR)/cached_graph.dot
-preprocessed_file = $(PKGBUILD_DIR)/preprocessed_graph.dot
-built_file        = $(PKGBUILD_DIR)/built_graph.dot
+graph_file        = $(PKGBUILD_DIR)/graph.$(PACKAGE_GRAPH_FORMAT)
+cached_file       = $(PKGBUILD_DIR)/cached_graph.$(PACKAGE_GRAPH_FORMAT)
+preprocessed_file = $(PKGBUILD_DIR)/preprocessed_graph.$(PACKAGE_GRAPH_FORMAT)
+built_file        = $(PKGBUILD_DIR)/built_graph.$(PACKAGE_GRAPH_FORMAT)
+build_journal     = $(PKGBUILD_DIR)/build_journal.jsonl
+build_summary     = $(PKGBUILD_DIR)/build_summary.json
+repro_report      = $(PKGBUILD_DIR)/reproducibility_report.json
 
 logging_command = --log-file=$(LOGS_DIR)/pkggen/workplan/$(notdir $@).log --log-level=$(LOG_LEVEL)
 $(call create_folder,$(LOGS_DIR)/pkggen/workplan)
 $(call create_folder,$(rpmbuilding_logs_dir))
 
-.PHONY: clean-workplan clean-cache graph-cache analyze-built-graph
+.PHONY: clean-workplan clean-cache graph-cache analyze-built-graph analyze-build-history diff-graph
 graph-cache: $(cached_file)
 clean: clean-workplan clean-cache
 clean-workplan:
@@ -63,8 +66,38 @@ analyze-built-graph: $(go-graphanalytics)
 		exit 1; \
 	fi
 
+# Optionally report how the dependency graph changed compared to an earlier graph, such as one from another branch.
+diff-graph: $(graph_file) $(go-graphdiff)
+	if [ -f "$(GRAPH_DIFF_BASELINE)" ]; then \
+		$(go-graphdiff) \
+			--old-graph="$(GRAPH_DIFF_BASELINE)" \
+			--new-graph="$(graph_file)" \
+			--output="$(PKGBUILD_DIR)/graph_diff.json" \
+			$(logging_command); \
+	else \
+		echo "GRAPH_DIFF_BASELINE must be set to an earlier graph file to compare against"; \
+		exit 1; \
+	fi
+
+# Optionally generate a report of the slowest package builds and any build time regressions.
+analyze-build-history: $(go-buildhistoryreport)
+	if [ -f $(BUILD_HISTORY_FILE) ]; then \
+		$(go-buildhistoryreport) \
+			--build-history-file=$(BUILD_HISTORY_FILE) \
+			$(logging_command) \
+			slowest \
+			--max-results=$(NUM_OF_ANALYTICS_RESULTS) && \
+		$(go-buildhistoryreport) \
+			--build-history-file=$(BUILD_HISTORY_FILE) \
+			$(logging_command) \
+			regressions; \
+	else \
+		echo "No build history to analyze"; \
+		exit 1; \
+	fi
+
 # Parse all specs in $(BUILD_SPECS_DIR) and generate a specs.json file encoding all dependency information
-$(specs_file): $(chroot_worker) $(BUILD_SPECS_DIR) $(build_specs) $(build_spec_dirs) $(go-specreader)
+$(specs_file): $(chroot_worker) $(BUILD_SPECS_DIR) $(build_specs) $(build_spec_dirs) $(go-specreader) $(depend_SEPARATE_DEBUG_RPMS) $(depend_DEBUG_PACKAGE_LIST) $(depend_BOOTSTRAP_SPECS_FILE) $(BOOTSTRAP_SPECS_FILE)
 	$(go-specreader) \
 		--dir $(BUILD_SPECS_DIR) \
 		--build-dir $(BUILD_DIR)/spec_parsing \
@@ -73,6 +106,10 @@ $(specs_file): $(chroot_worker) $(BUILD_SPECS_DIR) $(build_specs) $(build_spec_d
 		--dist-tag $(DIST_TAG) \
 		--worker-tar $(chroot_worker) \
 		$(if $(filter y,$(RUN_CHECK)),--run-check) \
+		$(if $(filter y,$(SEPARATE_DEBUG_RPMS)),--exclude-debug-packages) \
+		$(if $(filter y,$(SEPARATE_DEBUG_RPMS)),--debug-rpm-dir="$(DEBUG_RPMS_DIR)") \
+		$(if $(filter y,$(SEPARATE_DEBUG_RPMS)),$(foreach package,$(DEBUG_PACKAGE_LIST),--include-debug-package="$(package)")) \
+		$(if $(BOOTSTRAP_SPECS_FILE),--bootstrap-specs-file="$(BOOTSTRAP_SPECS_FILE)") \
 		$(logging_command) \
 		--output $@
 
@@ -123,6 +160,7 @@ $(cached_file): $(graph_file) $(go-graphpkgfetcher) $(chroot_worker) $(pkggen_lo
 		--tls-key=$(TLS_KEY) \
 		$(foreach repo, $(pkggen_local_repo) $(graphpkgfetcher_cloned_repo) $(REPO_LIST),--repo-file=$(repo) ) \
 		$(graphpkgfetcher_extra_flags) \
+		$(if $(METRICS_DIR),--metrics-file="$(METRICS_DIR)/graphpkgfetcher.prom") \
 		$(logging_command) \
 		--input-summary-file=$(PACKAGE_CACHE_SUMMARY) \
 		--output-summary-file=$(PKGBUILD_DIR)/graph_external_deps.json \
@@ -142,7 +180,7 @@ $(preprocessed_file): $(cached_file) $(go-graphPreprocessor)
 pkggen_archive	= $(OUT_DIR)/rpms.tar.gz
 srpms_archive  	= $(OUT_DIR)/srpms.tar.gz
 
-.PHONY: build-packages clean-build-packages hydrate-rpms compress-rpms clean-compress-rpms compress-srpms clean-compress-srpms
+.PHONY: build-packages clean-build-packages hydrate-rpms compress-rpms clean-compress-rpms compress-srpms clean-compress-srpms check-reproducibility
 
 # Execute the package build scheduler.
 build-packages: $(RPMS_DIR)
@@ -150,6 +188,7 @@ build-packages: $(RPMS_DIR)
 clean: clean-build-packages clean-compress-rpms clean-compress-srpms
 clean-build-packages:
 	rm -rf $(RPMS_DIR)
+	rm -rf $(DEBUG_RPMS_DIR)
 	rm -rf $(LOGS_DIR)/pkggen/failures.txt
 	rm -rf $(rpmbuilding_logs_dir)
 	rm -rf $(STATUS_FLAGS_DIR)/build-rpms.flag
@@ -170,7 +209,7 @@ $(RPMS_DIR):
 	@touch $@
 endif
 
-$(STATUS_FLAGS_DIR)/build-rpms.flag: $(preprocessed_file) $(chroot_worker) $(go-scheduler) $(go-pkgworker) $(depend_STOP_ON_PKG_FAIL) $(CONFIG_FILE) $(depend_CONFIG_FILE)
+$(STATUS_FLAGS_DIR)/build-rpms.flag: $(preprocessed_file) $(chroot_worker) $(go-scheduler) $(go-pkgworker) $(depend_STOP_ON_PKG_FAIL) $(depend_SEPARATE_DEBUG_RPMS) $(CONFIG_FILE) $(depend_CONFIG_FILE)
 	$(go-scheduler) \
 		--input="$(preprocessed_file)" \
 		--output="$(built_file)" \
@@ -187,21 +226,65 @@ $(STATUS_FLAGS_DIR)/build-rpms.flag: $(preprocessed_file) $(chroot_worker) $(go-
 		--distro-build-number="$(BUILD_NUMBER)" \
 		--rpmmacros-file="$(TOOLCHAIN_MANIFESTS_DIR)/macros.override" \
 		--build-attempts="$(PACKAGE_BUILD_RETRIES)" \
-		--build-agent="chroot-agent" \
+		--build-agent="$(PACKAGE_BUILD_AGENT)" \
+		--container-runtime="$(CONTAINER_RUNTIME)" \
+		$(foreach worker,$(REMOTE_BUILD_WORKERS),--remote-worker="$(worker)" ) \
+		--max-cpus="$(PACKAGE_BUILD_MAX_CPUS)" \
+		--max-memory-mb="$(PACKAGE_BUILD_MAX_MEMORY_MB)" \
+		--max-build-time="$(PACKAGE_BUILD_MAX_TIME)" \
+		--build-timeout="$(PACKAGE_BUILD_TIMEOUT)" \
+		$(if $(PACKAGE_BUILD_LIMITS_FILE),--build-limits-file="$(PACKAGE_BUILD_LIMITS_FILE)") \
 		--build-agent-program="$(go-pkgworker)" \
 		--ignored-packages="$(PACKAGE_IGNORE_LIST)" \
 		--packages="$(PACKAGE_BUILD_LIST)" \
 		--rebuild-packages="$(PACKAGE_REBUILD_LIST)" \
 		--image-config-file="$(CONFIG_FILE)" \
 		--reserved-file-list-file="$(TOOLCHAIN_MANIFEST)" \
+		--build-journal-file="$(build_journal)" \
+		--build-history-file="$(BUILD_HISTORY_FILE)" \
+		--summary-file="$(build_summary)" \
+		$(if $(BUILD_SUMMARY_JUNIT_FILE),--junit-summary-file="$(BUILD_SUMMARY_JUNIT_FILE)") \
+		$(if $(BUILD_CACHE_DIR),--build-cache-dir="$(BUILD_CACHE_DIR)") \
+		$(if $(BUILD_STATUS_ADDRESS),--status-address="$(BUILD_STATUS_ADDRESS)") \
+		$(if $(METRICS_DIR),--metrics-file="$(METRICS_DIR)/scheduler.prom") \
 		$(if $(CONFIG_FILE),--base-dir="$(CONFIG_BASE_DIR)") \
 		$(if $(filter y,$(RUN_CHECK)),--run-check) \
+		$(if $(and $(filter y,$(RUN_CHECK)),$(NON_FATAL_CHECKS_FILE)),--non-fatal-checks-file="$(NON_FATAL_CHECKS_FILE)") \
+		$(if $(filter y,$(SEPARATE_DEBUG_RPMS)),--debug-rpm-dir="$(DEBUG_RPMS_DIR)") \
 		$(if $(filter y,$(STOP_ON_PKG_FAIL)),--stop-on-failure) \
+		$(if $(PACKAGE_BUILD_FAILURE_POLICY),--failure-policy="$(PACKAGE_BUILD_FAILURE_POLICY)") \
+		$(if $(filter y,$(RESUME_BUILD)),--resume) \
 		$(if $(filter-out y,$(USE_PACKAGE_BUILD_CACHE)),--no-cache) \
 		$(if $(filter-out y,$(CLEANUP_PACKAGE_BUILDS)),--no-cleanup) \
+		$(if $(filter y,$(REUSE_PACKAGE_BUILD_CHROOTS)),--chroot-pool-dir="$(CHROOT_DIR)/pool") \
+		$(if $(filter y,$(CACHE_BUILD_DEPENDENCIES)),--cache-dependencies) \
 		$(logging_command) && \
 	touch $@
 
+# Build each package in $(REPRODUCIBILITY_CHECK_LIST) twice in independent chroots and compare the resulting RPMs.
+check-reproducibility: $(STATUS_FLAGS_DIR)/build-rpms.flag $(chroot_worker) $(go-reprocheck) $(go-pkgworker)
+	$(if $(REPRODUCIBILITY_CHECK_LIST),,$(error Must set REPRODUCIBILITY_CHECK_LIST=))
+	$(go-reprocheck) \
+		--input="$(built_file)" \
+		--packages="$(REPRODUCIBILITY_CHECK_LIST)" \
+		--report-file="$(repro_report)" \
+		--work-dir="$(CHROOT_DIR)/reprocheck" \
+		--worker-tar="$(chroot_worker)" \
+		--repo-file="$(pkggen_local_repo)" \
+		--rpm-dir="$(RPMS_DIR)" \
+		--cache-dir="$(CACHED_RPMS_DIR)/cache" \
+		--build-logs-dir="$(LOGS_DIR)/pkggen/reprocheck" \
+		--dist-tag="$(DIST_TAG)" \
+		--distro-release-version="$(RELEASE_VERSION)" \
+		--distro-build-number="$(BUILD_NUMBER)" \
+		--rpmmacros-file="$(TOOLCHAIN_MANIFESTS_DIR)/macros.override" \
+		--build-agent="$(if $(filter container-agent,$(PACKAGE_BUILD_AGENT)),container-agent,chroot-agent)" \
+		--container-runtime="$(CONTAINER_RUNTIME)" \
+		--build-agent-program="$(go-pkgworker)" \
+		$(if $(filter y,$(RUN_CHECK)),--run-check) \
+		$(if $(filter-out y,$(CLEANUP_PACKAGE_BUILDS)),--no-cleanup) \
+		$(logging_command)
+
 # use temp tarball to avoid tar warning "file changed as we read it"
 # that can sporadically occur when tarball is the dir that is compressed
 compress-rpms:
@@ -15,10 +15,12 @@ $(call create_folder,$(BUILD_DIR)/tools)
 # List of go utilities in tools/ directory
 go_tool_list = \
 	boilerplate \
+	buildhistoryreport \
 	depsearch \
 	grapher \
 	graphpkgfetcher \
 	graphanalytics \
+	graphdiff \
 	graphPreprocessor \
 	imageconfigvalidator \
 	imagepkgfetcher \
@@ -26,6 +28,8 @@ go_tool_list = \
 	isomaker \
 	liveinstaller \
 	pkgworker \
+	remoteworker \
+	reprocheck \
 	roast \
 	scheduler \
 	specreader \
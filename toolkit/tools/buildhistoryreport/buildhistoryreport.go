@@ -0,0 +1,93 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"os"
+	"time"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+	"microsoft.com/pkggen/internal/buildhistory"
+	"microsoft.com/pkggen/internal/exe"
+	"microsoft.com/pkggen/internal/logger"
+)
+
+const (
+	defaultMaxResults    = "10"
+	defaultMinIncrease   = "1m"
+	defaultMinPercentage = "25"
+)
+
+var (
+	app              = kingpin.New("buildhistoryreport", "A tool to report on the package build history recorded by the scheduler.")
+	buildHistoryFile = app.Flag("build-history-file", "Path to the build history file written by the scheduler.").Required().ExistingFile()
+	logFile          = exe.LogFileFlag(app)
+	logLevel         = exe.LogLevelFlag(app)
+
+	slowestCommand = app.Command("slowest", "Print the packages with the slowest latest build.")
+	maxResults     = slowestCommand.Flag("max-results", "The number of packages to print. Set 0 to print unlimited.").Default(defaultMaxResults).Int()
+
+	regressionsCommand = app.Command("regressions", "Print the packages whose latest build was slower than the build before it.")
+	minIncrease        = regressionsCommand.Flag("min-increase", "The minimum increase in build time to report.").Default(defaultMinIncrease).Duration()
+	minPercentage      = regressionsCommand.Flag("min-percentage", "The minimum increase in build time to report, as a percentage of the previous build time.").Default(defaultMinPercentage).Float64()
+)
+
+func main() {
+	app.Version(exe.ToolkitVersion)
+	command := kingpin.MustParse(app.Parse(os.Args[1:]))
+
+	logger.InitBestEffort(*logFile, *logLevel)
+
+	history, err := buildhistory.Load(*buildHistoryFile, buildhistory.DefaultMaxRecords)
+	if err != nil {
+		logger.Log.Fatalf("Unable to load build history, error: %s", err)
+	}
+
+	switch command {
+	case slowestCommand.FullCommand():
+		printSlowest(history, *maxResults)
+	case regressionsCommand.FullCommand():
+		printRegressions(history, *minIncrease, *minPercentage/100)
+	}
+}
+
+// printSlowest prints the packages with the slowest latest successful build.
+func printSlowest(history *buildhistory.History, maxResults int) {
+	slowest := history.Slowest(maxResults)
+
+	printTitle("Slowest package builds")
+	for i, entry := range slowest {
+		logger.Log.Infof("%d. %s - %s (%d attempt(s)), built %s", i+1, entry.Record.SrpmName, entry.Duration.Round(time.Second), entry.Record.Attempts, entry.Record.EndTime.Format(time.RFC3339))
+	}
+}
+
+// printRegressions prints the packages whose latest successful build was slower than the previous successful build.
+func printRegressions(history *buildhistory.History, minIncrease time.Duration, minRatio float64) {
+	regressions := history.Regressions(minIncrease, minRatio)
+
+	printTitle("Package build time regressions")
+	if len(regressions) == 0 {
+		logger.Log.Info("No regressions found")
+		return
+	}
+
+	for i, regression := range regressions {
+		previousDuration := regression.Previous.Duration()
+		latestDuration := regression.Latest.Duration()
+
+		logger.Log.Infof("%d. %s - %s -> %s (+%s, +%.0f%%)", i+1, regression.Latest.SrpmName, previousDuration.Round(time.Second), latestDuration.Round(time.Second),
+			regression.Increase().Round(time.Second), 100*float64(regression.Increase())/float64(previousDuration))
+		if regression.Previous.SrpmName != regression.Latest.SrpmName {
+			logger.Log.Infof("   (previously built from %s)", regression.Previous.SrpmName)
+		}
+	}
+}
+
+// printTitle prints a formatted title
+func printTitle(title string) {
+	logger.Log.Info("")
+	logger.Log.Info("================================================")
+	logger.Log.Info(title)
+	logger.Log.Info("================================================")
+}
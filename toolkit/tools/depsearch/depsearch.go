@@ -26,7 +26,7 @@ const (
 var (
 	app = kingpin.New("depsearch", "Returns a list of everything that depends on a given package or spec")
 
-	inputGraphFile  = exe.InputFlag(app, "Path to the DOT graph file to search.")
+	inputGraphFile  = exe.InputFlag(app, "Path to the graph file to search. Files with a .json extension use the JSON graph format, others DOT.")
 	outputGraphFile = app.Flag("output", "Path to save the graph.").String()
 
 	pkgsToSearch  = app.Flag("packages", "Space seperated list of packages to search from.").String()
@@ -79,9 +79,9 @@ func main() {
 	goalSearchList := exe.ParseListArgument(*goalsToSearch)
 
 	graph := pkggraph.NewPkgGraph()
-	err := pkggraph.ReadDOTGraphFile(graph, *inputGraphFile)
+	err := pkggraph.ReadGraphFile(graph, *inputGraphFile)
 	if err != nil {
-		logger.Log.Panicf("Failed to read DOT graph with error: %s", err)
+		logger.Log.Panicf("Failed to read graph with error: %s", err)
 	}
 
 	// Generate a list of nodes to search from
@@ -113,7 +113,7 @@ func main() {
 	printSpecs(outputGraph, *printTree, *filter, *filterFile, *printDuplicates, *verbosity, *maxDepth, root)
 
 	if len(*outputGraphFile) > 0 {
-		pkggraph.WriteDOTGraphFile(outputGraph, *outputGraphFile)
+		pkggraph.WriteGraphFile(outputGraph, *outputGraphFile)
 	}
 }
 
@@ -150,25 +150,15 @@ func searchForGoal(graph *pkggraph.PkgGraph, goals []string) (list []*pkggraph.P
 }
 
 func searchForPkg(graph *pkggraph.PkgGraph, packages []string) (list []*pkggraph.PkgNode) {
-	for _, n := range graph.AllRunNodes() {
-		nodeName := n.VersionedPkg.Name
-		for _, searchName := range packages {
-			if nodeName == searchName {
-				list = append(list, n)
-			}
-		}
+	for _, searchName := range packages {
+		list = append(list, graph.RunNodesByName(searchName)...)
 	}
 	return
 }
 
 func searchForSpec(graph *pkggraph.PkgGraph, specs []string) (list []*pkggraph.PkgNode) {
-	for _, n := range graph.AllRunNodes() {
-		nodeSpec := n.SpecName()
-		for _, searchSpec := range specs {
-			if nodeSpec == searchSpec {
-				list = append(list, n)
-			}
-		}
+	for _, searchSpec := range specs {
+		list = append(list, graph.RunNodesForSpec(searchSpec)...)
 	}
 	return
 }
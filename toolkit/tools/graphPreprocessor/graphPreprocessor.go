@@ -29,7 +29,7 @@ func replaceRunNodesWithPrebuiltNodes(pkgGraph *pkggraph.PkgGraph) (err error) {
 			continue
 		}
 
-		isPrebuilt, _, missing := pkggraph.IsSRPMPrebuilt(node.SrpmPath, pkgGraph, nil)
+		isPrebuilt, _, missing := pkggraph.IsSRPMPrebuilt(node.SrpmPath, pkgGraph)
 
 		if isPrebuilt == false {
 			logger.Log.Tracef("Can't mark %s as prebuilt, missing: %v", node.SrpmPath, missing)
@@ -68,7 +68,7 @@ func main() {
 
 	scrubbedGraph := pkggraph.NewPkgGraph()
 
-	err := pkggraph.ReadDOTGraphFile(scrubbedGraph, *inputGraphFile)
+	err := pkggraph.ReadGraphFile(scrubbedGraph, *inputGraphFile)
 	if err != nil {
 		logger.Log.Panicf("Failed to read graph to file, %s. Error: %s", *inputGraphFile, err)
 	}
@@ -82,7 +82,7 @@ func main() {
 		}
 	}
 
-	err = pkggraph.WriteDOTGraphFile(scrubbedGraph, *outputGraphFile)
+	err = pkggraph.WriteGraphFile(scrubbedGraph, *outputGraphFile)
 	if err != nil {
 		logger.Log.Panicf("Failed to write cache graph to file, %s. Error: %s", *outputGraphFile, err)
 	}
@@ -33,7 +33,7 @@ type mapPair struct {
 
 var (
 	app            = kingpin.New("graphanalytics", "A tool to print analytics of a given dependency graph.")
-	inputGraphFile = exe.InputFlag(app, "Path to the DOT graph file to analyze.")
+	inputGraphFile = exe.InputFlag(app, "Path to the graph file to analyze. Files with a .json extension use the JSON graph format, others DOT.")
 	maxResults     = app.Flag("max-results", "The number of results to print per category. Set 0 to print unlimited.").Default(defaultMaxResults).Int()
 	logFile        = exe.LogFileFlag(app)
 	logLevel       = exe.LogLevelFlag(app)
@@ -54,7 +54,7 @@ func main() {
 // analyzeGraph analyzes and prints various attributes of a graph file.
 func analyzeGraph(inputFile string, maxResults int) (err error) {
 	pkgGraph := pkggraph.NewPkgGraph()
-	err = pkggraph.ReadDOTGraphFile(pkgGraph, inputFile)
+	err = pkggraph.ReadGraphFile(pkgGraph, inputFile)
 	if err != nil {
 		return
 	}
@@ -78,7 +78,7 @@ func printIndirectlyMostUnresolved(pkgGraph *pkggraph.PkgGraph, maxResults int)
 		}
 
 		// Traverse each package (not unresolved or failed) to find all unresolved nodes that are blocking it.
-		if node.State == pkggraph.StateUnresolved || node.State == pkggraph.StateBuildError {
+		if node.State == pkggraph.StateUnresolved || node.State == pkggraph.StateBuildError || node.State == pkggraph.StateTimedOut {
 			continue
 		}
 
@@ -152,6 +152,8 @@ func printDirectlyClosestToBeingUnblocked(pkgGraph *pkggraph.PkgGraph, maxResult
 			// Only consider blocking nodes.
 			if dependency.State != pkggraph.StateBuild &&
 				dependency.State != pkggraph.StateBuildError &&
+				dependency.State != pkggraph.StateTimedOut &&
+				dependency.State != pkggraph.StateBlocked &&
 				dependency.State != pkggraph.StateUnresolved {
 				continue
 			}
@@ -191,7 +193,7 @@ func printIndirectlyClosestToBeingUnblocked(pkgGraph *pkggraph.PkgGraph, maxResu
 			dependency := n.(*pkggraph.PkgNode)
 
 			// Only consider unresolved or failed build nodes.
-			if dependency.State != pkggraph.StateUnresolved && dependency.State != pkggraph.StateBuildError {
+			if dependency.State != pkggraph.StateUnresolved && dependency.State != pkggraph.StateBuildError && dependency.State != pkggraph.StateTimedOut {
 				return
 			}
 
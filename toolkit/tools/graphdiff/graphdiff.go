@@ -0,0 +1,350 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+	"microsoft.com/pkggen/internal/exe"
+	"microsoft.com/pkggen/internal/jsonutils"
+	"microsoft.com/pkggen/internal/logger"
+	"microsoft.com/pkggen/internal/pkggraph"
+	"microsoft.com/pkggen/internal/pkgjson"
+	"microsoft.com/pkggen/internal/sliceutils"
+)
+
+// dependency is a Requires or BuildRequires edge between two packages.
+// For Requires, From is the name of the requiring package. For BuildRequires, From is the name of the requiring spec.
+// Packages and specs of a bootstrap stage are followed by the stage's bcond, e.g. "gcc[bootstrap]".
+type dependency struct {
+	From string
+	To   string
+}
+
+// versionChange is a package whose versions differ between the two graphs.
+// Versions of packages not built locally are the constraints on them followed by "(remote)", e.g. ">=1.2 (remote)".
+type versionChange struct {
+	Package     string
+	OldVersions []string
+	NewVersions []string
+}
+
+// stateChange is a node whose state differs between the two graphs.
+type stateChange struct {
+	Node     string
+	OldState string
+	NewState string
+}
+
+// graphDiff holds every difference found between two graphs.
+type graphDiff struct {
+	AddedPackages        []string
+	RemovedPackages      []string
+	VersionChanges       []versionChange
+	AddedRequires        []dependency
+	RemovedRequires      []dependency
+	AddedBuildRequires   []dependency
+	RemovedBuildRequires []dependency
+	StateChanges         []stateChange
+}
+
+// graphSummary holds the parts of a graph which are compared.
+type graphSummary struct {
+	packageVersions map[string][]string
+	requires        map[dependency]bool
+	buildRequires   map[dependency]bool
+	nodeStates      map[string]string
+}
+
+var (
+	app              = kingpin.New("graphdiff", "A tool to report how a package dependency graph changed compared to an earlier graph.")
+	oldGraph         = app.Flag("old-graph", "Path to the earlier graph file. Files with a .json extension use the JSON graph format, others DOT.").Required().ExistingFile()
+	newGraph         = app.Flag("new-graph", "Path to the later graph file. Files with a .json extension use the JSON graph format, others DOT.").Required().ExistingFile()
+	outputFile       = app.Flag("output", "Optional path to save the differences to as JSON.").String()
+	ignoreNodeStates = app.Flag("ignore-node-states", "Do not report nodes whose state changed, for example when comparing graphs from different build stages.").Bool()
+	logFile          = exe.LogFileFlag(app)
+	logLevel         = exe.LogLevelFlag(app)
+)
+
+func main() {
+	app.Version(exe.ToolkitVersion)
+	kingpin.MustParse(app.Parse(os.Args[1:]))
+
+	logger.InitBestEffort(*logFile, *logLevel)
+
+	oldSummary, err := summarizeGraphFile(*oldGraph)
+	if err != nil {
+		logger.Log.Fatalf("Unable to read graph (%s), error: %s", *oldGraph, err)
+	}
+
+	newSummary, err := summarizeGraphFile(*newGraph)
+	if err != nil {
+		logger.Log.Fatalf("Unable to read graph (%s), error: %s", *newGraph, err)
+	}
+
+	diff := diffGraphs(oldSummary, newSummary, *ignoreNodeStates)
+	printDiff(diff)
+
+	if *outputFile != "" {
+		err = jsonutils.WriteJSONFile(*outputFile, diff)
+		if err != nil {
+			logger.Log.Fatalf("Unable to save graph differences to (%s), error: %s", *outputFile, err)
+		}
+	}
+}
+
+// summarizeGraphFile reads a graph file and collects the parts of it which are compared.
+func summarizeGraphFile(graphFile string) (summary *graphSummary, err error) {
+	pkgGraph := pkggraph.NewPkgGraph()
+	err = pkggraph.ReadGraphFile(pkgGraph, graphFile)
+	if err != nil {
+		return
+	}
+
+	summary = summarizeGraph(pkgGraph)
+	return
+}
+
+// summarizeGraph collects the parts of a graph which are compared.
+func summarizeGraph(pkgGraph *pkggraph.PkgGraph) (summary *graphSummary) {
+	summary = &graphSummary{
+		packageVersions: make(map[string][]string),
+		requires:        make(map[dependency]bool),
+		buildRequires:   make(map[dependency]bool),
+		nodeStates:      make(map[string]string),
+	}
+
+	for _, node := range pkgGraph.AllNodes() {
+		if node.Type == pkggraph.TypePureMeta {
+			continue
+		}
+
+		summary.nodeStates[nodeKey(node)] = node.State.String()
+
+		switch node.Type {
+		case pkggraph.TypeRun:
+			// A bootstrap stage is a copy of the package's regular build, with the same version.
+			if node.Bcond == "" {
+				summary.addPackageVersion(node.VersionedPkg.Name, node.VersionedPkg.Version)
+			}
+			for _, dependencyNode := range packageDependencies(pkgGraph, node) {
+				summary.requires[dependency{From: packageName(node), To: packageName(dependencyNode)}] = true
+			}
+		case pkggraph.TypeRemote:
+			summary.addPackageVersion(node.VersionedPkg.Name, strings.TrimSpace(versionConstraint(node.VersionedPkg)+" (remote)"))
+		case pkggraph.TypeBuild:
+			for _, dependencyNode := range packageDependencies(pkgGraph, node) {
+				summary.buildRequires[dependency{From: node.SpecName() + bcondMarker(node), To: packageName(dependencyNode)}] = true
+			}
+		}
+	}
+
+	for _, versions := range summary.packageVersions {
+		sort.Strings(versions)
+	}
+
+	return
+}
+
+// addPackageVersion records a version of a package, unless it is already recorded.
+func (s *graphSummary) addPackageVersion(name, version string) {
+	versions := s.packageVersions[name]
+	if !sliceutils.Contains(versions, version, sliceutils.StringMatch) {
+		s.packageVersions[name] = append(versions, version)
+	}
+}
+
+// packageDependencies returns the run and remote nodes a node depends on. Meta nodes, such as the
+// ones added while resolving cycles, are looked through. A run node's dependency on its own build node is skipped.
+func packageDependencies(pkgGraph *pkggraph.PkgGraph, node *pkggraph.PkgNode) (dependencies []*pkggraph.PkgNode) {
+	visited := make(map[int64]bool)
+	toVisit := []*pkggraph.PkgNode{node}
+
+	for len(toVisit) > 0 {
+		current := toVisit[len(toVisit)-1]
+		toVisit = toVisit[:len(toVisit)-1]
+
+		dependencyNodes := pkgGraph.From(current.ID())
+		for dependencyNodes.Next() {
+			dependencyNode := dependencyNodes.Node().(*pkggraph.PkgNode).This
+			if visited[dependencyNode.ID()] {
+				continue
+			}
+			visited[dependencyNode.ID()] = true
+
+			switch dependencyNode.Type {
+			case pkggraph.TypeRun, pkggraph.TypeRemote:
+				dependencies = append(dependencies, dependencyNode)
+			case pkggraph.TypePureMeta:
+				toVisit = append(toVisit, dependencyNode)
+			}
+		}
+	}
+
+	return
+}
+
+// nodeKey returns a string identifying a node across graphs, independent of its ID and state.
+func nodeKey(node *pkggraph.PkgNode) string {
+	if node.Type == pkggraph.TypeGoal || node.VersionedPkg == nil {
+		return fmt.Sprintf("%s (%s)", node.GoalName, node.Type)
+	}
+
+	pkg := node.VersionedPkg
+	return fmt.Sprintf("%s-%s%s (%s)", pkg.Name, versionConstraint(pkg), bcondMarker(node), node.Type)
+}
+
+// versionConstraint returns the version of a package, along with its conditions, e.g. ">=1.2,<2.0".
+func versionConstraint(pkg *pkgjson.PackageVer) (version string) {
+	version = pkg.Condition + pkg.Version
+	if pkg.SCondition != "" || pkg.SVersion != "" {
+		version = fmt.Sprintf("%s,%s%s", version, pkg.SCondition, pkg.SVersion)
+	}
+
+	return
+}
+
+// packageName returns the name of a node's package, followed by the bcond if the node is part of a bootstrap stage.
+func packageName(node *pkggraph.PkgNode) string {
+	return node.VersionedPkg.Name + bcondMarker(node)
+}
+
+// bcondMarker returns the bcond of a bootstrap stage node in brackets, or an empty string for other nodes.
+func bcondMarker(node *pkggraph.PkgNode) string {
+	if node.Bcond == "" {
+		return ""
+	}
+
+	return fmt.Sprintf("[%s]", node.Bcond)
+}
+
+// diffGraphs compares the summaries of two graphs.
+func diffGraphs(oldSummary, newSummary *graphSummary, ignoreNodeStates bool) (diff *graphDiff) {
+	diff = &graphDiff{
+		AddedPackages:   []string{},
+		RemovedPackages: []string{},
+		VersionChanges:  []versionChange{},
+		StateChanges:    []stateChange{},
+	}
+
+	for name, newVersions := range newSummary.packageVersions {
+		oldVersions, exists := oldSummary.packageVersions[name]
+		if !exists {
+			diff.AddedPackages = append(diff.AddedPackages, name)
+			continue
+		}
+
+		if strings.Join(oldVersions, " ") != strings.Join(newVersions, " ") {
+			diff.VersionChanges = append(diff.VersionChanges, versionChange{
+				Package:     name,
+				OldVersions: oldVersions,
+				NewVersions: newVersions,
+			})
+		}
+	}
+
+	for name := range oldSummary.packageVersions {
+		if _, exists := newSummary.packageVersions[name]; !exists {
+			diff.RemovedPackages = append(diff.RemovedPackages, name)
+		}
+	}
+
+	diff.AddedRequires = missingDependencies(newSummary.requires, oldSummary.requires)
+	diff.RemovedRequires = missingDependencies(oldSummary.requires, newSummary.requires)
+	diff.AddedBuildRequires = missingDependencies(newSummary.buildRequires, oldSummary.buildRequires)
+	diff.RemovedBuildRequires = missingDependencies(oldSummary.buildRequires, newSummary.buildRequires)
+
+	if !ignoreNodeStates {
+		for key, newState := range newSummary.nodeStates {
+			oldState, exists := oldSummary.nodeStates[key]
+			if exists && oldState != newState {
+				diff.StateChanges = append(diff.StateChanges, stateChange{
+					Node:     key,
+					OldState: oldState,
+					NewState: newState,
+				})
+			}
+		}
+	}
+
+	sort.Strings(diff.AddedPackages)
+	sort.Strings(diff.RemovedPackages)
+	sort.Slice(diff.VersionChanges, func(i, j int) bool {
+		return diff.VersionChanges[i].Package < diff.VersionChanges[j].Package
+	})
+	sort.Slice(diff.StateChanges, func(i, j int) bool {
+		return diff.StateChanges[i].Node < diff.StateChanges[j].Node
+	})
+
+	return
+}
+
+// missingDependencies returns the sorted dependencies present in a but not in b.
+func missingDependencies(a, b map[dependency]bool) (missing []dependency) {
+	missing = []dependency{}
+	for dep := range a {
+		if !b[dep] {
+			missing = append(missing, dep)
+		}
+	}
+
+	sort.Slice(missing, func(i, j int) bool {
+		if missing[i].From != missing[j].From {
+			return missing[i].From < missing[j].From
+		}
+		return missing[i].To < missing[j].To
+	})
+
+	return
+}
+
+// printDiff prints every difference found between two graphs.
+func printDiff(diff *graphDiff) {
+	printTitle(fmt.Sprintf("Added packages (%d)", len(diff.AddedPackages)))
+	for _, name := range diff.AddedPackages {
+		logger.Log.Infof("+ %s", name)
+	}
+
+	printTitle(fmt.Sprintf("Removed packages (%d)", len(diff.RemovedPackages)))
+	for _, name := range diff.RemovedPackages {
+		logger.Log.Infof("- %s", name)
+	}
+
+	printTitle(fmt.Sprintf("Version changes (%d)", len(diff.VersionChanges)))
+	for _, change := range diff.VersionChanges {
+		logger.Log.Infof("%s: %s -> %s", change.Package, strings.Join(change.OldVersions, ", "), strings.Join(change.NewVersions, ", "))
+	}
+
+	printTitle(fmt.Sprintf("Requires changes (%d added, %d removed)", len(diff.AddedRequires), len(diff.RemovedRequires)))
+	printDependencies(diff.AddedRequires, "+")
+	printDependencies(diff.RemovedRequires, "-")
+
+	printTitle(fmt.Sprintf("BuildRequires changes (%d added, %d removed)", len(diff.AddedBuildRequires), len(diff.RemovedBuildRequires)))
+	printDependencies(diff.AddedBuildRequires, "+")
+	printDependencies(diff.RemovedBuildRequires, "-")
+
+	printTitle(fmt.Sprintf("State changes (%d)", len(diff.StateChanges)))
+	for _, change := range diff.StateChanges {
+		logger.Log.Infof("%s: %s -> %s", change.Node, change.OldState, change.NewState)
+	}
+}
+
+// printDependencies prints a list of dependencies, each prefixed with the given marker.
+func printDependencies(dependencies []dependency, marker string) {
+	for _, dep := range dependencies {
+		logger.Log.Infof("%s %s -> %s", marker, dep.From, dep.To)
+	}
+}
+
+// printTitle prints a section title.
+func printTitle(title string) {
+	logger.Log.Info("")
+	logger.Log.Info("================================================")
+	logger.Log.Info(title)
+	logger.Log.Info("================================================")
+}
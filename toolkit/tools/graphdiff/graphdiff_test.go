@@ -0,0 +1,206 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"microsoft.com/pkggen/internal/logger"
+	"microsoft.com/pkggen/internal/pkggraph"
+	"microsoft.com/pkggen/internal/pkggraph/pkggraphtest"
+	"microsoft.com/pkggen/internal/pkgjson"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitStderrLog()
+	os.Exit(m.Run())
+}
+
+// buildTestGraphHelper returns a graph where:
+// - B requires A and BuildRequires the remote package C.
+// - A BuildRequires B, which is broken by a bootstrap stage of B.
+func buildTestGraphHelper(t *testing.T) *pkggraph.PkgGraph {
+	g := pkggraph.NewPkgGraph()
+
+	aRun, aBuild := pkggraphtest.AddSRPM(t, g, "A", "1.0")
+	bRun, bBuild := pkggraphtest.AddSRPM(t, g, "B", "2.0")
+	assert.NoError(t, g.AddEdge(bRun, aRun))
+
+	cPkg := &pkgjson.PackageVer{Name: "C", Condition: ">=", Version: "3.0"}
+	cRemote, err := g.AddPkgNode(cPkg, pkggraph.StateUnresolved, pkggraph.TypeRemote, "<NO_SRPM_PATH>", "<NO_RPM_PATH>", "<NO_SPEC_PATH>", "<NO_SOURCE_PATH>", "<NO_ARCHITECTURE>", "<NO_REPO>")
+	assert.NoError(t, err)
+	assert.NoError(t, g.AddEdge(bBuild, cRemote))
+
+	bootstrapRun, bootstrapBuild, err := g.AddBootstrapNodes(bRun, bBuild, "bootstrap")
+	assert.NoError(t, err)
+	assert.NoError(t, g.AddEdge(bootstrapBuild, cRemote))
+	assert.NoError(t, g.AddEdge(aBuild, bootstrapRun))
+
+	return g
+}
+
+// withEmptyLists returns a copy of diff with every unset list replaced by an empty one, as diffGraphs reports them.
+func withEmptyLists(diff graphDiff) *graphDiff {
+	for _, list := range []*[]string{&diff.AddedPackages, &diff.RemovedPackages} {
+		if *list == nil {
+			*list = []string{}
+		}
+	}
+
+	for _, list := range []*[]dependency{&diff.AddedRequires, &diff.RemovedRequires, &diff.AddedBuildRequires, &diff.RemovedBuildRequires} {
+		if *list == nil {
+			*list = []dependency{}
+		}
+	}
+
+	if diff.VersionChanges == nil {
+		diff.VersionChanges = []versionChange{}
+	}
+
+	if diff.StateChanges == nil {
+		diff.StateChanges = []stateChange{}
+	}
+
+	return &diff
+}
+
+func TestSummarizeGraphFile(t *testing.T) {
+	tests := []struct {
+		name      string
+		graphFile string
+	}{
+		{"DOT", "graph.dot"},
+		{"JSON", "graph.json"},
+	}
+
+	dir, err := ioutil.TempDir("", "graphdiff")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			graphFile := filepath.Join(dir, test.graphFile)
+			assert.NoError(t, pkggraph.WriteGraphFile(buildTestGraphHelper(t), graphFile))
+
+			summary, err := summarizeGraphFile(graphFile)
+			assert.NoError(t, err)
+
+			assert.Equal(t, map[string][]string{
+				"A": {"1.0"},
+				"B": {"2.0"},
+				"C": {">=3.0 (remote)"},
+			}, summary.packageVersions)
+			assert.Equal(t, map[dependency]bool{
+				{From: "B", To: "A"}: true,
+			}, summary.requires)
+			assert.Equal(t, map[dependency]bool{
+				{From: "A", To: "B[bootstrap]"}: true,
+				{From: "B", To: "C"}:            true,
+				{From: "B[bootstrap]", To: "C"}: true,
+			}, summary.buildRequires)
+			assert.Contains(t, summary.nodeStates, "B-2.0 (Build)")
+			assert.Contains(t, summary.nodeStates, "B-2.0[bootstrap] (Build)")
+		})
+	}
+}
+
+func TestSummarizeGraphFileMissing(t *testing.T) {
+	_, err := summarizeGraphFile(filepath.Join(os.TempDir(), "graphdiff-missing.dot"))
+	assert.Error(t, err)
+}
+
+func TestDiffGraphs(t *testing.T) {
+	baseSummary := func() *graphSummary {
+		return &graphSummary{
+			packageVersions: map[string][]string{"A": {"1.0"}, "B": {"2.0"}},
+			requires:        map[dependency]bool{{From: "B", To: "A"}: true},
+			buildRequires:   map[dependency]bool{{From: "B", To: "C"}: true},
+			nodeStates:      map[string]string{"B-2.0 (Build)": "Build"},
+		}
+	}
+
+	tests := []struct {
+		name             string
+		change           func(summary *graphSummary)
+		ignoreNodeStates bool
+		expected         graphDiff
+	}{
+		{
+			name:   "identical",
+			change: func(summary *graphSummary) {},
+		},
+		{
+			name: "added and removed packages",
+			change: func(summary *graphSummary) {
+				delete(summary.packageVersions, "A")
+				summary.packageVersions["D"] = []string{"4.0"}
+			},
+			expected: graphDiff{
+				AddedPackages:   []string{"D"},
+				RemovedPackages: []string{"A"},
+			},
+		},
+		{
+			name: "version change",
+			change: func(summary *graphSummary) {
+				summary.packageVersions["A"] = []string{"1.0", "1.1"}
+			},
+			expected: graphDiff{
+				VersionChanges: []versionChange{{Package: "A", OldVersions: []string{"1.0"}, NewVersions: []string{"1.0", "1.1"}}},
+			},
+		},
+		{
+			name: "remote version change",
+			change: func(summary *graphSummary) {
+				summary.packageVersions["A"] = []string{">=1.0 (remote)"}
+			},
+			expected: graphDiff{
+				VersionChanges: []versionChange{{Package: "A", OldVersions: []string{"1.0"}, NewVersions: []string{">=1.0 (remote)"}}},
+			},
+		},
+		{
+			name: "dependency changes",
+			change: func(summary *graphSummary) {
+				summary.requires = map[dependency]bool{{From: "A", To: "B"}: true}
+				summary.buildRequires[dependency{From: "B[bootstrap]", To: "C"}] = true
+			},
+			expected: graphDiff{
+				AddedRequires:      []dependency{{From: "A", To: "B"}},
+				RemovedRequires:    []dependency{{From: "B", To: "A"}},
+				AddedBuildRequires: []dependency{{From: "B[bootstrap]", To: "C"}},
+			},
+		},
+		{
+			name: "state change",
+			change: func(summary *graphSummary) {
+				summary.nodeStates["B-2.0 (Build)"] = "UpToDate"
+			},
+			expected: graphDiff{
+				StateChanges: []stateChange{{Node: "B-2.0 (Build)", OldState: "Build", NewState: "UpToDate"}},
+			},
+		},
+		{
+			name: "ignored state change",
+			change: func(summary *graphSummary) {
+				summary.nodeStates["B-2.0 (Build)"] = "UpToDate"
+			},
+			ignoreNodeStates: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			newSummary := baseSummary()
+			test.change(newSummary)
+
+			diff := diffGraphs(baseSummary(), newSummary, test.ignoreNodeStates)
+
+			assert.Equal(t, withEmptyLists(test.expected), diff)
+		})
+	}
+}
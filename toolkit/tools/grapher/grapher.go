@@ -59,7 +59,7 @@ func main() {
 		logger.Log.Panic(err)
 	}
 
-	err = pkggraph.WriteDOTGraphFile(depGraph, *output)
+	err = pkggraph.WriteGraphFile(depGraph, *output)
 	if err != nil {
 		logger.Log.Panic(err)
 	}
@@ -242,6 +242,50 @@ func addPkgDependencies(g *pkggraph.PkgGraph, pkg *pkgjson.Package) (dependencie
 	return
 }
 
+// addBootstrapStage adds the bootstrap stage of the package described in the
+// Package structure, built with its BootstrapBcond. Edges are added for the
+// package's run-time requirements and for its bootstrap build requirements.
+// Returns an error if the nodes or edges could not be created.
+func addBootstrapStage(g *pkggraph.PkgGraph, pkg *pkgjson.Package) (err error) {
+	logger.Log.Debugf("Adding bootstrap stage with (%s) for package %s", pkg.BootstrapBcond, pkg.SrpmPath)
+	nodes, err := g.FindExactPkgNodeFromPkg(pkg.Provides)
+	if err != nil {
+		return
+	}
+	if nodes == nil {
+		return fmt.Errorf("can't add a bootstrap stage to a missing package %+v", pkg)
+	}
+
+	// A duplicate package reuses the nodes of the first SRPM providing it, only that SRPM's stage applies.
+	if nodes.RunNode.SrpmPath != pkg.SrpmPath {
+		logger.Log.Warnf(`Not adding a bootstrap stage for duplicate package %+v read from SRPM "%s"`, pkg.Provides, pkg.SrpmPath)
+		return
+	}
+
+	bootstrapRunNode, bootstrapBuildNode, err := g.AddBootstrapNodes(nodes.RunNode, nodes.BuildNode, pkg.BootstrapBcond)
+	if err != nil {
+		return
+	}
+
+	for _, dependency := range pkg.Requires {
+		err = addSingleDependency(g, bootstrapRunNode, dependency)
+		if err != nil {
+			logger.Log.Errorf("Unable to add bootstrap run-time dependencies for %+v", pkg)
+			return
+		}
+	}
+
+	for _, dependency := range pkg.BootstrapBuildRequires {
+		err = addSingleDependency(g, bootstrapBuildNode, dependency)
+		if err != nil {
+			logger.Log.Errorf("Unable to add bootstrap build-time dependencies for %+v", pkg)
+			return
+		}
+	}
+
+	return
+}
+
 // populateGraph adds all the data contained in the PackageRepo structure into
 // the graph.
 func populateGraph(graph *pkggraph.PkgGraph, repo *pkgjson.PackageRepo) (err error) {
@@ -274,5 +318,24 @@ func populateGraph(graph *pkggraph.PkgGraph, repo *pkgjson.PackageRepo) (err err
 	}
 	logger.Log.Infof("\tAdded %d dependencies", dependenciesAdded)
 
+	// Add the bootstrap stages last, so their dependencies resolve to the packages added above.
+	// They are only used if a cycle requires them, see MakeDAG().
+	logger.Log.Infof("Adding all bootstrap stages from %s", *input)
+	bootstrapStagesAdded := 0
+	for idx := range packages {
+		pkg := packages[idx]
+		if pkg.BootstrapBcond == "" {
+			continue
+		}
+
+		err = addBootstrapStage(graph, pkg)
+		if err != nil {
+			logger.Log.Errorf("Failed to add bootstrap stage %+v", pkg)
+			return err
+		}
+		bootstrapStagesAdded++
+	}
+	logger.Log.Infof("\tAdded %d bootstrap stages", bootstrapStagesAdded)
+
 	return err
 }
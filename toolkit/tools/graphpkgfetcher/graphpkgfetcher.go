@@ -13,6 +13,7 @@ import (
 	"gopkg.in/alecthomas/kingpin.v2"
 	"microsoft.com/pkggen/internal/exe"
 	"microsoft.com/pkggen/internal/logger"
+	"microsoft.com/pkggen/internal/metrics"
 	"microsoft.com/pkggen/internal/packagerepo/repocloner/rpmrepocloner"
 	"microsoft.com/pkggen/internal/packagerepo/repoutils"
 	"microsoft.com/pkggen/internal/pkggraph"
@@ -45,8 +46,19 @@ var (
 	inputSummaryFile  = app.Flag("input-summary-file", "Path to a file with the summary of packages cloned to be restored").String()
 	outputSummaryFile = app.Flag("output-summary-file", "Path to save the summary of packages cloned").String()
 
-	logFile  = exe.LogFileFlag(app)
-	logLevel = exe.LogLevelFlag(app)
+	logFile        = exe.LogFileFlag(app)
+	logLevel       = exe.LogLevelFlag(app)
+	metricsFile    = exe.MetricsFileFlag(app)
+	metricsAddress = exe.MetricsAddressFlag(app)
+
+	resolvedNodes = metrics.NewCounter("toolkit_resolved_dependencies", "Number of unresolved dependencies processed by the package fetcher, by how they were resolved.", "result")
+)
+
+// Values of the result label of the resolved dependencies metric.
+const (
+	resolvedNodePrebuilt   = "prebuilt"
+	resolvedNodeCached     = "cached"
+	resolvedNodeUnresolved = "unresolved"
 )
 
 func main() {
@@ -54,9 +66,15 @@ func main() {
 	kingpin.MustParse(app.Parse(os.Args[1:]))
 	logger.InitBestEffort(*logFile, *logLevel)
 
+	metricsExporter, err := metrics.StartExporter(*metricsFile, *metricsAddress)
+	if err != nil {
+		logger.Log.Fatalf("Unable to export metrics, error: %s", err)
+	}
+	defer metricsExporter.Close()
+
 	dependencyGraph := pkggraph.NewPkgGraph()
 
-	err := pkggraph.ReadDOTGraphFile(dependencyGraph, *inputGraph)
+	err = pkggraph.ReadGraphFile(dependencyGraph, *inputGraph)
 	if err != nil {
 		logger.Log.Panicf("Failed to read graph to file. Error: %s", err)
 	}
@@ -79,7 +97,7 @@ func main() {
 		logger.Log.Info("No unresolved packages to cache")
 	}
 
-	err = pkggraph.WriteDOTGraphFile(dependencyGraph, *outputGraph)
+	err = pkggraph.WriteGraphFile(dependencyGraph, *outputGraph)
 	if err != nil {
 		logger.Log.Panicf("Failed to write cache graph to file. Error: %s", err)
 	}
@@ -126,6 +144,7 @@ func resolveGraphNodes(dependencyGraph *pkggraph.PkgGraph, inputSummaryFile, out
 				// Failing to clone a dependency should not halt a build.
 				// The build should continue and attempt best effort to build as many packages as possible.
 				if resolveErr != nil {
+					resolvedNodes.Inc(resolvedNodeUnresolved)
 					cachingSucceeded = false
 					errorMessage := strings.Builder{}
 					errorMessage.WriteString(fmt.Sprintf("Failed to resolve all nodes in the graph while resolving '%s'\n", n))
@@ -221,8 +240,10 @@ func resolveSingleNode(cloner *rpmrepocloner.RpmRepoCloner, node *pkggraph.PkgNo
 		prebuiltPackages[node.RpmPath] = true
 		node.State = pkggraph.StateUpToDate
 		node.Type = pkggraph.TypePreBuilt
+		resolvedNodes.Inc(resolvedNodePrebuilt)
 	} else {
 		node.State = pkggraph.StateCached
+		resolvedNodes.Inc(resolvedNodeCached)
 	}
 
 	logger.Log.Infof("Choosing '%s' to provide '%s'.", filepath.Base(node.RpmPath), node.VersionedPkg.Name)
@@ -129,7 +129,7 @@ func cloneSystemConfigs(cloner repocloner.RepoCloner, configFile, baseDirPath st
 // filterExternalPackagesOnly returns the subset of packageVersionsInConfig that only contains external packages.
 func filterExternalPackagesOnly(packageVersionsInConfig []*pkgjson.PackageVer, inputGraph string) (filteredPackages []*pkgjson.PackageVer, err error) {
 	dependencyGraph := pkggraph.NewPkgGraph()
-	err = pkggraph.ReadDOTGraphFile(dependencyGraph, inputGraph)
+	err = pkggraph.ReadGraphFile(dependencyGraph, inputGraph)
 	if err != nil {
 		return
 	}
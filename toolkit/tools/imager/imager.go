@@ -17,6 +17,7 @@ import (
 	"microsoft.com/pkggen/internal/exe"
 	"microsoft.com/pkggen/internal/file"
 	"microsoft.com/pkggen/internal/logger"
+	"microsoft.com/pkggen/internal/metrics"
 	"microsoft.com/pkggen/internal/safechroot"
 )
 
@@ -34,6 +35,8 @@ var (
 	emitProgress    = app.Flag("emit-progress", "Write progress updates to stdout, such as percent complete and current action.").Bool()
 	logFile         = exe.LogFileFlag(app)
 	logLevel        = exe.LogLevelFlag(app)
+	metricsFile     = exe.MetricsFileFlag(app)
+	metricsAddress  = exe.MetricsAddressFlag(app)
 )
 
 const (
@@ -58,6 +61,12 @@ func main() {
 
 	logger.InitBestEffort(*logFile, *logLevel)
 
+	metricsExporter, err := metrics.StartExporter(*metricsFile, *metricsAddress)
+	if err != nil {
+		logger.Log.Fatalf("Unable to export metrics, error: %s", err)
+	}
+	defer metricsExporter.Close()
+
 	if *emitProgress {
 		installutils.EnableEmittingProgress()
 	}
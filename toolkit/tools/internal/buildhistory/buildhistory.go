@@ -0,0 +1,240 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package buildhistory
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"microsoft.com/pkggen/internal/file"
+	"microsoft.com/pkggen/internal/jsonutils"
+	"microsoft.com/pkggen/internal/logger"
+)
+
+const (
+	// DefaultMaxRecords is the default number of builds remembered for each package.
+	DefaultMaxRecords = 10
+
+	historyVersion = 1
+)
+
+// Record represents a single build of an SRPM.
+type Record struct {
+	SrpmName  string
+	StartTime time.Time
+	EndTime   time.Time
+	Attempts  int
+	LogFile   string
+	Succeeded bool
+}
+
+// Duration returns how long the build took.
+func (r *Record) Duration() time.Duration {
+	return r.EndTime.Sub(r.StartTime)
+}
+
+// PackageDuration pairs a package with the duration of one of its builds.
+type PackageDuration struct {
+	Package  string
+	Record   *Record
+	Duration time.Duration
+}
+
+// Regression represents a package whose latest build was slower than the one before it.
+type Regression struct {
+	Package  string
+	Previous *Record
+	Latest   *Record
+}
+
+// Increase returns how much slower the latest build was.
+func (r *Regression) Increase() time.Duration {
+	return r.Latest.Duration() - r.Previous.Duration()
+}
+
+// History is a store of past builds, keyed by package name. Records for each package are kept oldest first.
+type History struct {
+	Version    int
+	Packages   map[string][]*Record
+	maxRecords int
+}
+
+// New returns an empty History which will remember up to maxRecords builds per package.
+func New(maxRecords int) *History {
+	return &History{
+		Version:    historyVersion,
+		Packages:   make(map[string][]*Record),
+		maxRecords: maxRecords,
+	}
+}
+
+// Load reads a History from a file. If the file does not exist an empty History is returned.
+func Load(path string, maxRecords int) (h *History, err error) {
+	h = New(maxRecords)
+
+	exists, err := file.PathExists(path)
+	if err != nil || !exists {
+		return
+	}
+
+	err = jsonutils.ReadJSONFile(path, h)
+	if err != nil {
+		return
+	}
+
+	if h.Version != historyVersion {
+		err = fmt.Errorf("build history (%s) has unsupported version %d, expected %d", path, h.Version, historyVersion)
+		return
+	}
+
+	if h.Packages == nil {
+		h.Packages = make(map[string][]*Record)
+	}
+
+	logger.Log.Debugf("Loaded build history for %d packages from (%s)", len(h.Packages), path)
+
+	return
+}
+
+// Save writes the History to a file.
+func (h *History) Save(path string) error {
+	return jsonutils.WriteJSONFile(path, h)
+}
+
+// AddRecord adds a build of a package to the History, forgetting the oldest builds of that package if needed.
+func (h *History) AddRecord(pkg string, record *Record) {
+	records := append(h.Packages[pkg], record)
+	if h.maxRecords > 0 && len(records) > h.maxRecords {
+		records = records[len(records)-h.maxRecords:]
+	}
+
+	h.Packages[pkg] = records
+}
+
+// IsEmpty returns true if the History does not contain any successful builds.
+func (h *History) IsEmpty() bool {
+	for _, records := range h.Packages {
+		if len(successfulRecords(records)) > 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ExpectedDuration returns the average duration of all successful builds of a package.
+func (h *History) ExpectedDuration(pkg string) (duration time.Duration, found bool) {
+	records := successfulRecords(h.Packages[pkg])
+	if len(records) == 0 {
+		return
+	}
+
+	var total time.Duration
+	for _, record := range records {
+		total += record.Duration()
+	}
+
+	return total / time.Duration(len(records)), true
+}
+
+// AverageDuration returns the average expected duration across all packages with a successful build.
+func (h *History) AverageDuration() (duration time.Duration, found bool) {
+	var (
+		total    time.Duration
+		packages int
+	)
+
+	for pkg := range h.Packages {
+		expected, pkgFound := h.ExpectedDuration(pkg)
+		if !pkgFound {
+			continue
+		}
+
+		total += expected
+		packages++
+	}
+
+	if packages == 0 {
+		return
+	}
+
+	return total / time.Duration(packages), true
+}
+
+// Slowest returns the latest successful build of each package, slowest first.
+// - maxResults limits the number of returned entries. Set 0 for unlimited.
+func (h *History) Slowest(maxResults int) (slowest []*PackageDuration) {
+	for pkg, records := range h.Packages {
+		records = successfulRecords(records)
+		if len(records) == 0 {
+			continue
+		}
+
+		latest := records[len(records)-1]
+		slowest = append(slowest, &PackageDuration{
+			Package:  pkg,
+			Record:   latest,
+			Duration: latest.Duration(),
+		})
+	}
+
+	sort.Slice(slowest, func(i, j int) bool {
+		if slowest[i].Duration == slowest[j].Duration {
+			return slowest[i].Package < slowest[j].Package
+		}
+		return slowest[i].Duration > slowest[j].Duration
+	})
+
+	if maxResults > 0 && len(slowest) > maxResults {
+		slowest = slowest[:maxResults]
+	}
+
+	return
+}
+
+// Regressions returns all packages whose latest successful build was slower than the successful build before it.
+// A build is only considered a regression if it slowed down by at least minIncrease and by at least minRatio
+// (e.g. 0.25 for 25%) of the previous build's duration. Regressions are sorted by the largest increase first.
+func (h *History) Regressions(minIncrease time.Duration, minRatio float64) (regressions []*Regression) {
+	for pkg, records := range h.Packages {
+		records = successfulRecords(records)
+		if len(records) < 2 {
+			continue
+		}
+
+		regression := &Regression{
+			Package:  pkg,
+			Previous: records[len(records)-2],
+			Latest:   records[len(records)-1],
+		}
+
+		increase := regression.Increase()
+		if increase < minIncrease || float64(increase) < minRatio*float64(regression.Previous.Duration()) {
+			continue
+		}
+
+		regressions = append(regressions, regression)
+	}
+
+	sort.Slice(regressions, func(i, j int) bool {
+		if regressions[i].Increase() == regressions[j].Increase() {
+			return regressions[i].Package < regressions[j].Package
+		}
+		return regressions[i].Increase() > regressions[j].Increase()
+	})
+
+	return
+}
+
+// successfulRecords filters a list of records down to the successful builds.
+func successfulRecords(records []*Record) (successful []*Record) {
+	for _, record := range records {
+		if record.Succeeded {
+			successful = append(successful, record)
+		}
+	}
+
+	return
+}
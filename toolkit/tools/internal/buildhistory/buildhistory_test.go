@@ -0,0 +1,123 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package buildhistory
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"microsoft.com/pkggen/internal/logger"
+)
+
+var baseTime = time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+func TestMain(m *testing.M) {
+	logger.InitStderrLog()
+	os.Exit(m.Run())
+}
+
+func buildRecord(duration time.Duration, succeeded bool) *Record {
+	return &Record{
+		StartTime: baseTime,
+		EndTime:   baseTime.Add(duration),
+		Attempts:  1,
+		Succeeded: succeeded,
+	}
+}
+
+func TestAddRecordShouldLimitRecords(t *testing.T) {
+	h := New(2)
+	h.AddRecord("a", buildRecord(1*time.Minute, true))
+	h.AddRecord("a", buildRecord(2*time.Minute, true))
+	h.AddRecord("a", buildRecord(3*time.Minute, true))
+
+	assert.Len(t, h.Packages["a"], 2)
+	assert.Equal(t, 2*time.Minute, h.Packages["a"][0].Duration())
+	assert.Equal(t, 3*time.Minute, h.Packages["a"][1].Duration())
+}
+
+func TestExpectedDurationShouldIgnoreFailedBuilds(t *testing.T) {
+	h := New(DefaultMaxRecords)
+	h.AddRecord("a", buildRecord(1*time.Minute, true))
+	h.AddRecord("a", buildRecord(10*time.Minute, false))
+	h.AddRecord("a", buildRecord(3*time.Minute, true))
+
+	duration, found := h.ExpectedDuration("a")
+	assert.True(t, found)
+	assert.Equal(t, 2*time.Minute, duration)
+}
+
+func TestExpectedDurationShouldFailForUnknownPackage(t *testing.T) {
+	h := New(DefaultMaxRecords)
+	h.AddRecord("a", buildRecord(1*time.Minute, false))
+
+	_, found := h.ExpectedDuration("a")
+	assert.False(t, found)
+	_, found = h.ExpectedDuration("b")
+	assert.False(t, found)
+	assert.True(t, h.IsEmpty())
+}
+
+func TestSlowestShouldSortByLatestBuild(t *testing.T) {
+	h := New(DefaultMaxRecords)
+	h.AddRecord("a", buildRecord(10*time.Minute, true))
+	h.AddRecord("a", buildRecord(1*time.Minute, true))
+	h.AddRecord("b", buildRecord(5*time.Minute, true))
+	h.AddRecord("c", buildRecord(3*time.Minute, true))
+
+	slowest := h.Slowest(2)
+	assert.Len(t, slowest, 2)
+	assert.Equal(t, "b", slowest[0].Package)
+	assert.Equal(t, "c", slowest[1].Package)
+}
+
+func TestRegressionsShouldApplyThresholds(t *testing.T) {
+	h := New(DefaultMaxRecords)
+	// Slowed down by 100%
+	h.AddRecord("a", buildRecord(10*time.Minute, true))
+	h.AddRecord("a", buildRecord(20*time.Minute, true))
+	// Slowed down by 10%
+	h.AddRecord("b", buildRecord(10*time.Minute, true))
+	h.AddRecord("b", buildRecord(11*time.Minute, true))
+	// Slowed down by 100%, but only by a few seconds
+	h.AddRecord("c", buildRecord(5*time.Second, true))
+	h.AddRecord("c", buildRecord(10*time.Second, true))
+	// Sped up
+	h.AddRecord("d", buildRecord(10*time.Minute, true))
+	h.AddRecord("d", buildRecord(5*time.Minute, true))
+
+	regressions := h.Regressions(time.Minute, 0.25)
+	assert.Len(t, regressions, 1)
+	assert.Equal(t, "a", regressions[0].Package)
+	assert.Equal(t, 10*time.Minute, regressions[0].Increase())
+}
+
+func TestSaveAndLoadShouldRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buildhistory")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	historyFile := filepath.Join(dir, "history.json")
+
+	h := New(DefaultMaxRecords)
+	h.AddRecord("a", buildRecord(10*time.Minute, true))
+	err = h.Save(historyFile)
+	assert.NoError(t, err)
+
+	loaded, err := Load(historyFile, DefaultMaxRecords)
+	assert.NoError(t, err)
+	duration, found := loaded.ExpectedDuration("a")
+	assert.True(t, found)
+	assert.Equal(t, 10*time.Minute, duration)
+}
+
+func TestLoadShouldReturnEmptyHistoryForMissingFile(t *testing.T) {
+	h, err := Load(filepath.Join("testdata", "missing.json"), DefaultMaxRecords)
+	assert.NoError(t, err)
+	assert.True(t, h.IsEmpty())
+}
@@ -7,8 +7,10 @@ package buildpipeline
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"golang.org/x/sys/unix"
 
@@ -19,7 +21,12 @@ import (
 const (
 	rootBaseDirEnv = "CHROOT_DIR"
 	chrootLock     = "chroot-pool.lock"
-	chrootUse      = "chroot-used"
+)
+
+var (
+	// dockerChroots holds the chroot pool slots leased by GetChrootDir, by their directory.
+	dockerChroots      = make(map[string]*ChrootPoolSlot)
+	dockerChrootsMutex sync.Mutex
 )
 
 // IsRegularBuild indicates if it is a regular build (without using docker)
@@ -33,81 +40,52 @@ func IsRegularBuild() bool {
 
 // GetChrootDir returns the chroot folder
 // - proposeDir is suggested folder name
-//   in case of Docker based build a chroot dir is selected from the chroot pool and proposeDir is ignored
+//   in case of Docker based build a chroot dir is leased from the chroot pool and proposeDir is ignored
 func GetChrootDir(proposedDir string) (chrootDir string, err error) {
 	if IsRegularBuild() {
 		// don't change proposed dir in case of regular build
 		return proposedDir, nil
 	}
 
-	// In docker based pipeline pre-existing chroot pool is under a folder which path
-	// is indicated by an env variable
-	chrootPoolFolder, varExist := unix.Getenv(rootBaseDirEnv)
-	if !varExist || len(chrootPoolFolder) == 0 {
-		err = fmt.Errorf("env variable %s not defined", rootBaseDirEnv)
-		logger.Log.Errorf("%s", err.Error())
-		return "", err
+	chrootPoolFolder, err := dockerChrootPoolDir()
+	if err != nil {
+		return
 	}
 
 	// lock chroot pool (multi-process lock mechanism)
-	chrootLockFile := filepath.Join(chrootPoolFolder, chrootLock)
-	flock, err := os.Open(chrootLockFile)
+	poolLock, err := lockChrootPool(chrootPoolFolder)
 	if err != nil {
-		logger.Log.Errorf("Failed to open chroot pool lock (%s) - %s", chrootLockFile, err.Error())
-		return "", err
+		return
 	}
-	defer flock.Close()
+	defer unlockFile(poolLock)
 
-	err = unix.Flock(int(flock.Fd()), unix.LOCK_EX)
+	// get list of chroots inside chroot pool and lease one which is available,
+	// chroots are leased the same way as the slots of a regular build's chroot pool
+	infos, err := ioutil.ReadDir(chrootPoolFolder)
 	if err != nil {
-		logger.Log.Errorf("Failed to lock (%s) - %s", chrootLockFile, err.Error())
-		return "", err
+		logger.Log.Errorf("Failed to get subfolder in chroot pool folder (%s) - %s", chrootPoolFolder, err.Error())
+		return
 	}
-	defer unix.Flock(int(flock.Fd()), unix.LOCK_UN)
 
-	// get list of chroots inside chroot pool and found one which is available
-	// nNote that a chroot is currently in use if 'chrootUse' file exist hence is available for use
-	// if that file doesn't exist
-	chrootDirs, err := os.Open(chrootPoolFolder)
-	if err != nil {
-		logger.Log.Errorf("Failed to open chroot pool folder (%s) - %s", chrootPoolFolder, err.Error())
-		return "", err
-	}
-	defer chrootDirs.Close()
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
 
-	names, err := chrootDirs.Readdirnames(-1)
-	if err != nil {
-		logger.Log.Errorf("Failed to get subfolder in chroot pool folder (%s) - %s", chrootPoolFolder, err.Error())
-		return "", err
-	}
+		fullChrootPath := filepath.Join(chrootPoolFolder, info.Name())
 
-	for _, name := range names {
-		fullChrootPath := filepath.Join(chrootPoolFolder, name)
-
-		isDir, _ := file.IsDir(fullChrootPath)
-		if isDir {
-			// check if chroot is in use
-			inUseFilePath := filepath.Join(fullChrootPath, chrootUse)
-			_, err := os.Stat(inUseFilePath)
-			if err == nil {
-				// chroot in use => check next
-				logger.Log.Debugf("chroot %s currently used", fullChrootPath)
-				continue
-			} else if os.IsNotExist(err) {
-				// chroot not in use
-				inUseFile, err := os.Create(inUseFilePath)
-				if err != nil {
-					logger.Log.Errorf("Cannot indicate that chroot %s is now used - %s", fullChrootPath, err.Error())
-					return "", err
-				}
-
-				logger.Log.Debugf("Select chroot -> %s", fullChrootPath)
-				defer inUseFile.Close()
-				return fullChrootPath, nil
-			} else {
-				logger.Log.Errorf("Cannot read chroot status file (%s) - %s", inUseFilePath, err.Error())
-				return "", err
-			}
+		var slot *ChrootPoolSlot
+		slot, err = tryLeaseChrootPoolSlot(fullChrootPath)
+		if err != nil {
+			logger.Log.Errorf("Cannot lease chroot %s - %s", fullChrootPath, err.Error())
+			return
+		}
+
+		if slot != nil {
+			dockerChrootsMutex.Lock()
+			dockerChroots[fullChrootPath] = slot
+			dockerChrootsMutex.Unlock()
+			return fullChrootPath, nil
 		}
 	}
 
@@ -124,44 +102,29 @@ func ReleaseChrootDir(chrootDir string) (err error) {
 		return
 	}
 
+	dockerChrootsMutex.Lock()
+	slot, found := dockerChroots[chrootDir]
+	delete(dockerChroots, chrootDir)
+	dockerChrootsMutex.Unlock()
+
 	// sanity check
-	if len(chrootDir) == 0 {
-		err = fmt.Errorf("try to release unamed chroot")
+	if !found {
+		err = fmt.Errorf("try to release chroot (%s) which was not leased", chrootDir)
 		logger.Log.Errorf("%s", err.Error())
 		return
 	}
 
+	return slot.Release()
+}
+
+// dockerChrootPoolDir returns the pre-existing chroot pool of a Docker based pipeline.
+func dockerChrootPoolDir() (chrootPoolFolder string, err error) {
 	// In docker based pipeline pre-existing chroot pool is under a folder which path
 	// is indicated by an env variable
 	chrootPoolFolder, varExist := unix.Getenv(rootBaseDirEnv)
 	if !varExist || len(chrootPoolFolder) == 0 {
 		err = fmt.Errorf("env variable %s not defined", rootBaseDirEnv)
 		logger.Log.Errorf("%s", err.Error())
-		return
-	}
-
-	// lock chroot pool (multi-process lock mechanism)
-	chrootLockFile := filepath.Join(chrootPoolFolder, chrootLock)
-	flock, err := os.Open(chrootLockFile)
-	if err != nil {
-		logger.Log.Errorf("Failed to open chroot pool lock (%s) - %s", chrootLockFile, err.Error())
-		return
-	}
-	defer flock.Close()
-
-	err = unix.Flock(int(flock.Fd()), unix.LOCK_EX)
-	if err != nil {
-		logger.Log.Errorf("Failed to lock (%s) - %s", chrootLockFile, err.Error())
-		return
-	}
-	defer unix.Flock(int(flock.Fd()), unix.LOCK_UN)
-
-	// release chroot
-	logger.Log.Debugf("Release chroot -> %s", filepath.Join(chrootDir, chrootUse))
-	err = os.Remove(filepath.Join(chrootDir, chrootUse))
-	if err != nil {
-		logger.Log.Errorf("Failed to remove %s - %s", filepath.Join(chrootDir, chrootUse), err.Error())
-		return
 	}
 
 	return
@@ -192,7 +155,6 @@ func CleanupDockerChroot(chroot string) (err error) {
 		"localrpms",
 		"upstream-cached-rpms",
 		"sys",
-		chrootUse,
 	}
 
 	var folderToCreate = []string{
@@ -0,0 +1,276 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package buildpipeline
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"microsoft.com/pkggen/internal/logger"
+)
+
+const (
+	chrootPoolSlotPrefix   = "chroot-"
+	chrootPoolBasePrefix   = "base-"
+	chrootPoolLockSuffix   = ".lock"
+	chrootPoolBaseComplete = ".complete"
+)
+
+// ChrootPoolSlot is a directory leased from a pool of reusable chroots for regular builds.
+// A slot is leased by holding an exclusive lock on it, so it is released when the leasing process exits
+// even if it never calls Release.
+type ChrootPoolSlot struct {
+	dir  string
+	lock *os.File
+}
+
+// LeaseChrootPoolSlot leases an unused slot from the chroot pool in poolDir, adding a new slot
+// to the pool if every existing one is in use. Slots keep whatever the previous lease left in them.
+func LeaseChrootPoolSlot(poolDir string) (slot *ChrootPoolSlot, err error) {
+	poolLock, err := lockChrootPool(poolDir)
+	if err != nil {
+		return
+	}
+	defer unlockFile(poolLock)
+
+	for i := 0; slot == nil; i++ {
+		slotDir := filepath.Join(poolDir, fmt.Sprintf("%s%d", chrootPoolSlotPrefix, i))
+
+		slot, err = tryLeaseChrootPoolSlot(slotDir)
+		if err != nil {
+			return
+		}
+	}
+
+	err = os.MkdirAll(slot.dir, os.ModePerm)
+	if err != nil {
+		slot.Release()
+		slot = nil
+	}
+
+	return
+}
+
+// tryLeaseChrootPoolSlot leases the slot in slotDir, returning a nil slot if it is already leased.
+// The chroot pool must be locked by the caller.
+func tryLeaseChrootPoolSlot(slotDir string) (slot *ChrootPoolSlot, err error) {
+	slotLock, err := os.OpenFile(slotDir+chrootPoolLockSuffix, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return
+	}
+
+	err = unix.Flock(int(slotLock.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if err == unix.EWOULDBLOCK {
+		logger.Log.Debugf("chroot %s currently used", slotDir)
+		slotLock.Close()
+		err = nil
+		return
+	}
+	if err != nil {
+		slotLock.Close()
+		return
+	}
+
+	logger.Log.Debugf("Select chroot -> %s", slotDir)
+	slot = &ChrootPoolSlot{
+		dir:  slotDir,
+		lock: slotLock,
+	}
+	return
+}
+
+// Dir returns the slot's directory.
+func (s *ChrootPoolSlot) Dir() string {
+	return s.dir
+}
+
+// Release releases the slot so it can be leased again. Only the first call has any effect.
+func (s *ChrootPoolSlot) Release() (err error) {
+	if s.lock == nil {
+		return
+	}
+
+	logger.Log.Debugf("Release chroot -> %s", s.dir)
+	err = unlockFile(s.lock)
+	s.lock = nil
+	return
+}
+
+// ChrootPoolBase is a populated directory shared by every chroot of a pool.
+// Its users hold a shared lock on it, so it is only removed once no process uses it anymore,
+// and the lock is released when the holding process exits even if it never calls Release.
+type ChrootPoolBase struct {
+	dir  string
+	lock *os.File
+}
+
+// PrepareChrootPoolBase returns a directory in the chroot pool in poolDir which has been populated by populate.
+// key identifies the contents of the directory, populate is only called if no directory exists for key yet.
+// Directories populated for any other key are removed once no ChrootPoolBase refers to them.
+// The directory is shared by every user of the pool and must not be modified once populated.
+func PrepareChrootPoolBase(poolDir, key string, populate func(baseDir string) error) (base *ChrootPoolBase, err error) {
+	poolLock, err := lockChrootPool(poolDir)
+	if err != nil {
+		return
+	}
+	defer unlockFile(poolLock)
+
+	baseName := chrootPoolBasePrefix + key
+	baseDir := filepath.Join(poolDir, baseName)
+	completeMarker := filepath.Join(poolDir, baseName+chrootPoolBaseComplete)
+
+	_, err = os.Stat(completeMarker)
+	isComplete := err == nil
+
+	err = removeUnusedChrootPoolBases(poolDir, baseName, isComplete)
+	if err != nil {
+		return
+	}
+
+	if !isComplete {
+		logger.Log.Infof("Populating chroot pool base (%s)", baseDir)
+		err = os.MkdirAll(baseDir, os.ModePerm)
+		if err != nil {
+			return
+		}
+
+		err = populate(baseDir)
+		if err != nil {
+			os.RemoveAll(baseDir)
+			return
+		}
+
+		err = ioutil.WriteFile(completeMarker, []byte{}, 0644)
+		if err != nil {
+			return
+		}
+	}
+
+	baseLock, err := os.OpenFile(baseDir+chrootPoolLockSuffix, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return
+	}
+
+	err = unix.Flock(int(baseLock.Fd()), unix.LOCK_SH)
+	if err != nil {
+		baseLock.Close()
+		return
+	}
+
+	base = &ChrootPoolBase{
+		dir:  baseDir,
+		lock: baseLock,
+	}
+	return
+}
+
+// Dir returns the base's directory.
+func (b *ChrootPoolBase) Dir() string {
+	return b.dir
+}
+
+// Release releases the base so it can be removed once it is no longer current. Only the first call has any effect.
+func (b *ChrootPoolBase) Release() (err error) {
+	if b.lock == nil {
+		return
+	}
+
+	err = unlockFile(b.lock)
+	b.lock = nil
+	return
+}
+
+// removeUnusedChrootPoolBases removes every base in the chroot pool in poolDir which no ChrootPoolBase refers to,
+// along with any files named after it. The chroot pool must be locked by the caller.
+// - currentBaseName is the name of the base being prepared, it is kept if keepCurrent is set.
+func removeUnusedChrootPoolBases(poolDir, currentBaseName string, keepCurrent bool) (err error) {
+	infos, err := ioutil.ReadDir(poolDir)
+	if err != nil {
+		return
+	}
+
+	// Every file of a base is named after it, e.g. its complete marker and lock.
+	baseFiles := make(map[string][]string)
+	for _, info := range infos {
+		name := info.Name()
+		if !strings.HasPrefix(name, chrootPoolBasePrefix) {
+			continue
+		}
+
+		baseName := name
+		if i := strings.IndexAny(strings.TrimPrefix(name, chrootPoolBasePrefix), ".-"); i >= 0 {
+			baseName = name[:len(chrootPoolBasePrefix)+i]
+		}
+		baseFiles[baseName] = append(baseFiles[baseName], name)
+	}
+
+	for baseName, names := range baseFiles {
+		if keepCurrent && baseName == currentBaseName {
+			continue
+		}
+
+		// Bases are only ever locked while the pool is locked, so holding the pool lock
+		// means no other process can start using this base until it is removed.
+		baseLock, lockErr := os.Open(filepath.Join(poolDir, baseName+chrootPoolLockSuffix))
+		if lockErr == nil {
+			lockErr = unix.Flock(int(baseLock.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+			baseLock.Close()
+		}
+		if lockErr != nil && !os.IsNotExist(lockErr) {
+			logger.Log.Debugf("Keeping chroot pool base (%s) while it may be in use: %s", baseName, lockErr)
+			continue
+		}
+
+		for _, name := range names {
+			stalePath := filepath.Join(poolDir, name)
+			logger.Log.Debugf("Removing stale chroot pool base (%s)", stalePath)
+			err = os.RemoveAll(stalePath)
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	return
+}
+
+// lockChrootPool creates the chroot pool in poolDir if needed and takes an exclusive lock on it.
+func lockChrootPool(poolDir string) (poolLock *os.File, err error) {
+	err = os.MkdirAll(poolDir, os.ModePerm)
+	if err != nil {
+		return
+	}
+
+	chrootLockFile := filepath.Join(poolDir, chrootLock)
+	poolLock, err = os.OpenFile(chrootLockFile, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		logger.Log.Errorf("Failed to open chroot pool lock (%s) - %s", chrootLockFile, err.Error())
+		return
+	}
+
+	err = unix.Flock(int(poolLock.Fd()), unix.LOCK_EX)
+	if err != nil {
+		logger.Log.Errorf("Failed to lock (%s) - %s", chrootLockFile, err.Error())
+		poolLock.Close()
+		poolLock = nil
+	}
+
+	return
+}
+
+// unlockFile releases the lock on a file and closes it.
+func unlockFile(lockedFile *os.File) (err error) {
+	err = unix.Flock(int(lockedFile.Fd()), unix.LOCK_UN)
+	closeErr := lockedFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	return
+}
@@ -0,0 +1,75 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package buildpipeline
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"microsoft.com/pkggen/internal/file"
+	"microsoft.com/pkggen/internal/logger"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitStderrLog()
+	os.Exit(m.Run())
+}
+
+// prepareTestBase prepares the base for key, counting how often it is populated.
+func prepareTestBase(t *testing.T, poolDir, key string, populated *int) *ChrootPoolBase {
+	base, err := PrepareChrootPoolBase(poolDir, key, func(baseDir string) error {
+		*populated++
+		return ioutil.WriteFile(filepath.Join(baseDir, "contents"), []byte(key), 0644)
+	})
+	assert.NoError(t, err)
+	return base
+}
+
+func TestPrepareChrootPoolBaseShouldPopulateOnce(t *testing.T) {
+	poolDir, err := ioutil.TempDir("", "chrootpool")
+	assert.NoError(t, err)
+	defer os.RemoveAll(poolDir)
+
+	populated := 0
+	first := prepareTestBase(t, poolDir, "a", &populated)
+	second := prepareTestBase(t, poolDir, "a", &populated)
+	defer first.Release()
+	defer second.Release()
+
+	assert.Equal(t, 1, populated)
+	assert.Equal(t, first.Dir(), second.Dir())
+}
+
+func TestPrepareChrootPoolBaseShouldKeepBasesInUse(t *testing.T) {
+	poolDir, err := ioutil.TempDir("", "chrootpool")
+	assert.NoError(t, err)
+	defer os.RemoveAll(poolDir)
+
+	populated := 0
+	oldBase := prepareTestBase(t, poolDir, "a", &populated)
+	assert.NoError(t, os.MkdirAll(oldBase.Dir()+"-layers", os.ModePerm))
+
+	newBase := prepareTestBase(t, poolDir, "b", &populated)
+	defer newBase.Release()
+
+	exists, err := file.DirExists(oldBase.Dir())
+	assert.NoError(t, err)
+	assert.True(t, exists, "a base must not be removed while it is in use")
+
+	assert.NoError(t, oldBase.Release())
+	prepareTestBase(t, poolDir, "b", &populated).Release()
+
+	for _, path := range []string{oldBase.Dir(), oldBase.Dir() + "-layers", oldBase.Dir() + chrootPoolBaseComplete} {
+		_, err = os.Stat(path)
+		assert.True(t, os.IsNotExist(err), "%s must be removed once its base is unused", path)
+	}
+
+	exists, err = file.DirExists(newBase.Dir())
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, 2, populated)
+}
@@ -10,6 +10,7 @@ import (
 
 	"gopkg.in/alecthomas/kingpin.v2"
 	"microsoft.com/pkggen/internal/logger"
+	"microsoft.com/pkggen/internal/metrics"
 )
 
 // ToolkitVersion specifies the version of the toolkit and the reported version of all tools in it.
@@ -50,6 +51,16 @@ func LogLevelFlag(k *kingpin.Application) *string {
 	return k.Flag(logger.LevelsFlag, logger.LevelsHelp).PlaceHolder(logger.LevelsPlaceholder).Enum(logger.Levels()...)
 }
 
+// MetricsFileFlag registers a metrics file flag for k and returns the passed value
+func MetricsFileFlag(k *kingpin.Application) *string {
+	return k.Flag(metrics.FileFlag, metrics.FileFlagHelp).String()
+}
+
+// MetricsAddressFlag registers a metrics address flag for k and returns the passed value
+func MetricsAddressFlag(k *kingpin.Application) *string {
+	return k.Flag(metrics.AddressFlag, metrics.AddressFlagHelp).String()
+}
+
 // PlaceHolderize takes a list of available inputs and returns a corresponding placeholder
 func PlaceHolderize(thing []string) string {
 	return fmt.Sprintf("(%s)", strings.Join(thing, "|"))
@@ -0,0 +1,194 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+// Package failureclassifier scans package build logs for known causes of failure.
+
+package failureclassifier
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"microsoft.com/pkggen/internal/logger"
+)
+
+// Categories of package build failures, as reported in Classification.Category.
+const (
+	// CategoryDiskFull marks a build which ran out of disk space.
+	CategoryDiskFull = "disk full"
+	// CategoryDependencyResolution marks a build whose build dependencies could not be installed.
+	CategoryDependencyResolution = "dependency resolution"
+	// CategoryMissingBuildRequires marks a build which needs a package that is missing from its BuildRequires.
+	CategoryMissingBuildRequires = "missing BuildRequires"
+	// CategoryUnpackagedFiles marks a build which installed files not listed in any %files section.
+	CategoryUnpackagedFiles = "unpackaged files"
+	// CategoryCheckFailure marks a build whose %check section failed.
+	CategoryCheckFailure = "check failure"
+	// CategoryCompilerError marks a build which failed to compile or link.
+	CategoryCompilerError = "compiler error"
+	// CategoryScriptFailure marks a build where one of the SPEC's other sections, such as %build, failed.
+	CategoryScriptFailure = "build script failure"
+)
+
+const (
+	// maxExcerptLines limits how many lines of a log an excerpt may contain.
+	maxExcerptLines = 20
+	// maxLineLength is the longest log line which will be scanned.
+	maxLineLength = 4 * 1024 * 1024
+)
+
+// Classification is the likely cause of a failed package build.
+type Classification struct {
+	Category string
+	// Excerpt holds the lines of the log which show the failure.
+	Excerpt string
+}
+
+// rule matches the log lines of one category of failure.
+// - contextBefore is the number of lines before the matching line to add to the excerpt.
+// - continuation matches lines after the matching line which should be added to the excerpt, such as a list of files.
+// - contextAfter is the number of lines after the matching line, and any continuation lines, to add to the excerpt.
+type rule struct {
+	category      string
+	pattern       *regexp.Regexp
+	contextBefore int
+	continuation  *regexp.Regexp
+	contextAfter  int
+}
+
+// rules are checked in order of precedence, the first rule which matches any line of a log classifies it.
+// Causes which make later errors likely, like a full disk, come first.
+var rules = []rule{
+	{
+		category: CategoryDiskFull,
+		pattern:  regexp.MustCompile(`No space left on device`),
+	},
+	{
+		category:     CategoryDependencyResolution,
+		pattern:      regexp.MustCompile(`\bError\(\d+\) : |unable to install the following packages`),
+		contextAfter: 2,
+	},
+	{
+		// Packages are built with --nodeps, so missing BuildRequires usually show up as missing tools, headers or libraries.
+		category:      CategoryMissingBuildRequires,
+		pattern:       regexp.MustCompile(`^error: Failed build dependencies:|fatal error: \S+: No such file or directory|Could NOT find |No package '\S+' found|Package '\S+'.* not found`),
+		contextBefore: 2,
+		continuation:  regexp.MustCompile(`^\s+\S.* is needed by `),
+	},
+	{
+		category:     CategoryUnpackagedFiles,
+		pattern:      regexp.MustCompile(`^error: Installed \(but unpackaged\) file\(s\) found:`),
+		continuation: regexp.MustCompile(`^\s+/`),
+	},
+	{
+		category:      CategoryCheckFailure,
+		pattern:       regexp.MustCompile(`Bad exit status from \S+ \(%check\)`),
+		contextBefore: 10,
+	},
+	{
+		category:      CategoryCompilerError,
+		pattern:       regexp.MustCompile(`^\S+:\d+(:\d+)?: (fatal )?error: |collect2: error: |undefined reference to `),
+		contextBefore: 2,
+		contextAfter:  2,
+	},
+	{
+		// Missing tools reported by the shell or configure are often harmless, such as an optional tool being probed for,
+		// so they only classify a build which did not fail in a more specific way.
+		category:      CategoryMissingBuildRequires,
+		pattern:       regexp.MustCompile(`^(\S*/)?(ba)?sh: (line \d+: )?\S+: command not found$|^configure: error: .*\b([Nn]ot found|[Cc]ould not find|[Cc]annot find|no acceptable|is required|[Mm]issing)\b`),
+		contextBefore: 2,
+	},
+	{
+		category:      CategoryScriptFailure,
+		pattern:       regexp.MustCompile(`Bad exit status from \S+ \(%\w+\)`),
+		contextBefore: 5,
+	},
+}
+
+// ClassifyFile classifies the failure of a package build from its log file.
+// Returns nil if the log does not match any known cause of failure.
+func ClassifyFile(logFile string) (classification *Classification, err error) {
+	file, err := os.Open(logFile)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	return Classify(file)
+}
+
+// Classify classifies the failure of a package build from its log.
+// Returns nil if the log does not match any known cause of failure.
+func Classify(log io.Reader) (classification *Classification, err error) {
+	lines, err := readLogLines(log)
+	if err != nil {
+		return
+	}
+
+	for _, r := range rules {
+		for i, line := range lines {
+			if !r.pattern.MatchString(line) {
+				continue
+			}
+
+			classification = &Classification{
+				Category: r.category,
+				Excerpt:  r.excerpt(lines, i),
+			}
+			return
+		}
+	}
+
+	return
+}
+
+// excerpt returns the lines of a log around the line at index match.
+func (r *rule) excerpt(lines []string, match int) string {
+	start := match - r.contextBefore
+	if start < 0 {
+		start = 0
+	}
+
+	end := match + 1
+	if r.continuation != nil {
+		for end < len(lines) && r.continuation.MatchString(lines[end]) {
+			end++
+		}
+	}
+
+	end += r.contextAfter
+	if end > len(lines) {
+		end = len(lines)
+	}
+
+	if end-start > maxExcerptLines {
+		end = start + maxExcerptLines
+	}
+
+	return strings.Join(lines[start:end], "\n")
+}
+
+// readLogLines reads every line of a log. Lines written by the toolkit's logger are replaced by their message,
+// which may itself span several lines.
+func readLogLines(log io.Reader) (lines []string, err error) {
+	scanner := bufio.NewScanner(log)
+	scanner.Buffer(nil, maxLineLength)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		message, isLogLine := logger.ParseMessage(line)
+		if !isLogLine {
+			lines = append(lines, line)
+			continue
+		}
+
+		lines = append(lines, strings.Split(strings.TrimRight(message, "\n"), "\n")...)
+	}
+
+	err = scanner.Err()
+	return
+}
@@ -0,0 +1,176 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package failureclassifier
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"microsoft.com/pkggen/internal/logger"
+)
+
+const testDataDir = "testdata"
+
+func TestMain(m *testing.M) {
+	logger.InitStderrLog()
+	os.Exit(m.Run())
+}
+
+func classifyLines(t *testing.T, lines ...string) *Classification {
+	classification, err := Classify(strings.NewReader(strings.Join(lines, "\n")))
+	assert.NoError(t, err)
+	return classification
+}
+
+func TestShouldClassifyLogFile(t *testing.T) {
+	classification, err := ClassifyFile(filepath.Join(testDataDir, "unpackaged_files.log"))
+	assert.NoError(t, err)
+	assert.Equal(t, &Classification{
+		Category: CategoryUnpackagedFiles,
+		Excerpt:  "error: Installed (but unpackaged) file(s) found:\n   /usr/bin/foo-helper\n   /usr/share/man/man1/foo-helper.1.gz",
+	}, classification)
+}
+
+func TestShouldFailToClassifyMissingLogFile(t *testing.T) {
+	_, err := ClassifyFile(filepath.Join(testDataDir, "missing.log"))
+	assert.Error(t, err)
+}
+
+func TestShouldNotClassifyUnknownFailure(t *testing.T) {
+	classification := classifyLines(t,
+		"building foo",
+		"something went wrong",
+	)
+	assert.Nil(t, classification)
+}
+
+func TestShouldClassifyDiskFullBeforeOtherFailures(t *testing.T) {
+	classification := classifyLines(t,
+		"foo.c:10:5: error: cannot write output",
+		"/usr/bin/ld: final link failed: No space left on device",
+		"error: Bad exit status from /var/tmp/rpm-tmp.abc (%build)",
+	)
+	assert.Equal(t, CategoryDiskFull, classification.Category)
+	assert.Equal(t, "/usr/bin/ld: final link failed: No space left on device", classification.Excerpt)
+}
+
+func TestShouldClassifyDependencyResolutionFromLoggedMessage(t *testing.T) {
+	classification := classifyLines(t,
+		`time="2021-03-01T10:00:00Z" level=warning msg="Failed to install build requirements. stderr: Error(1011) : No matching packages\nstdout: "`,
+	)
+	assert.Equal(t, CategoryDependencyResolution, classification.Category)
+	assert.Equal(t, "Failed to install build requirements. stderr: Error(1011) : No matching packages\nstdout: ", classification.Excerpt)
+}
+
+func TestShouldClassifyMissingHeaderAsMissingBuildRequires(t *testing.T) {
+	classification := classifyLines(t,
+		"gcc -c -o foo.o foo.c",
+		"foo.c:1:10: fatal error: zlib.h: No such file or directory",
+		"compilation terminated.",
+		"error: Bad exit status from /var/tmp/rpm-tmp.abc (%build)",
+	)
+	assert.Equal(t, CategoryMissingBuildRequires, classification.Category)
+	assert.Equal(t, "gcc -c -o foo.o foo.c\nfoo.c:1:10: fatal error: zlib.h: No such file or directory", classification.Excerpt)
+}
+
+func TestShouldClassifyFailedBuildDependenciesWithList(t *testing.T) {
+	classification := classifyLines(t,
+		"error: Failed build dependencies:",
+		"\tzlib-devel is needed by foo-1.0-1.cm1.x86_64",
+		"\tpython3-devel is needed by foo-1.0-1.cm1.x86_64",
+		"done",
+	)
+	assert.Equal(t, CategoryMissingBuildRequires, classification.Category)
+	assert.Equal(t, "error: Failed build dependencies:\n\tzlib-devel is needed by foo-1.0-1.cm1.x86_64\n\tpython3-devel is needed by foo-1.0-1.cm1.x86_64", classification.Excerpt)
+}
+
+func TestShouldClassifyCheckFailureBeforeCompilerError(t *testing.T) {
+	classification := classifyLines(t,
+		"test_foo.c:3:1: error: expected ';'",
+		"FAIL: test_foo",
+		"error: Bad exit status from /var/tmp/rpm-tmp.abc (%check)",
+	)
+	assert.Equal(t, CategoryCheckFailure, classification.Category)
+	assert.Equal(t, "test_foo.c:3:1: error: expected ';'\nFAIL: test_foo\nerror: Bad exit status from /var/tmp/rpm-tmp.abc (%check)", classification.Excerpt)
+}
+
+func TestShouldClassifyMissingToolAsMissingBuildRequires(t *testing.T) {
+	classification := classifyLines(t,
+		"checking for xsltproc... no",
+		"configure: error: xsltproc is required to build the documentation",
+		"error: Bad exit status from /var/tmp/rpm-tmp.abc (%build)",
+	)
+	assert.Equal(t, CategoryMissingBuildRequires, classification.Category)
+	assert.Equal(t, "checking for xsltproc... no\nconfigure: error: xsltproc is required to build the documentation", classification.Excerpt)
+
+	classification = classifyLines(t,
+		"+ make doc",
+		"/bin/sh: line 1: sphinx-build: command not found",
+		"error: Bad exit status from /var/tmp/rpm-tmp.abc (%build)",
+	)
+	assert.Equal(t, CategoryMissingBuildRequires, classification.Category)
+}
+
+func TestShouldNotClassifyProbedToolsAsMissingBuildRequires(t *testing.T) {
+	classification := classifyLines(t,
+		"./run-tests.sh: line 4: valgrind: command not found",
+		"bash: git: command not found",
+		"FAIL: test_foo",
+		"error: Bad exit status from /var/tmp/rpm-tmp.abc (%check)",
+	)
+	assert.Equal(t, CategoryCheckFailure, classification.Category)
+
+	classification = classifyLines(t,
+		"configure: error: invalid value for --enable-foo",
+		"error: Bad exit status from /var/tmp/rpm-tmp.abc (%build)",
+	)
+	assert.Equal(t, CategoryScriptFailure, classification.Category)
+}
+
+func TestShouldClassifyCompilerError(t *testing.T) {
+	classification := classifyLines(t,
+		"make[1]: Entering directory '/usr/src/mariner/BUILD/foo-1.0'",
+		"gcc -c -o foo.o foo.c",
+		"foo.c:12:3: error: 'bar' undeclared (first use in this function)",
+		"   12 |   bar = 1;",
+		"      |   ^~~",
+		"make[1]: *** [Makefile:10: foo.o] Error 1",
+		"error: Bad exit status from /var/tmp/rpm-tmp.abc (%build)",
+	)
+	assert.Equal(t, CategoryCompilerError, classification.Category)
+	assert.Equal(t, "make[1]: Entering directory '/usr/src/mariner/BUILD/foo-1.0'\ngcc -c -o foo.o foo.c\nfoo.c:12:3: error: 'bar' undeclared (first use in this function)\n   12 |   bar = 1;\n      |   ^~~", classification.Excerpt)
+}
+
+func TestShouldClassifyLinkerErrorAsCompilerError(t *testing.T) {
+	classification := classifyLines(t,
+		"/usr/bin/ld: foo.o: in function `main':",
+		"foo.c:(.text+0x5): undefined reference to `bar'",
+		"collect2: error: ld returned 1 exit status",
+	)
+	assert.Equal(t, CategoryCompilerError, classification.Category)
+}
+
+func TestShouldClassifyScriptFailure(t *testing.T) {
+	classification := classifyLines(t,
+		"+ ./autogen.sh",
+		"autogen.sh: unsupported option",
+		"error: Bad exit status from /var/tmp/rpm-tmp.abc (%prep)",
+	)
+	assert.Equal(t, CategoryScriptFailure, classification.Category)
+	assert.Equal(t, "+ ./autogen.sh\nautogen.sh: unsupported option\nerror: Bad exit status from /var/tmp/rpm-tmp.abc (%prep)", classification.Excerpt)
+}
+
+func TestShouldLimitExcerptLength(t *testing.T) {
+	lines := []string{"error: Installed (but unpackaged) file(s) found:"}
+	for i := 0; i < 2*maxExcerptLines; i++ {
+		lines = append(lines, "   /usr/lib/file")
+	}
+
+	classification := classifyLines(t, lines...)
+	assert.Equal(t, CategoryUnpackagedFiles, classification.Category)
+	assert.Len(t, strings.Split(classification.Excerpt, "\n"), maxExcerptLines)
+}
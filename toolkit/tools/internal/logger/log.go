@@ -11,6 +11,8 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"sync"
 
 	log "github.com/sirupsen/logrus"
@@ -26,6 +28,9 @@ var (
 
 	// Valid log levels
 	levelsArray = []string{"panic", "fatal", "error", "warn", "info", "debug", "trace"}
+
+	// messageRegex matches the, possibly quoted, message of a line written to a log file by Log
+	messageRegex = regexp.MustCompile(`\bmsg=("(?:[^"\\]|\\.)*"|\S*)`)
 )
 
 const (
@@ -153,6 +158,22 @@ func StreamOutput(pipe io.Reader, logFunction func(...interface{}), wg *sync.Wai
 	wg.Done()
 }
 
+// ParseMessage returns the message of a line written to a log file by Log,
+// isLogLine is false if the line was written by something else, such as a program's output
+func ParseMessage(line string) (message string, isLogLine bool) {
+	matches := messageRegex.FindStringSubmatch(line)
+	if matches == nil {
+		return
+	}
+
+	message, isLogLine = matches[1], true
+	if unquoted, err := strconv.Unquote(message); err == nil {
+		message = unquoted
+	}
+
+	return
+}
+
 // ReplaceStderrWriter replaces the stderr writer and returns the old one
 func ReplaceStderrWriter(newOut io.Writer) (oldOut io.Writer) {
 	return stderrHook.ReplaceWriter(newOut)
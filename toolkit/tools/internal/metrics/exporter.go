@@ -0,0 +1,146 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package metrics
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"microsoft.com/pkggen/internal/logger"
+)
+
+const (
+	// FileFlag is the suggested name for the metrics file flag
+	FileFlag = "metrics-file"
+
+	// FileFlagHelp is the suggested help message for the metrics file flag
+	FileFlagHelp = "Optional path to write OpenMetrics text describing the tool's work to when it exits."
+
+	// AddressFlag is the suggested name for the metrics address flag
+	AddressFlag = "metrics-address"
+
+	// AddressFlagHelp is the suggested help message for the metrics address flag
+	AddressFlagHelp = "Optional address, e.g. localhost:9100, to serve OpenMetrics text describing the tool's work on while it runs. Has no authentication, only listen on trusted networks."
+
+	// ScrapePath is the path metrics are served on.
+	ScrapePath = "/metrics"
+
+	// contentType is the content type of the OpenMetrics text format.
+	contentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// Exporter exports the metrics in DefaultRegistry to a file and a scrape endpoint.
+type Exporter struct {
+	file      string
+	server    *http.Server
+	closeOnce sync.Once
+}
+
+// StartExporter starts exporting the metrics in DefaultRegistry.
+// - file is written once the exporter is closed, or the tool exits through a fatal log. If empty no file is written.
+// - address is where a scrape endpoint is served until the exporter is closed. If empty no endpoint is served.
+func StartExporter(file, address string) (e *Exporter, err error) {
+	e = &Exporter{
+		file: file,
+	}
+
+	if address != "" {
+		var listener net.Listener
+		listener, err = net.Listen("tcp", address)
+		if err != nil {
+			return
+		}
+
+		mux := http.NewServeMux()
+		mux.HandleFunc(ScrapePath, handleScrape)
+		e.server = &http.Server{Handler: mux}
+
+		logger.Log.Infof("Serving metrics on http://%s%s", listener.Addr(), ScrapePath)
+
+		go func() {
+			serveErr := e.server.Serve(listener)
+			if serveErr != http.ErrServerClosed {
+				logger.Log.Warnf("Metrics server stopped, error: %s", serveErr)
+			}
+		}()
+	}
+
+	// Tools commonly exit through a fatal log, still record what happened up to that point.
+	logrus.RegisterExitHandler(func() {
+		closeErr := e.Close()
+		if closeErr != nil {
+			logger.Log.Warnf("Failed to export metrics, error: %s", closeErr)
+		}
+	})
+
+	return
+}
+
+// Close writes the metrics file and stops the scrape endpoint.
+// Only the first call has any effect.
+func (e *Exporter) Close() (err error) {
+	e.closeOnce.Do(func() {
+		if e.server != nil {
+			e.server.Close()
+		}
+
+		if e.file != "" {
+			err = WriteFile(e.file)
+		}
+	})
+
+	return
+}
+
+// WriteFile writes the metrics in DefaultRegistry to a file.
+func WriteFile(path string) (err error) {
+	err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return
+	}
+
+	// Write to a temporary file first, so a concurrent reader never sees a partially written file.
+	tempPath := path + ".tmp"
+	file, err := os.Create(tempPath)
+	if err != nil {
+		return
+	}
+
+	writer := bufio.NewWriter(file)
+	err = DefaultRegistry.WriteOpenMetrics(writer)
+	if err == nil {
+		err = writer.Flush()
+	}
+
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tempPath)
+		return
+	}
+
+	return os.Rename(tempPath, path)
+}
+
+// handleScrape sends the metrics in DefaultRegistry.
+func handleScrape(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(resp, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp.Header().Set("Content-Type", contentType)
+	err := DefaultRegistry.WriteOpenMetrics(resp)
+	if err != nil {
+		logger.Log.Warnf("Failed to send metrics, error: %s", err)
+	}
+}
@@ -0,0 +1,385 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	counterSuffix         = "_total"
+	histogramBucketSuffix = "_bucket"
+	histogramCountSuffix  = "_count"
+	histogramSumSuffix    = "_sum"
+	histogramBucketLabel  = "le"
+)
+
+// parsedSample is a single sample line read from OpenMetrics text.
+type parsedSample struct {
+	name        string
+	labelNames  []string
+	labelValues []string
+	value       float64
+}
+
+// parsedFamily is a metric family read from OpenMetrics text.
+type parsedFamily struct {
+	name       string
+	metricType string
+	help       string
+	samples    []*parsedSample
+}
+
+// MergeFile adds the metrics in an OpenMetrics text file written by another tool to DefaultRegistry.
+// It is used to collect the metrics of child processes, e.g. every package build, into a single export.
+func MergeFile(path string) (err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	return DefaultRegistry.MergeOpenMetrics(file)
+}
+
+// MergeOpenMetrics adds the metrics in OpenMetrics text, as written by WriteOpenMetrics, to the registry.
+// Counters are summed and histogram observations are added to those already recorded. Metrics not yet in the
+// registry are created. Only counters and histograms are supported, and a metric already in the registry must
+// have the same type, labels and buckets as the merged one.
+func (r *Registry) MergeOpenMetrics(reader io.Reader) (err error) {
+	families, err := readOpenMetrics(reader)
+	if err != nil {
+		return
+	}
+
+	for _, family := range families {
+		switch family.metricType {
+		case counterType:
+			err = r.mergeCounter(family)
+		case histogramType:
+			err = r.mergeHistogram(family)
+		default:
+			err = fmt.Errorf("can't merge metric (%s) of unsupported type (%s)", family.name, family.metricType)
+		}
+
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// lookupOrRegister returns the metric registered under m's name, registering m first if there is none.
+func (r *Registry) lookupOrRegister(m metric) metric {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	existing, found := r.metrics[m.metricName()]
+	if found {
+		return existing
+	}
+
+	r.metrics[m.metricName()] = m
+	return m
+}
+
+// mergeCounter adds the samples of a counter family to the registry.
+func (r *Registry) mergeCounter(family *parsedFamily) (err error) {
+	for _, sample := range family.samples {
+		if sample.name != family.name+counterSuffix {
+			continue
+		}
+
+		if sample.value < 0 {
+			err = fmt.Errorf("counter (%s) can not be decreased", family.name)
+			return
+		}
+
+		registered := r.lookupOrRegister(&Counter{
+			labeledMetric: labeledMetric{
+				name:       family.name,
+				help:       family.help,
+				labelNames: sample.labelNames,
+			},
+			values: make(map[string]float64),
+		})
+
+		counter, isCounter := registered.(*Counter)
+		if !isCounter || !reflect.DeepEqual(counter.labelNames, sample.labelNames) {
+			err = fmt.Errorf("can't merge counter (%s) into a different metric of the same name", family.name)
+			return
+		}
+
+		counter.Add(sample.value, sample.labelValues...)
+	}
+
+	return
+}
+
+// mergeHistogram adds the samples of a histogram family to the registry.
+func (r *Registry) mergeHistogram(family *parsedFamily) (err error) {
+	var (
+		keys         []string
+		labelNames   []string
+		buckets      []float64
+		values       = make(map[string]*histogramValue)
+		bucketCounts = make(map[string]map[float64]uint64)
+	)
+
+	for _, sample := range family.samples {
+		var (
+			names, labelValues []string
+			upperBound         string
+		)
+
+		for i, name := range sample.labelNames {
+			if name == histogramBucketLabel {
+				upperBound = sample.labelValues[i]
+				continue
+			}
+
+			names = append(names, name)
+			labelValues = append(labelValues, sample.labelValues[i])
+		}
+
+		key := strings.Join(labelValues, labelValueSeparator)
+		if values[key] == nil {
+			keys = append(keys, key)
+			labelNames = names
+			values[key] = &histogramValue{}
+			bucketCounts[key] = make(map[float64]uint64)
+		}
+
+		switch sample.name {
+		case family.name + histogramBucketSuffix:
+			var bound float64
+			bound, err = strconv.ParseFloat(upperBound, 64)
+			if err != nil {
+				err = fmt.Errorf("histogram (%s) has an invalid bucket (%s)", family.name, upperBound)
+				return
+			}
+
+			if math.IsInf(bound, 1) {
+				continue
+			}
+
+			if len(keys) == 1 {
+				buckets = append(buckets, bound)
+			}
+			bucketCounts[key][bound] = uint64(sample.value)
+		case family.name + histogramCountSuffix:
+			values[key].count = uint64(sample.value)
+		case family.name + histogramSumSuffix:
+			values[key].sum = sample.value
+		}
+	}
+
+	if len(keys) == 0 {
+		return
+	}
+
+	registered := r.lookupOrRegister(&Histogram{
+		labeledMetric: labeledMetric{
+			name:       family.name,
+			help:       family.help,
+			labelNames: labelNames,
+		},
+		buckets: buckets,
+		values:  make(map[string]*histogramValue),
+	})
+
+	histogram, isHistogram := registered.(*Histogram)
+	if !isHistogram || !reflect.DeepEqual(histogram.labelNames, labelNames) || !reflect.DeepEqual(histogram.buckets, buckets) {
+		err = fmt.Errorf("can't merge histogram (%s) into a different metric of the same name", family.name)
+		return
+	}
+
+	for _, key := range keys {
+		value := values[key]
+		value.bucketCounts = make([]uint64, len(buckets))
+		for i, bound := range buckets {
+			value.bucketCounts[i] = bucketCounts[key][bound]
+		}
+
+		histogram.merge(key, value)
+	}
+
+	return
+}
+
+// merge adds observations recorded elsewhere for a key to the histogram.
+func (h *Histogram) merge(key string, observations *histogramValue) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	v, found := h.values[key]
+	if !found {
+		v = &histogramValue{
+			bucketCounts: make([]uint64, len(h.buckets)),
+		}
+		h.values[key] = v
+	}
+
+	for i := range v.bucketCounts {
+		v.bucketCounts[i] += observations.bucketCounts[i]
+	}
+	v.count += observations.count
+	v.sum += observations.sum
+}
+
+// readOpenMetrics reads every metric family from OpenMetrics text.
+// Samples must follow the TYPE line of their family, as WriteOpenMetrics writes them.
+func readOpenMetrics(reader io.Reader) (families []*parsedFamily, err error) {
+	const (
+		typePrefix = "# TYPE "
+		helpPrefix = "# HELP "
+		eofLine    = "# EOF"
+	)
+
+	var family *parsedFamily
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		switch {
+		case line == eofLine:
+			return
+		case strings.HasPrefix(line, typePrefix):
+			fields := strings.Fields(strings.TrimPrefix(line, typePrefix))
+			if len(fields) != 2 {
+				err = fmt.Errorf("invalid metric type line: %s", line)
+				return
+			}
+
+			family = &parsedFamily{
+				name:       fields[0],
+				metricType: fields[1],
+			}
+			families = append(families, family)
+		case strings.HasPrefix(line, helpPrefix):
+			nameAndHelp := strings.SplitN(strings.TrimPrefix(line, helpPrefix), " ", 2)
+			if family != nil && len(nameAndHelp) == 2 && nameAndHelp[0] == family.name {
+				family.help = unescape(nameAndHelp[1])
+			}
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		default:
+			var sample *parsedSample
+			sample, err = parseSample(line)
+			if err != nil {
+				return
+			}
+
+			if family == nil || !strings.HasPrefix(sample.name, family.name) {
+				err = fmt.Errorf("sample (%s) does not belong to the metric family before it", sample.name)
+				return
+			}
+
+			family.samples = append(family.samples, sample)
+		}
+	}
+
+	err = scanner.Err()
+	return
+}
+
+// parseSample parses a sample line: a metric name, optional labels and a value. A trailing timestamp is ignored.
+func parseSample(line string) (sample *parsedSample, err error) {
+	sample = &parsedSample{}
+
+	nameEnd := strings.IndexAny(line, "{ ")
+	if nameEnd <= 0 {
+		err = fmt.Errorf("invalid sample line: %s", line)
+		return
+	}
+
+	sample.name = line[:nameEnd]
+	rest := line[nameEnd:]
+
+	if strings.HasPrefix(rest, "{") {
+		sample.labelNames, sample.labelValues, rest, err = parseLabels(rest)
+		if err != nil {
+			err = fmt.Errorf("invalid sample line (%s): %w", line, err)
+			return
+		}
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		err = fmt.Errorf("sample line has no value: %s", line)
+		return
+	}
+
+	sample.value, err = strconv.ParseFloat(fields[0], 64)
+	return
+}
+
+// parseLabels parses a label set, e.g. {a="1",b="2"}, from the start of text and returns whatever follows it.
+func parseLabels(text string) (names, values []string, rest string, err error) {
+	rest = strings.TrimPrefix(text, "{")
+
+	for !strings.HasPrefix(rest, "}") {
+		nameEnd := strings.Index(rest, "=\"")
+		if nameEnd <= 0 {
+			err = fmt.Errorf("malformed labels")
+			return
+		}
+
+		names = append(names, rest[:nameEnd])
+		rest = rest[nameEnd+len("=\""):]
+
+		var (
+			value   strings.Builder
+			escaped bool
+			closed  bool
+		)
+
+		for i, char := range rest {
+			switch {
+			case escaped:
+				if char == 'n' {
+					char = '\n'
+				}
+				value.WriteRune(char)
+				escaped = false
+			case char == '\\':
+				escaped = true
+			case char == '"':
+				rest = rest[i+1:]
+				closed = true
+			default:
+				value.WriteRune(char)
+			}
+
+			if closed {
+				break
+			}
+		}
+
+		if !closed {
+			err = fmt.Errorf("unterminated label value")
+			return
+		}
+
+		values = append(values, value.String())
+		rest = strings.TrimPrefix(rest, ",")
+	}
+
+	rest = strings.TrimPrefix(rest, "}")
+	return
+}
+
+// unescape reverses escapeHelp.
+func unescape(text string) string {
+	return strings.NewReplacer(`\\`, `\`, `\n`, "\n").Replace(text)
+}
@@ -0,0 +1,84 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package metrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergeShouldSumCounters(t *testing.T) {
+	source := NewRegistry()
+	source.NewCounter("builds", "Number of builds.", "result").Add(2, "built")
+
+	r := NewRegistry()
+	c := r.NewCounter("builds", "Number of builds.", "result")
+	c.Inc("built")
+	c.Inc("failed")
+
+	assert.NoError(t, r.MergeOpenMetrics(strings.NewReader(writeRegistry(t, source))))
+
+	expected := "# TYPE builds counter\n" +
+		"# HELP builds Number of builds.\n" +
+		"builds_total{result=\"built\"} 3\n" +
+		"builds_total{result=\"failed\"} 1\n" +
+		"# EOF\n"
+	assert.Equal(t, expected, writeRegistry(t, r))
+}
+
+func TestMergeShouldAddHistogramObservations(t *testing.T) {
+	source := NewRegistry()
+	sourceHistogram := source.NewHistogram("duration_seconds", "Build durations.", []float64{1, 10}, "format")
+	sourceHistogram.Observe(5, "vhd")
+	sourceHistogram.Observe(50, "vhd")
+
+	r := NewRegistry()
+	h := r.NewHistogram("duration_seconds", "Build durations.", []float64{1, 10}, "format")
+	h.Observe(0.5, "vhd")
+
+	assert.NoError(t, r.MergeOpenMetrics(strings.NewReader(writeRegistry(t, source))))
+
+	expected := "# TYPE duration_seconds histogram\n" +
+		"# HELP duration_seconds Build durations.\n" +
+		"duration_seconds_bucket{format=\"vhd\",le=\"1\"} 1\n" +
+		"duration_seconds_bucket{format=\"vhd\",le=\"10\"} 2\n" +
+		"duration_seconds_bucket{format=\"vhd\",le=\"+Inf\"} 3\n" +
+		"duration_seconds_count{format=\"vhd\"} 3\n" +
+		"duration_seconds_sum{format=\"vhd\"} 55.5\n" +
+		"# EOF\n"
+	assert.Equal(t, expected, writeRegistry(t, r))
+}
+
+func TestMergeShouldCreateMissingMetrics(t *testing.T) {
+	source := NewRegistry()
+	source.NewCounter("files", "Files\\seen.", "name").Inc("a \"quoted\"\nname\\")
+	source.NewHistogram("setup_seconds", "Setup durations.", []float64{1, 10}).Observe(2)
+	sourceText := writeRegistry(t, source)
+
+	r := NewRegistry()
+	assert.NoError(t, r.MergeOpenMetrics(strings.NewReader(sourceText)))
+	assert.Equal(t, sourceText, writeRegistry(t, r))
+}
+
+func TestMergeShouldFailOnMismatchedMetric(t *testing.T) {
+	source := NewRegistry()
+	source.NewCounter("builds", "Number of builds.", "result").Inc("built")
+
+	r := NewRegistry()
+	r.NewHistogram("builds", "Build durations.", DurationBuckets)
+	assert.Error(t, r.MergeOpenMetrics(strings.NewReader(writeRegistry(t, source))))
+
+	r = NewRegistry()
+	r.NewCounter("builds", "Number of builds.", "agent")
+	assert.Error(t, r.MergeOpenMetrics(strings.NewReader(writeRegistry(t, source))))
+}
+
+func TestMergeShouldFailOnMalformedText(t *testing.T) {
+	r := NewRegistry()
+	assert.Error(t, r.MergeOpenMetrics(strings.NewReader("builds_total 1\n")))
+	assert.Error(t, r.MergeOpenMetrics(strings.NewReader("# TYPE builds counter\nbuilds_total{result=\"built} 1\n")))
+	assert.Error(t, r.MergeOpenMetrics(strings.NewReader("# TYPE builds gauge\nbuilds 1\n")))
+}
@@ -0,0 +1,346 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+// Package metrics collects counters and histograms describing the toolkit's work and exports them as OpenMetrics text.
+
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	counterType   = "counter"
+	histogramType = "histogram"
+
+	// labelValueSeparator joins label values into a single map key, it can not appear in a valid UTF-8 label value.
+	labelValueSeparator = "\xff"
+)
+
+// DurationBuckets are histogram buckets, in seconds, suited to operations taking from a second to several hours.
+var DurationBuckets = []float64{1, 5, 15, 30, 60, 120, 300, 600, 1200, 1800, 3600, 7200, 14400}
+
+// DefaultRegistry holds every metric created with NewCounter and NewHistogram.
+var DefaultRegistry = NewRegistry()
+
+// metric is a single metric family which can be written in the OpenMetrics text format.
+type metric interface {
+	metricName() string
+	writeOpenMetrics(w io.Writer) error
+}
+
+// Registry is a set of uniquely named metrics.
+type Registry struct {
+	mutex   sync.Mutex
+	metrics map[string]metric
+}
+
+// NewRegistry returns a new, empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		metrics: make(map[string]metric),
+	}
+}
+
+// register adds a metric to the registry. It panics if a metric with the same name already exists, since
+// metrics are created once at package initialization and a duplicate name is a programming error.
+func (r *Registry) register(m metric) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, exists := r.metrics[m.metricName()]; exists {
+		panic(fmt.Sprintf("metric (%s) is already registered", m.metricName()))
+	}
+
+	r.metrics[m.metricName()] = m
+}
+
+// WriteOpenMetrics writes every metric in the registry in the OpenMetrics text format.
+func (r *Registry) WriteOpenMetrics(w io.Writer) (err error) {
+	r.mutex.Lock()
+	metrics := make([]metric, 0, len(r.metrics))
+	for _, m := range r.metrics {
+		metrics = append(metrics, m)
+	}
+	r.mutex.Unlock()
+
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].metricName() < metrics[j].metricName()
+	})
+
+	for _, m := range metrics {
+		err = m.writeOpenMetrics(w)
+		if err != nil {
+			return
+		}
+	}
+
+	_, err = io.WriteString(w, "# EOF\n")
+	return
+}
+
+// labeledMetric holds the name, help and label names shared by every type of metric.
+type labeledMetric struct {
+	name       string
+	help       string
+	labelNames []string
+}
+
+func (m *labeledMetric) metricName() string {
+	return m.name
+}
+
+// key joins label values into a map key, checking the right number of values were given.
+func (m *labeledMetric) key(labelValues []string) string {
+	if len(labelValues) != len(m.labelNames) {
+		panic(fmt.Sprintf("metric (%s) expects %d label values, got %d", m.name, len(m.labelNames), len(labelValues)))
+	}
+
+	return strings.Join(labelValues, labelValueSeparator)
+}
+
+// writeHeader writes the TYPE and HELP lines of the metric.
+func (m *labeledMetric) writeHeader(w io.Writer, metricType string) (err error) {
+	_, err = fmt.Fprintf(w, "# TYPE %s %s\n# HELP %s %s\n", m.name, metricType, m.name, escapeHelp(m.help))
+	return
+}
+
+// labels formats the labels for a key, followed by any extra label, as they appear on a sample line.
+func (m *labeledMetric) labels(key string, extraName, extraValue string) string {
+	var pairs []string
+
+	if len(m.labelNames) > 0 {
+		for i, value := range strings.Split(key, labelValueSeparator) {
+			pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", m.labelNames[i], escapeLabelValue(value)))
+		}
+	}
+
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", extraName, escapeLabelValue(extraValue)))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("{%s}", strings.Join(pairs, ","))
+}
+
+// Counter is a monotonically increasing value, optionally partitioned by a set of labels.
+type Counter struct {
+	labeledMetric
+
+	mutex  sync.Mutex
+	values map[string]float64
+}
+
+// NewCounter creates a counter in DefaultRegistry.
+// - name must not include the "_total" suffix, it is added when the counter is written.
+// - labelNames are the names of the labels every Add or Inc must supply values for, in order.
+func NewCounter(name, help string, labelNames ...string) *Counter {
+	return DefaultRegistry.NewCounter(name, help, labelNames...)
+}
+
+// NewCounter creates a counter in the registry, see the package level NewCounter.
+func (r *Registry) NewCounter(name, help string, labelNames ...string) (c *Counter) {
+	c = &Counter{
+		labeledMetric: labeledMetric{
+			name:       name,
+			help:       help,
+			labelNames: labelNames,
+		},
+		values: make(map[string]float64),
+	}
+
+	r.register(c)
+	return
+}
+
+// Add increases the counter for the given label values by value, which must not be negative.
+func (c *Counter) Add(value float64, labelValues ...string) {
+	if value < 0 {
+		panic(fmt.Sprintf("counter (%s) can not be decreased", c.name))
+	}
+
+	key := c.key(labelValues)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.values[key] += value
+}
+
+// Inc increases the counter for the given label values by one.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) writeOpenMetrics(w io.Writer) (err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	err = c.writeHeader(w, counterType)
+	if err != nil {
+		return
+	}
+
+	for _, key := range sortedKeys(c.values) {
+		_, err = fmt.Fprintf(w, "%s_total%s %s\n", c.name, c.labels(key, "", ""), formatValue(c.values[key]))
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// histogramValue holds the observations of a histogram for a single set of label values.
+type histogramValue struct {
+	bucketCounts []uint64
+	count        uint64
+	sum          float64
+}
+
+// Histogram counts observations into buckets, optionally partitioned by a set of labels.
+type Histogram struct {
+	labeledMetric
+	buckets []float64
+
+	mutex  sync.Mutex
+	values map[string]*histogramValue
+}
+
+// NewHistogram creates a histogram in DefaultRegistry.
+// - buckets are the upper bounds of the histogram's buckets, in increasing order. A +Inf bucket is always added.
+// - labelNames are the names of the labels every Observe must supply values for, in order.
+func NewHistogram(name, help string, buckets []float64, labelNames ...string) *Histogram {
+	return DefaultRegistry.NewHistogram(name, help, buckets, labelNames...)
+}
+
+// NewHistogram creates a histogram in the registry, see the package level NewHistogram.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labelNames ...string) (h *Histogram) {
+	if !sort.Float64sAreSorted(buckets) {
+		panic(fmt.Sprintf("histogram (%s) buckets must be in increasing order", name))
+	}
+
+	h = &Histogram{
+		labeledMetric: labeledMetric{
+			name:       name,
+			help:       help,
+			labelNames: labelNames,
+		},
+		buckets: buckets,
+		values:  make(map[string]*histogramValue),
+	}
+
+	r.register(h)
+	return
+}
+
+// Observe records a single observation for the given label values.
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	key := h.key(labelValues)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	v, found := h.values[key]
+	if !found {
+		v = &histogramValue{
+			bucketCounts: make([]uint64, len(h.buckets)),
+		}
+		h.values[key] = v
+	}
+
+	for i, upperBound := range h.buckets {
+		if value <= upperBound {
+			v.bucketCounts[i]++
+		}
+	}
+	v.count++
+	v.sum += value
+}
+
+// ObserveSince records the number of seconds elapsed since start for the given label values.
+func (h *Histogram) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *Histogram) writeOpenMetrics(w io.Writer) (err error) {
+	const bucketLabel = "le"
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	err = h.writeHeader(w, histogramType)
+	if err != nil {
+		return
+	}
+
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		v := h.values[key]
+
+		for i, upperBound := range h.buckets {
+			_, err = fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labels(key, bucketLabel, formatValue(upperBound)), v.bucketCounts[i])
+			if err != nil {
+				return
+			}
+		}
+
+		_, err = fmt.Fprintf(w, "%s_bucket%s %d\n%s_count%s %d\n%s_sum%s %s\n",
+			h.name, h.labels(key, bucketLabel, formatValue(math.Inf(1))), v.count,
+			h.name, h.labels(key, "", ""), v.count,
+			h.name, h.labels(key, "", ""), formatValue(v.sum))
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// formatValue formats a sample value as OpenMetrics expects it.
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
+// escapeHelp escapes a HELP string.
+func escapeHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
+
+// escapeLabelValue escapes a label value.
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(value)
+}
+
+// sortedKeys returns the keys of a map in increasing order.
+func sortedKeys(m map[string]float64) (keys []string) {
+	keys = make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return
+}
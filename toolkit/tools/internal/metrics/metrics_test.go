@@ -0,0 +1,143 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package metrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"microsoft.com/pkggen/internal/logger"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitStderrLog()
+	os.Exit(m.Run())
+}
+
+func writeRegistry(t *testing.T, r *Registry) string {
+	var buf bytes.Buffer
+	err := r.WriteOpenMetrics(&buf)
+	assert.NoError(t, err)
+	return buf.String()
+}
+
+func TestEmptyRegistryShouldOnlyWriteEOF(t *testing.T) {
+	r := NewRegistry()
+	assert.Equal(t, "# EOF\n", writeRegistry(t, r))
+}
+
+func TestCounterShouldWriteTotal(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("builds", "Number of builds.")
+	c.Inc()
+	c.Add(2.5)
+
+	expected := "# TYPE builds counter\n" +
+		"# HELP builds Number of builds.\n" +
+		"builds_total 3.5\n" +
+		"# EOF\n"
+	assert.Equal(t, expected, writeRegistry(t, r))
+}
+
+func TestCounterShouldWriteSortedLabels(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("builds", "Number of builds.", "result", "agent")
+	c.Inc("failed", "chroot")
+	c.Inc("built", "chroot")
+	c.Inc("built", "chroot")
+
+	expected := "# TYPE builds counter\n" +
+		"# HELP builds Number of builds.\n" +
+		"builds_total{result=\"built\",agent=\"chroot\"} 2\n" +
+		"builds_total{result=\"failed\",agent=\"chroot\"} 1\n" +
+		"# EOF\n"
+	assert.Equal(t, expected, writeRegistry(t, r))
+}
+
+func TestCounterShouldEscapeLabelValues(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("files", "Files\\seen.", "name")
+	c.Inc("a \"quoted\"\nname\\")
+
+	expected := "# TYPE files counter\n" +
+		"# HELP files Files\\\\seen.\n" +
+		"files_total{name=\"a \\\"quoted\\\"\\nname\\\\\"} 1\n" +
+		"# EOF\n"
+	assert.Equal(t, expected, writeRegistry(t, r))
+}
+
+func TestCounterShouldPanicOnNegativeValue(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("builds", "Number of builds.")
+	assert.Panics(t, func() { c.Add(-1) })
+}
+
+func TestCounterShouldPanicOnWrongLabelCount(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("builds", "Number of builds.", "result")
+	assert.Panics(t, func() { c.Inc() })
+	assert.Panics(t, func() { c.Inc("built", "extra") })
+}
+
+func TestDuplicateMetricShouldPanic(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("builds", "Number of builds.")
+	assert.Panics(t, func() { r.NewHistogram("builds", "Build durations.", DurationBuckets) })
+}
+
+func TestHistogramShouldWriteCumulativeBuckets(t *testing.T) {
+	r := NewRegistry()
+	h := r.NewHistogram("duration_seconds", "Build durations.", []float64{1, 10}, "format")
+	h.Observe(0.5, "vhd")
+	h.Observe(5, "vhd")
+	h.Observe(50, "vhd")
+
+	expected := "# TYPE duration_seconds histogram\n" +
+		"# HELP duration_seconds Build durations.\n" +
+		"duration_seconds_bucket{format=\"vhd\",le=\"1\"} 1\n" +
+		"duration_seconds_bucket{format=\"vhd\",le=\"10\"} 2\n" +
+		"duration_seconds_bucket{format=\"vhd\",le=\"+Inf\"} 3\n" +
+		"duration_seconds_count{format=\"vhd\"} 3\n" +
+		"duration_seconds_sum{format=\"vhd\"} 55.5\n" +
+		"# EOF\n"
+	assert.Equal(t, expected, writeRegistry(t, r))
+}
+
+func TestHistogramShouldPanicOnUnsortedBuckets(t *testing.T) {
+	r := NewRegistry()
+	assert.Panics(t, func() { r.NewHistogram("duration_seconds", "Build durations.", []float64{10, 1}) })
+}
+
+func TestRegistryShouldWriteMetricsSortedByName(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("b", "B.").Inc()
+	r.NewCounter("a", "A.").Inc()
+
+	expected := "# TYPE a counter\n" +
+		"# HELP a A.\n" +
+		"a_total 1\n" +
+		"# TYPE b counter\n" +
+		"# HELP b B.\n" +
+		"b_total 1\n" +
+		"# EOF\n"
+	assert.Equal(t, expected, writeRegistry(t, r))
+}
+
+func TestWriteFileShouldCreateParentDirectories(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "nested", "metrics.txt")
+	err = WriteFile(path)
+	assert.NoError(t, err)
+
+	contents, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Contains(t, string(contents), "# EOF\n")
+}
@@ -13,6 +13,7 @@ import (
 
 	"microsoft.com/pkggen/internal/buildpipeline"
 	"microsoft.com/pkggen/internal/logger"
+	"microsoft.com/pkggen/internal/metrics"
 	"microsoft.com/pkggen/internal/packagerepo/repocloner"
 	"microsoft.com/pkggen/internal/packagerepo/repomanager/rpmrepomanager"
 	"microsoft.com/pkggen/internal/pkgjson"
@@ -53,6 +54,9 @@ var (
 	//   - version:         1.1b.8_X-22~rc1
 	//   - dist:            cm1
 	listedPackageRegex = regexp.MustCompile(`^\s*([[:alnum:]_+-]+)\.([[:alnum:]_+-]+)\s+([[:alnum:]._+~-]+)\.([[:alnum:]_+-]+)`)
+
+	downloadedPackages = metrics.NewCounter("toolkit_downloaded_packages", "Number of RPMs downloaded by the repo cloner.")
+	downloadedBytes    = metrics.NewCounter("toolkit_downloaded_bytes", "Size in bytes of the RPMs downloaded by the repo cloner.")
 )
 
 const (
@@ -69,6 +73,7 @@ type RpmRepoCloner struct {
 	chroot         *safechroot.Chroot
 	usePreviewRepo bool
 	cloneDir       string
+	knownRPMs      map[string]bool
 }
 
 // New creates a new RpmRepoCloner
@@ -169,6 +174,10 @@ func (r *RpmRepoCloner) Initialize(destinationDir, tmpDir, workerTar, existingRp
 		return
 	}
 
+	// Remember which RPMs were already present, so only new downloads are counted.
+	r.knownRPMs = make(map[string]bool)
+	_, _, err = r.findNewRPMs()
+
 	return
 }
 
@@ -371,6 +380,13 @@ func (r *RpmRepoCloner) ConvertDownloadedPackagesIntoRepo() (err error) {
 	srcDir := filepath.Join(r.chroot.RootDir(), chrootDownloadDir)
 	repoDir := srcDir
 
+	newPackages, newBytes, err := r.findNewRPMs()
+	if err != nil {
+		return
+	}
+	downloadedPackages.Add(float64(newPackages))
+	downloadedBytes.Add(float64(newBytes))
+
 	if !buildpipeline.IsRegularBuild() {
 		// Docker based build doesn't use overlay so repo folder
 		// must be explicitely set to the RPMs cache folder
@@ -525,6 +541,33 @@ func (r *RpmRepoCloner) clonePackage(baseArgs []string, enabledRepoOrder ...stri
 	return
 }
 
+// findNewRPMs finds every RPM in the download directory which was not seen by an earlier call, and returns their count and total size.
+// RPMs are tracked by file name, since they may be moved into architecture specific subdirectories once downloaded.
+func (r *RpmRepoCloner) findNewRPMs() (count int, size int64, err error) {
+	downloadDir := r.cloneDir
+	if !buildpipeline.IsRegularBuild() {
+		downloadDir = filepath.Join(r.chroot.RootDir(), cacheRepoDir)
+	}
+
+	err = filepath.Walk(downloadDir, func(path string, info os.FileInfo, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+
+		if info.IsDir() || filepath.Ext(path) != ".rpm" || r.knownRPMs[info.Name()] {
+			return nil
+		}
+
+		r.knownRPMs[info.Name()] = true
+		count++
+		size += info.Size()
+
+		return nil
+	})
+
+	return
+}
+
 func convertPackageVersionToTdnfArg(pkgVer *pkgjson.PackageVer) (tdnfArg string) {
 	tdnfArg = pkgVer.Name
 	// TDNF does not accept versioning information on implicit provides.
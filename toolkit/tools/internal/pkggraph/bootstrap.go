@@ -0,0 +1,171 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package pkggraph
+
+import (
+	"fmt"
+	"os"
+
+	"microsoft.com/pkggen/internal/file"
+	"microsoft.com/pkggen/internal/logger"
+)
+
+// Bootstrap stages break cycles of 'BuildRequires' which no pre-built SRPM breaks.
+//
+// A spec with a bootstrap build conditional (bcond), such as "%{with bootstrap}", may be built twice:
+// - Stage 1 builds the spec with the bcond enabled, which drops the build dependencies closing the cycle.
+// - Stage 2 is the spec's regular build, done once everything which needed stage 1 is built.
+// Stage 1 is represented by copies of the spec's run and build nodes with Bcond set. The copies are not part
+// of the lookup table, so dependencies only resolve to them when MakeDAG redirects the 'BuildRequires' of a cycle.
+//
+// Both stages build the same RPM files, as the packages they provide are only installed by name from the local repository.
+// The RPMs built by stage 1 are recorded with RecordRPMsStage, so they are never mistaken for those of the regular build.
+// Stage 2 overwrites them once everything depending on stage 1 is built, since it depends on all of it through the cycle.
+
+// bootstrapStageRecordSuffix is added to the path of an RPM built by a bootstrap stage to name the file recording the stage.
+const bootstrapStageRecordSuffix = ".bootstrap-stage"
+
+// AddBootstrapNodes adds the bootstrap stage of a package: copies of its run and build nodes, built with the given bcond.
+// The only dependency added is the one of the new run node on the new build node, the caller adds the others.
+func (g *PkgGraph) AddBootstrapNodes(runNode, buildNode *PkgNode, bcond string) (bootstrapRunNode, bootstrapBuildNode *PkgNode, err error) {
+	if bcond == "" {
+		err = fmt.Errorf("a bootstrap stage of %s requires a bcond", runNode.FriendlyName())
+		return
+	}
+
+	if runNode.Type != TypeRun || buildNode.Type != TypeBuild {
+		err = fmt.Errorf("a bootstrap stage can only copy a run and a build node, got %s and %s", runNode.FriendlyName(), buildNode.FriendlyName())
+		return
+	}
+
+	if runNode.Bcond != "" || buildNode.Bcond != "" {
+		err = fmt.Errorf("%s is already part of a bootstrap stage", runNode.FriendlyName())
+		return
+	}
+
+	bootstrapBuildNode = g.CloneNode(buildNode)
+	bootstrapBuildNode.Bcond = bcond
+	g.AddNode(bootstrapBuildNode)
+
+	bootstrapRunNode = g.CloneNode(runNode)
+	bootstrapRunNode.Bcond = bcond
+	g.AddNode(bootstrapRunNode)
+
+	logger.Log.Debugf("Adding bootstrap stage nodes %s and %s", bootstrapRunNode.FriendlyName(), bootstrapBuildNode.FriendlyName())
+
+	err = g.AddEdge(bootstrapRunNode, bootstrapBuildNode)
+	return
+}
+
+// fixBootstrapCycle attempts to fix a cycle if one of its 'BuildRequires' is on a package with a bootstrap stage.
+// If a cycle can be fixed, the edges from the requiring SRPM's build nodes to the package are moved to the package's
+// bootstrap stage. The package's regular build still depends on the requiring SRPM, so it is rebuilt afterwards.
+func (g *PkgGraph) fixBootstrapCycle(trimmedCycle []*PkgNode) (err error) {
+	logger.Log.Debug("Checking if cycle contains packages with a bootstrap stage.")
+
+	currentNode := trimmedCycle[len(trimmedCycle)-1]
+	for _, previousNode := range trimmedCycle {
+		// Like fixPrebuiltSRPMsCycle, only "build node -> run node" edges, the 'BuildRequires' from the .spec file, are redirected.
+		buildToRunEdge := previousNode.Type == TypeBuild && currentNode.Type == TypeRun
+		if buildToRunEdge {
+			bootstrapRunNode := g.findBootstrapRunNode(currentNode)
+			if bootstrapRunNode != nil && g.redirectToBootstrapStage(previousNode.SrpmPath, currentNode, bootstrapRunNode) > 0 {
+				return
+			}
+		}
+
+		currentNode = previousNode
+	}
+
+	return fmt.Errorf("cycle contains no packages with a bootstrap stage, unresolvable")
+}
+
+// redirectToBootstrapStage moves the edges from an SRPM's build nodes to a run node onto the run node's bootstrap stage.
+// The bootstrap stage's own build nodes are left alone, as they can not depend on themselves.
+// Returns the number of edges moved.
+func (g *PkgGraph) redirectToBootstrapStage(srpmPath string, runNode, bootstrapRunNode *PkgNode) (redirected int) {
+	var parentsToRedirect []*PkgNode
+
+	parentNodes := g.To(runNode.ID())
+	for parentNodes.Next() {
+		parentNode := parentNodes.Node().(*PkgNode).This
+		isBootstrapBuildNode := parentNode.SrpmPath == bootstrapRunNode.SrpmPath && parentNode.Bcond == bootstrapRunNode.Bcond
+		if parentNode.Type == TypeBuild && parentNode.SrpmPath == srpmPath && !isBootstrapBuildNode {
+			parentsToRedirect = append(parentsToRedirect, parentNode)
+		}
+	}
+
+	for _, parentNode := range parentsToRedirect {
+		logger.Log.Debugf("Replacing edge %s -> %s with an edge to bootstrap stage %s.", parentNode.FriendlyName(), runNode.FriendlyName(), bootstrapRunNode.FriendlyName())
+
+		g.RemoveEdge(parentNode.ID(), runNode.ID())
+		g.SetEdge(g.NewEdge(parentNode, bootstrapRunNode))
+		redirected++
+	}
+
+	return
+}
+
+// findBootstrapRunNode returns the bootstrap stage copy of a run node, or nil if its package has no bootstrap stage.
+func (g *PkgGraph) findBootstrapRunNode(runNode *PkgNode) *PkgNode {
+	if runNode.Bcond != "" {
+		return nil
+	}
+
+	for _, node := range g.NodesBySRPM(runNode.SrpmPath) {
+		if node.Type == TypeRun && node.Bcond != "" &&
+			node.VersionedPkg.Name == runNode.VersionedPkg.Name &&
+			node.VersionedPkg.Version == runNode.VersionedPkg.Version {
+			return node
+		}
+	}
+
+	return nil
+}
+
+// removeUnusedBootstrapNodes removes every bootstrap stage node nothing depends on.
+// Removing a bootstrap run node may leave its build node unused, so nodes are removed until none are left.
+func (g *PkgGraph) removeUnusedBootstrapNodes() {
+	for removedAny := true; removedAny; {
+		removedAny = false
+
+		for _, node := range g.AllNodes() {
+			if node.Bcond == "" || g.To(node.ID()).Len() > 0 {
+				continue
+			}
+
+			logger.Log.Debugf("Removing unused bootstrap stage node %s", node.FriendlyName())
+			g.RemoveNode(node.ID())
+			removedAny = true
+		}
+	}
+}
+
+// RecordRPMsStage records which stage of an SRPM built its RPMs. The bcond of a bootstrap stage is recorded next to
+// each RPM, while the regular build, with an empty bcond, removes any such record.
+func RecordRPMsStage(rpmFiles []string, bcond string) (err error) {
+	for _, rpmFile := range rpmFiles {
+		recordFile := rpmFile + bootstrapStageRecordSuffix
+		if bcond != "" {
+			err = file.Write(bcond, recordFile)
+		} else {
+			err = os.Remove(recordFile)
+			if os.IsNotExist(err) {
+				err = nil
+			}
+		}
+
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// IsBootstrapStageRPM checks if an RPM was last built by the bootstrap stage of its SRPM.
+func IsBootstrapStageRPM(rpmFile string) bool {
+	exists, _ := file.PathExists(rpmFile + bootstrapStageRecordSuffix)
+	return exists
+}
@@ -0,0 +1,190 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package pkggraph
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// bootstrapNodes returns every bootstrap stage node of the graph.
+func bootstrapNodes(g *PkgGraph) (nodes []*PkgNode) {
+	for _, node := range g.AllNodes() {
+		if node.Bcond != "" {
+			nodes = append(nodes, node)
+		}
+	}
+	return
+}
+
+func TestAddBootstrapNodes(t *testing.T) {
+	g := NewPkgGraph()
+	aRun, aBuild := addSRPMHelper(t, g, "A")
+
+	bootstrapRun, bootstrapBuild, err := g.AddBootstrapNodes(aRun, aBuild, "bootstrap")
+	assert.NoError(t, err)
+
+	assert.Equal(t, TypeRun, bootstrapRun.Type)
+	assert.Equal(t, TypeBuild, bootstrapBuild.Type)
+	assert.Equal(t, "bootstrap", bootstrapRun.Bcond)
+	assert.Equal(t, "bootstrap", bootstrapBuild.Bcond)
+	assert.Equal(t, aRun.SrpmPath, bootstrapBuild.SrpmPath)
+	assert.NotNil(t, g.Edge(bootstrapRun.ID(), bootstrapBuild.ID()))
+	assert.Contains(t, bootstrapBuild.FriendlyName(), "[bootstrap]")
+
+	// Bootstrap stages are never looked up
+	lookup, err := g.FindExactPkgNodeFromPkg(aRun.VersionedPkg)
+	assert.NoError(t, err)
+	assert.Equal(t, aRun, lookup.RunNode)
+	assert.Equal(t, aBuild, lookup.BuildNode)
+	assert.Len(t, g.AllRunNodes(), 1)
+	assert.Len(t, g.AllBuildNodes(), 1)
+
+	_, _, err = g.AddBootstrapNodes(aRun, aBuild, "")
+	assert.Error(t, err)
+	_, _, err = g.AddBootstrapNodes(bootstrapRun, bootstrapBuild, "bootstrap")
+	assert.Error(t, err)
+	_, _, err = g.AddBootstrapNodes(aBuild, aRun, "bootstrap")
+	assert.Error(t, err)
+}
+
+func TestMakeDAGBreaksBuildCycleWithBootstrapStage(t *testing.T) {
+	g := NewPkgGraph()
+	aRun, aBuild := addSRPMHelper(t, g, "A")
+	bRun, bBuild := addSRPMHelper(t, g, "B")
+
+	// A BuildRequires B, B BuildRequires A. B can be built without A in a bootstrap stage.
+	assert.NoError(t, g.AddEdge(aBuild, bRun))
+	assert.NoError(t, g.AddEdge(bBuild, aRun))
+	bootstrapRun, bootstrapBuild, err := g.AddBootstrapNodes(bRun, bBuild, "bootstrap")
+	assert.NoError(t, err)
+
+	err = g.MakeDAG()
+	assert.NoError(t, err)
+
+	// A is built against the bootstrap stage of B, then B is built again against A.
+	assert.Nil(t, g.Edge(aBuild.ID(), bRun.ID()))
+	assert.NotNil(t, g.Edge(aBuild.ID(), bootstrapRun.ID()))
+	assert.NotNil(t, g.Edge(bootstrapRun.ID(), bootstrapBuild.ID()))
+	assert.NotNil(t, g.Edge(bBuild.ID(), aRun.ID()))
+	assert.Len(t, bootstrapNodes(g), 2)
+}
+
+func TestMakeDAGBreaksSelfBuildCycleWithBootstrapStage(t *testing.T) {
+	g := NewPkgGraph()
+	aRun, aBuild := addSRPMHelper(t, g, "A")
+	bRun, _ := addSRPMHelper(t, g, "B")
+
+	// A BuildRequires A-devel, provided by A's own SRPM. A's bootstrap stage only requires B.
+	aDevelRun, aDevelBuild := addSRPMHelper(t, g, "A-devel")
+	aDevelRun.SrpmPath = aRun.SrpmPath
+	aDevelBuild.SrpmPath = aRun.SrpmPath
+	assert.NoError(t, g.AddEdge(aBuild, aDevelRun))
+	assert.NoError(t, g.AddEdge(aDevelBuild, aDevelRun))
+
+	bootstrapRun, bootstrapBuild, err := g.AddBootstrapNodes(aDevelRun, aDevelBuild, "bootstrap")
+	assert.NoError(t, err)
+	assert.NoError(t, g.AddEdge(bootstrapBuild, bRun))
+
+	err = g.MakeDAG()
+	assert.NoError(t, err)
+
+	assert.NotNil(t, g.Edge(aBuild.ID(), bootstrapRun.ID()))
+	assert.NotNil(t, g.Edge(aDevelBuild.ID(), bootstrapRun.ID()))
+	assert.NotNil(t, g.Edge(bootstrapBuild.ID(), bRun.ID()))
+}
+
+func TestMakeDAGFailsIfBootstrapStageIsStillInCycle(t *testing.T) {
+	g := NewPkgGraph()
+	aRun, aBuild := addSRPMHelper(t, g, "A")
+	bRun, bBuild := addSRPMHelper(t, g, "B")
+
+	// The bootstrap stage of B still requires A, so it can't break the cycle.
+	assert.NoError(t, g.AddEdge(aBuild, bRun))
+	assert.NoError(t, g.AddEdge(bBuild, aRun))
+	_, bootstrapBuild, err := g.AddBootstrapNodes(bRun, bBuild, "bootstrap")
+	assert.NoError(t, err)
+	assert.NoError(t, g.AddEdge(bootstrapBuild, aRun))
+
+	err = g.MakeDAG()
+	assert.Error(t, err)
+}
+
+func TestMakeDAGRemovesUnusedBootstrapStages(t *testing.T) {
+	g := NewPkgGraph()
+	aRun, aBuild := addSRPMHelper(t, g, "A")
+	bRun, bBuild := addSRPMHelper(t, g, "B")
+
+	// A BuildRequires B, there is no cycle to break.
+	assert.NoError(t, g.AddEdge(aBuild, bRun))
+	_, bootstrapBuild, err := g.AddBootstrapNodes(bRun, bBuild, "bootstrap")
+	assert.NoError(t, err)
+	assert.NoError(t, g.AddEdge(bootstrapBuild, aRun))
+
+	err = g.MakeDAG()
+	assert.NoError(t, err)
+
+	assert.Empty(t, bootstrapNodes(g))
+	assert.NotNil(t, g.Edge(aBuild.ID(), bRun.ID()))
+	assert.Equal(t, 4, g.Nodes().Len())
+}
+
+// Make sure bootstrap stages survive encoding and decoding, and stay out of the lookup table.
+func TestEncodeDecodeBootstrapNodes(t *testing.T) {
+	gOut := NewPkgGraph()
+	aRun, aBuild := addSRPMHelper(t, gOut, "A")
+	_, _, err := gOut.AddBootstrapNodes(aRun, aBuild, "bootstrap")
+	assert.NoError(t, err)
+
+	var dotBuf, jsonBuf bytes.Buffer
+	assert.NoError(t, WriteDOTGraph(gOut, &dotBuf))
+	assert.NoError(t, WriteJSONGraph(gOut, &jsonBuf))
+
+	gDOT := NewPkgGraph()
+	assert.NoError(t, ReadDOTGraph(gDOT, &dotBuf))
+	gJSON := NewPkgGraph()
+	assert.NoError(t, ReadJSONGraph(gJSON, &jsonBuf))
+
+	for _, gIn := range []*PkgGraph{gDOT, gJSON} {
+		assert.Len(t, bootstrapNodes(gIn), 2)
+		assert.Len(t, gIn.AllRunNodes(), 1)
+		assert.Len(t, gIn.AllBuildNodes(), 1)
+		for _, node := range bootstrapNodes(gIn) {
+			assert.Equal(t, "bootstrap", node.Bcond)
+		}
+	}
+}
+
+func TestRegularBuildShouldNotReuseBootstrapStageRPMs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bootstrap")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	g := NewPkgGraph()
+	aRun, _ := addSRPMHelper(t, g, "A")
+	aRun.RpmPath = filepath.Join(dir, "A.rpm")
+	assert.NoError(t, ioutil.WriteFile(aRun.RpmPath, []byte("stage 1"), 0644))
+
+	assert.NoError(t, RecordRPMsStage([]string{aRun.RpmPath}, "bootstrap"))
+	assert.True(t, IsBootstrapStageRPM(aRun.RpmPath))
+
+	isPrebuilt, _, missing := IsSRPMPrebuilt(aRun.SrpmPath, g)
+	assert.False(t, isPrebuilt)
+	assert.Equal(t, []string{aRun.RpmPath}, missing)
+
+	isPrebuilt, _, _ = IsBootstrapStagePrebuilt(aRun.SrpmPath, g)
+	assert.True(t, isPrebuilt)
+
+	// The regular build replaces the bootstrap stage's RPMs.
+	assert.NoError(t, RecordRPMsStage([]string{aRun.RpmPath}, ""))
+	assert.False(t, IsBootstrapStageRPM(aRun.RpmPath))
+
+	isPrebuilt, _, _ = IsSRPMPrebuilt(aRun.SrpmPath, g)
+	assert.True(t, isPrebuilt)
+}
@@ -0,0 +1,259 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package pkggraph
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"microsoft.com/pkggen/internal/logger"
+	"microsoft.com/pkggen/internal/pkgjson"
+)
+
+// JSONGraphFormatVersion is the version of the JSON graph format written by WriteJSONGraph.
+// It must be incremented whenever a change to the format would break existing readers.
+const JSONGraphFormatVersion = 2
+
+// JSONGraphFileExtension is the file extension ReadGraphFile and WriteGraphFile use the JSON graph format for.
+// Every other extension uses the DOT format.
+const JSONGraphFileExtension = ".json"
+
+// jsonGraph is the JSON representation of a PkgGraph, see docs/formats/pkggraph.md.
+type jsonGraph struct {
+	FormatVersion int         `json:"FormatVersion"`
+	Nodes         []*jsonNode `json:"Nodes"`
+	Edges         []*jsonEdge `json:"Edges"`
+}
+
+// jsonNode is the JSON representation of a PkgNode.
+type jsonNode struct {
+	ID           int64               `json:"ID"`
+	VersionedPkg *pkgjson.PackageVer `json:"VersionedPkg,omitempty"`
+	State        string              `json:"State"`
+	Type         string              `json:"Type"`
+	SrpmPath     string              `json:"SrpmPath"`
+	RpmPath      string              `json:"RpmPath"`
+	SpecPath     string              `json:"SpecPath"`
+	SourceDir    string              `json:"SourceDir"`
+	Architecture string              `json:"Architecture"`
+	SourceRepo   string              `json:"SourceRepo"`
+	GoalName     string              `json:"GoalName"`
+	Implicit     bool                `json:"Implicit"`
+	Bcond        string              `json:"Bcond,omitempty"`
+}
+
+// jsonEdge is the JSON representation of a dependency, the node with ID From depends on the node with ID To.
+type jsonEdge struct {
+	From int64 `json:"From"`
+	To   int64 `json:"To"`
+}
+
+// IsJSONGraphFile returns true if ReadGraphFile and WriteGraphFile use the JSON graph format for the file.
+func IsJSONGraphFile(filename string) bool {
+	return strings.EqualFold(filepath.Ext(filename), JSONGraphFileExtension)
+}
+
+// ReadGraphFile reads the graph from a file, using the JSON graph format if the file has
+// a JSONGraphFileExtension extension and the DOT graph format otherwise.
+func ReadGraphFile(g *PkgGraph, filename string) (err error) {
+	if IsJSONGraphFile(filename) {
+		return ReadJSONGraphFile(g, filename)
+	}
+
+	return ReadDOTGraphFile(g, filename)
+}
+
+// WriteGraphFile writes the graph to a file, using the JSON graph format if the file has
+// a JSONGraphFileExtension extension and the DOT graph format otherwise.
+func WriteGraphFile(g *PkgGraph, filename string) (err error) {
+	if IsJSONGraphFile(filename) {
+		return WriteJSONGraphFile(g, filename)
+	}
+
+	return WriteDOTGraphFile(g, filename)
+}
+
+// WriteJSONGraphFile writes the graph to a JSON graph format file
+func WriteJSONGraphFile(g *PkgGraph, filename string) (err error) {
+	logger.Log.Infof("Writing JSON graph to %s", filename)
+	f, err := os.Create(filename)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	err = WriteJSONGraph(g, f)
+
+	return
+}
+
+// ReadJSONGraphFile reads the graph from a JSON graph format file
+func ReadJSONGraphFile(g *PkgGraph, filename string) (err error) {
+	logger.Log.Infof("Reading JSON graph from %s", filename)
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	err = ReadJSONGraph(g, f)
+
+	return
+}
+
+// WriteJSONGraph serializes a graph into a JSON formatted object.
+// Nodes are ordered by ID and edges by the IDs of their nodes so the same graph always serializes the same way.
+func WriteJSONGraph(g *PkgGraph, output io.Writer) (err error) {
+	serializedGraph := &jsonGraph{
+		FormatVersion: JSONGraphFormatVersion,
+		Nodes:         []*jsonNode{},
+		Edges:         []*jsonEdge{},
+	}
+
+	for _, node := range g.AllNodes() {
+		serializedGraph.Nodes = append(serializedGraph.Nodes, &jsonNode{
+			ID:           node.ID(),
+			VersionedPkg: node.VersionedPkg,
+			State:        node.State.String(),
+			Type:         node.Type.String(),
+			SrpmPath:     node.SrpmPath,
+			RpmPath:      node.RpmPath,
+			SpecPath:     node.SpecPath,
+			SourceDir:    node.SourceDir,
+			Architecture: node.Architecture,
+			SourceRepo:   node.SourceRepo,
+			GoalName:     node.GoalName,
+			Implicit:     node.Implicit,
+			Bcond:        node.Bcond,
+		})
+
+		dependencies := g.From(node.ID())
+		for dependencies.Next() {
+			serializedGraph.Edges = append(serializedGraph.Edges, &jsonEdge{
+				From: node.ID(),
+				To:   dependencies.Node().ID(),
+			})
+		}
+	}
+
+	sort.Slice(serializedGraph.Nodes, func(i, j int) bool {
+		return serializedGraph.Nodes[i].ID < serializedGraph.Nodes[j].ID
+	})
+	sort.Slice(serializedGraph.Edges, func(i, j int) bool {
+		if serializedGraph.Edges[i].From != serializedGraph.Edges[j].From {
+			return serializedGraph.Edges[i].From < serializedGraph.Edges[j].From
+		}
+		return serializedGraph.Edges[i].To < serializedGraph.Edges[j].To
+	})
+
+	bytes, err := json.MarshalIndent(serializedGraph, "", " ")
+	if err != nil {
+		return
+	}
+	_, err = output.Write(bytes)
+	return
+}
+
+// ReadJSONGraph de-serializes a graph from a JSON formatted object into an empty graph.
+// Unlike the DOT format, node IDs are preserved.
+func ReadJSONGraph(g *PkgGraph, input io.Reader) (err error) {
+	bytes, err := ioutil.ReadAll(input)
+	if err != nil {
+		return
+	}
+
+	serializedGraph := &jsonGraph{}
+	err = json.Unmarshal(bytes, serializedGraph)
+	if err != nil {
+		return
+	}
+
+	if serializedGraph.FormatVersion < 1 || serializedGraph.FormatVersion > JSONGraphFormatVersion {
+		return fmt.Errorf("unsupported JSON graph format version (%d), expected at most (%d)", serializedGraph.FormatVersion, JSONGraphFormatVersion)
+	}
+
+	nodes := make(map[int64]*PkgNode, len(serializedGraph.Nodes))
+	for _, serializedNode := range serializedGraph.Nodes {
+		if _, exists := nodes[serializedNode.ID]; exists {
+			return fmt.Errorf("duplicate node ID (%d)", serializedNode.ID)
+		}
+
+		node := &PkgNode{
+			nodeID:       serializedNode.ID,
+			VersionedPkg: serializedNode.VersionedPkg,
+			SrpmPath:     serializedNode.SrpmPath,
+			RpmPath:      serializedNode.RpmPath,
+			SpecPath:     serializedNode.SpecPath,
+			SourceDir:    serializedNode.SourceDir,
+			Architecture: serializedNode.Architecture,
+			SourceRepo:   serializedNode.SourceRepo,
+			GoalName:     serializedNode.GoalName,
+			Implicit:     serializedNode.Implicit,
+			Bcond:        serializedNode.Bcond,
+		}
+		node.This = node
+
+		node.State, err = parseNodeState(serializedNode.State)
+		if err != nil {
+			return fmt.Errorf("node (%d): %w", serializedNode.ID, err)
+		}
+
+		node.Type, err = parseNodeType(serializedNode.Type)
+		if err != nil {
+			return fmt.Errorf("node (%d): %w", serializedNode.ID, err)
+		}
+
+		if g.Node(node.ID()) != nil {
+			return fmt.Errorf("node ID (%d) is already in use by the graph", node.ID())
+		}
+
+		nodes[node.ID()] = node
+		g.AddNode(node)
+	}
+
+	for _, serializedEdge := range serializedGraph.Edges {
+		from, fromExists := nodes[serializedEdge.From]
+		to, toExists := nodes[serializedEdge.To]
+		if !fromExists || !toExists {
+			return fmt.Errorf("edge (%d -> %d) references a node which does not exist", serializedEdge.From, serializedEdge.To)
+		}
+
+		if from == to {
+			return fmt.Errorf("edge (%d -> %d) is a self loop", serializedEdge.From, serializedEdge.To)
+		}
+
+		g.SetEdge(g.NewEdge(from, to))
+	}
+
+	return
+}
+
+// parseNodeState returns the NodeState a string produced by NodeState.String() represents.
+func parseNodeState(stateName string) (state NodeState, err error) {
+	for state = StateUnknown + 1; state <= StateMAX; state++ {
+		if state.String() == stateName {
+			return
+		}
+	}
+
+	return StateUnknown, fmt.Errorf("invalid node state (%s)", stateName)
+}
+
+// parseNodeType returns the NodeType a string produced by NodeType.String() represents.
+func parseNodeType(typeName string) (nodeType NodeType, err error) {
+	for nodeType = TypeUnknown + 1; nodeType <= TypeMAX; nodeType++ {
+		if nodeType.String() == typeName {
+			return
+		}
+	}
+
+	return TypeUnknown, fmt.Errorf("invalid node type (%s)", typeName)
+}
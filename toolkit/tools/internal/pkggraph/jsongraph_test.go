@@ -0,0 +1,133 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package pkggraph
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test encoding and decoding a JSON formatted graph
+func TestEncodeDecodeJSON(t *testing.T) {
+	gOut, err := buildTestGraphHelper()
+	assert.NoError(t, err)
+	assert.NotNil(t, gOut)
+
+	var buf bytes.Buffer
+	err = WriteJSONGraph(gOut, &buf)
+	assert.NoError(t, err)
+
+	gIn := NewPkgGraph()
+	err = ReadJSONGraph(gIn, &buf)
+	assert.NoError(t, err)
+
+	checkTestGraph(t, gIn)
+
+	// Unlike DOT, the JSON format preserves node IDs
+	for _, node := range gOut.AllNodes() {
+		decodedNode := gIn.Node(node.ID())
+		assert.NotNil(t, decodedNode)
+		assert.True(t, node.Equal(decodedNode.(*PkgNode)))
+		assert.Equal(t, gOut.From(node.ID()).Len(), gIn.From(node.ID()).Len())
+	}
+}
+
+// Make sure the same graph always encodes to the same JSON.
+func TestEncodeJSONIsStable(t *testing.T) {
+	gOut, err := buildTestGraphHelper()
+	assert.NoError(t, err)
+
+	var buf1, buf2 bytes.Buffer
+	err = WriteJSONGraph(gOut, &buf1)
+	assert.NoError(t, err)
+
+	gIntermediate := NewPkgGraph()
+	err = ReadJSONGraph(gIntermediate, bytes.NewReader(buf1.Bytes()))
+	assert.NoError(t, err)
+	err = WriteJSONGraph(gIntermediate, &buf2)
+	assert.NoError(t, err)
+
+	assert.Equal(t, buf1.String(), buf2.String())
+}
+
+// Make sure the graph file format is picked based on the file extension.
+func TestReadWriteGraphFileFormats(t *testing.T) {
+	gOut, err := buildTestGraphHelper()
+	assert.NoError(t, err)
+
+	for _, filename := range []string{"test_graph.json", "test_graph.dot"} {
+		_ = os.Remove(filename)
+		err = WriteGraphFile(gOut, filename)
+		assert.NoError(t, err)
+
+		var contents bytes.Buffer
+		f, err := os.Open(filename)
+		assert.NoError(t, err)
+		_, err = contents.ReadFrom(f)
+		f.Close()
+		assert.NoError(t, err)
+		assert.Equal(t, IsJSONGraphFile(filename), strings.HasPrefix(contents.String(), "{"))
+
+		gIn := NewPkgGraph()
+		err = ReadGraphFile(gIn, filename)
+		assert.NoError(t, err)
+		err = os.Remove(filename)
+		assert.NoError(t, err)
+
+		checkTestGraph(t, gIn)
+	}
+
+	noGraph := NewPkgGraph()
+	err = ReadGraphFile(noGraph, "no_such_file.json")
+	assert.Error(t, err)
+}
+
+func TestIsJSONGraphFile(t *testing.T) {
+	assert.True(t, IsJSONGraphFile("graph.json"))
+	assert.True(t, IsJSONGraphFile("/path/to/graph.JSON"))
+	assert.False(t, IsJSONGraphFile("graph.dot"))
+	assert.False(t, IsJSONGraphFile("graph.json.dot"))
+	assert.False(t, IsJSONGraphFile("graph"))
+}
+
+// Make sure malformed JSON graphs are rejected.
+func TestDecodeInvalidJSON(t *testing.T) {
+	invalidGraphs := map[string]string{
+		"not json":            `digraph {}`,
+		"missing version":     `{"Nodes": [], "Edges": []}`,
+		"future version":      `{"FormatVersion": 1000, "Nodes": [], "Edges": []}`,
+		"invalid state":       `{"FormatVersion": 1, "Nodes": [{"ID": 0, "State": "Bogus", "Type": "Run"}], "Edges": []}`,
+		"invalid type":        `{"FormatVersion": 1, "Nodes": [{"ID": 0, "State": "Build", "Type": "Bogus"}], "Edges": []}`,
+		"duplicate node":      `{"FormatVersion": 1, "Nodes": [{"ID": 0, "State": "Meta", "Type": "PureMeta"}, {"ID": 0, "State": "Meta", "Type": "PureMeta"}], "Edges": []}`,
+		"missing edge target": `{"FormatVersion": 1, "Nodes": [{"ID": 0, "State": "Meta", "Type": "PureMeta"}], "Edges": [{"From": 0, "To": 1}]}`,
+		"self loop":           `{"FormatVersion": 1, "Nodes": [{"ID": 0, "State": "Meta", "Type": "PureMeta"}], "Edges": [{"From": 0, "To": 0}]}`,
+	}
+
+	for name, serializedGraph := range invalidGraphs {
+		g := NewPkgGraph()
+		err := ReadJSONGraph(g, strings.NewReader(serializedGraph))
+		assert.Error(t, err, name)
+	}
+}
+
+// Make sure every node type survives encoding and decoding.
+func TestEncodeDecodeJSONNodeTypes(t *testing.T) {
+	var nodeType NodeType
+	for nodeType = TypeUnknown + 1; nodeType <= TypeMAX; nodeType++ {
+		parsedType, err := parseNodeType(nodeType.String())
+		assert.NoError(t, err)
+		assert.Equal(t, nodeType, parsedType)
+	}
+
+	var state NodeState
+	for state = StateUnknown + 1; state <= StateMAX; state++ {
+		parsedState, err := parseNodeState(state.String())
+		assert.NoError(t, err)
+		assert.Equal(t, state, parsedState)
+	}
+}
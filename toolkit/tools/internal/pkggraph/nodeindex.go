@@ -0,0 +1,204 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package pkggraph
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"gonum.org/v1/gonum/graph"
+)
+
+// indexKind is one of the keys nodes are indexed by.
+type indexKind int
+
+// Valid values for indexKind type
+const (
+	indexSRPM     indexKind = iota // The SRPM the node is built from
+	indexSpec     indexKind = iota // The name of the spec the node is built from
+	indexName     indexKind = iota // The name of the package the node provides
+	indexKindsMax indexKind = iota // Number of index kinds
+)
+
+// nodeKeys holds the keys a node was indexed under, an empty key is not indexed.
+type nodeKeys [indexKindsMax]string
+
+// nodeIndex indexes the nodes of a graph by the SRPM and spec they are built from and by the package they provide.
+// It is updated as nodes are added to and removed from the graph and is safe for concurrent use.
+// Nodes are only indexed by the first lookup after they were added, since nodes decoded from
+// a DOT graph only receive their attributes after being added to the graph.
+type nodeIndex struct {
+	mutex   sync.Mutex
+	pending map[int64]*PkgNode                           // Nodes added since the last lookup
+	indexed map[int64]nodeKeys                           // Keys of every indexed node, used to remove them
+	tables  [indexKindsMax]map[string]map[int64]*PkgNode // Indexed nodes for each kind of key
+}
+
+// NodesBySRPM returns every node built from an SRPM, sorted by ID.
+// Like all indexed lookups it is safe to call without holding the graph's lock.
+func (g *PkgGraph) NodesBySRPM(srpmPath string) []*PkgNode {
+	return g.index.lookup(indexSRPM, srpmPath, isAnyNode)
+}
+
+// RunNodesBySRPM returns the run nodes of every package built from an SRPM, sorted by ID.
+// Like AllRunNodes, the nodes of bootstrap stages are left out.
+func (g *PkgGraph) RunNodesBySRPM(srpmPath string) []*PkgNode {
+	return g.index.lookup(indexSRPM, srpmPath, isLookupRunNode)
+}
+
+// NodesForSpec returns every node built from a spec, sorted by ID.
+// The spec may be given as a path or as a name, as returned by SpecName.
+func (g *PkgGraph) NodesForSpec(spec string) []*PkgNode {
+	return g.index.lookup(indexSpec, specKey(spec), isAnyNode)
+}
+
+// RunNodesForSpec returns the run nodes of every package built from a spec, sorted by ID.
+// The spec may be given as a path or as a name, as returned by SpecName. Bootstrap stages are left out.
+func (g *PkgGraph) RunNodesForSpec(spec string) []*PkgNode {
+	return g.index.lookup(indexSpec, specKey(spec), isLookupRunNode)
+}
+
+// BuildNodesForSpec returns the build nodes of every package built from a spec, sorted by ID.
+// The spec may be given as a path or as a name, as returned by SpecName. Bootstrap stages are left out.
+func (g *PkgGraph) BuildNodesForSpec(spec string) []*PkgNode {
+	return g.index.lookup(indexSpec, specKey(spec), isLookupBuildNode)
+}
+
+// RunNodesByName returns the run and remote nodes of every version of a package, sorted by ID.
+// Bootstrap stages are left out.
+func (g *PkgGraph) RunNodesByName(pkgName string) []*PkgNode {
+	return g.index.lookup(indexName, pkgName, isLookupRunNode)
+}
+
+// isAnyNode matches every node.
+func isAnyNode(node *PkgNode) bool {
+	return true
+}
+
+// isLookupRunNode matches the nodes AllRunNodes returns.
+func isLookupRunNode(node *PkgNode) bool {
+	return (node.Type == TypeRun || node.Type == TypeRemote) && node.Bcond == ""
+}
+
+// isLookupBuildNode matches the nodes AllBuildNodes returns.
+func isLookupBuildNode(node *PkgNode) bool {
+	return node.Type == TypeBuild && node.Bcond == ""
+}
+
+// specKey returns the name of a spec given as either a path or a name.
+func specKey(spec string) string {
+	return strings.TrimSuffix(filepath.Base(spec), ".spec")
+}
+
+// keysOf returns the keys a node is indexed under.
+func keysOf(node *PkgNode) (keys nodeKeys) {
+	keys[indexSRPM] = node.SrpmPath
+	if node.SpecPath != "" {
+		keys[indexSpec] = node.SpecName()
+	}
+	if node.VersionedPkg != nil {
+		keys[indexName] = node.VersionedPkg.Name
+	}
+
+	return
+}
+
+// add queues a node which was added to the graph for indexing.
+func (idx *nodeIndex) add(n graph.Node) {
+	pkgNode, ok := n.(*PkgNode)
+	if !ok {
+		return
+	}
+
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	if idx.pending == nil {
+		idx.pending = make(map[int64]*PkgNode)
+	}
+	idx.pending[pkgNode.ID()] = pkgNode
+}
+
+// remove drops a node which was removed from the graph from the index.
+func (idx *nodeIndex) remove(id int64) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	delete(idx.pending, id)
+
+	keys, found := idx.indexed[id]
+	if !found {
+		return
+	}
+
+	for kind, key := range keys {
+		if key == "" {
+			continue
+		}
+
+		delete(idx.tables[kind][key], id)
+		if len(idx.tables[kind][key]) == 0 {
+			delete(idx.tables[kind], key)
+		}
+	}
+	delete(idx.indexed, id)
+}
+
+// lookup returns the sorted nodes indexed under a key which match the filter.
+func (idx *nodeIndex) lookup(kind indexKind, key string, filter func(*PkgNode) bool) (nodes []*PkgNode) {
+	if key == "" {
+		return
+	}
+
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	idx.indexPending()
+
+	for _, node := range idx.tables[kind][key] {
+		if filter(node) {
+			nodes = append(nodes, node)
+		}
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].ID() < nodes[j].ID()
+	})
+
+	return
+}
+
+// indexPending indexes every node added since the last lookup.
+// The caller must hold the index's mutex.
+func (idx *nodeIndex) indexPending() {
+	if len(idx.pending) == 0 {
+		return
+	}
+
+	if idx.indexed == nil {
+		idx.indexed = make(map[int64]nodeKeys)
+		for kind := range idx.tables {
+			idx.tables[kind] = make(map[string]map[int64]*PkgNode)
+		}
+	}
+
+	for id, node := range idx.pending {
+		keys := keysOf(node)
+		for kind, key := range keys {
+			if key == "" {
+				continue
+			}
+
+			if idx.tables[kind][key] == nil {
+				idx.tables[kind][key] = make(map[int64]*PkgNode)
+			}
+			idx.tables[kind][key][id] = node
+		}
+		idx.indexed[id] = keys
+	}
+
+	idx.pending = nil
+}
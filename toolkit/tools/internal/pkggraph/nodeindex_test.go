@@ -0,0 +1,185 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package pkggraph
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"microsoft.com/pkggen/internal/pkgjson"
+)
+
+// checkIndexedTestGraph checks the indexed lookups of the test graph described in pkggraph_test.go.
+func checkIndexedTestGraph(t *testing.T, g *PkgGraph) {
+	nodes := g.NodesBySRPM("C.src.rpm")
+	assert.Len(t, nodes, 4)
+	for _, node := range nodes {
+		assert.Equal(t, "C.src.rpm", node.SrpmPath)
+	}
+
+	runNodes := g.RunNodesBySRPM("C.src.rpm")
+	assert.Len(t, runNodes, 2)
+	for _, node := range runNodes {
+		assert.Equal(t, TypeRun, node.Type)
+	}
+
+	assert.Len(t, g.RunNodesByName("D"), len(unresolvedNodes))
+	assert.Empty(t, g.NodesBySRPM("missing.src.rpm"))
+}
+
+func TestNodesBySRPM(t *testing.T) {
+	g, err := buildTestGraphHelper()
+	assert.NoError(t, err)
+
+	checkIndexedTestGraph(t, g)
+
+	nodes := g.NodesBySRPM("A.src.rpm")
+	assert.Len(t, nodes, 2)
+	assert.True(t, nodes[0].ID() < nodes[1].ID())
+}
+
+func TestNodesForSpecByPathOrName(t *testing.T) {
+	g, err := buildTestGraphHelper()
+	assert.NoError(t, err)
+
+	assert.Len(t, g.NodesForSpec("C"), 4)
+	assert.Len(t, g.RunNodesForSpec("C"), 2)
+	assert.Len(t, g.BuildNodesForSpec("C"), 2)
+	assert.Equal(t, g.RunNodesForSpec("C"), g.RunNodesForSpec("C.spec"))
+	assert.Equal(t, g.RunNodesForSpec("C"), g.RunNodesForSpec("/SPECS/C/C.spec"))
+	assert.Empty(t, g.RunNodesForSpec(""))
+}
+
+func TestRunNodesByName(t *testing.T) {
+	g, err := buildTestGraphHelper()
+	assert.NoError(t, err)
+
+	nodes := g.RunNodesByName("C")
+	assert.Len(t, nodes, 2)
+	for _, node := range nodes {
+		assert.Equal(t, "C", node.VersionedPkg.Name)
+		assert.Equal(t, TypeRun, node.Type)
+	}
+
+	// Unresolved nodes provide a package just like run nodes
+	assert.Len(t, g.RunNodesByName("D"), len(unresolvedNodes))
+	assert.Empty(t, g.RunNodesByName("missing"))
+}
+
+func TestIndexedLookupsAfterRemovingNodes(t *testing.T) {
+	g, err := buildTestGraphHelper()
+	assert.NoError(t, err)
+
+	lookup, err := g.FindExactPkgNodeFromPkg(&pkgA)
+	assert.NoError(t, err)
+	assert.Len(t, g.NodesBySRPM("A.src.rpm"), 2)
+
+	g.RemovePkgNode(lookup.BuildNode)
+	assert.Equal(t, []*PkgNode{lookup.RunNode}, g.NodesBySRPM("A.src.rpm"))
+	assert.Empty(t, g.BuildNodesForSpec("A"))
+
+	g.RemovePkgNode(lookup.RunNode)
+	assert.Empty(t, g.NodesBySRPM("A.src.rpm"))
+	assert.Empty(t, g.RunNodesByName("A"))
+}
+
+func TestIndexedLookupsAfterAddingNodes(t *testing.T) {
+	g := NewPkgGraph()
+	assert.Empty(t, g.RunNodesByName("A"))
+
+	aRun, aBuild := addSRPMHelper(t, g, "A")
+	assert.Equal(t, []*PkgNode{aRun, aBuild}, g.NodesBySRPM("A.src.rpm"))
+
+	// Nodes added through an edge are indexed too
+	preBuiltNode := g.CloneNode(aRun)
+	preBuiltNode.Type = TypePreBuilt
+	assert.NoError(t, g.AddEdge(aBuild, preBuiltNode))
+	assert.Equal(t, []*PkgNode{aRun, aBuild, preBuiltNode}, g.NodesBySRPM("A.src.rpm"))
+	assert.Equal(t, []*PkgNode{aRun}, g.RunNodesBySRPM("A.src.rpm"))
+}
+
+func TestIndexedLookupsSkipBootstrapNodes(t *testing.T) {
+	g := NewPkgGraph()
+	aRun, aBuild := addSRPMHelper(t, g, "A")
+
+	bootstrapRun, bootstrapBuild, err := g.AddBootstrapNodes(aRun, aBuild, "bootstrap")
+	assert.NoError(t, err)
+
+	assert.Equal(t, []*PkgNode{aRun, aBuild, bootstrapBuild, bootstrapRun}, g.NodesBySRPM("A.src.rpm"))
+	assert.Equal(t, []*PkgNode{aRun}, g.RunNodesBySRPM("A.src.rpm"))
+	assert.Equal(t, []*PkgNode{aBuild}, g.BuildNodesForSpec("A"))
+	assert.Equal(t, []*PkgNode{aRun}, g.RunNodesByName("A"))
+}
+
+func TestIndexedLookupsOfDecodedGraph(t *testing.T) {
+	gOut, err := buildTestGraphHelper()
+	assert.NoError(t, err)
+
+	var dotBuf, jsonBuf bytes.Buffer
+	assert.NoError(t, WriteDOTGraph(gOut, &dotBuf))
+	assert.NoError(t, WriteJSONGraph(gOut, &jsonBuf))
+
+	gDOT := NewPkgGraph()
+	assert.NoError(t, ReadDOTGraph(gDOT, &dotBuf))
+	checkIndexedTestGraph(t, gDOT)
+
+	gJSON := NewPkgGraph()
+	assert.NoError(t, ReadJSONGraph(gJSON, &jsonBuf))
+	checkIndexedTestGraph(t, gJSON)
+}
+
+func TestIndexedLookupsOfSubGraph(t *testing.T) {
+	g, err := buildTestGraphHelper()
+	assert.NoError(t, err)
+
+	root, err := g.FindBestPkgNode(&pkgjson.PackageVer{Name: "B"})
+	assert.NoError(t, err)
+	subGraph, err := g.CreateSubGraph(root.RunNode)
+	assert.NoError(t, err)
+
+	assert.Len(t, subGraph.NodesBySRPM("B.src.rpm"), 2)
+	assert.Len(t, subGraph.NodesBySRPM("C.src.rpm"), 2)
+	assert.Empty(t, subGraph.NodesBySRPM("A.src.rpm"))
+	assert.Len(t, g.NodesBySRPM("A.src.rpm"), 2)
+}
+
+func TestConcurrentIndexedLookups(t *testing.T) {
+	const (
+		readers  = 4
+		packages = 50
+	)
+
+	g := NewPkgGraph()
+	aRun, _ := addSRPMHelper(t, g, "A")
+
+	var wg sync.WaitGroup
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < packages; j++ {
+				assert.Contains(t, g.RunNodesBySRPM("A.src.rpm"), aRun)
+
+				g.RLock()
+				g.AllNodes()
+				g.RUnlock()
+			}
+		}()
+	}
+
+	for i := 0; i < packages; i++ {
+		g.Lock()
+		addSRPMHelper(t, g, fmt.Sprintf("P%d", i))
+		g.Unlock()
+	}
+	wg.Wait()
+
+	assert.Len(t, g.AllNodes(), 2*(packages+1))
+	for i := 0; i < packages; i++ {
+		assert.Len(t, g.NodesBySRPM(fmt.Sprintf("P%d.src.rpm", i)), 2)
+	}
+}
@@ -28,19 +28,22 @@ import (
 	"microsoft.com/pkggen/internal/versioncompare"
 )
 
-// NodeState indicates if a node is a package node (build, upToDate,unresolved,cached) or a meta node (meta)
+// NodeState indicates if a node is a package node (build, upToDate,unresolved,cached,blocked,skipped,timedOut) or a meta node (meta)
 type NodeState int
 
 // Valid values for NodeState type
 const (
-	StateUnknown    NodeState = iota            // Unknown state
-	StateMeta       NodeState = iota            // Meta nodes do not represent actual build artifacts, but additional nodes used for managing dependencies
-	StateBuild      NodeState = iota            // A package from a local SRPM which should be built from source
-	StateUpToDate   NodeState = iota            // A local RPM is already built and is available
-	StateUnresolved NodeState = iota            // A dependency is not available locally and must be acquired from a remote repo
-	StateCached     NodeState = iota            // A dependency was not available locally, but is now available in the chache
-	StateBuildError NodeState = iota            // A package from a local SRPM which failed to build
-	StateMAX        NodeState = StateBuildError // Max allowable state
+	StateUnknown    NodeState = iota          // Unknown state
+	StateMeta       NodeState = iota          // Meta nodes do not represent actual build artifacts, but additional nodes used for managing dependencies
+	StateBuild      NodeState = iota          // A package from a local SRPM which should be built from source
+	StateUpToDate   NodeState = iota          // A local RPM is already built and is available
+	StateUnresolved NodeState = iota          // A dependency is not available locally and must be acquired from a remote repo
+	StateCached     NodeState = iota          // A dependency was not available locally, but is now available in the chache
+	StateBuildError NodeState = iota          // A package from a local SRPM which failed to build
+	StateBlocked    NodeState = iota          // A package from a local SRPM which was not built because one of its dependencies failed to build
+	StateSkipped    NodeState = iota          // A package from a local SRPM which was not built because it was ignored per user request
+	StateTimedOut   NodeState = iota          // A package from a local SRPM which failed to build within the allowed time
+	StateMAX        NodeState = StateTimedOut // Max allowable state
 )
 
 // NodeType indicates the general node type (build, run, goal, remote).
@@ -55,7 +58,7 @@ const (
 	TypeRemote   NodeType = iota         // A non-local node which may have a cache entry
 	TypePureMeta NodeType = iota         // An arbitrary meta node with no other meaning
 	TypePreBuilt NodeType = iota         // A node indicating a pre-built SRPM used in breaking cyclic build dependencies
-	TypeMAX      NodeType = TypePureMeta // Max allowable type
+	TypeMAX      NodeType = TypePreBuilt // Max allowable type
 )
 
 // Dot encoding/decoding keys
@@ -80,6 +83,7 @@ type PkgNode struct {
 	SourceRepo   string              // The location this package was acquired from
 	GoalName     string              // Optional string for goal nodes
 	Implicit     bool                // If the package is an implicit provide
+	Bcond        string              // Spec build conditional the SRPM is built with, only set on the nodes of a bootstrap stage
 	This         *PkgNode            // Self reference since the graph library returns nodes by value, not reference
 }
 
@@ -89,9 +93,13 @@ func (n PkgNode) ID() int64 {
 }
 
 //PkgGraph implements a simple.DirectedGraph using pkggraph Nodes.
+// A graph shared between goroutines must be locked with Lock or RLock while it is walked or modified.
+// The indexed lookups, such as NodesBySRPM, are safe for concurrent use without holding the lock.
 type PkgGraph struct {
 	*simple.DirectedGraph
 	nodeLookup map[string][]*LookupNode
+	mutex      sync.RWMutex // Guards the graph while it is shared between goroutines
+	index      nodeIndex    // Indexes the nodes by SRPM, spec and package name
 }
 
 //LookupNode represents a graph node for a package in the lookup list
@@ -118,6 +126,12 @@ func (n NodeState) String() string {
 		return "Unresolved"
 	case StateCached:
 		return "Cached"
+	case StateBlocked:
+		return "Blocked"
+	case StateSkipped:
+		return "Skipped"
+	case StateTimedOut:
+		return "TimedOut"
 	default:
 		logger.Log.Panic("Invalid NodeState encountered when serializing to string!")
 		return "error"
@@ -165,6 +179,12 @@ func (n *PkgNode) DOTColor() string {
 		return "crimson"
 	case StateCached:
 		return "darkorchid"
+	case StateBlocked:
+		return "lightsalmon"
+	case StateSkipped:
+		return "lightgray"
+	case StateTimedOut:
+		return "orangered"
 	default:
 		logger.Log.Panic("Invalid NodeState encountered when serializing to color!")
 		return "error"
@@ -180,15 +200,36 @@ func NewPkgGraph() *PkgGraph {
 	return g
 }
 
+// Lock locks the graph for writing.
+func (g *PkgGraph) Lock() {
+	g.mutex.Lock()
+}
+
+// Unlock unlocks the graph for writing.
+func (g *PkgGraph) Unlock() {
+	g.mutex.Unlock()
+}
+
+// RLock locks the graph for reading. A read lock must not be taken again by a goroutine already holding one.
+func (g *PkgGraph) RLock() {
+	g.mutex.RLock()
+}
+
+// RUnlock undoes a single RLock call.
+func (g *PkgGraph) RUnlock() {
+	g.mutex.RUnlock()
+}
+
 // initLookup initializes the run and build node lookup table
 func (g *PkgGraph) initLookup() {
 	g.nodeLookup = make(map[string][]*LookupNode)
 
 	// Scan all nodes, start with only the run nodes to properly initialize the lookup structures
 	// (they always expect a run node to be present)
+	// Bootstrap stage nodes are never looked up, dependencies only resolve to them while breaking cycles.
 	for _, n := range graph.NodesOf(g.Nodes()) {
 		pkgNode := n.(*PkgNode)
-		if pkgNode.Type == TypeRun || pkgNode.Type == TypeRemote {
+		if (pkgNode.Type == TypeRun || pkgNode.Type == TypeRemote) && pkgNode.Bcond == "" {
 			g.addToLookup(pkgNode, true)
 		}
 	}
@@ -196,7 +237,7 @@ func (g *PkgGraph) initLookup() {
 	// Now run again for any build nodes, or other nodes we want to track
 	for _, n := range graph.NodesOf(g.Nodes()) {
 		pkgNode := n.(*PkgNode)
-		if pkgNode.Type != TypeRun && pkgNode.Type != TypeRemote {
+		if pkgNode.Type != TypeRun && pkgNode.Type != TypeRemote && pkgNode.Bcond == "" {
 			g.addToLookup(pkgNode, true)
 		}
 	}
@@ -382,6 +423,38 @@ func (g *PkgGraph) NewNode() graph.Node {
 	return pkgNode
 }
 
+// AddNode adds a node to the graph and queues it for indexing. It panics if a node with the same ID already exists.
+func (g *PkgGraph) AddNode(n graph.Node) {
+	g.DirectedGraph.AddNode(n)
+	g.index.add(n)
+}
+
+// RemoveNode removes a node and its edges from the graph and the index.
+// Use RemovePkgNode to also remove the node from the lookup table.
+func (g *PkgGraph) RemoveNode(id int64) {
+	if g.Node(id) == nil {
+		return
+	}
+
+	g.DirectedGraph.RemoveNode(id)
+	g.index.remove(id)
+}
+
+// SetEdge adds an edge to the graph. Nodes of the edge which are not in the graph yet are added and queued for indexing.
+func (g *PkgGraph) SetEdge(e graph.Edge) {
+	isFromNew := g.Node(e.From().ID()) == nil
+	isToNew := g.Node(e.To().ID()) == nil
+
+	g.DirectedGraph.SetEdge(e)
+
+	if isFromNew {
+		g.index.add(e.From())
+	}
+	if isToNew {
+		g.index.add(e.To())
+	}
+}
+
 // CreateCollapsedNode creates a new run node linked to a given parent node. All nodes in nodesToCollapse will be collapsed into the new node.
 // - When a node is collapsed all of its dependents will be mirrored onto the new node.
 // - The parentNode must be a run node.
@@ -656,9 +729,9 @@ func (n PkgNode) SetDOTID(id string) {
 func (n *PkgNode) FriendlyName() string {
 	switch n.Type {
 	case TypeBuild:
-		return fmt.Sprintf("%s-%s-BUILD<%s>", n.VersionedPkg.Name, n.VersionedPkg.Version, n.State.String())
+		return fmt.Sprintf("%s-%s-BUILD%s<%s>", n.VersionedPkg.Name, n.VersionedPkg.Version, n.bcondMarker(), n.State.String())
 	case TypeRun:
-		return fmt.Sprintf("%s-%s-RUN<%s>", n.VersionedPkg.Name, n.VersionedPkg.Version, n.State.String())
+		return fmt.Sprintf("%s-%s-RUN%s<%s>", n.VersionedPkg.Name, n.VersionedPkg.Version, n.bcondMarker(), n.State.String())
 	case TypeRemote:
 		ver1 := fmt.Sprintf("%s%s", n.VersionedPkg.Condition, n.VersionedPkg.Version)
 		ver2 := ""
@@ -677,6 +750,14 @@ func (n *PkgNode) FriendlyName() string {
 	}
 }
 
+// bcondMarker returns the bcond of a bootstrap stage node formatted for FriendlyName, or an empty string for other nodes.
+func (n *PkgNode) bcondMarker() string {
+	if n.Bcond == "" {
+		return ""
+	}
+	return fmt.Sprintf("[%s]", n.Bcond)
+}
+
 // SpecName returns the name of the spec associated with this node.
 // Returns "." if the node doesn't have a spec file path or URL.
 func (n *PkgNode) SpecName() string {
@@ -730,7 +811,8 @@ func (n *PkgNode) Equal(otherNode *PkgNode) bool {
 		n.Architecture == otherNode.Architecture &&
 		n.SourceRepo == otherNode.SourceRepo &&
 		n.GoalName == otherNode.GoalName &&
-		n.Implicit == otherNode.Implicit
+		n.Implicit == otherNode.Implicit &&
+		n.Bcond == otherNode.Bcond
 }
 
 func registerTypes() {
@@ -805,6 +887,11 @@ func (n PkgNode) MarshalBinary() (data []byte, err error) {
 		err = fmt.Errorf("encoding Implicit: %s", err.Error())
 		return
 	}
+	err = encoder.Encode(n.Bcond)
+	if err != nil {
+		err = fmt.Errorf("encoding Bcond: %s", err.Error())
+		return
+	}
 	return outBuffer.Bytes(), err
 }
 
@@ -829,6 +916,10 @@ func (n *PkgNode) UnmarshalBinary(inBuffer []byte) (err error) {
 		err = fmt.Errorf("decoding State: %s", err.Error())
 		return
 	}
+	if n.State < StateUnknown || n.State > StateMAX {
+		err = fmt.Errorf("decoding State: invalid state (%d)", n.State)
+		return
+	}
 	err = decoder.Decode(&n.Type)
 	if err != nil {
 		err = fmt.Errorf("decoding Type: %s", err.Error())
@@ -874,6 +965,14 @@ func (n *PkgNode) UnmarshalBinary(inBuffer []byte) (err error) {
 		err = fmt.Errorf("decoding Implicit: %s", err.Error())
 		return
 	}
+	// Graphs written before bootstrap stages were supported end here.
+	err = decoder.Decode(&n.Bcond)
+	if err == io.EOF {
+		err = nil
+	} else if err != nil {
+		err = fmt.Errorf("decoding Bcond: %s", err.Error())
+		return
+	}
 	n.This = n
 	return
 }
@@ -1120,11 +1219,25 @@ func (g *PkgGraph) CreateSubGraph(rootNode *PkgNode) (subGraph *PkgGraph, err er
 }
 
 // IsSRPMPrebuilt checks if an SRPM is prebuilt, returning true if so along with a slice of corresponding prebuilt RPMs.
-// The function will lock 'graphMutex' before performing the check if the mutex is not nil.
-func IsSRPMPrebuilt(srpmPath string, pkgGraph *PkgGraph, graphMutex *sync.RWMutex) (isPrebuilt bool, expectedFiles, missingFiles []string) {
-	expectedFiles = rpmsProvidedBySRPM(srpmPath, pkgGraph, graphMutex)
+// RPMs last built by a bootstrap stage of the SRPM are considered missing.
+// The RPMs are found through the graph's index, so the graph does not need to be locked.
+func IsSRPMPrebuilt(srpmPath string, pkgGraph *PkgGraph) (isPrebuilt bool, expectedFiles, missingFiles []string) {
+	const allowBootstrapStage = false
+	return isSRPMPrebuilt(srpmPath, pkgGraph, allowBootstrapStage)
+}
+
+// IsBootstrapStagePrebuilt checks if a bootstrap stage of an SRPM is prebuilt, returning true if so along with a slice of
+// corresponding prebuilt RPMs. The RPMs of either the bootstrap stage or the SRPM's regular build will do.
+func IsBootstrapStagePrebuilt(srpmPath string, pkgGraph *PkgGraph) (isPrebuilt bool, expectedFiles, missingFiles []string) {
+	const allowBootstrapStage = true
+	return isSRPMPrebuilt(srpmPath, pkgGraph, allowBootstrapStage)
+}
+
+// isSRPMPrebuilt checks if all RPMs of an SRPM are on disk, optionally accepting RPMs built by a bootstrap stage.
+func isSRPMPrebuilt(srpmPath string, pkgGraph *PkgGraph, allowBootstrapStage bool) (isPrebuilt bool, expectedFiles, missingFiles []string) {
+	expectedFiles = rpmsProvidedBySRPM(srpmPath, pkgGraph)
 	logger.Log.Tracef("Expected RPMs from %s: %v", srpmPath, expectedFiles)
-	isPrebuilt, missingFiles = findAllRPMS(expectedFiles)
+	isPrebuilt, missingFiles = findAllRPMS(expectedFiles, allowBootstrapStage)
 	logger.Log.Tracef("Missing RPMs from %s: %v", srpmPath, missingFiles)
 	return
 }
@@ -1193,18 +1306,26 @@ func (g *PkgGraph) DeepCopy() (deepCopy *PkgGraph, err error) {
 
 // MakeDAG ensures the graph is a directed acyclic graph (DAG).
 // If the graph is not a DAG, this routine will attempt to resolve any cycles to make the graph a DAG.
+// Bootstrap stage nodes which were not needed to resolve a cycle are removed once the graph is a DAG.
 func (g *PkgGraph) MakeDAG() (err error) {
 	var cycle []*PkgNode
 
 	for {
 		cycle, err = g.FindAnyDirectedCycle()
-		if err != nil || len(cycle) == 0 {
+		if err != nil {
+			return
+		}
+
+		if len(cycle) == 0 {
+			g.removeUnusedBootstrapNodes()
 			return
 		}
 
 		err = g.fixCycle(cycle)
 		if err != nil {
-			return formatCycleErrorMessage(cycle, err)
+			err = formatCycleErrorMessage(cycle, err)
+			g.logUnresolvableCycles()
+			return
 		}
 	}
 }
@@ -1224,6 +1345,7 @@ func (g *PkgGraph) CloneNode(pkgNode *PkgNode) (newNode *PkgNode) {
 		Architecture: pkgNode.Architecture,
 		SourceRepo:   pkgNode.SourceRepo,
 		Implicit:     pkgNode.Implicit,
+		Bcond:        pkgNode.Bcond,
 	}
 	newNode.This = newNode
 
@@ -1232,7 +1354,8 @@ func (g *PkgGraph) CloneNode(pkgNode *PkgNode) (newNode *PkgNode) {
 
 // fixCycle attempts to fix a cycle. Cycles may be acceptable if:
 // - all nodes are from the same spec file or
-// - at least one of the nodes of the cycle represents a pre-built SRPM.
+// - at least one of the nodes of the cycle represents a pre-built SRPM or
+// - at least one of the packages of the cycle can be built in a bootstrap stage.
 func (g *PkgGraph) fixCycle(cycle []*PkgNode) (err error) {
 	logger.Log.Debugf("Found cycle: %v", cycle)
 
@@ -1244,7 +1367,12 @@ func (g *PkgGraph) fixCycle(cycle []*PkgNode) (err error) {
 		return
 	}
 
-	return g.fixPrebuiltSRPMsCycle(trimmedCycle)
+	err = g.fixPrebuiltSRPMsCycle(trimmedCycle)
+	if err == nil {
+		return
+	}
+
+	return g.fixBootstrapCycle(trimmedCycle)
 }
 
 // fixIntraSpecCycle attempts to fix a cycle if none of the cycle nodes are build nodes.
@@ -1325,7 +1453,7 @@ func (g *PkgGraph) fixPrebuiltSRPMsCycle(trimmedCycle []*PkgNode) (err error) {
 		// 2. Every build cycle must contain at least one edge between a build node and a run node from different SRPMs.
 		//    These edges represent the 'BuildRequires' from the .spec file. If the cycle is breakable, the run node comes from a pre-built SRPM.
 		buildToRunEdge := previousNode.Type == TypeBuild && currentNode.Type == TypeRun
-		if isPrebuilt, _, _ := IsSRPMPrebuilt(currentNode.SrpmPath, g, nil); buildToRunEdge && isPrebuilt {
+		if isPrebuilt, _, _ := IsSRPMPrebuilt(currentNode.SrpmPath, g); buildToRunEdge && isPrebuilt {
 			logger.Log.Debugf("Cycle contains pre-built SRPM '%s'. Replacing edges from build nodes associated with '%s' with an edge to a new 'PreBuilt' node.",
 				currentNode.SrpmPath, previousNode.SrpmPath)
 
@@ -1383,20 +1511,33 @@ func formatCycleErrorMessage(cycle []*PkgNode, err error) error {
 	return fmt.Errorf("cycles detected in dependency graph")
 }
 
-// rpmsProvidedBySRPM returns all RPMs produced from a SRPM file.
-func rpmsProvidedBySRPM(srpmPath string, pkgGraph *PkgGraph, graphMutex *sync.RWMutex) (rpmFiles []string) {
-	if graphMutex != nil {
-		graphMutex.RLock()
-		defer graphMutex.RUnlock()
-	}
-
-	rpmsMap := make(map[string]bool)
-	runNodes := pkgGraph.AllRunNodes()
-	for _, node := range runNodes {
-		if node.SrpmPath != srpmPath {
+// logUnresolvableCycles logs every cycle left in the graph which requires a pre-built SRPM to break,
+// so they can all be fixed at once instead of one at a time.
+func (g *PkgGraph) logUnresolvableCycles() {
+	for _, report := range g.FindCycles() {
+		if !report.NeedsPrebuiltSRPM {
 			continue
 		}
 
+		// Skip cycles MakeDAG could break on its own, since all of the suggested SRPMs are already built.
+		allPrebuilt := len(report.SuggestedPrebuiltSRPMs) > 0
+		for _, srpm := range report.SuggestedPrebuiltSRPMs {
+			if isPrebuilt, _, _ := IsSRPMPrebuilt(srpm, g); !isPrebuilt {
+				allPrebuilt = false
+				break
+			}
+		}
+
+		if !allPrebuilt {
+			logger.Log.Error(report.String())
+		}
+	}
+}
+
+// rpmsProvidedBySRPM returns all RPMs produced from a SRPM file.
+func rpmsProvidedBySRPM(srpmPath string, pkgGraph *PkgGraph) (rpmFiles []string) {
+	rpmsMap := make(map[string]bool)
+	for _, node := range pkgGraph.RunNodesBySRPM(srpmPath) {
 		if node.RpmPath == "" || node.RpmPath == "<NO_RPM_PATH>" {
 			continue
 		}
@@ -1414,13 +1555,17 @@ func rpmsProvidedBySRPM(srpmPath string, pkgGraph *PkgGraph, graphMutex *sync.RW
 
 // findAllRPMS returns true if all RPMs requested are found on disk.
 //	Also returns a list of all missing files
-func findAllRPMS(rpmsToFind []string) (foundAllRpms bool, missingRpms []string) {
+//	Unless allowBootstrapStage is set, RPMs last built by a bootstrap stage are missing as well.
+func findAllRPMS(rpmsToFind []string, allowBootstrapStage bool) (foundAllRpms bool, missingRpms []string) {
 	for _, rpm := range rpmsToFind {
 		isFile, _ := file.IsFile(rpm)
 
 		if !isFile {
 			logger.Log.Debugf("Did not find (%s)", rpm)
 			missingRpms = append(missingRpms, "rpm")
+		} else if !allowBootstrapStage && IsBootstrapStageRPM(rpm) {
+			logger.Log.Debugf("(%s) was built by a bootstrap stage", rpm)
+			missingRpms = append(missingRpms, rpm)
 		}
 	}
 	foundAllRpms = len(missingRpms) == 0
@@ -179,6 +179,19 @@ func addNodesHelper(g *PkgGraph, nodes []*PkgNode) (err error) {
 	return
 }
 
+// addSRPMHelper adds the run and build node of a single package built from its own SRPM.
+func addSRPMHelper(t *testing.T, g *PkgGraph, name string) (runNode, buildNode *PkgNode) {
+	pkg := &pkgjson.PackageVer{Name: name, Version: "1"}
+
+	runNode, err := addNodeToGraphHelper(g, buildRunNodeHelper(pkg))
+	assert.NoError(t, err)
+	buildNode, err = addNodeToGraphHelper(g, buildBuildNodeHelper(pkg))
+	assert.NoError(t, err)
+	assert.NoError(t, g.AddEdge(runNode, buildNode))
+
+	return
+}
+
 // Add edges to the graph. Nodes must be found in the lookup table since this is
 // meant to work based on copies of the nodes.
 func addEdgeHelper(g *PkgGraph, pkg1 PkgNode, pkg2 PkgNode) (err error) {
@@ -293,6 +306,9 @@ func TestNodeStateString(t *testing.T) {
 	assert.Equal(t, "UpToDate", StateUpToDate.String())
 	assert.Equal(t, "Unresolved", StateUnresolved.String())
 	assert.Equal(t, "Cached", StateCached.String())
+	assert.Equal(t, "Blocked", StateBlocked.String())
+	assert.Equal(t, "Skipped", StateSkipped.String())
+	assert.Equal(t, "TimedOut", StateTimedOut.String())
 	var s NodeState
 	s = -1
 	assert.Panics(t, func() { _ = s.String() })
@@ -857,6 +873,44 @@ func TestEncodeDecodeDOT(t *testing.T) {
 	checkTestGraph(t, gIn)
 }
 
+// Make sure every node state survives encoding and decoding.
+func TestEncodeDecodeNodeStates(t *testing.T) {
+	var st NodeState
+	for st = StateUnknown + 1; st <= StateMAX; st++ {
+		nodeOut := PkgNode{
+			VersionedPkg: &pkgjson.PackageVer{Name: "A", Version: "1"},
+			State:        st,
+			Type:         TypeBuild,
+			SrpmPath:     "A.src.rpm",
+		}
+
+		data, err := nodeOut.MarshalBinary()
+		assert.NoError(t, err)
+
+		nodeIn := PkgNode{}
+		err = nodeIn.UnmarshalBinary(data)
+		assert.NoError(t, err)
+		assert.Equal(t, st, nodeIn.State)
+		assert.Equal(t, nodeOut.DOTColor(), nodeIn.DOTColor())
+	}
+}
+
+// Make sure decoding rejects node states which do not exist.
+func TestDecodeInvalidNodeState(t *testing.T) {
+	nodeOut := PkgNode{
+		VersionedPkg: &pkgjson.PackageVer{Name: "A", Version: "1"},
+		State:        StateMAX + 1,
+		Type:         TypeBuild,
+	}
+
+	data, err := nodeOut.MarshalBinary()
+	assert.NoError(t, err)
+
+	nodeIn := PkgNode{}
+	err = nodeIn.UnmarshalBinary(data)
+	assert.Error(t, err)
+}
+
 // Test the deep copy functionality works as expected.
 func TestDeepCopy(t *testing.T) {
 
@@ -0,0 +1,30 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+// Package pkggraphtest provides helpers to build package graphs in tests.
+package pkggraphtest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"microsoft.com/pkggen/internal/pkggraph"
+	"microsoft.com/pkggen/internal/pkgjson"
+)
+
+// AddSRPM adds the run and build node of a package built from its own SRPM to a graph.
+// The package's SRPM, RPM and spec are named after the package, e.g. "A.src.rpm" for package "A".
+func AddSRPM(t *testing.T, g *pkggraph.PkgGraph, name, version string) (runNode, buildNode *pkggraph.PkgNode) {
+	pkg := &pkgjson.PackageVer{Name: name, Version: version}
+	srpmPath := name + ".src.rpm"
+	rpmPath := name + ".rpm"
+	specPath := name + ".spec"
+
+	runNode, err := g.AddPkgNode(pkg, pkggraph.StateMeta, pkggraph.TypeRun, srpmPath, rpmPath, specPath, name, "test_arch", "test_repo")
+	assert.NoError(t, err)
+	buildNode, err = g.AddPkgNode(pkg, pkggraph.StateBuild, pkggraph.TypeBuild, srpmPath, rpmPath, specPath, name, "test_arch", "test_repo")
+	assert.NoError(t, err)
+	assert.NoError(t, g.AddEdge(runNode, buildNode))
+
+	return
+}
@@ -0,0 +1,289 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package pkggraph
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gonum.org/v1/gonum/graph"
+	"gonum.org/v1/gonum/graph/simple"
+	"gonum.org/v1/gonum/graph/topo"
+
+	"microsoft.com/pkggen/internal/logger"
+)
+
+// CycleEdgeKind describes the dependency an edge inside a cycle represents.
+type CycleEdgeKind int
+
+// Valid values for CycleEdgeKind type
+const (
+	EdgeOther         CycleEdgeKind = iota // Any other edge, such as ones to or from meta nodes
+	EdgeBuildRequires CycleEdgeKind = iota // A build node depending on a package, a 'BuildRequires' from a .spec file
+	EdgeRequires      CycleEdgeKind = iota // A run node depending on a package, a 'Requires' from a .spec file
+	EdgePackageBuild  CycleEdgeKind = iota // A run node depending on the build node producing its package
+)
+
+// CycleEdge is an edge between two nodes of the same strongly connected component.
+type CycleEdge struct {
+	From *PkgNode
+	To   *PkgNode
+	Kind CycleEdgeKind
+}
+
+// CycleReport describes a strongly connected component of the graph: a group of nodes which all,
+// directly or indirectly, depend on each other. Every cycle of the graph is contained in a single component.
+type CycleReport struct {
+	Nodes []*PkgNode   // Every node of the component, sorted by SRPM and name
+	Edges []*CycleEdge // Every edge between two nodes of the component, sorted by SRPM and name
+	SRPMs []string     // The sorted, distinct SRPMs of the component's nodes, meta nodes have none
+	// NeedsPrebuiltSRPM is set if the component contains build nodes, so its cycles can only be broken by pre-built SRPMs.
+	// Cycles without build nodes are resolved by MakeDAG on its own.
+	NeedsPrebuiltSRPM bool
+	// SuggestedPrebuiltSRPMs is a small set of SRPMs which, if pre-built, would break every cycle of the component requiring one.
+	SuggestedPrebuiltSRPMs []string
+}
+
+func (k CycleEdgeKind) String() string {
+	switch k {
+	case EdgeBuildRequires:
+		return "BuildRequires"
+	case EdgeRequires:
+		return "Requires"
+	case EdgePackageBuild:
+		return "PackageBuild"
+	default:
+		return "Other"
+	}
+}
+
+// FindCycles runs a Tarjan strongly connected component analysis on the graph and returns a report
+// for every component containing a cycle. Unlike FindAnyDirectedCycle, all cycles are found at once.
+func (g *PkgGraph) FindCycles() (reports []*CycleReport) {
+	for _, component := range topo.TarjanSCC(g) {
+		if len(component) < 2 {
+			continue
+		}
+
+		reports = append(reports, g.newCycleReport(component))
+	}
+
+	sort.Slice(reports, func(i, j int) bool {
+		return lessCycleNode(reports[i].Nodes[0], reports[j].Nodes[0])
+	})
+
+	return
+}
+
+// newCycleReport builds a report for a strongly connected component.
+func (g *PkgGraph) newCycleReport(component []graph.Node) (report *CycleReport) {
+	report = &CycleReport{}
+
+	inComponent := make(map[int64]bool, len(component))
+	srpms := make(map[string]bool)
+	for _, node := range component {
+		pkgNode := node.(*PkgNode).This
+		inComponent[pkgNode.ID()] = true
+		if pkgNode.SrpmPath != "" {
+			srpms[pkgNode.SrpmPath] = true
+		}
+		report.Nodes = append(report.Nodes, pkgNode)
+
+		if pkgNode.Type == TypeBuild {
+			report.NeedsPrebuiltSRPM = true
+		}
+	}
+
+	for _, node := range report.Nodes {
+		dependencies := g.From(node.ID())
+		for dependencies.Next() {
+			dependency := dependencies.Node().(*PkgNode).This
+			if !inComponent[dependency.ID()] {
+				continue
+			}
+
+			report.Edges = append(report.Edges, &CycleEdge{
+				From: node,
+				To:   dependency,
+				Kind: cycleEdgeKind(node, dependency),
+			})
+		}
+	}
+
+	for srpm := range srpms {
+		report.SRPMs = append(report.SRPMs, srpm)
+	}
+	sort.Strings(report.SRPMs)
+
+	sort.Slice(report.Nodes, func(i, j int) bool {
+		return lessCycleNode(report.Nodes[i], report.Nodes[j])
+	})
+	sort.Slice(report.Edges, func(i, j int) bool {
+		if report.Edges[i].From != report.Edges[j].From {
+			return lessCycleNode(report.Edges[i].From, report.Edges[j].From)
+		}
+		return lessCycleNode(report.Edges[i].To, report.Edges[j].To)
+	})
+
+	if report.NeedsPrebuiltSRPM {
+		report.SuggestedPrebuiltSRPMs = suggestPrebuiltSRPMs(report)
+	}
+
+	return
+}
+
+// cycleEdgeKind returns the kind of dependency an edge represents.
+func cycleEdgeKind(from, to *PkgNode) CycleEdgeKind {
+	toPackage := to.Type == TypeRun || to.Type == TypeRemote || to.Type == TypePreBuilt
+
+	switch {
+	case from.Type == TypeBuild && toPackage:
+		return EdgeBuildRequires
+	case from.Type == TypeRun && toPackage:
+		return EdgeRequires
+	case from.Type == TypeRun && to.Type == TypeBuild:
+		return EdgePackageBuild
+	default:
+		return EdgeOther
+	}
+}
+
+// lessCycleNode orders nodes by SRPM, then by name and finally by ID.
+func lessCycleNode(a, b *PkgNode) bool {
+	if a.SrpmPath != b.SrpmPath {
+		return a.SrpmPath < b.SrpmPath
+	}
+	if a.FriendlyName() != b.FriendlyName() {
+		return a.FriendlyName() < b.FriendlyName()
+	}
+	return a.ID() < b.ID()
+}
+
+// suggestPrebuiltSRPMs greedily picks SRPMs which, if pre-built, break every cycle of a component
+// which contains a build node. Pre-building an SRPM removes the 'BuildRequires' edges other SRPMs
+// have on its packages, the same way MakeDAG does when it finds the SRPM's RPMs already built.
+func suggestPrebuiltSRPMs(report *CycleReport) (suggestions []string) {
+	prebuilt := make(map[string]bool)
+
+	for {
+		remaining := nodesNeedingPrebuiltSRPM(report, prebuilt)
+		if remaining == 0 {
+			break
+		}
+
+		bestSRPM := ""
+		bestRemaining := remaining
+		for _, candidate := range prebuiltSRPMCandidates(report, prebuilt) {
+			prebuilt[candidate] = true
+			candidateRemaining := nodesNeedingPrebuiltSRPM(report, prebuilt)
+			delete(prebuilt, candidate)
+
+			if candidateRemaining < bestRemaining {
+				bestSRPM = candidate
+				bestRemaining = candidateRemaining
+			}
+		}
+
+		if bestSRPM == "" {
+			logger.Log.Debugf("Unable to find pre-built SRPMs breaking every cycle between %v", report.SRPMs)
+			break
+		}
+
+		prebuilt[bestSRPM] = true
+		suggestions = append(suggestions, bestSRPM)
+	}
+
+	sort.Strings(suggestions)
+	return
+}
+
+// prebuiltSRPMCandidates returns the sorted SRPMs whose packages are build dependencies of another SRPM in the component.
+func prebuiltSRPMCandidates(report *CycleReport, prebuilt map[string]bool) (candidates []string) {
+	seen := make(map[string]bool)
+	for _, edge := range report.Edges {
+		srpm := edge.To.SrpmPath
+		if edge.Kind != EdgeBuildRequires || edge.From.SrpmPath == srpm || prebuilt[srpm] || seen[srpm] {
+			continue
+		}
+
+		seen[srpm] = true
+		candidates = append(candidates, srpm)
+	}
+
+	sort.Strings(candidates)
+	return
+}
+
+// nodesNeedingPrebuiltSRPM returns how many nodes of a component are still part of a cycle containing a build node
+// once the given SRPMs are pre-built.
+func nodesNeedingPrebuiltSRPM(report *CycleReport, prebuilt map[string]bool) (count int) {
+	subGraph := simple.NewDirectedGraph()
+	for _, node := range report.Nodes {
+		subGraph.AddNode(simple.Node(node.ID()))
+	}
+
+	for _, edge := range report.Edges {
+		if edge.Kind == EdgeBuildRequires && edge.From.SrpmPath != edge.To.SrpmPath && prebuilt[edge.To.SrpmPath] {
+			continue
+		}
+
+		subGraph.SetEdge(subGraph.NewEdge(subGraph.Node(edge.From.ID()), subGraph.Node(edge.To.ID())))
+	}
+
+	buildNodes := make(map[int64]bool)
+	for _, node := range report.Nodes {
+		if node.Type == TypeBuild {
+			buildNodes[node.ID()] = true
+		}
+	}
+
+	for _, component := range topo.TarjanSCC(subGraph) {
+		if len(component) < 2 {
+			continue
+		}
+
+		for _, node := range component {
+			if buildNodes[node.ID()] {
+				count += len(component)
+				break
+			}
+		}
+	}
+
+	return
+}
+
+// String explains the report, grouping the component's edges by the SRPM they start from.
+func (r *CycleReport) String() string {
+	var builder strings.Builder
+
+	fmt.Fprintf(&builder, "Dependency cycle between %d SRPM(s) and %d node(s):\n", len(r.SRPMs), len(r.Nodes))
+
+	lastSRPM := ""
+	for i, edge := range r.Edges {
+		if i == 0 || edge.From.SrpmPath != lastSRPM {
+			lastSRPM = edge.From.SrpmPath
+			fmt.Fprintf(&builder, "\tSRPM '%s':\n", filepath.Base(lastSRPM))
+		}
+
+		fmt.Fprintf(&builder, "\t\t{%s} --%s--> {%s}\n", edge.From.FriendlyName(), edge.Kind, edge.To.FriendlyName())
+	}
+
+	switch {
+	case !r.NeedsPrebuiltSRPM:
+		builder.WriteString("\tThe cycle contains no build nodes and is resolved automatically.")
+	case len(r.SuggestedPrebuiltSRPMs) == 0:
+		builder.WriteString("\tNo set of pre-built SRPMs breaks the cycle.")
+	default:
+		suggestions := make([]string, 0, len(r.SuggestedPrebuiltSRPMs))
+		for _, srpm := range r.SuggestedPrebuiltSRPMs {
+			suggestions = append(suggestions, filepath.Base(srpm))
+		}
+		fmt.Fprintf(&builder, "\tPre-building these SRPMs would break the cycle: %s", strings.Join(suggestions, ", "))
+	}
+
+	return builder.String()
+}
@@ -0,0 +1,114 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package pkggraph
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindCyclesNoCycle(t *testing.T) {
+	g, err := buildTestGraphHelper()
+	assert.NoError(t, err)
+
+	assert.Empty(t, g.FindCycles())
+}
+
+func TestFindCyclesBuildCycle(t *testing.T) {
+	g, err := buildTestGraphHelper()
+	assert.NoError(t, err)
+
+	// Create the same cycle as TestDFSFindCycle: A BuildRequires B, B BuildRequires C, C BuildRequires A
+	addEdgeHelper(g, *pkgCBuild, *pkgARun)
+
+	reports := g.FindCycles()
+	assert.Len(t, reports, 1)
+
+	report := reports[0]
+	assert.Len(t, report.Nodes, 6)
+	assert.Equal(t, []string{"A.src.rpm", "B.src.rpm", "C.src.rpm"}, report.SRPMs)
+	assert.True(t, report.NeedsPrebuiltSRPM)
+	assert.Len(t, report.SuggestedPrebuiltSRPMs, 1)
+
+	kinds := make(map[CycleEdgeKind]int)
+	for _, edge := range report.Edges {
+		kinds[edge.Kind]++
+	}
+	assert.Equal(t, 3, kinds[EdgeBuildRequires])
+	assert.Equal(t, 3, kinds[EdgePackageBuild])
+	assert.Equal(t, 0, kinds[EdgeRequires])
+
+	assert.Contains(t, report.String(), "--BuildRequires-->")
+	assert.Contains(t, report.String(), report.SuggestedPrebuiltSRPMs[0])
+}
+
+func TestFindCyclesRunCycle(t *testing.T) {
+	g := NewPkgGraph()
+	aRun, _ := addSRPMHelper(t, g, "A")
+	bRun, _ := addSRPMHelper(t, g, "B")
+
+	// A Requires B, B Requires A
+	assert.NoError(t, g.AddEdge(aRun, bRun))
+	assert.NoError(t, g.AddEdge(bRun, aRun))
+
+	reports := g.FindCycles()
+	assert.Len(t, reports, 1)
+	assert.Len(t, reports[0].Nodes, 2)
+	assert.False(t, reports[0].NeedsPrebuiltSRPM)
+	assert.Empty(t, reports[0].SuggestedPrebuiltSRPMs)
+	for _, edge := range reports[0].Edges {
+		assert.Equal(t, EdgeRequires, edge.Kind)
+	}
+}
+
+func TestFindCyclesReportsAllCycles(t *testing.T) {
+	g := NewPkgGraph()
+	aRun, aBuild := addSRPMHelper(t, g, "A")
+	bRun, bBuild := addSRPMHelper(t, g, "B")
+	cRun, cBuild := addSRPMHelper(t, g, "C")
+	dRun, dBuild := addSRPMHelper(t, g, "D")
+
+	// Two independent build cycles: A <-> B and C <-> D
+	assert.NoError(t, g.AddEdge(aBuild, bRun))
+	assert.NoError(t, g.AddEdge(bBuild, aRun))
+	assert.NoError(t, g.AddEdge(cBuild, dRun))
+	assert.NoError(t, g.AddEdge(dBuild, cRun))
+
+	reports := g.FindCycles()
+	assert.Len(t, reports, 2)
+	assert.Equal(t, []string{"A.src.rpm", "B.src.rpm"}, reports[0].SRPMs)
+	assert.Equal(t, []string{"C.src.rpm", "D.src.rpm"}, reports[1].SRPMs)
+	assert.Len(t, reports[0].SuggestedPrebuiltSRPMs, 1)
+	assert.Len(t, reports[1].SuggestedPrebuiltSRPMs, 1)
+}
+
+func TestFindCyclesSuggestsSharedSRPM(t *testing.T) {
+	g := NewPkgGraph()
+	aRun, aBuild := addSRPMHelper(t, g, "A")
+	bRun, bBuild := addSRPMHelper(t, g, "B")
+	cRun, cBuild := addSRPMHelper(t, g, "C")
+
+	// B is part of two build cycles, A <-> B and B <-> C, pre-building it breaks both.
+	assert.NoError(t, g.AddEdge(aBuild, bRun))
+	assert.NoError(t, g.AddEdge(bBuild, aRun))
+	assert.NoError(t, g.AddEdge(cBuild, bRun))
+	assert.NoError(t, g.AddEdge(bBuild, cRun))
+
+	reports := g.FindCycles()
+	assert.Len(t, reports, 1)
+	assert.Equal(t, []string{"B.src.rpm"}, reports[0].SuggestedPrebuiltSRPMs)
+}
+
+func TestMakeDAGFailsOnBuildCycle(t *testing.T) {
+	g := NewPkgGraph()
+	aRun, aBuild := addSRPMHelper(t, g, "A")
+	bRun, bBuild := addSRPMHelper(t, g, "B")
+
+	assert.NoError(t, g.AddEdge(aBuild, bRun))
+	assert.NoError(t, g.AddEdge(bBuild, aRun))
+
+	err := g.MakeDAG()
+	assert.Error(t, err)
+}
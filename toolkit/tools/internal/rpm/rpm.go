@@ -5,8 +5,10 @@ package rpm
 
 import (
 	"fmt"
+	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
 
 	"microsoft.com/pkggen/internal/file"
 	"microsoft.com/pkggen/internal/logger"
@@ -41,6 +43,9 @@ const (
 	// WithCheckDefine specifies the with_check option for rpm tool commands
 	WithCheckDefine = "with_check"
 
+	// SMPMFlagsDefine specifies the parallel make flags option for rpm tool commands
+	SMPMFlagsDefine = "_smp_mflags"
+
 	// NoCompatibleArchError specifies the error message when processing a SPEC written for a different architecture.
 	NoCompatibleArchError = "error: No compatible architectures found for build"
 )
@@ -49,8 +54,23 @@ const (
 	rpmProgram      = "rpm"
 	rpmSpecProgram  = "rpmspec"
 	rpmBuildProgram = "rpmbuild"
+
+	// buildStopGracePeriod is how long a build which exceeded its time limit is given to exit before it is killed.
+	buildStopGracePeriod = 10 * time.Second
 )
 
+// BuildLimiter applies resource limits to the rpmbuild processes which build and check packages.
+type BuildLimiter interface {
+	// Setup is called with the process ID of every build before it starts running.
+	// Limits applied to the process are inherited by every process the build starts.
+	Setup(pid int) error
+	// Timeout returns how much longer builds may run for. If limited is false builds may run indefinitely.
+	Timeout() (remaining time.Duration, limited bool)
+}
+
+// buildLimiter limits every build started by this package, if set.
+var buildLimiter BuildLimiter
+
 var (
 	// Output from 'rpm' prints installed RPMs in a line with the following format:
 	//
@@ -60,8 +80,17 @@ var (
 	//
 	//	D: ========== +++ systemd-devel-239-42.cm2 x86_64-linux 0x0
 	installedRPMLineRegex = regexp.MustCompile(`^D: =+ \+{3} (\S+).*$`)
+
+	// debugPackageSuffixes are the suffixes rpmbuild gives the names of the debuginfo and debugsource packages it generates.
+	debugPackageSuffixes = []string{"-debuginfo", "-debugsource"}
 )
 
+// SetBuildLimiter limits every rpmbuild process started by this package to build or check a package.
+// Other processes, including the caller itself, are not limited.
+func SetBuildLimiter(limiter BuildLimiter) {
+	buildLimiter = limiter
+}
+
 // SetMacroDir adds RPM_CONFIGDIR=$(newMacroDir) into the shell's environment for the duration of a program.
 // To restore the environment the caller can use shell.SetEnvironment() with the returned origenv.
 // On an empty string argument return success immediately and do not modify the environment.
@@ -138,6 +167,27 @@ func executeRpmCommand(program string, args ...string) (results []string, err er
 	return
 }
 
+// executeRpmBuild runs an rpmbuild command which builds or checks a package, subject to the build limiter if one is set.
+// A build which runs out of time is stopped along with every process it started, and returns an error wrapping shell.ErrTimedOut.
+func executeRpmBuild(args ...string) (err error) {
+	const (
+		squashErrors       = true
+		printOutputOnError = false
+	)
+
+	if buildLimiter == nil {
+		return shell.ExecuteLive(squashErrors, rpmBuildProgram, args...)
+	}
+
+	timeout, limited := buildLimiter.Timeout()
+	if limited && timeout <= 0 {
+		err = fmt.Errorf("%w before the build started", shell.ErrTimedOut)
+		return
+	}
+
+	return shell.ExecuteLiveWithSetupAndTimeout(buildLimiter.Setup, timeout, buildStopGracePeriod, logger.Log.Debug, logger.Log.Debug, printOutputOnError, rpmBuildProgram, args...)
+}
+
 // DefaultDefines returns a new map of default defines that can be used during RPM queries.
 func DefaultDefines(runCheck bool) map[string]string {
 	// "with_check" definition should align with the RUN_CHECK Make variable whenever possible
@@ -151,6 +201,17 @@ func DefaultDefines(runCheck bool) map[string]string {
 	}
 }
 
+// EnableBcond enables a spec build conditional in a set of defines, the same way rpmbuild's "--with <bcond>" option does.
+// Specs can then test for it with "%{with <bcond>}".
+func EnableBcond(defines map[string]string, bcond string) {
+	const (
+		bcondDefinePrefix = "_with_"
+		bcondValuePrefix  = "--with-"
+	)
+
+	defines[bcondDefinePrefix+bcond] = bcondValuePrefix + bcond
+}
+
 // GetInstalledPackages returns a string list of all packages installed on the system
 // in the "[name]-[version]-[release].[distribution].[architecture]" format.
 // Example: tdnf-2.1.0-4.cm1.x86_64
@@ -204,15 +265,69 @@ func QueryPackage(packageFile, queryFormat string, defines map[string]string, ex
 
 // BuildRPMFromSRPM builds an RPM from the given SRPM file
 func BuildRPMFromSRPM(srpmFile string, defines map[string]string, extraArgs ...string) (err error) {
+	const queryFormat = ""
+
+	extraArgs = append(extraArgs, "--rebuild", "--nodeps")
+
+	args := formatCommandArgs(extraArgs, srpmFile, queryFormat, defines)
+	return executeRpmBuild(args...)
+}
+
+// BuildRPMFromSPEC builds RPMs from the given SPEC file, whose sources must already be in place.
+// Unlike BuildRPMFromSRPM the build directory and build root are kept afterwards, so RunSPECCheck can be run on them.
+func BuildRPMFromSPEC(specFile string, defines map[string]string, extraArgs ...string) (err error) {
+	const queryFormat = ""
+
+	extraArgs = append(extraArgs, "-bb", "--noclean", "--nodeps")
+
+	args := formatCommandArgs(extraArgs, specFile, queryFormat, defines)
+	return executeRpmBuild(args...)
+}
+
+// RunSPECCheck runs the %check section of a SPEC file previously built with BuildRPMFromSPEC, in its existing build root.
+func RunSPECCheck(specFile string, defines map[string]string, extraArgs ...string) (err error) {
 	const (
+		queryFormat = ""
+		// rpmbuild has no stage which runs only %check, the closest is %install followed by %check.
+		// Replacing the start of the %install script with an exit skips it, leaving the build root as it was built.
+		installPreDefine = "__spec_install_pre"
+		skipScript       = "exit 0"
+	)
+
+	checkDefines := make(map[string]string, len(defines)+1)
+	for k, v := range defines {
+		checkDefines[k] = v
+	}
+	checkDefines[installPreDefine] = skipScript
+
+	extraArgs = append(extraArgs, "-bi", "--short-circuit", "--noclean", "--nodeps")
+
+	args := formatCommandArgs(extraArgs, specFile, queryFormat, checkDefines)
+	return executeRpmBuild(args...)
+}
+
+// QuerySRPMSpecFile returns the file name of the SPEC file packaged in an SRPM.
+func QuerySRPMSpecFile(srpmFile string) (specFileName string, err error) {
+	const (
+		listFilesArg = "-lp"
+		specSuffix   = ".spec"
 		queryFormat  = ""
-		squashErrors = true
 	)
 
-	extraArgs = append(extraArgs, "--rebuild", "--nodeps")
+	files, err := QueryPackage(srpmFile, queryFormat, nil, listFilesArg)
+	if err != nil {
+		return
+	}
 
-	args := formatCommandArgs(extraArgs, srpmFile, queryFormat, defines)
-	return shell.ExecuteLive(squashErrors, rpmBuildProgram, args...)
+	for _, f := range files {
+		if strings.HasSuffix(f, specSuffix) {
+			specFileName = f
+			return
+		}
+	}
+
+	err = fmt.Errorf("no SPEC file found in (%s)", srpmFile)
+	return
 }
 
 // GenerateSRPMFromSPEC generates an SRPM for the given SPEC file
@@ -245,6 +360,52 @@ func GenerateSRPMFromSPEC(specFile, topDir string, defines map[string]string) (e
 	return
 }
 
+// IsDebugPackage checks if a package is a debuginfo or debugsource package.
+func IsDebugPackage(packageName string) bool {
+	for _, suffix := range debugPackageSuffixes {
+		if strings.HasSuffix(packageName, suffix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsDebugRPMFile checks if an RPM file, named [name]-[version]-[release].[architecture].rpm, holds a debuginfo or debugsource package.
+func IsDebugRPMFile(rpmFile string) bool {
+	packageName, isRPMFile := PackageNameFromRPMFile(rpmFile)
+	return isRPMFile && IsDebugPackage(packageName)
+}
+
+// PackageNameFromRPMFile returns the name of the package held by an RPM file, named [name]-[version]-[release].[architecture].rpm.
+// If the file is not named that way, isRPMFile will be false.
+func PackageNameFromRPMFile(rpmFile string) (packageName string, isRPMFile bool) {
+	const (
+		archSeparator    = "."
+		versionSeparator = "-"
+	)
+
+	packageName = strings.TrimSuffix(filepath.Base(rpmFile), ".rpm")
+
+	archIndex := strings.LastIndex(packageName, archSeparator)
+	if archIndex == -1 {
+		return
+	}
+	packageName = packageName[:archIndex]
+
+	// Strip the release, then the version.
+	for i := 0; i < 2; i++ {
+		versionIndex := strings.LastIndex(packageName, versionSeparator)
+		if versionIndex == -1 {
+			return
+		}
+		packageName = packageName[:versionIndex]
+	}
+
+	isRPMFile = true
+	return
+}
+
 // InstallRPM installs the given RPM or SRPM
 func InstallRPM(rpmFile string) (err error) {
 	const installOption = "-ihv"
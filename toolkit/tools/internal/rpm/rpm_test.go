@@ -95,3 +95,40 @@ func TestArchShouldFailForExcludedArchitectures(t *testing.T) {
 	assert.NoError(t, err)
 	assert.False(t, matches)
 }
+
+func TestShouldDetectDebugPackages(t *testing.T) {
+	assert.True(t, IsDebugPackage("zlib-debuginfo"))
+	assert.True(t, IsDebugPackage("zlib-debugsource"))
+	assert.False(t, IsDebugPackage("zlib-devel"))
+	assert.False(t, IsDebugPackage("debuginfo-tools"))
+}
+
+func TestShouldDetectDebugRPMFiles(t *testing.T) {
+	assert.True(t, IsDebugRPMFile("/out/RPMS/x86_64/zlib-debuginfo-1.2.11-4.cm1.x86_64.rpm"))
+	assert.True(t, IsDebugRPMFile("zlib-libs-debugsource-1.2.11-4.cm1.x86_64.rpm"))
+	assert.False(t, IsDebugRPMFile("/out/RPMS/x86_64/zlib-devel-1.2.11-4.cm1.x86_64.rpm"))
+}
+
+func TestShouldNotDetectDebugRPMFileFromVersion(t *testing.T) {
+	assert.False(t, IsDebugRPMFile("foo-1.0-debuginfo.cm1.noarch.rpm"))
+}
+
+func TestShouldNotDetectDebugRPMFileFromMalformedName(t *testing.T) {
+	assert.False(t, IsDebugRPMFile("zlib-debuginfo.rpm"))
+}
+
+func TestShouldGetPackageNameFromRPMFile(t *testing.T) {
+	packageName, isRPMFile := PackageNameFromRPMFile("/out/RPMS/x86_64/zlib-libs-debugsource-1.2.11-4.cm1.x86_64.rpm")
+	assert.True(t, isRPMFile)
+	assert.Equal(t, "zlib-libs-debugsource", packageName)
+
+	_, isRPMFile = PackageNameFromRPMFile("zlib-debuginfo.rpm")
+	assert.False(t, isRPMFile)
+}
+
+func TestEnableBcondShouldDefineWithMacro(t *testing.T) {
+	defines := DefaultDefines(false)
+	EnableBcond(defines, "bootstrap")
+	assert.Equal(t, "--with-bootstrap", defines["_with_bootstrap"])
+	assert.Equal(t, "0", defines[WithCheckDefine])
+}
@@ -0,0 +1,184 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package safechroot
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+	"microsoft.com/pkggen/internal/buildpipeline"
+	"microsoft.com/pkggen/internal/file"
+	"microsoft.com/pkggen/internal/logger"
+	"microsoft.com/pkggen/internal/shell"
+)
+
+// Directories inside a chroot pool slot.
+const (
+	poolRootDir    = "root"
+	poolUpperDir   = "upper"
+	poolWorkDir    = "work"
+	poolScratchDir = "scratch"
+)
+
+// poolLayersDirSuffix is appended to a pool's base directory to get the directory its layers are kept in,
+// so they are removed along with the base.
+const poolLayersDirSuffix = "-layers"
+
+// ChrootPool is a directory of reusable chroots sharing a read-only copy of a worker tar.
+// Rather than extracting the tar for every chroot, the pool extracts it once into a base and each chroot's root is
+// an overlay of that base, any layers saved from earlier chroots, and an empty upper directory. Changes made inside
+// a chroot are discarded when it is closed, or the next time its slot is leased if it was left on disk.
+// Pooled chroots are only supported in regular builds.
+type ChrootPool struct {
+	dir  string
+	base *buildpipeline.ChrootPoolBase
+}
+
+// OpenChrootPool opens the chroot pool in poolDir, creating it if needed.
+// - tarPath is the worker tar the pool's chroots are created from, it is only extracted if its contents have changed.
+// - tarHash is the SHA256 of the worker tar. It is computed if empty, pass it when opening the pool repeatedly.
+func OpenChrootPool(poolDir, tarPath, tarHash string) (pool *ChrootPool, err error) {
+	if !buildpipeline.IsRegularBuild() {
+		err = fmt.Errorf("chroot pools are only supported in regular builds")
+		return
+	}
+
+	if tarHash == "" {
+		tarHash, err = file.GenerateSHA256(tarPath)
+		if err != nil {
+			return
+		}
+	}
+
+	base, err := buildpipeline.PrepareChrootPoolBase(poolDir, tarHash, func(baseDir string) error {
+		return extractWorkerTar(baseDir, tarPath)
+	})
+	if err != nil {
+		return
+	}
+
+	pool = &ChrootPool{
+		dir:  poolDir,
+		base: base,
+	}
+	return
+}
+
+// Close releases the pool's base, so it can be removed once the worker tar changes.
+// Chroots leased from the pool must be closed first.
+func (p *ChrootPool) Close() error {
+	return p.base.Release()
+}
+
+// LayersDir returns a directory for callers to keep layers saved with SaveLayer in.
+// It is removed along with the pool's base if the worker tar changes.
+func (p *ChrootPool) LayersDir() string {
+	return p.base.Dir() + poolLayersDirSuffix
+}
+
+// NewChroot creates a new Chroot leased from the pool, Initialize must be called without a tar.
+// - layers are optional directories saved with SaveLayer to place on top of the pool's base, topmost first.
+func (p *ChrootPool) NewChroot(layers ...string) (c *Chroot, err error) {
+	slot, err := buildpipeline.LeaseChrootPoolSlot(p.dir)
+	if err != nil {
+		return
+	}
+
+	err = resetPoolSlot(slot.Dir())
+	if err != nil {
+		slot.Release()
+		return
+	}
+
+	lowerDirs := append(append([]string{}, layers...), p.base.Dir())
+	overlayData := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", strings.Join(lowerDirs, ":"), filepath.Join(slot.Dir(), poolUpperDir), filepath.Join(slot.Dir(), poolWorkDir))
+
+	c = &Chroot{
+		rootDir:        filepath.Join(slot.Dir(), poolRootDir),
+		rootMountPoint: NewMountPoint("overlay", "/", "overlay", 0, overlayData),
+		poolSlot:       slot,
+		isExistingDir:  true,
+	}
+
+	logger.Log.Debugf("Leased pooled chroot (%s) with layers %v", c.rootDir, lowerDirs)
+	return
+}
+
+// SaveLayer copies every change made inside a pooled chroot so far into layerDir, which must not exist.
+// The layer can then be passed to ChrootPool.NewChroot, on top of the same layers this chroot was created with.
+// - excludedPaths are paths inside the chroot whose changes should not be saved.
+func (c *Chroot) SaveLayer(layerDir string, excludedPaths ...string) (err error) {
+	if c.poolSlot == nil {
+		err = fmt.Errorf("chroot (%s) is not pooled, only pooled chroots can save layers", c.rootDir)
+		return
+	}
+
+	err = os.MkdirAll(filepath.Dir(layerDir), os.ModePerm)
+	if err != nil {
+		return
+	}
+
+	// Preserve everything, overlay whiteouts are device files and opaque directories are marked with extended attributes.
+	upperDir := filepath.Join(c.poolSlot.Dir(), poolUpperDir)
+	_, stderr, err := shell.Execute("cp", "-a", upperDir, layerDir)
+	if err != nil {
+		logger.Log.Warnf("Failed to save chroot layer (%s): %s", layerDir, stderr)
+		os.RemoveAll(layerDir)
+		return
+	}
+
+	for _, excludedPath := range excludedPaths {
+		err = os.RemoveAll(filepath.Join(layerDir, excludedPath))
+		if err != nil {
+			os.RemoveAll(layerDir)
+			return
+		}
+	}
+
+	return
+}
+
+// ScratchDir returns a directory outside of a pooled chroot which is emptied along with the chroot.
+// Overlays mounted inside a pooled chroot must keep their upper and work directories here,
+// since an overlay's upper directory can not be on another overlay.
+// Returns an empty string for chroots which are not pooled.
+func (c *Chroot) ScratchDir() string {
+	if c.poolSlot == nil {
+		return ""
+	}
+
+	return filepath.Join(c.poolSlot.Dir(), poolScratchDir)
+}
+
+// resetPoolSlot discards any changes left in a chroot pool slot by a previous lease.
+func resetPoolSlot(slotDir string) (err error) {
+	rootDir := filepath.Join(slotDir, poolRootDir)
+
+	// A previous lease may have exited without unmounting its chroot, detach its root along with any nested mounts.
+	// Fails with EINVAL if the root is not a mount point, which is expected.
+	err = unix.Unmount(rootDir, unix.MNT_DETACH)
+	if err != nil && err != unix.EINVAL && err != unix.ENOENT {
+		logger.Log.Warnf("Failed to unmount stale pooled chroot (%s). Error: %s", rootDir, err)
+		return
+	}
+
+	for _, dir := range []string{poolUpperDir, poolWorkDir, poolScratchDir} {
+		dirPath := filepath.Join(slotDir, dir)
+
+		err = os.RemoveAll(dirPath)
+		if err != nil {
+			return
+		}
+
+		err = os.MkdirAll(dirPath, os.ModePerm)
+		if err != nil {
+			return
+		}
+	}
+
+	return os.MkdirAll(rootDir, os.ModePerm)
+}
@@ -17,6 +17,7 @@ import (
 	"microsoft.com/pkggen/internal/buildpipeline"
 	"microsoft.com/pkggen/internal/file"
 	"microsoft.com/pkggen/internal/logger"
+	"microsoft.com/pkggen/internal/metrics"
 	"microsoft.com/pkggen/internal/retry"
 	"microsoft.com/pkggen/internal/shell"
 	"microsoft.com/pkggen/internal/systemdependency"
@@ -50,6 +51,10 @@ type Chroot struct {
 	rootDir     string
 	mountPoints []*MountPoint
 
+	// rootMountPoint and poolSlot are only set for chroots leased from a chroot pool.
+	rootMountPoint *MountPoint
+	poolSlot       *buildpipeline.ChrootPoolSlot
+
 	isExistingDir bool
 }
 
@@ -71,6 +76,9 @@ var (
 	activeChroots      []*Chroot
 )
 
+// chrootSetupDuration records how long successful chroot initializations take.
+var chrootSetupDuration = metrics.NewHistogram("toolkit_chroot_setup_duration_seconds", "Time taken to initialize a chroot, including extracting its tarball and creating its mount points.", metrics.DurationBuckets)
+
 var defaultChrootEnv = []string{
 	"USER=root",
 	"HOME=/root",
@@ -161,6 +169,13 @@ func (c *Chroot) Initialize(tarPath string, extraDirectories []string, extraMoun
 	activeChrootsMutex.Lock()
 	defer activeChrootsMutex.Unlock()
 
+	setupStartTime := time.Now()
+	defer func() {
+		if err == nil {
+			chrootSetupDuration.ObserveSince(setupStartTime)
+		}
+	}()
+
 	if c.isExistingDir {
 		_, err = os.Stat(c.rootDir)
 		if os.IsNotExist(err) {
@@ -206,6 +221,21 @@ func (c *Chroot) Initialize(tarPath string, extraDirectories []string, extraMoun
 		}
 	}()
 
+	// Pooled chroots are populated by mounting their root overlay, which must happen before anything is created inside them.
+	if c.rootMountPoint != nil {
+		if tarPath != "" {
+			err = fmt.Errorf("pooled chroot (%s) can not extract a tar", c.rootDir)
+			return
+		}
+
+		c.mountPoints = []*MountPoint{c.rootMountPoint}
+		err = c.createMountPoints(c.mountPoints)
+		if err != nil {
+			logger.Log.Warn("Error mounting root of pooled chroot")
+			return
+		}
+	}
+
 	// Extract a given tarball if necessary
 	if tarPath != "" {
 		err = extractWorkerTar(c.rootDir, tarPath)
@@ -237,7 +267,7 @@ func (c *Chroot) Initialize(tarPath string, extraDirectories []string, extraMoun
 		// e.g.: /dev/pts is unmounted and then /dev is.
 		//
 		// Sort now before checking err so that `unmountAndRemove` can be called from Initialize.
-		c.mountPoints = allMountPoints
+		c.mountPoints = append(c.mountPoints, allMountPoints...)
 		sort.Slice(c.mountPoints, func(i, j int) bool {
 			return c.mountPoints[i].target > c.mountPoints[j].target
 		})
@@ -458,6 +488,20 @@ func (c *Chroot) unmountAndRemove(leaveOnDisk bool) (err error) {
 		}
 	}
 
+	// A pooled chroot's root directory is its slot's mount point, reset the slot instead of removing it.
+	if c.poolSlot != nil {
+		if !leaveOnDisk {
+			err = resetPoolSlot(c.poolSlot.Dir())
+		}
+
+		releaseErr := c.poolSlot.Release()
+		if err == nil {
+			err = releaseErr
+		}
+
+		return
+	}
+
 	if !leaveOnDisk {
 		err = os.RemoveAll(c.rootDir)
 	}
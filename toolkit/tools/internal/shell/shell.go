@@ -5,11 +5,15 @@ package shell
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/sys/unix"
 	"microsoft.com/pkggen/internal/logger"
@@ -18,6 +22,21 @@ import (
 // ShellProgram is the default shell program used by the tooling.
 const ShellProgram = "/bin/bash"
 
+var (
+	// ErrTimedOut is returned when a command is stopped for running longer than its timeout.
+	ErrTimedOut = errors.New("command timed out")
+
+	// ErrCancelled is returned when a command is stopped because it was cancelled.
+	ErrCancelled = errors.New("command cancelled")
+)
+
+// Reasons a command may be stopped for before it exits on its own.
+const (
+	notStopped int32 = iota
+	stoppedOnTimeout
+	stoppedOnCancel
+)
+
 var (
 	activeCommands = make(map[*exec.Cmd]bool)
 	// Guards activeCommands
@@ -135,10 +154,49 @@ func ExecuteLive(squashErrors bool, program string, args ...string) (err error)
 // If printOutputOnError is true, the full output of the command will be printed after completion if the command returns an error. In the event
 // the buffer becomes full the oldest buffered output is discarded.
 func ExecuteLiveWithCallback(onStdout, onStderr func(...interface{}), printOutputOnError bool, program string, args ...string) (err error) {
-	var outputChan chan string
-	const outputChanBufferSize = 1500
+	const (
+		noTimeout     = 0
+		noGracePeriod = 0
+	)
+
+	return ExecuteLiveWithCallbackAndTimeout(noTimeout, noGracePeriod, onStdout, onStderr, printOutputOnError, program, args...)
+}
 
+// ExecuteLiveWithCallbackAndTimeout runs a command like ExecuteLiveWithCallback, but stops the command and all of its children
+// if it runs for longer than timeout. The command's process group is sent SIGTERM to let it clean up, followed by SIGKILL
+// if it is still running after gracePeriod. The returned error wraps ErrTimedOut if the command was stopped.
+// A timeout of 0 lets the command run indefinitely.
+func ExecuteLiveWithCallbackAndTimeout(timeout, gracePeriod time.Duration, onStdout, onStderr func(...interface{}), printOutputOnError bool, program string, args ...string) (err error) {
 	cmd := exec.Command(program, args...)
+	return executeLive(cmd, nil, nil, timeout, gracePeriod, onStdout, onStderr, printOutputOnError)
+}
+
+// ExecuteLiveWithCancelAndTimeout runs a command like ExecuteLiveWithCallbackAndTimeout, but also stops the command and all of its
+// children once cancel is closed. Unlike PermanentlyStopAllProcesses, no other command is affected.
+// The returned error wraps ErrCancelled if the command was stopped because it was cancelled.
+func ExecuteLiveWithCancelAndTimeout(cancel <-chan struct{}, timeout, gracePeriod time.Duration, onStdout, onStderr func(...interface{}), printOutputOnError bool, program string, args ...string) (err error) {
+	cmd := exec.Command(program, args...)
+	return executeLive(cmd, nil, cancel, timeout, gracePeriod, onStdout, onStderr, printOutputOnError)
+}
+
+// ExecuteLiveWithSetupAndTimeout runs a command like ExecuteLiveWithCallbackAndTimeout, but calls setup with the command's
+// process ID before the command's program starts running. Anything setup applies to the process, like resource limits
+// or a cgroup membership, is inherited by every child of the command. If setup fails the command is never run.
+func ExecuteLiveWithSetupAndTimeout(setup func(pid int) error, timeout, gracePeriod time.Duration, onStdout, onStderr func(...interface{}), printOutputOnError bool, program string, args ...string) (err error) {
+	// The shell holds off running the program until a line is written to its stdin, which happens once setup finished.
+	const waitForSetupScript = `read -r _ && exec "$@"`
+
+	shellArgs := append([]string{"-c", waitForSetupScript, program, program}, args...)
+	cmd := exec.Command(ShellProgram, shellArgs...)
+	return executeLive(cmd, setup, nil, timeout, gracePeriod, onStdout, onStderr, printOutputOnError)
+}
+
+// executeLive runs a command, streaming its output to the provided callbacks in real-time.
+// If setup is set, the command must wait for a line on its stdin before running, which is written once setup succeeded.
+// The command is stopped if it times out or once cancel is closed.
+func executeLive(cmd *exec.Cmd, setup func(pid int) error, cancel <-chan struct{}, timeout, gracePeriod time.Duration, onStdout, onStderr func(...interface{}), printOutputOnError bool) (err error) {
+	var outputChan chan string
+	const outputChanBufferSize = 1500
 
 	stdoutPipe, err := cmd.StdoutPipe()
 	if err != nil {
@@ -154,6 +212,16 @@ func ExecuteLiveWithCallback(onStdout, onStderr func(...interface{}), printOutpu
 	}
 	defer stderrPipe.Close()
 
+	var stdinPipe io.WriteCloser
+	if setup != nil {
+		stdinPipe, err = cmd.StdinPipe()
+		if err != nil {
+			logger.Log.Error("ExecuteLive failed to start StdinPipe ", err)
+			return
+		}
+		defer stdinPipe.Close()
+	}
+
 	err = trackAndStartProcess(cmd)
 	if err != nil {
 		return
@@ -161,6 +229,20 @@ func ExecuteLiveWithCallback(onStdout, onStderr func(...interface{}), printOutpu
 
 	defer untrackProcess(cmd)
 
+	if setup != nil {
+		err = releaseAfterSetup(cmd, stdinPipe, setup)
+		if err != nil {
+			return
+		}
+	}
+
+	var stopReason int32
+	if timeout > 0 || cancel != nil {
+		exited := make(chan struct{})
+		defer close(exited)
+		go stopOnTimeoutOrCancel(cmd, timeout, gracePeriod, cancel, exited, &stopReason)
+	}
+
 	wg := new(sync.WaitGroup)
 	wg.Add(2)
 
@@ -172,6 +254,12 @@ func ExecuteLiveWithCallback(onStdout, onStderr func(...interface{}), printOutpu
 
 	wg.Wait()
 	err = cmd.Wait()
+	switch atomic.LoadInt32(&stopReason) {
+	case stoppedOnTimeout:
+		err = fmt.Errorf("%w after %s", ErrTimedOut, timeout)
+	case stoppedOnCancel:
+		err = ErrCancelled
+	}
 
 	// Optionally dump the output in the event of an error
 	if outputChan != nil {
@@ -225,6 +313,61 @@ func MustExecuteLive(command string, args ...string) {
 	}
 }
 
+// releaseAfterSetup calls setup for a started command, then lets the command's program run.
+// If setup fails the command is stopped and waited for.
+func releaseAfterSetup(cmd *exec.Cmd, stdinPipe io.WriteCloser, setup func(pid int) error) (err error) {
+	err = setup(cmd.Process.Pid)
+	if err == nil {
+		_, err = io.WriteString(stdinPipe, "\n")
+	}
+
+	// Closing stdin without writing a line makes the shell exit without running the program.
+	stdinPipe.Close()
+	if err != nil {
+		cmd.Wait()
+	}
+
+	return
+}
+
+// stopOnTimeoutOrCancel stops a command's process group if it has not exited before the timeout expires or cancel is closed.
+// The process group is sent SIGTERM, followed by SIGKILL once the grace period expires.
+// A timeout of 0 never expires, and a nil cancel channel is never closed.
+func stopOnTimeoutOrCancel(cmd *exec.Cmd, timeout, gracePeriod time.Duration, cancel, exited <-chan struct{}, stopReason *int32) {
+	var timedOut <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timedOut = timer.C
+	}
+
+	select {
+	case <-exited:
+		return
+	case <-timedOut:
+		logger.Log.Warnf("(%s) timed out after %s, stopping it", strings.Join(cmd.Args, " "), timeout)
+		atomic.StoreInt32(stopReason, stoppedOnTimeout)
+	case <-cancel:
+		logger.Log.Infof("(%s) was cancelled, stopping it", strings.Join(cmd.Args, " "))
+		atomic.StoreInt32(stopReason, stoppedOnCancel)
+	}
+
+	signals := []unix.Signal{unix.SIGTERM, unix.SIGKILL}
+	for _, signal := range signals {
+		// Issue the signal to the negative Pid, sending it to the process's process group.
+		err := unix.Kill(-cmd.Process.Pid, signal)
+		if err != nil {
+			logger.Log.Warnf("Unable to stop (%s): %v", cmd.Path, err)
+		}
+
+		select {
+		case <-exited:
+			return
+		case <-time.After(gracePeriod):
+		}
+	}
+}
+
 func trackAndStartProcess(cmd *exec.Cmd) (err error) {
 	logger.Log.Debugf("Executing: %v", cmd.Args)
 
@@ -0,0 +1,265 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+	"microsoft.com/pkggen/internal/logger"
+	"microsoft.com/pkggen/internal/rpm"
+	"microsoft.com/pkggen/scheduler/buildagents"
+)
+
+const (
+	cgroupRoot            = "/sys/fs/cgroup"
+	cgroupParentName      = "pkgworker"
+	cgroupCPUPeriodMicros = 100000
+)
+
+// buildLimiter enforces the resource limits of a single build on the rpmbuild processes building the package.
+// pkgworker itself, and any other command it runs, is not limited.
+type buildLimiter struct {
+	cgroupDir    string
+	cgroupProcs  *os.File
+	memoryRlimit *unix.Rlimit
+	deadline     time.Time
+}
+
+// enforceBuildLimits limits every rpmbuild process pkgworker starts to the given limits.
+// CPU and memory limits are enforced by placing the builds in a new cgroup if the host supports cgroup v2.
+// Otherwise memory is limited with an rlimit, which can not be told apart from other build failures,
+// and CPUs only limit the build's parallelism.
+// Once the time limit expires any running build is stopped, and no further builds are started.
+func enforceBuildLimits(name string, limits buildagents.BuildLimits, defines map[string]string) (limiter *buildLimiter, err error) {
+	limiter = &buildLimiter{}
+
+	if limits.CPUs != 0 {
+		// Keep the build's parallelism in line with the CPUs it may use.
+		defines[rpm.SMPMFlagsDefine] = fmt.Sprintf("-j%d", int(math.Ceil(limits.CPUs)))
+	}
+
+	if limits.CPUs != 0 || limits.MemoryMB != 0 {
+		if cgroupControllersAvailable() {
+			err = limiter.createCgroup(name, limits)
+		} else {
+			limiter.setMemoryRlimit(limits)
+		}
+
+		if err != nil {
+			return
+		}
+	}
+
+	if limits.TimeLimit != 0 {
+		limiter.deadline = time.Now().Add(limits.TimeLimit)
+	}
+
+	rpm.SetBuildLimiter(limiter)
+
+	return
+}
+
+// Setup places a build process under the limits before it starts running.
+// The process's children inherit both its cgroup and its rlimits.
+func (l *buildLimiter) Setup(pid int) (err error) {
+	if l.cgroupProcs != nil {
+		// The cgroup's procs file was opened before entering the chroot, which does not mount the cgroup filesystem.
+		_, err = l.cgroupProcs.WriteString(strconv.Itoa(pid))
+		if err != nil {
+			return
+		}
+	}
+
+	if l.memoryRlimit != nil {
+		err = setProcessRlimit(pid, unix.RLIMIT_AS, l.memoryRlimit)
+	}
+
+	return
+}
+
+// Timeout returns how much longer builds may run for before exceeding the time limit.
+func (l *buildLimiter) Timeout() (remaining time.Duration, limited bool) {
+	if l.deadline.IsZero() {
+		return
+	}
+
+	return time.Until(l.deadline), true
+}
+
+// release stops enforcing the limits and returns which limit the build exceeded, if any.
+func (l *buildLimiter) release() (exceededLimit string) {
+	rpm.SetBuildLimiter(nil)
+
+	if !l.deadline.IsZero() && time.Now().After(l.deadline) {
+		exceededLimit = buildagents.ExceededTimeLimit
+	}
+
+	if l.cgroupDir == "" {
+		return
+	}
+
+	if exceededLimit == "" && l.oomKilled() {
+		exceededLimit = buildagents.ExceededMemoryLimit
+	}
+
+	l.removeCgroup()
+
+	return
+}
+
+// createCgroup creates a leaf cgroup with the given limits for the builds to run in.
+// pkgworker never joins the cgroup itself, since cgroup v2 only allows processes in the leaves of a tree with controllers enabled.
+func (l *buildLimiter) createCgroup(name string, limits buildagents.BuildLimits) (err error) {
+	const enableControllers = "+cpu +memory"
+
+	// Controllers must be enabled in every ancestor of a cgroup for it to use them.
+	parentDir := filepath.Join(cgroupRoot, cgroupParentName)
+	err = writeCgroupFile(cgroupRoot, "cgroup.subtree_control", enableControllers)
+	if err != nil {
+		return
+	}
+
+	err = os.MkdirAll(parentDir, os.ModePerm)
+	if err != nil {
+		return
+	}
+
+	err = writeCgroupFile(parentDir, "cgroup.subtree_control", enableControllers)
+	if err != nil {
+		return
+	}
+
+	cgroupDir := filepath.Join(parentDir, fmt.Sprintf("%s-%d", name, os.Getpid()))
+	err = os.Mkdir(cgroupDir, os.ModePerm)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			os.Remove(cgroupDir)
+		}
+	}()
+
+	if limits.CPUs != 0 {
+		quota := int64(limits.CPUs * cgroupCPUPeriodMicros)
+		err = writeCgroupFile(cgroupDir, "cpu.max", fmt.Sprintf("%d %d", quota, cgroupCPUPeriodMicros))
+		if err != nil {
+			return
+		}
+	}
+
+	if limits.MemoryMB != 0 {
+		err = writeCgroupFile(cgroupDir, "memory.max", strconv.FormatUint(limits.MemoryMB*1024*1024, 10))
+		if err != nil {
+			return
+		}
+
+		// Swap accounting may be disabled, in which case the build can not swap anyway.
+		swapErr := writeCgroupFile(cgroupDir, "memory.swap.max", "0")
+		if swapErr != nil {
+			logger.Log.Debugf("Unable to disable swap for the build: %s", swapErr)
+		}
+	}
+
+	l.cgroupProcs, err = os.OpenFile(filepath.Join(cgroupDir, "cgroup.procs"), os.O_WRONLY, 0)
+	if err != nil {
+		return
+	}
+
+	logger.Log.Debugf("Enforcing build limits with cgroup (%s)", cgroupDir)
+	l.cgroupDir = cgroupDir
+
+	return
+}
+
+// removeCgroup removes the build's cgroup.
+func (l *buildLimiter) removeCgroup() {
+	l.cgroupProcs.Close()
+
+	// A cgroup can only be removed once every process in it has exited.
+	err := os.Remove(l.cgroupDir)
+	if err != nil {
+		logger.Log.Warnf("Unable to remove cgroup (%s): %s", l.cgroupDir, err)
+	}
+}
+
+// oomKilled returns true if any process in the build's cgroup was killed for exceeding the memory limit.
+func (l *buildLimiter) oomKilled() bool {
+	const oomKillEvent = "oom_kill"
+
+	events, err := ioutil.ReadFile(filepath.Join(l.cgroupDir, "memory.events"))
+	if err != nil {
+		logger.Log.Warnf("Unable to read memory events of cgroup (%s): %s", l.cgroupDir, err)
+		return false
+	}
+
+	for _, line := range strings.Split(string(events), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == oomKillEvent {
+			return fields[1] != "0"
+		}
+	}
+
+	return false
+}
+
+// cgroupControllersAvailable returns true if the host uses cgroup v2 and provides the cpu and memory controllers.
+func cgroupControllersAvailable() bool {
+	controllers, err := ioutil.ReadFile(filepath.Join(cgroupRoot, "cgroup.controllers"))
+	if err != nil {
+		return false
+	}
+
+	var foundCPU, foundMemory bool
+	for _, controller := range strings.Fields(string(controllers)) {
+		switch controller {
+		case "cpu":
+			foundCPU = true
+		case "memory":
+			foundMemory = true
+		}
+	}
+
+	return foundCPU && foundMemory
+}
+
+// setMemoryRlimit limits the virtual memory available to every build if cgroups are unavailable.
+func (l *buildLimiter) setMemoryRlimit(limits buildagents.BuildLimits) {
+	if limits.CPUs != 0 {
+		logger.Log.Warn("cgroup v2 is unavailable, the CPU limit only restricts the build's parallelism")
+	}
+
+	if limits.MemoryMB == 0 {
+		return
+	}
+
+	logger.Log.Warn("cgroup v2 is unavailable, limiting the build's virtual memory instead")
+	limit := limits.MemoryMB * 1024 * 1024
+	l.memoryRlimit = &unix.Rlimit{Cur: limit, Max: limit}
+}
+
+// setProcessRlimit sets a resource limit of another process.
+func setProcessRlimit(pid, resource int, rlimit *unix.Rlimit) (err error) {
+	_, _, errno := unix.RawSyscall6(unix.SYS_PRLIMIT64, uintptr(pid), uintptr(resource), uintptr(unsafe.Pointer(rlimit)), 0, 0, 0)
+	if errno != 0 {
+		err = errno
+	}
+
+	return
+}
+
+// writeCgroupFile writes a value to one of a cgroup's interface files.
+func writeCgroupFile(cgroupDir, name, value string) error {
+	return ioutil.WriteFile(filepath.Join(cgroupDir, name), []byte(value), 0)
+}
@@ -0,0 +1,441 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"microsoft.com/pkggen/internal/file"
+	"microsoft.com/pkggen/internal/jsonutils"
+	"microsoft.com/pkggen/internal/logger"
+	"microsoft.com/pkggen/internal/safechroot"
+)
+
+const (
+	dependencyLayerRootDir    = "rootfs"
+	dependencyLayerInfoFile   = "layer.json"
+	dependencyLayerSeenTag    = ".seen"
+	dependencyLayerLockSuffix = ".lock"
+	dependencyLayerTempPrefix = ".tmp-"
+	dependencyLayerKeyPrefix  = "deps-"
+)
+
+const (
+	// maxDependencyLayerDepth is the most layers a chroot is created with. Every layer adds a directory to the
+	// chroot's overlay mount options, which must fit in a single page.
+	maxDependencyLayerDepth = 8
+	// maxDependencyLayers is the most layers kept, the least recently used ones are evicted beyond it.
+	maxDependencyLayers = 32
+)
+
+// dependencyLayer describes a chroot layer holding an installed set of build dependencies.
+type dependencyLayer struct {
+	// Packages identify the build dependencies which were requested when the layer was saved, sorted.
+	// Each is the dependency's NEVRA followed by the SHA256 of its RPM.
+	Packages []string `json:"packages"`
+	// Parents are the keys of the layers the layer was saved on top of, topmost first.
+	Parents []string `json:"parents"`
+
+	key      string
+	lastUsed time.Time
+}
+
+// dependencyLayers caches chroot layers with build dependencies already installed, keyed on the set of
+// dependencies that were requested. A locally rebuilt dependency keeps its NEVRA, so dependencies are identified
+// by their contents as well. A build can start from the layer for its exact set of dependencies or the largest
+// layer whose dependencies are a subset of its own, only installing what is missing.
+//
+// To avoid saving a layer for every build, a layer is only saved the second time a set of dependencies is requested.
+// Builds hold a shared lock on every layer they use, layers are only evicted while no build uses them.
+type dependencyLayers struct {
+	dir      string
+	packages []string
+	key      string
+
+	// base is the layer the build started from, nil if it started from the pool's base.
+	base *dependencyLayer
+	// locks are held on base and its parents.
+	locks []*os.File
+}
+
+// newDependencyLayers finds the best layer in layersDir to install packages on top of.
+// - packages are the paths of the RPMs to install.
+func newDependencyLayers(layersDir string, packages []string) (d *dependencyLayers, err error) {
+	d = &dependencyLayers{
+		dir: layersDir,
+	}
+
+	d.packages, err = dependencyIDs(packages)
+	if err != nil {
+		return
+	}
+	d.key = dependencyLayerKey(d.packages)
+
+	if len(d.packages) == 0 {
+		return
+	}
+
+	layers, err := readDependencyLayers(layersDir)
+	if err != nil {
+		return
+	}
+
+	var candidates []*dependencyLayer
+	for _, layer := range layers {
+		if isSortedSubset(layer.Packages, d.packages) && len(layer.Parents) < maxDependencyLayerDepth {
+			candidates = append(candidates, layer)
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return len(candidates[i].Packages) > len(candidates[j].Packages)
+	})
+
+	// A candidate may be evicted before it is locked, fall back to the next best one.
+	for _, layer := range candidates {
+		if d.lockLayer(layer) {
+			d.base = layer
+			break
+		}
+	}
+
+	if d.base != nil {
+		logger.Log.Infof("Starting from dependency layer (%s) with %d of %d build dependencies installed", d.base.key, len(d.base.Packages), len(d.packages))
+
+		now := time.Now()
+		err = os.Chtimes(filepath.Join(layersDir, d.base.key), now, now)
+		if err != nil {
+			logger.Log.Warnf("Failed to record use of dependency layer (%s): %s", d.base.key, err)
+			err = nil
+		}
+	}
+
+	return
+}
+
+// Close releases the layers the build used, so they can be evicted.
+func (d *dependencyLayers) Close() {
+	for _, lock := range d.locks {
+		lock.Close()
+	}
+	d.locks = nil
+}
+
+// lockLayer takes a shared lock on a layer and its parents, so they are not evicted while the build uses them.
+// Returns false if any of them is being or has been evicted.
+func (d *dependencyLayers) lockLayer(layer *dependencyLayer) bool {
+	var locks []*os.File
+	for _, key := range append([]string{layer.key}, layer.Parents...) {
+		lock, err := lockDependencyLayer(filepath.Join(d.dir, key), unix.LOCK_SH)
+		if err != nil {
+			logger.Log.Debugf("Skipping dependency layer (%s): %s", layer.key, err)
+			for _, lock := range locks {
+				lock.Close()
+			}
+			return false
+		}
+		locks = append(locks, lock)
+	}
+
+	d.locks = append(d.locks, locks...)
+	return true
+}
+
+// Layers returns the layer directories the build's chroot should be created with, topmost first.
+func (d *dependencyLayers) Layers() (layers []string) {
+	if d.base == nil {
+		return
+	}
+
+	for _, key := range append([]string{d.base.key}, d.base.Parents...) {
+		layers = append(layers, filepath.Join(d.dir, key, dependencyLayerRootDir))
+	}
+
+	return
+}
+
+// Save saves the dependencies installed in chroot as a layer, if they are worth saving.
+// - excludedPaths are paths inside the chroot which are specific to the build and should not be saved.
+func (d *dependencyLayers) Save(chroot *safechroot.Chroot, excludedPaths ...string) (err error) {
+	if len(d.packages) == 0 || (d.base != nil && d.base.key == d.key) {
+		return
+	}
+
+	// Every layer adds to the chroot's overlay mount options, stop adding layers once the limit is reached.
+	if d.base != nil && len(d.base.Parents)+1 >= maxDependencyLayerDepth {
+		logger.Log.Debugf("Not saving dependency layer (%s), it would be deeper than %d layers", d.key, maxDependencyLayerDepth)
+		return
+	}
+
+	err = os.MkdirAll(d.dir, os.ModePerm)
+	if err != nil {
+		return
+	}
+
+	layerDir := filepath.Join(d.dir, d.key)
+	exists, err := file.DirExists(layerDir)
+	if err != nil || exists {
+		return
+	}
+
+	// Only save a layer once its set of dependencies has been requested before.
+	seenMarker := layerDir + dependencyLayerSeenTag
+	seen, err := file.PathExists(seenMarker)
+	if err != nil {
+		return
+	}
+	if !seen {
+		err = file.Create(seenMarker, 0644)
+		if os.IsExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	// Save into a temporary directory, then move it into place, so other builds never see a partial layer.
+	tempDir, err := ioutil.TempDir(d.dir, dependencyLayerTempPrefix)
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	err = chroot.SaveLayer(filepath.Join(tempDir, dependencyLayerRootDir), excludedPaths...)
+	if err != nil {
+		return
+	}
+
+	layer := &dependencyLayer{
+		Packages: d.packages,
+	}
+	if d.base != nil {
+		layer.Parents = append([]string{d.base.key}, d.base.Parents...)
+	}
+
+	err = jsonutils.WriteJSONFile(filepath.Join(tempDir, dependencyLayerInfoFile), layer)
+	if err != nil {
+		return
+	}
+
+	err = os.Rename(tempDir, layerDir)
+	if err != nil {
+		// Another build saved the same layer first.
+		exists, _ = file.DirExists(layerDir)
+		if exists {
+			err = nil
+		}
+		return
+	}
+
+	logger.Log.Infof("Saved dependency layer (%s) with %d build dependencies", d.key, len(d.packages))
+
+	err = evictDependencyLayers(d.dir, maxDependencyLayers)
+	return
+}
+
+// readDependencyLayers reads every layer in layersDir whose parents are all still present.
+func readDependencyLayers(layersDir string) (layers map[string]*dependencyLayer, err error) {
+	layers = make(map[string]*dependencyLayer)
+
+	infos, err := ioutil.ReadDir(layersDir)
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	for _, info := range infos {
+		if !info.IsDir() || !strings.HasPrefix(info.Name(), dependencyLayerKeyPrefix) {
+			continue
+		}
+
+		layer := &dependencyLayer{}
+		err = jsonutils.ReadJSONFile(filepath.Join(layersDir, info.Name(), dependencyLayerInfoFile), layer)
+		if err != nil {
+			logger.Log.Warnf("Ignoring unreadable dependency layer (%s): %s", info.Name(), err)
+			err = nil
+			continue
+		}
+		layer.key = info.Name()
+		layer.lastUsed = info.ModTime()
+
+		layers[layer.key] = layer
+	}
+
+	for key, layer := range layers {
+		for _, parent := range layer.Parents {
+			if layers[parent] == nil {
+				delete(layers, key)
+				break
+			}
+		}
+	}
+
+	return
+}
+
+// evictDependencyLayers removes the least recently used layers in layersDir until at most maxLayers are left.
+// Layers other layers were saved on top of, and layers in use by a build, are kept.
+func evictDependencyLayers(layersDir string, maxLayers int) (err error) {
+	layers, err := readDependencyLayers(layersDir)
+	if err != nil || len(layers) <= maxLayers {
+		return
+	}
+
+	// Evicting a layer may leave its parent as the least recently used leaf, so look for leaves after every eviction.
+	for len(layers) > maxLayers {
+		var evicted *dependencyLayer
+		evicted, err = evictLeastRecentlyUsedLeaf(layersDir, layers)
+		if err != nil || evicted == nil {
+			return
+		}
+
+		delete(layers, evicted.key)
+	}
+
+	return
+}
+
+// evictLeastRecentlyUsedLeaf removes the least recently used layer which no other layer was saved on top of
+// and no build uses. Returns a nil layer if every such layer is in use.
+func evictLeastRecentlyUsedLeaf(layersDir string, layers map[string]*dependencyLayer) (evicted *dependencyLayer, err error) {
+	isParent := make(map[string]bool)
+	for _, layer := range layers {
+		for _, parent := range layer.Parents {
+			isParent[parent] = true
+		}
+	}
+
+	var leaves []*dependencyLayer
+	for key, layer := range layers {
+		if !isParent[key] {
+			leaves = append(leaves, layer)
+		}
+	}
+
+	sort.Slice(leaves, func(i, j int) bool {
+		return leaves[i].lastUsed.Before(leaves[j].lastUsed)
+	})
+
+	for _, layer := range leaves {
+		layerDir := filepath.Join(layersDir, layer.key)
+		lock, lockErr := lockDependencyLayer(layerDir, unix.LOCK_EX)
+		if lockErr != nil {
+			logger.Log.Debugf("Not evicting dependency layer (%s): %s", layer.key, lockErr)
+			continue
+		}
+
+		logger.Log.Debugf("Evicting dependency layer (%s)", layer.key)
+		err = os.RemoveAll(layerDir)
+		if err == nil {
+			err = os.Remove(layerDir + dependencyLayerLockSuffix)
+		}
+		lock.Close()
+
+		evicted = layer
+		return
+	}
+
+	return
+}
+
+// lockDependencyLayer takes a non-blocking flock of the given type on a layer's lock file.
+// Evicting a layer removes its lock file, so the lock is only returned if it is still the layer's lock file
+// and the layer still exists.
+func lockDependencyLayer(layerDir string, how int) (lock *os.File, err error) {
+	lockPath := layerDir + dependencyLayerLockSuffix
+	lock, err = os.OpenFile(lockPath, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			lock.Close()
+			lock = nil
+		}
+	}()
+
+	err = unix.Flock(int(lock.Fd()), how|unix.LOCK_NB)
+	if err != nil {
+		return
+	}
+
+	lockInfo, err := lock.Stat()
+	if err != nil {
+		return
+	}
+
+	pathInfo, err := os.Stat(lockPath)
+	if err != nil {
+		return
+	}
+
+	if !os.SameFile(lockInfo, pathInfo) {
+		err = fmt.Errorf("layer was evicted")
+		return
+	}
+
+	exists, err := file.DirExists(layerDir)
+	if err == nil && !exists {
+		err = fmt.Errorf("layer was evicted")
+	}
+
+	return
+}
+
+// dependencyIDs returns the sorted, unique IDs of a list of RPMs to install, which are their NEVRAs
+// followed by the SHA256 of their contents.
+func dependencyIDs(packages []string) (ids []string, err error) {
+	unique := make(map[string]bool)
+	for _, pkg := range packages {
+		var hash string
+		hash, err = file.GenerateSHA256(pkg)
+		if err != nil {
+			return
+		}
+
+		nevra := filepath.Base(strings.TrimSuffix(pkg, ".rpm"))
+		unique[fmt.Sprintf("%s %s", nevra, hash)] = true
+	}
+
+	for id := range unique {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+	return
+}
+
+// dependencyLayerKey returns the key of the layer for a sorted set of dependency IDs.
+func dependencyLayerKey(ids []string) string {
+	hash := sha256.Sum256([]byte(strings.Join(ids, "\n")))
+	return fmt.Sprintf("%s%x", dependencyLayerKeyPrefix, hash)
+}
+
+// isSortedSubset checks if every entry of the sorted slice subset is in the sorted slice set.
+func isSortedSubset(subset, set []string) bool {
+	i := 0
+	for _, entry := range subset {
+		for i < len(set) && set[i] < entry {
+			i++
+		}
+
+		if i == len(set) || set[i] != entry {
+			return false
+		}
+		i++
+	}
+
+	return true
+}
@@ -0,0 +1,106 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+	"microsoft.com/pkggen/internal/jsonutils"
+	"microsoft.com/pkggen/internal/logger"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitStderrLog()
+	os.Exit(m.Run())
+}
+
+// writeTestLayer writes a layer to layersDir as if it was last used at lastUsed.
+func writeTestLayer(t *testing.T, layersDir, key string, lastUsed time.Time, packages []string, parents ...string) {
+	layerDir := filepath.Join(layersDir, key)
+	assert.NoError(t, os.MkdirAll(filepath.Join(layerDir, dependencyLayerRootDir), os.ModePerm))
+	assert.NoError(t, jsonutils.WriteJSONFile(filepath.Join(layerDir, dependencyLayerInfoFile), &dependencyLayer{
+		Packages: packages,
+		Parents:  parents,
+	}))
+	assert.NoError(t, os.Chtimes(layerDir, lastUsed, lastUsed))
+}
+
+func TestDependencyLayerKeyShouldChangeWithContents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dependencylayers")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	rpm := filepath.Join(dir, "A-1.0-1.x86_64.rpm")
+	assert.NoError(t, ioutil.WriteFile(rpm, []byte("original"), 0644))
+
+	ids, err := dependencyIDs([]string{rpm, rpm})
+	assert.NoError(t, err)
+	assert.Len(t, ids, 1)
+
+	assert.NoError(t, ioutil.WriteFile(rpm, []byte("rebuilt"), 0644))
+	rebuiltIDs, err := dependencyIDs([]string{rpm})
+	assert.NoError(t, err)
+
+	assert.NotEqual(t, dependencyLayerKey(ids), dependencyLayerKey(rebuiltIDs))
+}
+
+func TestNewDependencyLayersShouldSkipLayersTooDeep(t *testing.T) {
+	layersDir, err := ioutil.TempDir("", "dependencylayers")
+	assert.NoError(t, err)
+	defer os.RemoveAll(layersDir)
+
+	rpm := filepath.Join(layersDir, "A-1.0-1.x86_64.rpm")
+	assert.NoError(t, ioutil.WriteFile(rpm, []byte("A"), 0644))
+	ids, err := dependencyIDs([]string{rpm})
+	assert.NoError(t, err)
+
+	var parents []string
+	for i := 0; i < maxDependencyLayerDepth; i++ {
+		key := dependencyLayerKeyPrefix + string(rune('a'+i))
+		writeTestLayer(t, layersDir, key, time.Now(), nil, parents...)
+		parents = append([]string{key}, parents...)
+	}
+	writeTestLayer(t, layersDir, dependencyLayerKeyPrefix+"deep", time.Now(), ids, parents...)
+
+	d, err := newDependencyLayers(layersDir, []string{rpm})
+	assert.NoError(t, err)
+	defer d.Close()
+
+	assert.NotNil(t, d.base)
+	assert.NotEqual(t, dependencyLayerKeyPrefix+"deep", d.base.key)
+	assert.True(t, len(d.Layers()) <= maxDependencyLayerDepth)
+}
+
+func TestEvictDependencyLayersShouldRemoveLeastRecentlyUsedLeaves(t *testing.T) {
+	layersDir, err := ioutil.TempDir("", "dependencylayers")
+	assert.NoError(t, err)
+	defer os.RemoveAll(layersDir)
+
+	now := time.Now()
+	writeTestLayer(t, layersDir, "deps-parent", now.Add(-4*time.Hour), nil)
+	writeTestLayer(t, layersDir, "deps-oldest", now.Add(-3*time.Hour), nil, "deps-parent")
+	writeTestLayer(t, layersDir, "deps-inuse", now.Add(-2*time.Hour), nil)
+	writeTestLayer(t, layersDir, "deps-newest", now.Add(-1*time.Hour), nil)
+
+	inUse, err := lockDependencyLayer(filepath.Join(layersDir, "deps-inuse"), unix.LOCK_SH)
+	assert.NoError(t, err)
+	defer inUse.Close()
+
+	assert.NoError(t, evictDependencyLayers(layersDir, 2))
+
+	layers, err := readDependencyLayers(layersDir)
+	assert.NoError(t, err)
+
+	var keys []string
+	for key := range layers {
+		keys = append(keys, key)
+	}
+	assert.ElementsMatch(t, []string{"deps-inuse", "deps-newest"}, keys)
+}
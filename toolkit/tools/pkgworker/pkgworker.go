@@ -17,26 +17,35 @@ import (
 	"microsoft.com/pkggen/internal/exe"
 	"microsoft.com/pkggen/internal/file"
 	"microsoft.com/pkggen/internal/logger"
+	"microsoft.com/pkggen/internal/metrics"
 	"microsoft.com/pkggen/internal/packagerepo/repomanager/rpmrepomanager"
 	"microsoft.com/pkggen/internal/rpm"
 	"microsoft.com/pkggen/internal/safechroot"
 	"microsoft.com/pkggen/internal/shell"
 	"microsoft.com/pkggen/internal/sliceutils"
+	"microsoft.com/pkggen/scheduler/buildagents"
 )
 
 const (
 	chrootRpmBuildRoot      = "/usr/src/mariner"
 	chrootLocalRpmsDir      = "/localrpms"
 	chrootLocalRpmsCacheDir = "/upstream-cached-rpms"
+	chrootTdnfCacheDir      = "/var/cache/tdnf"
+	resolvFilePath          = "/etc/resolv.conf"
 )
 
 var (
 	app                  = kingpin.New("pkgworker", "A worker for building packages locally")
 	srpmFile             = exe.InputFlag(app, "Full path to the SRPM to build")
-	workDir              = app.Flag("work-dir", "The directory to create the build folder").Required().String()
-	workerTar            = app.Flag("worker-tar", "Full path to worker_chroot.tar.gz").Required().ExistingFile()
+	workDir              = app.Flag("work-dir", "The directory to create the build folder. Required unless --no-chroot is set").String()
+	workerTar            = app.Flag("worker-tar", "Full path to worker_chroot.tar.gz. Required unless --no-chroot is set").ExistingFile()
+	workerTarHash        = app.Flag("worker-tar-hash", "Optional SHA256 of --worker-tar, used to identify the chroot pool's base without hashing the tar for every build").String()
+	chrootPoolDir        = app.Flag("chroot-pool-dir", "Optional directory of reusable chroots to lease the build chroot from, instead of extracting --worker-tar into a new chroot under --work-dir").String()
+	cacheDependencies    = app.Flag("cache-dependencies", "Cache installed build dependencies as layers in the chroot pool, so builds requesting the same dependencies do not reinstall them. Requires --chroot-pool-dir").Bool()
+	noChroot             = app.Flag("no-chroot", "Build directly in the current root filesystem instead of a new chroot. Only use inside a disposable build environment, such as a container").Bool()
 	repoFile             = app.Flag("repo-file", "Full path to local.repo").Required().ExistingFile()
 	rpmsDirPath          = app.Flag("rpm-dir", "The directory to use as the local repo and to submit RPM packages to").Required().ExistingDir()
+	debugRpmsDirPath     = app.Flag("debug-rpm-dir", "Optional directory to submit debuginfo and debugsource RPM packages to instead of --rpm-dir. They are not reported as built RPMs").String()
 	srpmsDirPath         = app.Flag("srpm-dir", "The output directory for source RPM packages").Required().String()
 	cacheDir             = app.Flag("cache-dir", "The cache directory containing downloaded dependency RPMS from CBL-Mariner Base").Required().ExistingDir()
 	noCleanup            = app.Flag("no-cleanup", "Whether or not to delete the chroot folder after the build is done").Bool()
@@ -45,10 +54,16 @@ var (
 	distroBuildNumber    = app.Flag("distro-build-number", "The distro build number that the SRPM will be built with").Required().String()
 	rpmmacrosFile        = app.Flag("rpmmacros-file", "Optional file path to an rpmmacros file for rpmbuild to use").ExistingFile()
 	runCheck             = app.Flag("run-check", "Run the check during package build").Bool()
+	bcond                = app.Flag("with", "Optional spec build conditional to enable, like rpmbuild's --with option. Used to build bootstrap stages, which skip the check").String()
+	allowCheckFailure    = app.Flag("allow-check-failure", "Do not fail the build if the package's check fails. Requires --run-check").Bool()
 	packagesToInstall    = app.Flag("install-package", "Filepaths to RPM packages that should be installed before building.").Strings()
+	maxCPUs              = app.Flag("max-cpus", "Maximum number of CPUs the build may use, fractions are allowed").Float64()
+	maxMemoryMB          = app.Flag("max-memory-mb", fmt.Sprintf("Maximum memory in MiB the build may use. pkgworker exits with %d if the build exceeds it", buildagents.MemoryLimitExitCode)).Uint64()
+	maxBuildTime         = app.Flag("max-build-time", fmt.Sprintf("Maximum time the build may take. pkgworker exits with %d if the build exceeds it", buildagents.TimeLimitExitCode)).Duration()
 
-	logFile  = exe.LogFileFlag(app)
-	logLevel = exe.LogLevelFlag(app)
+	logFile     = exe.LogFileFlag(app)
+	logLevel    = exe.LogLevelFlag(app)
+	metricsFile = exe.MetricsFileFlag(app)
 )
 
 var (
@@ -65,21 +80,73 @@ func main() {
 	kingpin.MustParse(app.Parse(os.Args[1:]))
 	logger.InitBestEffort(*logFile, *logLevel)
 
+	metricsExporter, err := metrics.StartExporter(*metricsFile, "")
+	if err != nil {
+		logger.Log.Fatalf("Unable to export metrics, error: %s", err)
+	}
+	defer metricsExporter.Close()
+
+	if !*noChroot && (*workDir == "" || *workerTar == "") {
+		logger.Log.Fatal("--work-dir and --worker-tar are required unless --no-chroot is set")
+	}
+
+	if *cacheDependencies && *chrootPoolDir == "" {
+		logger.Log.Fatal("--cache-dependencies requires --chroot-pool-dir")
+	}
+
+	if *allowCheckFailure && !*runCheck {
+		logger.Log.Fatal("--allow-check-failure requires --run-check")
+	}
+
 	rpmsDirAbsPath, err := filepath.Abs(*rpmsDirPath)
 	logger.PanicOnError(err, "Unable to find absolute path for RPMs directory '%s'", *rpmsDirPath)
 
 	srpmsDirAbsPath, err := filepath.Abs(*srpmsDirPath)
 	logger.PanicOnError(err, "Unable to find absolute path for SRPMs directory '%s'", *srpmsDirPath)
 
+	var debugRpmsDirAbsPath string
+	if *debugRpmsDirPath != "" {
+		debugRpmsDirAbsPath, err = filepath.Abs(*debugRpmsDirPath)
+		logger.PanicOnError(err, "Unable to find absolute path for debug RPMs directory '%s'", *debugRpmsDirPath)
+	}
+
 	srpmName := strings.TrimSuffix(filepath.Base(*srpmFile), ".src.rpm")
 	chrootDir := filepath.Join(*workDir, srpmName)
 
-	defines := rpm.DefaultDefines(*runCheck)
+	// A bootstrap stage is built without some of its usual dependencies, leave the check to the package's final build.
+	checkEnabled := *runCheck
+	if *bcond != "" && checkEnabled {
+		logger.Log.Infof("Skipping the check of (%s) since it is built with (%s)", filepath.Base(*srpmFile), *bcond)
+		checkEnabled = false
+	}
+
+	defines := rpm.DefaultDefines(checkEnabled)
 	defines[rpm.DistTagDefine] = *distTag
 	defines[rpm.DistroReleaseVersionDefine] = *distroReleaseVersion
 	defines[rpm.DistroBuildNumberDefine] = *distroBuildNumber
+	if *bcond != "" {
+		rpm.EnableBcond(defines, *bcond)
+	}
 
-	builtRPMs, err := buildSRPMInChroot(chrootDir, rpmsDirAbsPath, *workerTar, *srpmFile, *repoFile, *rpmmacrosFile, defines, *noCleanup, *runCheck, *packagesToInstall)
+	limits := buildagents.BuildLimits{
+		CPUs:      *maxCPUs,
+		MemoryMB:  *maxMemoryMB,
+		TimeLimit: *maxBuildTime,
+	}
+	limiter, err := enforceBuildLimits(srpmName, limits, defines)
+	logger.PanicOnError(err, "Failed to apply build limits %+v.", limits)
+
+	var builtRPMs []string
+	if *noChroot {
+		builtRPMs, err = buildSRPMInCurrentRoot(rpmsDirAbsPath, debugRpmsDirAbsPath, *srpmFile, *repoFile, *rpmmacrosFile, defines, checkEnabled, *allowCheckFailure, *packagesToInstall)
+	} else {
+		builtRPMs, err = buildSRPMInChroot(chrootDir, *chrootPoolDir, rpmsDirAbsPath, debugRpmsDirAbsPath, *workerTar, *workerTarHash, *srpmFile, *repoFile, *rpmmacrosFile, defines, *noCleanup, checkEnabled, *allowCheckFailure, *cacheDependencies, *packagesToInstall)
+	}
+
+	exceededLimit := limiter.release()
+	if err != nil && exceededLimit != "" {
+		exitWithExceededLimit(exceededLimit, metricsExporter)
+	}
 	logger.PanicOnError(err, "Failed to build SRPM '%s'. For details see log file: %s .", *srpmFile, *logFile)
 
 	err = copySRPMToOutput(*srpmFile, srpmsDirAbsPath)
@@ -90,6 +157,24 @@ func main() {
 	fmt.Printf(strings.Join(builtRPMs, ","))
 }
 
+// exitWithExceededLimit exits with the code build agents expect for a build which exceeded the given limit.
+// Deferred calls do not run on os.Exit, so the metrics exporter is closed first.
+func exitWithExceededLimit(exceededLimit string, metricsExporter *metrics.Exporter) {
+	logger.Log.Errorf("Failed to build SRPM '%s', the build exceeded its %s limit. For details see log file: %s .", *srpmFile, exceededLimit, *logFile)
+
+	err := metricsExporter.Close()
+	if err != nil {
+		logger.Log.Warnf("Failed to export metrics, error: %s", err)
+	}
+
+	switch exceededLimit {
+	case buildagents.ExceededMemoryLimit:
+		os.Exit(buildagents.MemoryLimitExitCode)
+	case buildagents.ExceededTimeLimit:
+		os.Exit(buildagents.TimeLimitExitCode)
+	}
+}
+
 func copySRPMToOutput(srpmFilePath, srpmOutputDirPath string) (err error) {
 	const srpmsDirName = "SRPMS"
 
@@ -101,7 +186,7 @@ func copySRPMToOutput(srpmFilePath, srpmOutputDirPath string) (err error) {
 	return
 }
 
-func buildSRPMInChroot(chrootDir, rpmDirPath, workerTar, srpmFile, repoFile, rpmmacrosFile string, defines map[string]string, noCleanup, runCheck bool, packagesToInstall []string) (builtRPMs []string, err error) {
+func buildSRPMInChroot(chrootDir, chrootPoolDir, rpmDirPath, debugRPMDirPath, workerTar, workerTarHash, srpmFile, repoFile, rpmmacrosFile string, defines map[string]string, noCleanup, runCheck, allowCheckFailure, cacheDependencies bool, packagesToInstall []string) (builtRPMs []string, err error) {
 	const (
 		buildHeartbeatTimeout = 30 * time.Minute
 
@@ -136,12 +221,60 @@ func buildSRPMInChroot(chrootDir, rpmDirPath, workerTar, srpmFile, repoFile, rpm
 	}()
 
 	// Create the chroot used to build the SRPM
-	chroot := safechroot.NewChroot(chrootDir, existingChrootDir)
+	var (
+		chroot    *safechroot.Chroot
+		depLayers *dependencyLayers
+	)
+	if chrootPoolDir != "" {
+		var pool *safechroot.ChrootPool
+		pool, err = safechroot.OpenChrootPool(chrootPoolDir, workerTar, workerTarHash)
+		if err != nil {
+			return
+		}
+		defer pool.Close()
+
+		var layers []string
+		if cacheDependencies {
+			depLayers, err = newDependencyLayers(pool.LayersDir(), packagesToInstall)
+			if err != nil {
+				return
+			}
+			defer depLayers.Close()
+			layers = depLayers.Layers()
+		}
+
+		chroot, err = pool.NewChroot(layers...)
+		if err != nil {
+			return
+		}
+
+		// The pool already provides the contents of the worker tar.
+		workerTar = ""
+	} else {
+		chroot = safechroot.NewChroot(chrootDir, existingChrootDir)
+	}
+
+	// A pooled chroot's root is already an overlay, so the local RPMs overlay must keep its upper layer outside of it.
+	overlayDir := chroot.RootDir()
+	if chroot.ScratchDir() != "" {
+		overlayDir = chroot.ScratchDir()
+	}
+
+	overlayMount, overlayExtraDirs := safechroot.NewOverlayMountPoint(overlayDir, overlaySource, chrootLocalRpmsDir, rpmDirPath, chrootLocalRpmsDir, overlayWorkDir)
+	extraDirs := []string{chrootLocalRpmsCacheDir}
+	if overlayDir == chroot.RootDir() {
+		extraDirs = append(overlayExtraDirs, extraDirs...)
+	} else {
+		for _, dir := range overlayExtraDirs {
+			err = os.MkdirAll(filepath.Join(overlayDir, dir), os.ModePerm)
+			if err != nil {
+				return
+			}
+		}
+	}
 
-	overlayMount, overlayExtraDirs := safechroot.NewOverlayMountPoint(chroot.RootDir(), overlaySource, chrootLocalRpmsDir, rpmDirPath, chrootLocalRpmsDir, overlayWorkDir)
 	rpmCacheMount := safechroot.NewMountPoint(*cacheDir, chrootLocalRpmsCacheDir, "", safechroot.BindMountPointFlags, "")
 	mountPoints := []*safechroot.MountPoint{overlayMount, rpmCacheMount}
-	extraDirs := append(overlayExtraDirs, chrootLocalRpmsCacheDir)
 
 	err = chroot.Initialize(workerTar, extraDirs, mountPoints)
 	if err != nil {
@@ -156,31 +289,80 @@ func buildSRPMInChroot(chrootDir, rpmDirPath, workerTar, srpmFile, repoFile, rpm
 	}
 
 	err = chroot.Run(func() (err error) {
-		return buildRPMFromSRPMInChroot(srpmFileInChroot, runCheck, defines, packagesToInstall)
+		return installBuildDependencies(packagesToInstall)
+	})
+	if err != nil {
+		return
+	}
+
+	if depLayers != nil {
+		// Only the installed dependencies are worth saving, not the files placed in the chroot for this build
+		// or the package manager's cache, which would hide packages added to the local repository later.
+		saveErr := depLayers.Save(chroot, srpmFileInChroot, resolvFilePath, chrootTdnfCacheDir)
+		if saveErr != nil {
+			logger.Log.Warnf("Failed to save dependency layer: %s", saveErr)
+		}
+	}
+
+	err = chroot.Run(func() (err error) {
+		return buildRPMFromSRPMInChroot(srpmFileInChroot, runCheck, allowCheckFailure, defines)
 	})
 	if err != nil {
 		return
 	}
 
 	rpmBuildOutputDir := filepath.Join(chroot.RootDir(), chrootRpmBuildRoot, rpmDirName)
-	builtRPMs, err = moveBuiltRPMs(rpmBuildOutputDir, rpmDirPath)
+	builtRPMs, err = moveBuiltRPMs(rpmBuildOutputDir, rpmDirPath, debugRPMDirPath)
 
 	return
 }
 
-func buildRPMFromSRPMInChroot(srpmFile string, runCheck bool, defines map[string]string, packagesToInstall []string) (err error) {
-	// Convert /localrpms into a repository that a package manager can use.
-	err = rpmrepomanager.CreateRepo(chrootLocalRpmsDir)
+// buildSRPMInCurrentRoot builds an SRPM directly in the current root filesystem.
+// The environment is expected to already provide the local RPM repository at chrootLocalRpmsDir
+// and the upstream RPM cache at chrootLocalRpmsCacheDir, as a chroot build would.
+func buildSRPMInCurrentRoot(rpmDirPath, debugRPMDirPath, srpmFile, repoFile, rpmmacrosFile string, defines map[string]string, runCheck, allowCheckFailure bool, packagesToInstall []string) (builtRPMs []string, err error) {
+	const rpmDirName = "RPMS"
+
+	logger.Log.Infof("Building (%s) without a chroot.", filepath.Base(srpmFile))
+
+	// Place the same files a chroot build would need into the current root.
+	filesToCopy, srpmFileInRoot := buildFilesToCopy(srpmFile, repoFile, rpmmacrosFile)
+	for _, f := range filesToCopy {
+		logger.Log.Debugf("Copying '%s' to '%s'", f.Src, f.Dest)
+		err = file.Copy(f.Src, f.Dest)
+		if err != nil {
+			return
+		}
+	}
+
+	err = installBuildDependencies(packagesToInstall)
+	if err != nil {
+		return
+	}
+
+	err = buildRPMFromSRPMInChroot(srpmFileInRoot, runCheck, allowCheckFailure, defines)
 	if err != nil {
 		return
 	}
 
-	// install any additional packages, such as build dependencies.
-	err = tdnfInstall(packagesToInstall)
+	rpmBuildOutputDir := filepath.Join(chrootRpmBuildRoot, rpmDirName)
+	builtRPMs, err = moveBuiltRPMs(rpmBuildOutputDir, rpmDirPath, debugRPMDirPath)
+
+	return
+}
+
+// installBuildDependencies installs any additional packages, such as build dependencies, from the local repository.
+func installBuildDependencies(packagesToInstall []string) (err error) {
+	// Convert /localrpms into a repository that a package manager can use.
+	err = rpmrepomanager.CreateRepo(chrootLocalRpmsDir)
 	if err != nil {
 		return
 	}
 
+	return tdnfInstall(packagesToInstall)
+}
+
+func buildRPMFromSRPMInChroot(srpmFile string, runCheck, allowCheckFailure bool, defines map[string]string) (err error) {
 	// Remove all libarchive files on the system before issuing a build.
 	// If the build environment has libtool archive files present, gnu configure
 	// could detect it and create more libtool archive files which can cause
@@ -192,7 +374,7 @@ func buildRPMFromSRPMInChroot(srpmFile string, runCheck bool, defines map[string
 
 	// Build the SRPM
 	if runCheck {
-		err = rpm.BuildRPMFromSRPM(srpmFile, defines)
+		err = buildRPMAndRunCheck(srpmFile, allowCheckFailure, defines)
 	} else {
 		err = rpm.BuildRPMFromSRPM(srpmFile, defines, "--nocheck")
 	}
@@ -200,7 +382,62 @@ func buildRPMFromSRPMInChroot(srpmFile string, runCheck bool, defines map[string
 	return
 }
 
-func moveBuiltRPMs(rpmOutDir, dstDir string) (builtRPMs []string, err error) {
+// buildRPMAndRunCheck builds an SRPM without its check, then runs the check as a separate phase,
+// so its outcome and duration are reported in the build log independently of packaging.
+// A failed check fails the build unless allowCheckFailure is set.
+func buildRPMAndRunCheck(srpmFile string, allowCheckFailure bool, defines map[string]string) (err error) {
+	const specsDirName = "SPECS"
+
+	specFileName, err := rpm.QuerySRPMSpecFile(srpmFile)
+	if err != nil {
+		return
+	}
+
+	err = rpm.InstallRPM(srpmFile)
+	if err != nil {
+		return
+	}
+
+	specFile := filepath.Join(chrootRpmBuildRoot, specsDirName, specFileName)
+	err = rpm.BuildRPMFromSPEC(specFile, defines, "--nocheck")
+	if err != nil {
+		return
+	}
+
+	logger.Log.Infof("Running the check of (%s)", filepath.Base(srpmFile))
+
+	result := &buildagents.CheckResult{
+		NonFatal: allowCheckFailure,
+	}
+
+	startTime := time.Now()
+	checkErr := rpm.RunSPECCheck(specFile, defines)
+	result.Seconds = time.Since(startTime).Seconds()
+	result.Passed = checkErr == nil
+	if checkErr != nil {
+		result.Err = checkErr.Error()
+	}
+
+	logErr := buildagents.LogCheckResult(result)
+	if logErr != nil {
+		logger.Log.Warnf("Failed to report the check result of (%s): %s", filepath.Base(srpmFile), logErr)
+	}
+
+	if checkErr != nil {
+		if !allowCheckFailure {
+			err = fmt.Errorf("check failed: %w", checkErr)
+			return
+		}
+
+		logger.Log.Warnf("The check of (%s) failed, but check failures are allowed for it: %s", filepath.Base(srpmFile), checkErr)
+	}
+
+	return
+}
+
+// moveBuiltRPMs moves every RPM built into dstDir, returning their new paths.
+// If debugDstDir is set, debuginfo and debugsource RPMs are moved there instead.
+func moveBuiltRPMs(rpmOutDir, dstDir, debugDstDir string) (builtRPMs []string, err error) {
 	const rpmExtension = ".rpm"
 	err = filepath.Walk(rpmOutDir, func(path string, info os.FileInfo, fileErr error) (err error) {
 		if fileErr != nil {
@@ -224,6 +461,18 @@ func moveBuiltRPMs(rpmOutDir, dstDir string) (builtRPMs []string, err error) {
 			return
 		}
 
+		if debugDstDir != "" && rpm.IsDebugRPMFile(path) {
+			debugDstFile := filepath.Join(debugDstDir, relPath)
+			logger.Log.Debugf("Moving debug RPM (%s) to (%s)", filepath.Base(path), debugDstFile)
+			err = file.Move(path, debugDstFile)
+			if err != nil {
+				return
+			}
+
+			builtRPMs = append(builtRPMs, debugDstFile)
+			return
+		}
+
 		dstFile := filepath.Join(dstDir, relPath)
 		err = file.Move(path, dstFile)
 		if err != nil {
@@ -345,17 +594,34 @@ func removeLibArchivesFromSystem() (err error) {
 
 // copyFilesIntoChroot copies several required build specific files into the chroot.
 func copyFilesIntoChroot(chroot *safechroot.Chroot, srpmFile, repoFile, rpmmacrosFile string, runCheck bool) (srpmFileInChroot string, err error) {
+	filesToCopy, srpmFileInChroot := buildFilesToCopy(srpmFile, repoFile, rpmmacrosFile)
+
+	if runCheck {
+		logger.Log.Debug("Enabling network access because we're running package tests.")
+
+		resolvFileCopy := safechroot.FileToCopy{
+			Src:  resolvFilePath,
+			Dest: resolvFilePath,
+		}
+		filesToCopy = append(filesToCopy, resolvFileCopy)
+	}
+
+	err = chroot.AddFiles(filesToCopy...)
+	return
+}
+
+// buildFilesToCopy returns the build specific files which must be placed in the build root, and where the SRPM will be placed.
+func buildFilesToCopy(srpmFile, repoFile, rpmmacrosFile string) (filesToCopy []safechroot.FileToCopy, srpmFileInChroot string) {
 	const (
 		chrootRepoDestDir = "/etc/yum.repos.d"
 		chrootSrpmDestDir = "/root/SRPMS"
-		resolvFilePath    = "/etc/resolv.conf"
 		rpmmacrosDest     = "/usr/lib/rpm/macros.d/macros.override"
 	)
 
 	repoFileInChroot := filepath.Join(chrootRepoDestDir, filepath.Base(repoFile))
 	srpmFileInChroot = filepath.Join(chrootSrpmDestDir, filepath.Base(srpmFile))
 
-	filesToCopy := []safechroot.FileToCopy{
+	filesToCopy = []safechroot.FileToCopy{
 		safechroot.FileToCopy{
 			Src:  repoFile,
 			Dest: repoFileInChroot,
@@ -374,16 +640,5 @@ func copyFilesIntoChroot(chroot *safechroot.Chroot, srpmFile, repoFile, rpmmacro
 		filesToCopy = append(filesToCopy, rpmmacrosCopy)
 	}
 
-	if runCheck {
-		logger.Log.Debug("Enabling network access because we're running package tests.")
-
-		resolvFileCopy := safechroot.FileToCopy{
-			Src:  resolvFilePath,
-			Dest: resolvFilePath,
-		}
-		filesToCopy = append(filesToCopy, resolvFileCopy)
-	}
-
-	err = chroot.AddFiles(filesToCopy...)
 	return
 }
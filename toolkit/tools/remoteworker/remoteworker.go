@@ -0,0 +1,574 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+// A daemon which builds packages on behalf of a remote scheduler
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+	"microsoft.com/pkggen/internal/exe"
+	"microsoft.com/pkggen/internal/file"
+	"microsoft.com/pkggen/internal/logger"
+	"microsoft.com/pkggen/internal/shell"
+	"microsoft.com/pkggen/scheduler/buildagents"
+)
+
+const (
+	defaultListenAddress = "127.0.0.1:7341"
+	defaultMaxBuilds     = "1"
+)
+
+var (
+	app = kingpin.New("remoteworker", "A daemon which builds packages on behalf of a scheduler using the remote-agent. It has no authentication, only listen on trusted networks.")
+
+	listenAddress = app.Flag("listen", "Address to listen for requests on.").Default(defaultListenAddress).String()
+	maxBuilds     = app.Flag("max-builds", "Maximum number of packages to build at once.").Default(defaultMaxBuilds).Int()
+
+	buildAgentProgram = app.Flag("build-agent-program", "Path to pkgworker, used to build packages.").Required().ExistingFile()
+	workDir           = app.Flag("work-dir", "The directory to create build chroots in.").Required().ExistingDir()
+	workerTar         = app.Flag("worker-tar", "Full path to worker_chroot.tar.gz.").Required().ExistingFile()
+	chrootPoolDir     = app.Flag("chroot-pool-dir", "Optional directory of reusable chroots to build in, instead of extracting the worker tar for every build.").String()
+	cacheDependencies = app.Flag("cache-dependencies", "Cache installed build dependencies as layers in the chroot pool. Requires --chroot-pool-dir.").Bool()
+	repoFile          = app.Flag("repo-file", "Full path to local.repo.").Required().ExistingFile()
+	rpmDir            = app.Flag("rpm-dir", "The directory to use as the local repo. Uploaded dependencies and built RPMs are stored here.").Required().ExistingDir()
+	debugRpmDir       = app.Flag("debug-rpm-dir", "Optional directory to store built debuginfo and debugsource RPMs in, for schedulers which keep them apart from the other RPMs.").ExistingDir()
+	cacheDir          = app.Flag("cache-dir", "The directory to store uploaded upstream RPMs in.").Required().ExistingDir()
+	inputDir          = app.Flag("input-dir", "The directory to store uploaded SRPMs and other build inputs in.").Required().ExistingDir()
+	srpmDir           = app.Flag("srpm-dir", "The output directory for source RPM packages.").Required().ExistingDir()
+	buildLogsDir      = app.Flag("build-logs-dir", "Directory to store package build logs.").Required().ExistingDir()
+
+	logFile  = exe.LogFileFlag(app)
+	logLevel = exe.LogLevelFlag(app)
+)
+
+// remoteWorker serves build requests from a remote-agent.
+type remoteWorker struct {
+	config    buildagents.BuildAgentConfig
+	areas     map[string]string
+	buildSlot chan bool
+	newAgent  func() buildagents.BuildAgent
+
+	statusMutex  sync.Mutex
+	activeBuilds int
+}
+
+func main() {
+	app.Version(exe.ToolkitVersion)
+	kingpin.MustParse(app.Parse(os.Args[1:]))
+	logger.InitBestEffort(*logFile, *logLevel)
+
+	if *maxBuilds <= 0 {
+		logger.Log.Fatalf("Value in --max-builds must be greater than zero. Found %d", *maxBuilds)
+	}
+
+	worker, err := newRemoteWorker()
+	if err != nil {
+		logger.Log.Fatalf("Unable to start remote worker, error: %s", err)
+	}
+
+	logger.Log.Infof("Listening for build requests on (%s), building up to %d packages at once", *listenAddress, *maxBuilds)
+	err = http.ListenAndServe(*listenAddress, worker.handler())
+	logger.Log.Fatalf("Remote worker stopped, error: %s", err)
+}
+
+// newRemoteWorker creates a remoteWorker from the command line flags.
+func newRemoteWorker() (worker *remoteWorker, err error) {
+	worker = &remoteWorker{
+		config: buildagents.BuildAgentConfig{
+			Program:   *buildAgentProgram,
+			WorkDir:   *workDir,
+			WorkerTar: *workerTar,
+			RepoFile:  *repoFile,
+			SrpmDir:   *srpmDir,
+			LogDir:    *buildLogsDir,
+			LogLevel:  *logLevel,
+
+			ChrootPoolDir:     *chrootPoolDir,
+			CacheDependencies: *cacheDependencies,
+		},
+		areas: map[string]string{
+			buildagents.RemoteRpmsArea:   *rpmDir,
+			buildagents.RemoteCacheArea:  *cacheDir,
+			buildagents.RemoteInputsArea: *inputDir,
+		},
+		buildSlot: make(chan bool, *maxBuilds),
+		newAgent: func() buildagents.BuildAgent {
+			return buildagents.NewChrootAgent()
+		},
+	}
+
+	if *debugRpmDir != "" {
+		worker.areas[buildagents.RemoteDebugRpmsArea] = *debugRpmDir
+	}
+
+	for area, dir := range worker.areas {
+		worker.areas[area], err = filepath.Abs(dir)
+		if err != nil {
+			return
+		}
+	}
+
+	worker.config.RpmDir = worker.areas[buildagents.RemoteRpmsArea]
+	worker.config.CacheDir = worker.areas[buildagents.RemoteCacheArea]
+
+	// Hash the worker tar once, rather than in every build leasing a chroot from the pool.
+	if *chrootPoolDir != "" {
+		worker.config.WorkerTarHash, err = file.GenerateSHA256(*workerTar)
+	}
+
+	return
+}
+
+// handler returns the handler serving the remote build protocol.
+func (w *remoteWorker) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(buildagents.RemoteStatusPath, w.handleStatus)
+	mux.HandleFunc(buildagents.RemoteBuildPath, w.handleBuild)
+	mux.HandleFunc(buildagents.RemoteFilesPath+"/", w.handleFile)
+
+	return mux
+}
+
+// handleStatus reports how busy the worker is.
+func (w *remoteWorker) handleStatus(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(resp, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.statusMutex.Lock()
+	status := buildagents.RemoteWorkerStatus{
+		ActiveBuilds: w.activeBuilds,
+		MaxBuilds:    cap(w.buildSlot),
+	}
+	w.statusMutex.Unlock()
+
+	resp.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(resp).Encode(status)
+	if err != nil {
+		logger.Log.Warnf("Failed to send status, error: %s", err)
+	}
+}
+
+// handleFile checks for, downloads, uploads or removes a file in one of the worker's areas.
+func (w *remoteWorker) handleFile(resp http.ResponseWriter, req *http.Request) {
+	path, err := w.resolveAreaPath(strings.TrimPrefix(req.URL.Path, buildagents.RemoteFilesPath+"/"))
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodHead, http.MethodGet:
+		w.serveFile(resp, req, path)
+	case http.MethodPut:
+		w.receiveFile(resp, req, path)
+	case http.MethodDelete:
+		w.removeDebugDir(resp, req, path)
+	default:
+		http.Error(resp, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveFile sends a file, or only its hash for HEAD requests.
+func (w *remoteWorker) serveFile(resp http.ResponseWriter, req *http.Request, path string) {
+	isFile, _ := file.IsFile(path)
+	if !isFile {
+		http.NotFound(resp, req)
+		return
+	}
+
+	hash, err := file.GenerateSHA256(path)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp.Header().Set(buildagents.RemoteSHA256Header, hash)
+	if req.Method == http.MethodHead {
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	_, err = io.Copy(resp, f)
+	if err != nil {
+		logger.Log.Warnf("Failed to send (%s), error: %s", path, err)
+	}
+}
+
+// receiveFile stores an uploaded file, verifying its hash.
+func (w *remoteWorker) receiveFile(resp http.ResponseWriter, req *http.Request, path string) {
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Write to a unique temporary file first, concurrent builds may upload the same dependency.
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), ".upload-")
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmpFile.Name())
+
+	_, err = io.Copy(tmpFile, req.Body)
+	tmpFile.Close()
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hash, err := file.GenerateSHA256(tmpFile.Name())
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	expectedHash := req.Header.Get(buildagents.RemoteSHA256Header)
+	if expectedHash != "" && hash != expectedHash {
+		http.Error(resp, fmt.Sprintf("uploaded file has SHA256 %s, expected %s", hash, expectedHash), http.StatusBadRequest)
+		return
+	}
+
+	err = os.Rename(tmpFile.Name(), path)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	logger.Log.Debugf("Received (%s)", path)
+}
+
+// removeDebugDir removes the directory holding the debug RPMs of a build, once they have been downloaded.
+// Only directories directly in the RemoteDebugRpmsArea may be removed.
+func (w *remoteWorker) removeDebugDir(resp http.ResponseWriter, req *http.Request, path string) {
+	debugAreaDir, found := w.areas[buildagents.RemoteDebugRpmsArea]
+	if !found || filepath.Dir(path) != filepath.Clean(debugAreaDir) {
+		http.Error(resp, "only the debug RPM directory of a build may be removed", http.StatusForbidden)
+		return
+	}
+
+	err := os.RemoveAll(path)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	logger.Log.Debugf("Removed (%s)", path)
+}
+
+// handleBuild builds an SRPM, streaming its build log and result back as RemoteBuildMessages.
+func (w *remoteWorker) handleBuild(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(resp, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	buildReq := &buildagents.RemoteBuildRequest{}
+	err := json.NewDecoder(req.Body).Decode(buildReq)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	agent, srpmFile, dependencies, err := w.newBuildAgent(buildReq)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := resp.(http.Flusher)
+	if !ok {
+		http.Error(resp, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(resp)
+	send := func(msg *buildagents.RemoteBuildMessage) {
+		err := encoder.Encode(msg)
+		if err != nil {
+			logger.Log.Debugf("Failed to send build message for (%s), error: %s", filepath.Base(srpmFile), err)
+			return
+		}
+		flusher.Flush()
+	}
+
+	err = w.acquireBuildSlot(req.Context())
+	if err != nil {
+		logger.Log.Infof("Remote agent gave up on (%s) before it started building", filepath.Base(srpmFile))
+		return
+	}
+	defer w.releaseBuildSlot()
+
+	logger.Log.Infof("Building (%s)", filepath.Base(srpmFile))
+
+	var (
+		builtFiles []string
+		buildErr   error
+	)
+
+	// Remove the log of any previous attempt so it is not streamed again.
+	logName := filepath.Base(buildReq.LogName)
+	logPath := filepath.Join(w.config.LogDir, logName)
+	os.Remove(logPath)
+
+	done := make(chan bool)
+	go func() {
+		builtFiles, _, buildErr = agent.BuildPackage(buildReq.BasePackageName, srpmFile, buildReq.Bcond, logName, dependencies)
+		close(done)
+	}()
+
+	// The remote-agent cancels a build by disconnecting, stop the build rather than leaving it to hold a build slot.
+	go func() {
+		select {
+		case <-req.Context().Done():
+			logger.Log.Warnf("Remote agent disconnected, stopping the build of (%s)", filepath.Base(srpmFile))
+			closeErr := agent.Close()
+			if closeErr != nil {
+				logger.Log.Warnf("Failed to stop the build of (%s), error: %s", filepath.Base(srpmFile), closeErr)
+			}
+		case <-done:
+		}
+	}()
+
+	followLog(logPath, done, func(line string) {
+		send(&buildagents.RemoteBuildMessage{Log: line})
+	})
+
+	result := &buildagents.RemoteBuildMessage{Done: true}
+	if buildErr != nil {
+		logger.Log.Warnf("Failed to build (%s), error: %s", filepath.Base(srpmFile), buildErr)
+		result.Err = buildErr.Error()
+
+		var limitErr *buildagents.BuildLimitError
+		if errors.As(buildErr, &limitErr) {
+			result.ExceededLimit = limitErr.Limit
+		}
+		result.TimedOut = errors.Is(buildErr, shell.ErrTimedOut)
+	} else {
+		result.BuiltFiles, result.BuiltDebugFiles, err = w.remoteBuiltFiles(builtFiles, agent.Config().DebugRpmDir)
+		if err != nil {
+			result.Err = err.Error()
+		}
+		logger.Log.Infof("Built (%s) -> %v", filepath.Base(srpmFile), result.BuiltFiles)
+	}
+
+	// Debug RPMs are only kept until the remote-agent downloads them, which it will not do for a failed build.
+	if result.Err != "" && agent.Config().DebugRpmDir != "" {
+		err = os.RemoveAll(agent.Config().DebugRpmDir)
+		if err != nil {
+			logger.Log.Warnf("Failed to remove debug RPMs of (%s), error: %s", filepath.Base(srpmFile), err)
+		}
+	}
+
+	send(result)
+}
+
+// newBuildAgent creates a build agent configured for a build request, resolving the request's files to local paths.
+func (w *remoteWorker) newBuildAgent(buildReq *buildagents.RemoteBuildRequest) (agent buildagents.BuildAgent, srpmFile string, dependencies []string, err error) {
+	config := w.config
+	config.DistTag = buildReq.DistTag
+	config.DistroReleaseVersion = buildReq.DistroReleaseVersion
+	config.DistroBuildNumber = buildReq.DistroBuildNumber
+	config.NoCleanup = buildReq.NoCleanup
+	config.RunCheck = buildReq.RunCheck
+	config.NonFatalChecks = map[string]bool{buildReq.BasePackageName: buildReq.AllowCheckFailure}
+	config.Limits = buildReq.Limits
+
+	srpmFile, err = w.resolveAreaPath(buildReq.SrpmFile)
+	if err != nil {
+		return
+	}
+
+	if buildReq.SeparateDebugRPMs {
+		debugAreaDir, found := w.areas[buildagents.RemoteDebugRpmsArea]
+		if !found {
+			err = fmt.Errorf("separate debug RPMs were requested, but the remote worker has no --debug-rpm-dir")
+			return
+		}
+
+		// Give each build its own directory, so the debug RPMs it built can be told apart. Remove any left by a previous attempt.
+		config.DebugRpmDir = filepath.Join(debugAreaDir, strings.TrimSuffix(filepath.Base(srpmFile), ".src.rpm"))
+		err = os.RemoveAll(config.DebugRpmDir)
+		if err != nil {
+			return
+		}
+	}
+
+	if buildReq.RpmmacrosFile != "" {
+		config.RpmmacrosFile, err = w.resolveAreaPath(buildReq.RpmmacrosFile)
+		if err != nil {
+			return
+		}
+	}
+
+	for _, dependency := range buildReq.Dependencies {
+		var path string
+		path, err = w.resolveAreaPath(dependency)
+		if err != nil {
+			return
+		}
+		dependencies = append(dependencies, path)
+	}
+
+	agent = w.newAgent()
+	err = agent.Initialize(&config)
+
+	return
+}
+
+// remoteBuiltFiles converts the local paths of the RPMs a build reported into paths in the RemoteRpmsArea,
+// and those of any debug RPMs placed in debugRpmDir into paths in the RemoteDebugRpmsArea.
+func (w *remoteWorker) remoteBuiltFiles(builtFiles []string, debugRpmDir string) (remoteBuiltFiles, remoteBuiltDebugFiles []string, err error) {
+	for _, builtFile := range builtFiles {
+		var relPath string
+
+		if debugRpmDir != "" && strings.HasPrefix(builtFile, debugRpmDir+string(filepath.Separator)) {
+			relPath, err = filepath.Rel(w.areas[buildagents.RemoteDebugRpmsArea], builtFile)
+			if err != nil {
+				return
+			}
+
+			remoteBuiltDebugFiles = append(remoteBuiltDebugFiles, filepath.ToSlash(relPath))
+			continue
+		}
+
+		relPath, err = filepath.Rel(w.config.RpmDir, builtFile)
+		if err != nil {
+			return
+		}
+
+		remoteBuiltFiles = append(remoteBuiltFiles, relPath)
+	}
+
+	return
+}
+
+// resolveAreaPath converts a path of the form <area>/<relative path> into a local path.
+// Paths which are absolute or escape their area are rejected.
+func (w *remoteWorker) resolveAreaPath(areaPath string) (path string, err error) {
+	const (
+		pathSeparator = "/"
+		parentDir     = ".."
+	)
+
+	parts := strings.SplitN(filepath.ToSlash(areaPath), pathSeparator, 2)
+	if len(parts) != 2 || parts[1] == "" {
+		err = fmt.Errorf("invalid file path (%s)", areaPath)
+		return
+	}
+
+	areaDir, found := w.areas[parts[0]]
+	if !found {
+		err = fmt.Errorf("unknown file area (%s)", parts[0])
+		return
+	}
+
+	relPath := filepath.Clean(parts[1])
+	if filepath.IsAbs(relPath) || relPath == "." || relPath == parentDir || strings.HasPrefix(relPath, parentDir+pathSeparator) {
+		err = fmt.Errorf("file path (%s) escapes its area", areaPath)
+		return
+	}
+
+	path = filepath.Join(areaDir, relPath)
+	return
+}
+
+// acquireBuildSlot blocks until fewer than --max-builds builds are running, or ctx is done.
+func (w *remoteWorker) acquireBuildSlot(ctx context.Context) (err error) {
+	select {
+	case w.buildSlot <- true:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	w.statusMutex.Lock()
+	w.activeBuilds++
+	w.statusMutex.Unlock()
+
+	return
+}
+
+// releaseBuildSlot frees a slot reserved with acquireBuildSlot.
+func (w *remoteWorker) releaseBuildSlot() {
+	w.statusMutex.Lock()
+	w.activeBuilds--
+	w.statusMutex.Unlock()
+
+	<-w.buildSlot
+}
+
+// followLog calls onLine for every line written to logPath until done is closed.
+func followLog(logPath string, done <-chan bool, onLine func(string)) {
+	const pollInterval = time.Second
+
+	var (
+		log     *os.File
+		reader  *bufio.Reader
+		partial string
+	)
+
+	defer func() {
+		if log != nil {
+			log.Close()
+		}
+	}()
+
+	readLines := func() {
+		if log == nil {
+			var err error
+			log, err = os.Open(logPath)
+			if err != nil {
+				return
+			}
+			reader = bufio.NewReader(log)
+		}
+
+		for {
+			line, err := reader.ReadString('\n')
+			partial += line
+			if err != nil {
+				return
+			}
+
+			onLine(strings.TrimSuffix(partial, "\n"))
+			partial = ""
+		}
+	}
+
+	for {
+		select {
+		case <-done:
+			readLines()
+			if partial != "" {
+				onLine(partial)
+			}
+			return
+		case <-time.After(pollInterval):
+			readLines()
+		}
+	}
+}
@@ -0,0 +1,344 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"microsoft.com/pkggen/internal/logger"
+	"microsoft.com/pkggen/internal/shell"
+	"microsoft.com/pkggen/scheduler/buildagents"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitStderrLog()
+	os.Exit(m.Run())
+}
+
+// scriptedAgent is a test agent which writes a fixed build log and returns a fixed result instead of building.
+// If block is set, builds wait until the agent is closed.
+type scriptedAgent struct {
+	*buildagents.TestAgent
+
+	logLines   []string
+	builtRPM   string
+	err        error
+	block      bool
+	started    chan bool
+	closed     chan bool
+	closedOnce sync.Once
+}
+
+func (a *scriptedAgent) BuildPackage(basePackageName, inputFile, bcond, logName string, dependencies []string) (builtFiles []string, logFile string, err error) {
+	config := a.Config()
+	logFile = filepath.Join(config.LogDir, logName)
+
+	err = ioutil.WriteFile(logFile, []byte(strings.Join(a.logLines, "\n")+"\n"), os.ModePerm)
+	if err != nil {
+		return
+	}
+
+	if a.block {
+		a.started <- true
+		<-a.closed
+		err = fmt.Errorf("build was stopped")
+		return
+	}
+
+	if a.err != nil {
+		err = a.err
+		return
+	}
+
+	builtFile := filepath.Join(config.RpmDir, a.builtRPM)
+	err = ioutil.WriteFile(builtFile, []byte("built "+a.builtRPM), os.ModePerm)
+	builtFiles = []string{builtFile}
+
+	return
+}
+
+func (a *scriptedAgent) Close() (err error) {
+	a.closedOnce.Do(func() {
+		close(a.closed)
+	})
+	return
+}
+
+// remoteTest is a remote worker served over loopback and a remote agent connected to it.
+type remoteTest struct {
+	dir    string
+	worker *remoteWorker
+	server *httptest.Server
+	agent  *buildagents.RemoteAgent
+
+	uploadsMutex sync.Mutex
+	uploads      []string
+}
+
+// newRemoteTest starts a remote worker whose builds are run by agent and connects a remote agent to it.
+func newRemoteTest(t *testing.T, agent *scriptedAgent) (r *remoteTest) {
+	dir, err := ioutil.TempDir("", "remoteworker")
+	assert.NoError(t, err)
+
+	r = &remoteTest{dir: dir}
+
+	mkdir := func(name string) string {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, os.MkdirAll(path, os.ModePerm))
+		return path
+	}
+
+	agent.TestAgent = buildagents.NewTestAgent()
+	agent.started = make(chan bool, 1)
+	agent.closed = make(chan bool)
+
+	r.worker = &remoteWorker{
+		config: buildagents.BuildAgentConfig{
+			SrpmDir: mkdir("worker/SRPMS"),
+			LogDir:  mkdir("worker/logs"),
+		},
+		areas: map[string]string{
+			buildagents.RemoteRpmsArea:   mkdir("worker/RPMS"),
+			buildagents.RemoteCacheArea:  mkdir("worker/cache"),
+			buildagents.RemoteInputsArea: mkdir("worker/inputs"),
+		},
+		buildSlot: make(chan bool, 1),
+		newAgent: func() buildagents.BuildAgent {
+			return agent
+		},
+	}
+	r.worker.config.RpmDir = r.worker.areas[buildagents.RemoteRpmsArea]
+	r.worker.config.CacheDir = r.worker.areas[buildagents.RemoteCacheArea]
+
+	// Record every upload the remote agent makes.
+	handler := r.worker.handler()
+	r.server = httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodPut {
+			r.uploadsMutex.Lock()
+			r.uploads = append(r.uploads, strings.TrimPrefix(req.URL.Path, buildagents.RemoteFilesPath+"/"))
+			r.uploadsMutex.Unlock()
+		}
+		handler.ServeHTTP(resp, req)
+	}))
+
+	r.agent = buildagents.NewRemoteAgent()
+	err = r.agent.Initialize(&buildagents.BuildAgentConfig{
+		RpmDir:        mkdir("local/RPMS"),
+		SrpmDir:       mkdir("local/SRPMS"),
+		CacheDir:      mkdir("local/cache"),
+		LogDir:        mkdir("local/logs"),
+		RemoteWorkers: []string{r.server.URL},
+	})
+	assert.NoError(t, err)
+
+	return
+}
+
+// close stops the remote agent and worker and removes their files.
+func (r *remoteTest) close() {
+	r.agent.Close()
+	r.server.Close()
+	os.RemoveAll(r.dir)
+}
+
+// writeLocalFile writes a file on the remote agent's side and returns its path.
+func (r *remoteTest) writeLocalFile(t *testing.T, relPath, contents string) string {
+	path := filepath.Join(r.dir, "local", relPath)
+	assert.NoError(t, ioutil.WriteFile(path, []byte(contents), os.ModePerm))
+	return path
+}
+
+// takeUploads returns the files uploaded since the last call.
+func (r *remoteTest) takeUploads() (uploads []string) {
+	r.uploadsMutex.Lock()
+	defer r.uploadsMutex.Unlock()
+
+	uploads, r.uploads = r.uploads, nil
+	return
+}
+
+func TestRemoteBuild(t *testing.T) {
+	agent := &scriptedAgent{
+		logLines: []string{"Building A", "Wrote: A-1.0-1.x86_64.rpm"},
+		builtRPM: "A-1.0-1.x86_64.rpm",
+	}
+	r := newRemoteTest(t, agent)
+	defer r.close()
+
+	srpm := r.writeLocalFile(t, "A-1.0-1.src.rpm", "srpm")
+	dependency := r.writeLocalFile(t, "RPMS/B-1.0-1.x86_64.rpm", "dependency")
+
+	builtFiles, logFile, err := r.agent.BuildPackage("A", srpm, "", "A-1.0-1.src.rpm.log", []string{dependency})
+	assert.NoError(t, err)
+
+	// The built RPM is downloaded into the local RPM directory.
+	localRPM := filepath.Join(r.dir, "local/RPMS/A-1.0-1.x86_64.rpm")
+	assert.Equal(t, []string{localRPM}, builtFiles)
+	contents, err := ioutil.ReadFile(localRPM)
+	assert.NoError(t, err)
+	assert.Equal(t, "built A-1.0-1.x86_64.rpm", string(contents))
+
+	// The build log is streamed back line by line.
+	log, err := ioutil.ReadFile(logFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "Building A\nWrote: A-1.0-1.x86_64.rpm\n", string(log))
+
+	// The dependency was uploaded into the worker's RPM area and the SRPM copied into the local output directory.
+	contents, err = ioutil.ReadFile(filepath.Join(r.worker.areas[buildagents.RemoteRpmsArea], "B-1.0-1.x86_64.rpm"))
+	assert.NoError(t, err)
+	assert.Equal(t, "dependency", string(contents))
+	assert.FileExists(t, filepath.Join(r.dir, "local/SRPMS/A-1.0-1.src.rpm"))
+}
+
+func TestRemoteBuildSkipsUploadingUnchangedFiles(t *testing.T) {
+	agent := &scriptedAgent{builtRPM: "A-1.0-1.x86_64.rpm"}
+	r := newRemoteTest(t, agent)
+	defer r.close()
+
+	srpm := r.writeLocalFile(t, "A-1.0-1.src.rpm", "srpm")
+	dependency := r.writeLocalFile(t, "RPMS/B-1.0-1.x86_64.rpm", "dependency")
+
+	build := func() {
+		_, _, err := r.agent.BuildPackage("A", srpm, "", "A-1.0-1.src.rpm.log", []string{dependency})
+		assert.NoError(t, err)
+	}
+
+	build()
+	assert.ElementsMatch(t, []string{"inputs/A-1.0-1.src.rpm", "rpms/B-1.0-1.x86_64.rpm"}, r.takeUploads())
+
+	build()
+	assert.Empty(t, r.takeUploads())
+
+	r.writeLocalFile(t, "RPMS/B-1.0-1.x86_64.rpm", "rebuilt dependency")
+	build()
+	assert.Equal(t, []string{"rpms/B-1.0-1.x86_64.rpm"}, r.takeUploads())
+}
+
+func TestRemoteBuildFailures(t *testing.T) {
+	tests := []struct {
+		name     string
+		buildErr error
+		check    func(t *testing.T, err error)
+	}{
+		{
+			name:     "error",
+			buildErr: fmt.Errorf("rpmbuild failed"),
+			check: func(t *testing.T, err error) {
+				assert.Contains(t, err.Error(), "rpmbuild failed")
+			},
+		},
+		{
+			name:     "exceeded limit",
+			buildErr: fmt.Errorf("build stopped: %w", &buildagents.BuildLimitError{Limit: buildagents.ExceededMemoryLimit}),
+			check: func(t *testing.T, err error) {
+				var limitErr *buildagents.BuildLimitError
+				assert.True(t, errors.As(err, &limitErr))
+				assert.Equal(t, buildagents.ExceededMemoryLimit, limitErr.Limit)
+			},
+		},
+		{
+			name:     "timed out",
+			buildErr: fmt.Errorf("build stopped: %w", shell.ErrTimedOut),
+			check: func(t *testing.T, err error) {
+				assert.True(t, errors.Is(err, shell.ErrTimedOut))
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			agent := &scriptedAgent{
+				logLines: []string{"error: Bad exit status"},
+				err:      test.buildErr,
+			}
+			r := newRemoteTest(t, agent)
+			defer r.close()
+
+			srpm := r.writeLocalFile(t, "A-1.0-1.src.rpm", "srpm")
+
+			builtFiles, logFile, err := r.agent.BuildPackage("A", srpm, "", "A-1.0-1.src.rpm.log", nil)
+			assert.Error(t, err)
+			assert.Empty(t, builtFiles)
+			test.check(t, err)
+
+			// The log of a failed build is still streamed back.
+			log, err := ioutil.ReadFile(logFile)
+			assert.NoError(t, err)
+			assert.Equal(t, "error: Bad exit status\n", string(log))
+		})
+	}
+}
+
+func TestRemoteAgentCloseStopsRemoteBuilds(t *testing.T) {
+	const closeTimeout = 10 * time.Second
+
+	agent := &scriptedAgent{block: true}
+	r := newRemoteTest(t, agent)
+	defer r.close()
+
+	srpm := r.writeLocalFile(t, "A-1.0-1.src.rpm", "srpm")
+
+	buildErr := make(chan error, 1)
+	go func() {
+		_, _, err := r.agent.BuildPackage("A", srpm, "", "A-1.0-1.src.rpm.log", nil)
+		buildErr <- err
+	}()
+
+	<-agent.started
+	assert.NoError(t, r.agent.Close())
+	assert.Error(t, <-buildErr)
+
+	select {
+	case <-agent.closed:
+	case <-time.After(closeTimeout):
+		assert.Fail(t, "remote worker did not stop the build")
+	}
+}
+
+func TestResolveAreaPath(t *testing.T) {
+	worker := &remoteWorker{
+		areas: map[string]string{buildagents.RemoteRpmsArea: "/worker/RPMS"},
+	}
+
+	tests := []struct {
+		areaPath     string
+		expectedPath string
+	}{
+		{"rpms/A.rpm", "/worker/RPMS/A.rpm"},
+		{"rpms/x86_64/A.rpm", "/worker/RPMS/x86_64/A.rpm"},
+		{"rpms/x86_64/../A.rpm", "/worker/RPMS/A.rpm"},
+		{"rpms/../A.rpm", ""},
+		{"rpms/../../etc/passwd", ""},
+		{"rpms/x86_64/../../A.rpm", ""},
+		{"rpms/..", ""},
+		{"rpms//etc/passwd", ""},
+		{"rpms/", ""},
+		{"rpms", ""},
+		{"inputs/A.src.rpm", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.areaPath, func(t *testing.T) {
+			path, err := worker.resolveAreaPath(test.areaPath)
+			if test.expectedPath == "" {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, test.expectedPath, path)
+		})
+	}
+}
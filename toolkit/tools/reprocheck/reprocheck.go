@@ -0,0 +1,331 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+// A tool to check if packages build reproducibly
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+	"microsoft.com/pkggen/internal/exe"
+	"microsoft.com/pkggen/internal/file"
+	"microsoft.com/pkggen/internal/jsonutils"
+	"microsoft.com/pkggen/internal/logger"
+	"microsoft.com/pkggen/internal/pkggraph"
+	"microsoft.com/pkggen/scheduler/buildagents"
+	"microsoft.com/pkggen/scheduler/schedulerutils"
+)
+
+// buildsPerPackage is the number of independent builds compared for every package.
+const buildsPerPackage = 2
+
+var (
+	app = kingpin.New("reprocheck", "A tool to check if packages build reproducibly by building them twice in independent chroots and comparing the resulting RPMs.")
+
+	inputGraphFile = exe.InputFlag(app, "Path to the graph file of a finished build, used to find the SRPMs to check and their build dependencies.")
+	reportFile     = app.Flag("report-file", "Optional path to write a JSON report of every checked package to.").String()
+	pkgsToCheck    = app.Flag("packages", "Space separated list of spec names to check.").Required().String()
+
+	workDir      = app.Flag("work-dir", "The directory to build the packages in. Every build gets a separate chroot and RPM directory here.").Required().String()
+	workerTar    = app.Flag("worker-tar", "Full path to worker_chroot.tar.gz").Required().ExistingFile()
+	repoFile     = app.Flag("repo-file", "Full path to local.repo").Required().ExistingFile()
+	rpmDir       = app.Flag("rpm-dir", "The directory holding the RPMs of the finished build. Build dependencies are installed from here").Required().ExistingDir()
+	cacheDir     = app.Flag("cache-dir", "The cache directory containing downloaded dependency RPMS from Mariner Base").Required().ExistingDir()
+	buildLogsDir = app.Flag("build-logs-dir", "Directory to store package build logs").Required().String()
+
+	distTag              = app.Flag("dist-tag", "The distribution tag SRPMs will be built with.").Required().String()
+	distroReleaseVersion = app.Flag("distro-release-version", "The distro release version that the SRPM will be built with.").Required().String()
+	distroBuildNumber    = app.Flag("distro-build-number", "The distro build number that the SRPM will be built with.").Required().String()
+	rpmmacrosFile        = app.Flag("rpmmacros-file", "Optional file path to an rpmmacros file for rpmbuild to use.").ExistingFile()
+	runCheck             = app.Flag("run-check", "Run the check during package builds.").Bool()
+	noCleanup            = app.Flag("no-cleanup", "Whether or not to delete the chroot folder after the build is done").Bool()
+
+	validBuildAgentFlags = []string{buildagents.ChrootAgentFlag, buildagents.ContainerAgentFlag}
+	buildAgent           = app.Flag("build-agent", "Type of build agent to build packages with.").PlaceHolder(exe.PlaceHolderize(validBuildAgentFlags)).Required().Enum(validBuildAgentFlags...)
+	buildAgentProgram    = app.Flag("build-agent-program", "Path to the build agent that will be invoked to build packages.").Required().ExistingFile()
+	containerRuntime     = app.Flag("container-runtime", fmt.Sprintf("Podman compatible container runtime used by the %s to run builds.", buildagents.ContainerAgentFlag)).Default(buildagents.DefaultContainerRuntime).String()
+
+	logFile  = exe.LogFileFlag(app)
+	logLevel = exe.LogLevelFlag(app)
+)
+
+// packageReport describes the result of checking a single package.
+type packageReport struct {
+	SrpmPath     string
+	Reproducible bool
+	Error        string        `json:",omitempty"`
+	LogFiles     []string      `json:",omitempty"`
+	Differences  []*difference `json:",omitempty"`
+}
+
+// buildOutput holds the result of a single build of a package.
+type buildOutput struct {
+	rpmDir     string
+	builtFiles []string
+	logFile    string
+	err        error
+}
+
+func main() {
+	app.Version(exe.ToolkitVersion)
+	kingpin.MustParse(app.Parse(os.Args[1:]))
+	logger.InitBestEffort(*logFile, *logLevel)
+
+	packagesToCheck := exe.ParseListArgument(*pkgsToCheck)
+	if len(packagesToCheck) == 0 {
+		logger.Log.Fatal("--packages must list at least one package to check")
+	}
+
+	baseConfig := buildagents.BuildAgentConfig{
+		Program:   *buildAgentProgram,
+		CacheDir:  *cacheDir,
+		RepoFile:  *repoFile,
+		WorkerTar: *workerTar,
+
+		DistTag:              *distTag,
+		DistroReleaseVersion: *distroReleaseVersion,
+		DistroBuildNumber:    *distroBuildNumber,
+		RpmmacrosFile:        *rpmmacrosFile,
+
+		NoCleanup: *noCleanup,
+		RunCheck:  *runCheck,
+
+		ContainerRuntime: *containerRuntime,
+
+		LogLevel: *logLevel,
+	}
+
+	reports, err := checkPackages(*inputGraphFile, packagesToCheck, baseConfig)
+	if err != nil {
+		logger.Log.Fatalf("Unable to check packages, error: %s", err)
+	}
+
+	printReports(reports)
+
+	if *reportFile != "" {
+		err = jsonutils.WriteJSONFile(*reportFile, reports)
+		if err != nil {
+			logger.Log.Fatalf("Failed to save report, error: %s", err)
+		}
+	}
+
+	for _, report := range reports {
+		if !report.Reproducible {
+			logger.Log.Fatal("Not all packages are reproducible.\nFor details see the summary section above.")
+		}
+	}
+}
+
+// checkPackages builds every requested package twice and compares the results.
+func checkPackages(inputFile string, packagesToCheck []string, baseConfig buildagents.BuildAgentConfig) (reports []*packageReport, err error) {
+	pkgGraph := pkggraph.NewPkgGraph()
+	err = pkggraph.ReadGraphFile(pkgGraph, inputFile)
+	if err != nil {
+		return
+	}
+
+	buildNodes := findBuildNodes(pkgGraph, packagesToCheck)
+	for _, packageName := range packagesToCheck {
+		if buildNodes[packageName] == nil {
+			err = fmt.Errorf("unable to find a build node for (%s) in the graph", packageName)
+			return
+		}
+	}
+
+	for _, packageName := range packagesToCheck {
+		node := buildNodes[packageName]
+		dependencies := schedulerutils.GetBuildDependencies(node, pkgGraph)
+
+		logger.Log.Infof("Checking %s", node.SRPMFileName())
+		reports = append(reports, checkPackage(node, dependencies, baseConfig))
+	}
+
+	return
+}
+
+// findBuildNodes returns a build node for each of the requested spec names, keyed by spec name.
+func findBuildNodes(pkgGraph *pkggraph.PkgGraph, packagesToCheck []string) (buildNodes map[string]*pkggraph.PkgNode) {
+	buildNodes = make(map[string]*pkggraph.PkgNode)
+	for _, specName := range packagesToCheck {
+		if nodes := pkgGraph.BuildNodesForSpec(specName); len(nodes) > 0 {
+			buildNodes[specName] = nodes[0]
+		}
+	}
+
+	return
+}
+
+// checkPackage builds a package in independent build environments and compares their output.
+func checkPackage(node *pkggraph.PkgNode, dependencies []string, baseConfig buildagents.BuildAgentConfig) (report *packageReport) {
+	report = &packageReport{
+		SrpmPath: node.SrpmPath,
+	}
+
+	outputs := make([]*buildOutput, buildsPerPackage)
+
+	var wg sync.WaitGroup
+	for i := range outputs {
+		wg.Add(1)
+		go func(buildNumber int) {
+			defer wg.Done()
+			outputs[buildNumber] = buildPackage(node, dependencies, baseConfig, buildNumber)
+		}(i)
+	}
+	wg.Wait()
+
+	for _, output := range outputs {
+		report.LogFiles = append(report.LogFiles, output.logFile)
+		if output.err != nil {
+			report.Error = output.err.Error()
+			return
+		}
+	}
+
+	first, second := outputs[0], outputs[1]
+	differences, err := compareRPMSets(first.rpmDir, first.builtFiles, second.rpmDir, second.builtFiles)
+	if err != nil {
+		report.Error = err.Error()
+		return
+	}
+
+	report.Differences = differences
+	report.Reproducible = len(differences) == 0
+
+	return
+}
+
+// buildPackage builds a package in a build environment of its own.
+// Every build gets its own work, RPM, SRPM and log directories so builds never see each other's output.
+func buildPackage(node *pkggraph.PkgNode, dependencies []string, baseConfig buildagents.BuildAgentConfig, buildNumber int) (output *buildOutput) {
+	buildDir := filepath.Join(*workDir, node.SpecName(), fmt.Sprintf("build-%d", buildNumber+1))
+
+	config := baseConfig
+	config.WorkDir = filepath.Join(buildDir, "work")
+	config.RpmDir = filepath.Join(buildDir, "RPMS")
+	config.SrpmDir = filepath.Join(buildDir, "SRPMS")
+	config.LogDir = filepath.Join(*buildLogsDir, fmt.Sprintf("build-%d", buildNumber+1))
+
+	output = &buildOutput{
+		rpmDir: config.RpmDir,
+	}
+
+	// Start from a clean slate, a previous check may have left RPMs behind.
+	output.err = os.RemoveAll(buildDir)
+	if output.err != nil {
+		return
+	}
+
+	for _, dir := range []string{config.WorkDir, config.RpmDir, config.SrpmDir, config.LogDir} {
+		output.err = os.MkdirAll(dir, os.ModePerm)
+		if output.err != nil {
+			return
+		}
+	}
+
+	output.err = linkLocalDependencies(dependencies, *rpmDir, config.RpmDir)
+	if output.err != nil {
+		return
+	}
+
+	agent, err := buildagents.BuildAgentFactory(*buildAgent)
+	if err != nil {
+		output.err = err
+		return
+	}
+
+	output.err = agent.Initialize(&config)
+	if output.err != nil {
+		return
+	}
+	defer agent.Close()
+
+	logName := filepath.Base(node.SrpmPath) + ".log"
+	output.builtFiles, output.logFile, output.err = agent.BuildPackage(node.SpecName(), node.SrpmPath, node.Bcond, logName, dependencies)
+	if output.err != nil {
+		output.err = fmt.Errorf("build %d failed, for details see (%s): %w", buildNumber+1, output.logFile, output.err)
+	}
+
+	return
+}
+
+// linkLocalDependencies makes the locally built dependencies of a package available in a build's RPM directory.
+// Dependencies outside of the finished build's RPM directory are served from the cache directory instead.
+// Files are hard linked where possible, build agents replace RPMs instead of writing to them so the originals are never modified.
+func linkLocalDependencies(dependencies []string, srcRpmDir, dstRpmDir string) (err error) {
+	for _, dependency := range dependencies {
+		relativePath, relErr := filepath.Rel(srcRpmDir, dependency)
+		if relErr != nil || strings.HasPrefix(relativePath, "..") {
+			continue
+		}
+
+		dst := filepath.Join(dstRpmDir, relativePath)
+		err = os.MkdirAll(filepath.Dir(dst), os.ModePerm)
+		if err != nil {
+			return
+		}
+
+		linkErr := os.Link(dependency, dst)
+		if linkErr != nil {
+			logger.Log.Debugf("Unable to link (%s), copying it instead: %s", dependency, linkErr)
+			err = file.Copy(dependency, dst)
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	return
+}
+
+// printReports prints a summary of all checked packages.
+func printReports(reports []*packageReport) {
+	var reproducible, notReproducible, failed []*packageReport
+	for _, report := range reports {
+		switch {
+		case report.Error != "":
+			failed = append(failed, report)
+		case report.Reproducible:
+			reproducible = append(reproducible, report)
+		default:
+			notReproducible = append(notReproducible, report)
+		}
+	}
+
+	logger.Log.Info("---------------------------")
+	logger.Log.Info("--------- Summary ---------")
+	logger.Log.Info("---------------------------")
+
+	logger.Log.Infof("Number of reproducible SRPMs:     %d", len(reproducible))
+	logger.Log.Infof("Number of non-reproducible SRPMs: %d", len(notReproducible))
+	logger.Log.Infof("Number of failed SRPMs:           %d", len(failed))
+
+	if len(reproducible) != 0 {
+		logger.Log.Info("Reproducible SRPMs:")
+		for _, report := range reproducible {
+			logger.Log.Infof("--> %s", filepath.Base(report.SrpmPath))
+		}
+	}
+
+	if len(notReproducible) != 0 {
+		logger.Log.Info("Non-reproducible SRPMs:")
+		for _, report := range notReproducible {
+			logger.Log.Infof("--> %s , %d difference(s):", filepath.Base(report.SrpmPath), len(report.Differences))
+			for _, diff := range report.Differences {
+				logger.Log.Infof("    %s", diff)
+			}
+		}
+	}
+
+	if len(failed) != 0 {
+		logger.Log.Info("Failed SRPMs:")
+		for _, report := range failed {
+			logger.Log.Infof("--> %s , error: %s", filepath.Base(report.SrpmPath), report.Error)
+		}
+	}
+}
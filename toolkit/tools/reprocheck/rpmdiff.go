@@ -0,0 +1,292 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"microsoft.com/pkggen/internal/rpm"
+)
+
+const (
+	// fileTag prefixes every line describing a payload file in rpmQueryFormat.
+	fileTag = "FILE"
+	// presenceField is reported when an RPM or a payload file is only produced by one of the builds.
+	presenceField = "presence"
+	present       = "present"
+	missing       = "missing"
+)
+
+// headerTags lists the RPM header fields compared between builds.
+// BUILDHOST and BUILDTIME are left out, builds are not run with SOURCE_DATE_EPOCH so they always differ.
+var headerTags = []string{
+	"NAME",
+	"EPOCHNUM",
+	"VERSION",
+	"RELEASE",
+	"ARCH",
+	"SUMMARY",
+	"LICENSE",
+	"VENDOR",
+	"URL",
+	"SIZE",
+}
+
+// arrayHeaderTags lists the RPM header arrays compared between builds, each array is compared as a whole.
+var arrayHeaderTags = []string{
+	"REQUIRENEVRS",
+	"PROVIDENEVRS",
+	"CONFLICTNEVRS",
+	"OBSOLETENEVRS",
+}
+
+// fileFields lists the payload file fields compared between builds, in the order rpmQueryFormat prints them.
+// Modification times are left out for the same reason as the build time, differences in the files' contents show up in their digests.
+var fileFields = []string{
+	"digest",
+	"mode",
+	"user",
+	"group",
+	"size",
+	"flags",
+	"linkto",
+}
+
+// rpmQueryFormat prints every compared header field and payload file of an RPM, one per line.
+var rpmQueryFormat = buildRPMQueryFormat()
+
+// difference describes a single difference between two builds of an RPM.
+// File is empty for differences in the RPM's header.
+type difference struct {
+	RPM    string
+	File   string `json:",omitempty"`
+	Field  string
+	First  string
+	Second string
+}
+
+// String returns a human readable description of the difference.
+func (d *difference) String() string {
+	if d.File == "" {
+		return fmt.Sprintf("%s: %s: %q != %q", d.RPM, d.Field, d.First, d.Second)
+	}
+
+	return fmt.Sprintf("%s: %s: %s: %q != %q", d.RPM, d.File, d.Field, d.First, d.Second)
+}
+
+// rpmContents holds the compared fields of a single RPM.
+type rpmContents struct {
+	header map[string]string
+	files  map[string][]string
+	paths  []string
+}
+
+// compareRPMSets compares two builds of the same SRPM, matching RPMs by their path relative to each build's RPM directory.
+func compareRPMSets(firstDir string, firstRPMs []string, secondDir string, secondRPMs []string) (differences []*difference, err error) {
+	firstByPath, err := relativePaths(firstDir, firstRPMs)
+	if err != nil {
+		return
+	}
+
+	secondByPath, err := relativePaths(secondDir, secondRPMs)
+	if err != nil {
+		return
+	}
+
+	for _, relativePath := range sortedUnion(mapKeys(firstByPath), mapKeys(secondByPath)) {
+		firstRPM, inFirst := firstByPath[relativePath]
+		secondRPM, inSecond := secondByPath[relativePath]
+
+		if !inFirst || !inSecond {
+			differences = append(differences, presenceDifference(relativePath, "", inFirst, inSecond))
+			continue
+		}
+
+		var rpmDifferences []*difference
+		rpmDifferences, err = compareRPMs(relativePath, firstRPM, secondRPM)
+		if err != nil {
+			return
+		}
+
+		differences = append(differences, rpmDifferences...)
+	}
+
+	return
+}
+
+// compareRPMs compares the header fields and payload files of two RPMs.
+func compareRPMs(name, firstRPM, secondRPM string) (differences []*difference, err error) {
+	first, err := queryRPMContents(firstRPM)
+	if err != nil {
+		return
+	}
+
+	second, err := queryRPMContents(secondRPM)
+	if err != nil {
+		return
+	}
+
+	for _, tag := range append(headerTags, arrayHeaderTags...) {
+		if first.header[tag] != second.header[tag] {
+			differences = append(differences, &difference{
+				RPM:    name,
+				Field:  tag,
+				First:  first.header[tag],
+				Second: second.header[tag],
+			})
+		}
+	}
+
+	for _, path := range sortedUnion(first.paths, second.paths) {
+		firstFields, inFirst := first.files[path]
+		secondFields, inSecond := second.files[path]
+
+		if !inFirst || !inSecond {
+			differences = append(differences, presenceDifference(name, path, inFirst, inSecond))
+			continue
+		}
+
+		for i, field := range fileFields {
+			if firstFields[i] != secondFields[i] {
+				differences = append(differences, &difference{
+					RPM:    name,
+					File:   path,
+					Field:  field,
+					First:  firstFields[i],
+					Second: secondFields[i],
+				})
+			}
+		}
+	}
+
+	return
+}
+
+// queryRPMContents reads the compared header fields and payload files of an RPM.
+func queryRPMContents(rpmFile string) (contents *rpmContents, err error) {
+	const (
+		tagSeparator   = "="
+		fieldSeparator = "\t"
+	)
+
+	lines, err := rpm.QueryPackage(rpmFile, rpmQueryFormat, nil, "-p")
+	if err != nil {
+		return
+	}
+
+	contents = &rpmContents{
+		header: make(map[string]string),
+		files:  make(map[string][]string),
+	}
+
+	arrayValues := make(map[string][]string)
+	for _, line := range lines {
+		tagAndValue := strings.SplitN(line, tagSeparator, 2)
+		if len(tagAndValue) != 2 {
+			err = fmt.Errorf("unexpected output while querying (%s): %s", rpmFile, line)
+			return
+		}
+
+		tag, value := tagAndValue[0], tagAndValue[1]
+		if tag != fileTag {
+			arrayValues[tag] = append(arrayValues[tag], value)
+			continue
+		}
+
+		// Trailing empty fields are trimmed from the query output, pad them back.
+		fields := strings.Split(value, fieldSeparator)
+		path := fields[0]
+		fields = fields[1:]
+		for len(fields) < len(fileFields) {
+			fields = append(fields, "")
+		}
+		contents.files[path] = fields
+		contents.paths = append(contents.paths, path)
+	}
+
+	for tag, values := range arrayValues {
+		sort.Strings(values)
+		contents.header[tag] = strings.Join(values, ", ")
+	}
+
+	return
+}
+
+// buildRPMQueryFormat returns a query format printing every header tag and payload file on its own line.
+// Array tags are printed once per element, so an empty array prints nothing.
+func buildRPMQueryFormat() string {
+	var builder strings.Builder
+
+	for _, tag := range headerTags {
+		fmt.Fprintf(&builder, "%s=%%{%s}\\n", tag, tag)
+	}
+
+	for _, tag := range arrayHeaderTags {
+		fmt.Fprintf(&builder, "[%s=%%{%s}\\n]", tag, tag)
+	}
+
+	fmt.Fprintf(&builder, "[%s=%%{FILENAMES}\\t%%{FILEDIGESTS}\\t%%{FILEMODES:perms}\\t%%{FILEUSERNAME}\\t%%{FILEGROUPNAME}\\t%%{FILEMTIMES}\\t%%{FILESIZES}\\t%%{FILEFLAGS:fflags}\\t%%{FILELINKTOS}\\n]", fileTag)
+
+	return builder.String()
+}
+
+// presenceDifference returns a difference for an RPM or payload file only present in one of the builds.
+func presenceDifference(name, path string, inFirst, inSecond bool) *difference {
+	presence := func(isPresent bool) string {
+		if isPresent {
+			return present
+		}
+		return missing
+	}
+
+	return &difference{
+		RPM:    name,
+		File:   path,
+		Field:  presenceField,
+		First:  presence(inFirst),
+		Second: presence(inSecond),
+	}
+}
+
+// relativePaths maps the paths of RPMs relative to their RPM directory to their full paths.
+func relativePaths(rpmDir string, rpmFiles []string) (byRelativePath map[string]string, err error) {
+	byRelativePath = make(map[string]string)
+	for _, rpmFile := range rpmFiles {
+		var relativePath string
+		relativePath, err = filepath.Rel(rpmDir, rpmFile)
+		if err != nil {
+			return
+		}
+
+		byRelativePath[relativePath] = rpmFile
+	}
+
+	return
+}
+
+// mapKeys returns the keys of a map.
+func mapKeys(m map[string]string) (keys []string) {
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	return
+}
+
+// sortedUnion returns the sorted union of two lists, without duplicates.
+func sortedUnion(first, second []string) (union []string) {
+	found := make(map[string]bool)
+	for _, value := range append(first, second...) {
+		if !found[value] {
+			found[value] = true
+			union = append(union, value)
+		}
+	}
+
+	sort.Strings(union)
+	return
+}
@@ -10,17 +10,22 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"time"
 
 	"gopkg.in/alecthomas/kingpin.v2"
 	"microsoft.com/pkggen/imagegen/configuration"
 	"microsoft.com/pkggen/internal/exe"
 	"microsoft.com/pkggen/internal/file"
 	"microsoft.com/pkggen/internal/logger"
+	"microsoft.com/pkggen/internal/metrics"
 	"microsoft.com/pkggen/roast/formats"
 )
 
 const defaultWorkerCount = "10"
 
+// conversionDurations records how long each artifact conversion takes, by the format converted to.
+var conversionDurations = metrics.NewHistogram("toolkit_image_artifact_conversion_duration_seconds", "Time taken to convert an image artifact, by the format converted to.", metrics.DurationBuckets, "format")
+
 type convertRequest struct {
 	inputPath   string
 	isInputFile bool
@@ -36,8 +41,10 @@ type convertResult struct {
 var (
 	app = kingpin.New("roast", "A tool to convert raw disk file into another image type")
 
-	logFile  = exe.LogFileFlag(app)
-	logLevel = exe.LogLevelFlag(app)
+	logFile        = exe.LogFileFlag(app)
+	logLevel       = exe.LogLevelFlag(app)
+	metricsFile    = exe.MetricsFileFlag(app)
+	metricsAddress = exe.MetricsAddressFlag(app)
 
 	inputDir  = exe.InputDirFlag(app, "A directory containing a .RAW image or a rootfs directory")
 	outputDir = exe.OutputDirFlag(app, "A destination directory for the output image")
@@ -57,6 +64,12 @@ func main() {
 	kingpin.MustParse(app.Parse(os.Args[1:]))
 	logger.InitBestEffort(*logFile, *logLevel)
 
+	metricsExporter, err := metrics.StartExporter(*metricsFile, *metricsAddress)
+	if err != nil {
+		logger.Log.Fatalf("Unable to export metrics, error: %s", err)
+	}
+	defer metricsExporter.Close()
+
 	if *workers <= 0 {
 		logger.Log.Panicf("Value in --workers must be greater than zero. Found %d", *workers)
 	}
@@ -263,7 +276,11 @@ func convertArtifact(artifactName, outDir, format, imageTag, input string, isInp
 	outputPath := filepath.Join(outDir, artifactName)
 	outputFile = fmt.Sprintf("%s%s%s", outputPath, imageTag, newExt)
 
+	conversionStartTime := time.Now()
 	err = typeConverter.Convert(input, outputFile, isInputFile)
+	if err == nil {
+		conversionDurations.ObserveSince(conversionStartTime, format)
+	}
 	return
 }
 
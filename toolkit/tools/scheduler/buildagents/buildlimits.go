@@ -0,0 +1,175 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package buildagents
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"time"
+
+	"microsoft.com/pkggen/internal/jsonutils"
+)
+
+// Exit codes pkgworker uses to report that a build was stopped for exceeding one of its limits.
+const (
+	MemoryLimitExitCode = 90
+	TimeLimitExitCode   = 91
+)
+
+// Limits a build may exceed, as reported by BuildLimitError.
+const (
+	ExceededMemoryLimit = "memory"
+	ExceededTimeLimit   = "time"
+)
+
+// buildTimeoutGracePeriod is how long a build agent that timed out is given to clean up before it is killed.
+const buildTimeoutGracePeriod = 2 * time.Minute
+
+// BuildLimits restricts the resources a single package build may use. A zero value means no limit.
+//
+// TimeLimit is enforced by pkgworker from inside the build environment, while Timeout is enforced
+// by the build agent on the whole build, stopping builds which hang in a way pkgworker can not recover from.
+type BuildLimits struct {
+	CPUs      float64
+	MemoryMB  uint64
+	TimeLimit time.Duration
+	Timeout   time.Duration
+}
+
+// BuildLimitError is returned by a build agent when a build was stopped for exceeding one of its limits.
+type BuildLimitError struct {
+	Limit string
+}
+
+func (e *BuildLimitError) Error() string {
+	return fmt.Sprintf("build exceeded its %s limit", e.Limit)
+}
+
+// packageBuildLimitsFile is the on-disk format of a per-package build limits manifest, e.g.:
+//
+// {"Packages": {"llvm": {"CPUs": 16, "MemoryMB": 32768, "TimeLimit": "3h", "Timeout": "4h"}}}
+type packageBuildLimitsFile struct {
+	Packages map[string]packageBuildLimitsEntry
+}
+
+type packageBuildLimitsEntry struct {
+	CPUs      float64
+	MemoryMB  uint64
+	TimeLimit string
+	Timeout   string
+}
+
+// ReadPackageBuildLimits reads a manifest of build limits, keyed by the base name of each package's spec.
+func ReadPackageBuildLimits(path string) (packageLimits map[string]BuildLimits, err error) {
+	manifest := &packageBuildLimitsFile{}
+	err = jsonutils.ReadJSONFile(path, manifest)
+	if err != nil {
+		return
+	}
+
+	packageLimits = make(map[string]BuildLimits, len(manifest.Packages))
+	for basePackageName, entry := range manifest.Packages {
+		limits := BuildLimits{
+			CPUs:     entry.CPUs,
+			MemoryMB: entry.MemoryMB,
+		}
+
+		if entry.TimeLimit != "" {
+			limits.TimeLimit, err = time.ParseDuration(entry.TimeLimit)
+			if err != nil {
+				err = fmt.Errorf("invalid time limit for (%s) in (%s): %w", basePackageName, path, err)
+				return
+			}
+		}
+
+		if entry.Timeout != "" {
+			limits.Timeout, err = time.ParseDuration(entry.Timeout)
+			if err != nil {
+				err = fmt.Errorf("invalid timeout for (%s) in (%s): %w", basePackageName, path, err)
+				return
+			}
+		}
+
+		if limits.CPUs < 0 || limits.TimeLimit < 0 || limits.Timeout < 0 {
+			err = fmt.Errorf("negative build limit for (%s) in (%s)", basePackageName, path)
+			return
+		}
+
+		packageLimits[basePackageName] = limits
+	}
+
+	return
+}
+
+// Override returns a copy of the limits with every limit set in overrides replaced.
+func (l BuildLimits) Override(overrides BuildLimits) (limits BuildLimits) {
+	limits = l
+
+	if overrides.CPUs != 0 {
+		limits.CPUs = overrides.CPUs
+	}
+
+	if overrides.MemoryMB != 0 {
+		limits.MemoryMB = overrides.MemoryMB
+	}
+
+	if overrides.TimeLimit != 0 {
+		limits.TimeLimit = overrides.TimeLimit
+	}
+
+	if overrides.Timeout != 0 {
+		limits.Timeout = overrides.Timeout
+	}
+
+	return
+}
+
+// PackageBuildLimits returns the limits a package should be built with: the agent's limits,
+// overridden by any limits specific to the package.
+func (c *BuildAgentConfig) PackageBuildLimits(basePackageName string) (limits BuildLimits) {
+	limits = c.Limits
+
+	packageLimits, found := c.PackageLimits[basePackageName]
+	if found {
+		limits = limits.Override(packageLimits)
+	}
+
+	return
+}
+
+// serializeBuildLimits serializes build limits into arguments usable by pkgworker.
+func serializeBuildLimits(limits BuildLimits) (serializedArgs []string) {
+	if limits.CPUs != 0 {
+		serializedArgs = append(serializedArgs, fmt.Sprintf("--max-cpus=%g", limits.CPUs))
+	}
+
+	if limits.MemoryMB != 0 {
+		serializedArgs = append(serializedArgs, fmt.Sprintf("--max-memory-mb=%d", limits.MemoryMB))
+	}
+
+	if limits.TimeLimit != 0 {
+		serializedArgs = append(serializedArgs, fmt.Sprintf("--max-build-time=%s", limits.TimeLimit))
+	}
+
+	return
+}
+
+// buildLimitErrorFromExitCode converts the error of a pkgworker process that exited with one of the
+// build limit exit codes into a BuildLimitError. Any other error is returned unchanged.
+func buildLimitErrorFromExitCode(err error) error {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return err
+	}
+
+	switch exitErr.ExitCode() {
+	case MemoryLimitExitCode:
+		return &BuildLimitError{Limit: ExceededMemoryLimit}
+	case TimeLimitExitCode:
+		return &BuildLimitError{Limit: ExceededTimeLimit}
+	default:
+		return err
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package buildagents
+
+import (
+	"os"
+	"strings"
+
+	"microsoft.com/pkggen/internal/logger"
+	"microsoft.com/pkggen/internal/metrics"
+)
+
+// buildMetricsName returns the name of the file a package build exports its metrics to, next to its log.
+func buildMetricsName(logName string) string {
+	const (
+		logSuffix     = ".log"
+		metricsSuffix = ".prom"
+	)
+
+	return strings.TrimSuffix(logName, logSuffix) + metricsSuffix
+}
+
+// mergeBuildMetrics adds the metrics exported by a package build to the scheduler's own metrics and removes the file.
+// A build which failed before exporting its metrics is not an error.
+func mergeBuildMetrics(metricsFile string) {
+	err := metrics.MergeFile(metricsFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Log.Warnf("Failed to merge build metrics (%s): %s", metricsFile, err)
+		}
+		return
+	}
+
+	err = os.Remove(metricsFile)
+	if err != nil {
+		logger.Log.Warnf("Failed to remove build metrics (%s): %s", metricsFile, err)
+	}
+}
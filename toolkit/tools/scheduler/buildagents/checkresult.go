@@ -0,0 +1,114 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package buildagents
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"strings"
+
+	"microsoft.com/pkggen/internal/file"
+	"microsoft.com/pkggen/internal/logger"
+)
+
+// checkResultPrefix starts the build log message pkgworker reports a package's CheckResult in.
+const checkResultPrefix = "Check result: "
+
+// CheckResult is the outcome of a package's %check section, which pkgworker runs as a separate phase after packaging.
+type CheckResult struct {
+	Passed bool
+	// NonFatal is set if a failure of the check was not allowed to fail the build.
+	NonFatal bool `json:",omitempty"`
+	Seconds  float64
+	Err      string `json:",omitempty"`
+}
+
+// LogCheckResult reports a check result in the build log, where ReadCheckResult can find it.
+// The log is the only output of a build which reaches the scheduler from every kind of build agent.
+func LogCheckResult(result *CheckResult) (err error) {
+	serializedResult, err := json.Marshal(result)
+	if err != nil {
+		return
+	}
+
+	logger.Log.Info(checkResultPrefix + string(serializedResult))
+	return
+}
+
+// ReadCheckResult reads the check result reported in a build log by LogCheckResult.
+// Returns nil if the log does not report one, for example because the build failed before running its check.
+// Each build attempt starts a new log, if the log still reports several results the last one is returned.
+func ReadCheckResult(logFile string) (result *CheckResult, err error) {
+	const maxLineLength = 4 * 1024 * 1024
+
+	exists, err := file.PathExists(logFile)
+	if err != nil || !exists {
+		return
+	}
+
+	log, err := os.Open(logFile)
+	if err != nil {
+		return
+	}
+	defer log.Close()
+
+	var lastResult string
+	scanner := bufio.NewScanner(log)
+	scanner.Buffer(nil, maxLineLength)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.Contains(line, strings.TrimSpace(checkResultPrefix)) {
+			continue
+		}
+
+		message, isLogLine := logger.ParseMessage(line)
+		if !isLogLine {
+			message = line
+		}
+
+		if strings.HasPrefix(message, checkResultPrefix) {
+			lastResult = strings.TrimPrefix(message, checkResultPrefix)
+		}
+	}
+
+	err = scanner.Err()
+	if err != nil || lastResult == "" {
+		return
+	}
+
+	result = &CheckResult{}
+	err = json.Unmarshal([]byte(lastResult), result)
+	if err != nil {
+		result = nil
+	}
+
+	return
+}
+
+// ReadNonFatalChecks reads a list of spec names, one per line, whose check failures should not fail their build.
+// Blank lines and lines starting with '#' are ignored.
+func ReadNonFatalChecks(path string) (nonFatalChecks map[string]bool, err error) {
+	lines, err := file.ReadLines(path)
+	if err != nil {
+		return
+	}
+
+	nonFatalChecks = make(map[string]bool)
+	for _, line := range lines {
+		basePackageName := strings.TrimSpace(line)
+		if basePackageName == "" || strings.HasPrefix(basePackageName, "#") {
+			continue
+		}
+
+		nonFatalChecks[basePackageName] = true
+	}
+
+	return
+}
+
+// CheckFailureAllowed returns true if a failure of the package's check should not fail its build.
+func (c *BuildAgentConfig) CheckFailureAllowed(basePackageName string) bool {
+	return c.RunCheck && c.NonFatalChecks[basePackageName]
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"microsoft.com/pkggen/internal/logger"
 	"microsoft.com/pkggen/internal/shell"
@@ -18,11 +19,19 @@ const ChrootAgentFlag = "chroot-agent"
 // ChrootAgent implements the BuildAgent interface to build SRPMs using a local chroot.
 type ChrootAgent struct {
 	config *BuildAgentConfig
+
+	// buildsMutex guards closed and adding to activeBuilds.
+	buildsMutex  sync.Mutex
+	closed       bool
+	cancel       chan struct{}
+	activeBuilds sync.WaitGroup
 }
 
 // NewChrootAgent returns a new ChrootAgent.
 func NewChrootAgent() *ChrootAgent {
-	return &ChrootAgent{}
+	return &ChrootAgent{
+		cancel: make(chan struct{}),
+	}
 }
 
 // Initialize initializes the chroot agent with the given configuration.
@@ -32,16 +41,24 @@ func (c *ChrootAgent) Initialize(config *BuildAgentConfig) (err error) {
 }
 
 // BuildPackage builds a given file and returns the output files or error.
+// - basePackageName is the base name of the package's spec, used to look up any package specific limits.
 // - inputFile is the SRPM to build.
+// - bcond is an optional spec build conditional to enable, like rpmbuild's "--with" option. Used to build bootstrap stages.
 // - logName is the file name to save the package build log to.
 // - dependencies is a list of dependencies that need to be installed before building.
-func (c *ChrootAgent) BuildPackage(inputFile, logName string, dependencies []string) (builtFiles []string, logFile string, err error) {
+func (c *ChrootAgent) BuildPackage(basePackageName, inputFile, bcond, logName string, dependencies []string) (builtFiles []string, logFile string, err error) {
 	// On success, pkgworker will print a comma-seperated list of all RPMs built to stdout.
 	// This will be the last stdout line written.
 	const delimiter = ","
 
 	logFile = filepath.Join(c.config.LogDir, logName)
 
+	err = c.startBuild()
+	if err != nil {
+		return
+	}
+	defer c.activeBuilds.Done()
+
 	var lastStdoutLine string
 	onStdout := func(args ...interface{}) {
 		if len(args) == 0 {
@@ -52,8 +69,13 @@ func (c *ChrootAgent) BuildPackage(inputFile, logName string, dependencies []str
 		logger.Log.Trace(lastStdoutLine)
 	}
 
-	args := serializeChrootBuildAgentConfig(c.config, inputFile, logFile, dependencies)
-	err = shell.ExecuteLiveWithCallback(onStdout, logger.Log.Trace, true, c.config.Program, args...)
+	limits := c.config.PackageBuildLimits(basePackageName)
+	allowCheckFailure := c.config.CheckFailureAllowed(basePackageName)
+	metricsFile := filepath.Join(c.config.LogDir, buildMetricsName(logName))
+	args := serializeChrootBuildAgentConfig(c.config, limits, allowCheckFailure, inputFile, bcond, logFile, metricsFile, dependencies)
+	err = shell.ExecuteLiveWithCancelAndTimeout(c.cancel, limits.Timeout, buildTimeoutGracePeriod, onStdout, logger.Log.Trace, true, c.config.Program, args...)
+	err = buildLimitErrorFromExitCode(err)
+	mergeBuildMetrics(metricsFile)
 
 	if err == nil && lastStdoutLine != "" {
 		builtFiles = strings.Split(lastStdoutLine, delimiter)
@@ -67,13 +89,36 @@ func (c *ChrootAgent) Config() (config BuildAgentConfig) {
 	return *c.config
 }
 
-// Close closes the ChrootAgent, releasing any resources.
+// Close closes the ChrootAgent, stopping any active builds and waiting for them to exit.
+// No other process is affected, and no further builds can be started.
 func (c *ChrootAgent) Close() (err error) {
+	c.buildsMutex.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.cancel)
+	}
+	c.buildsMutex.Unlock()
+
+	c.activeBuilds.Wait()
+	return
+}
+
+// startBuild records a new active build, unless the agent was already closed.
+func (c *ChrootAgent) startBuild() (err error) {
+	c.buildsMutex.Lock()
+	defer c.buildsMutex.Unlock()
+
+	if c.closed {
+		err = fmt.Errorf("build agent is closed")
+		return
+	}
+
+	c.activeBuilds.Add(1)
 	return
 }
 
 // serializeChrootBuildAgentConfig serializes a BuildAgentConfig into arguments usable by pkgworker.
-func serializeChrootBuildAgentConfig(config *BuildAgentConfig, inputFile, logFile string, dependencies []string) (serializedArgs []string) {
+func serializeChrootBuildAgentConfig(config *BuildAgentConfig, limits BuildLimits, allowCheckFailure bool, inputFile, bcond, logFile, metricsFile string, dependencies []string) (serializedArgs []string) {
 	serializedArgs = []string{
 		fmt.Sprintf("--input=%s", inputFile),
 		fmt.Sprintf("--work-dir=%s", config.WorkDir),
@@ -87,12 +132,29 @@ func serializeChrootBuildAgentConfig(config *BuildAgentConfig, inputFile, logFil
 		fmt.Sprintf("--distro-build-number=%s", config.DistroBuildNumber),
 		fmt.Sprintf("--log-file=%s", logFile),
 		fmt.Sprintf("--log-level=%s", config.LogLevel),
+		fmt.Sprintf("--metrics-file=%s", metricsFile),
 	}
 
 	if config.RpmmacrosFile != "" {
 		serializedArgs = append(serializedArgs, fmt.Sprintf("--rpmmacros-file=%s", config.RpmmacrosFile))
 	}
 
+	if config.DebugRpmDir != "" {
+		serializedArgs = append(serializedArgs, fmt.Sprintf("--debug-rpm-dir=%s", config.DebugRpmDir))
+	}
+
+	if config.ChrootPoolDir != "" {
+		serializedArgs = append(serializedArgs, fmt.Sprintf("--chroot-pool-dir=%s", config.ChrootPoolDir))
+	}
+
+	if config.WorkerTarHash != "" {
+		serializedArgs = append(serializedArgs, fmt.Sprintf("--worker-tar-hash=%s", config.WorkerTarHash))
+	}
+
+	if config.CacheDependencies {
+		serializedArgs = append(serializedArgs, "--cache-dependencies")
+	}
+
 	if config.NoCleanup {
 		serializedArgs = append(serializedArgs, "--no-cleanup")
 	}
@@ -101,6 +163,16 @@ func serializeChrootBuildAgentConfig(config *BuildAgentConfig, inputFile, logFil
 		serializedArgs = append(serializedArgs, "--run-check")
 	}
 
+	if allowCheckFailure {
+		serializedArgs = append(serializedArgs, "--allow-check-failure")
+	}
+
+	if bcond != "" {
+		serializedArgs = append(serializedArgs, fmt.Sprintf("--with=%s", bcond))
+	}
+
+	serializedArgs = append(serializedArgs, serializeBuildLimits(limits)...)
+
 	for _, dependency := range dependencies {
 		serializedArgs = append(serializedArgs, fmt.Sprintf("--install-package=%s", dependency))
 	}
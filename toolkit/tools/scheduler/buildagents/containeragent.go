@@ -0,0 +1,345 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package buildagents
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"microsoft.com/pkggen/internal/file"
+	"microsoft.com/pkggen/internal/logger"
+	"microsoft.com/pkggen/internal/shell"
+)
+
+const (
+	// ContainerAgentFlag is the build-agent option for ContainerAgent.
+	ContainerAgentFlag = "container-agent"
+
+	// DefaultContainerRuntime is the container runtime used if none is configured.
+	DefaultContainerRuntime = "podman"
+)
+
+// Paths inside the build container. They must match the paths pkgworker and the local repo file expect.
+const (
+	containerProgram          = "/usr/local/bin/pkgworker"
+	containerInputDir         = "/input"
+	containerRepoFile         = "/input/local.repo"
+	containerRpmmacrosFile    = "/input/macros.override"
+	containerLocalRpmsDir     = "/localrpms"
+	containerLocalRpmsCache   = "/upstream-cached-rpms"
+	containerRpmOutputDir     = "/output/RPMS"
+	containerDebugRpmOutDir   = "/output/DEBUGRPMS"
+	containerSrpmOutputDir    = "/output/SRPMS"
+	containerLogDir           = "/output/logs"
+	containerImageName        = "localhost/pkgworker-chroot"
+	containerImageTagHashSize = 12
+)
+
+var (
+	// invalidContainerNameCharsRegex matches characters container runtimes do not accept in a container name.
+	invalidContainerNameCharsRegex = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+
+	// containerBuildCount counts the builds started by all container agents, it makes container names unique.
+	containerBuildCount uint64
+)
+
+// ContainerAgent implements the BuildAgent interface to build SRPMs inside rootless OCI containers
+// created from the worker chroot tarball.
+//
+// The container runtime must be podman compatible, overlay volumes (":O") are used to give each build
+// a private, writable view of the local RPM repository.
+type ContainerAgent struct {
+	config *BuildAgentConfig
+	image  string
+
+	containersMutex sync.Mutex
+	containers      map[string]bool
+}
+
+// NewContainerAgent returns a new ContainerAgent.
+func NewContainerAgent() *ContainerAgent {
+	return &ContainerAgent{
+		containers: make(map[string]bool),
+	}
+}
+
+// Initialize initializes the container agent with the given configuration.
+// It imports the worker chroot tarball as a container image if it has not been imported before.
+func (c *ContainerAgent) Initialize(config *BuildAgentConfig) (err error) {
+	c.config = config
+	if c.config.ContainerRuntime == "" {
+		c.config.ContainerRuntime = DefaultContainerRuntime
+	}
+
+	// Relative paths would be treated as named volumes by the container runtime.
+	hostPaths := []*string{&c.config.Program, &c.config.RepoFile, &c.config.RpmDir, &c.config.SrpmDir, &c.config.CacheDir, &c.config.LogDir, &c.config.RpmmacrosFile}
+	for _, hostPath := range hostPaths {
+		if *hostPath == "" {
+			continue
+		}
+
+		*hostPath, err = filepath.Abs(*hostPath)
+		if err != nil {
+			return
+		}
+	}
+
+	// Tag the image with the tarball's hash so a rebuilt worker chroot is imported again.
+	tarHash, err := file.GenerateSHA256(c.config.WorkerTar)
+	if err != nil {
+		return
+	}
+	c.image = fmt.Sprintf("%s:%s", containerImageName, tarHash[:containerImageTagHashSize])
+
+	_, _, err = shell.Execute(c.config.ContainerRuntime, "image", "inspect", c.image)
+	if err == nil {
+		logger.Log.Debugf("Using existing build container image (%s)", c.image)
+		return
+	}
+
+	logger.Log.Infof("Importing (%s) as build container image (%s)", c.config.WorkerTar, c.image)
+	_, stderr, err := shell.Execute(c.config.ContainerRuntime, "import", c.config.WorkerTar, c.image)
+	if err != nil {
+		err = fmt.Errorf("failed to import worker chroot into %s: %w, stderr: %s", c.config.ContainerRuntime, err, stderr)
+	}
+
+	return
+}
+
+// BuildPackage builds a given file and returns the output files or error.
+// - basePackageName is the base name of the package's spec, used to look up any package specific limits.
+// - inputFile is the SRPM to build.
+// - bcond is an optional spec build conditional to enable, like rpmbuild's "--with" option. Used to build bootstrap stages.
+// - logName is the file name to save the package build log to.
+// - dependencies is a list of dependencies that need to be installed before building.
+func (c *ContainerAgent) BuildPackage(basePackageName, inputFile, bcond, logName string, dependencies []string) (builtFiles []string, logFile string, err error) {
+	// On success, pkgworker will print a comma-seperated list of all RPMs built to stdout.
+	// This will be the last stdout line written.
+	const delimiter = ","
+
+	logFile = filepath.Join(c.config.LogDir, logName)
+
+	var lastStdoutLine string
+	onStdout := func(args ...interface{}) {
+		if len(args) == 0 {
+			return
+		}
+
+		lastStdoutLine = strings.TrimSpace(args[0].(string))
+		logger.Log.Trace(lastStdoutLine)
+	}
+
+	containerName := containerNameForBuild(inputFile, bcond)
+	c.trackContainer(containerName, true)
+	defer c.trackContainer(containerName, false)
+
+	limits := c.config.PackageBuildLimits(basePackageName)
+	allowCheckFailure := c.config.CheckFailureAllowed(basePackageName)
+	args := serializeContainerBuildAgentConfig(c.config, c.image, containerName, limits, allowCheckFailure, inputFile, bcond, logName, dependencies)
+	err = shell.ExecuteLiveWithCallbackAndTimeout(limits.Timeout, buildTimeoutGracePeriod, onStdout, logger.Log.Trace, true, c.config.ContainerRuntime, args...)
+	err = containerBuildLimitError(err, limits)
+	mergeBuildMetrics(filepath.Join(c.config.LogDir, buildMetricsName(logName)))
+
+	// The container may outlive a runtime client that was stopped, remove it so the build can be retried.
+	if errors.Is(err, shell.ErrTimedOut) {
+		shell.Execute(c.config.ContainerRuntime, "rm", "--force", "--ignore", containerName)
+	}
+
+	if err == nil && lastStdoutLine != "" {
+		for _, builtFile := range strings.Split(lastStdoutLine, delimiter) {
+			builtFiles = append(builtFiles, c.hostRPMPath(builtFile))
+		}
+	}
+
+	return
+}
+
+// Config returns a copy of the agent's configuration.
+func (c *ContainerAgent) Config() (config BuildAgentConfig) {
+	return *c.config
+}
+
+// Close closes the ContainerAgent, removing any build containers that are still running.
+func (c *ContainerAgent) Close() (err error) {
+	c.containersMutex.Lock()
+	defer c.containersMutex.Unlock()
+
+	for containerName := range c.containers {
+		logger.Log.Debugf("Removing build container (%s)", containerName)
+		_, stderr, rmErr := shell.Execute(c.config.ContainerRuntime, "rm", "--force", "--ignore", containerName)
+		if rmErr != nil {
+			logger.Log.Warnf("Failed to remove build container (%s): %s", containerName, stderr)
+			err = rmErr
+		}
+	}
+
+	return
+}
+
+// trackContainer records if a build container is running so it can be removed on Close.
+func (c *ContainerAgent) trackContainer(containerName string, running bool) {
+	c.containersMutex.Lock()
+	defer c.containersMutex.Unlock()
+
+	if running {
+		c.containers[containerName] = true
+	} else {
+		delete(c.containers, containerName)
+	}
+}
+
+// hostRPMPath translates the path of an RPM built inside the container to its path on the host.
+func (c *ContainerAgent) hostRPMPath(containerPath string) string {
+	containerDir, hostDir := containerRpmOutputDir, c.config.RpmDir
+	if c.config.DebugRpmDir != "" && strings.HasPrefix(containerPath, containerDebugRpmOutDir+"/") {
+		containerDir, hostDir = containerDebugRpmOutDir, c.config.DebugRpmDir
+	}
+
+	relPath, err := filepath.Rel(containerDir, containerPath)
+	if err != nil || strings.HasPrefix(relPath, "..") {
+		logger.Log.Warnf("Build container reported an RPM outside of its output directories (%s)", containerPath)
+		return containerPath
+	}
+
+	return filepath.Join(hostDir, relPath)
+}
+
+// serializeContainerBuildAgentConfig serializes a BuildAgentConfig into arguments for the container runtime to run pkgworker
+// on an SRPM in a container created from image.
+// CPU and memory limits are enforced by the container runtime, pkgworker only enforces the time limit.
+func serializeContainerBuildAgentConfig(config *BuildAgentConfig, image, containerName string, limits BuildLimits, allowCheckFailure bool, inputFile, bcond, logName string, dependencies []string) (serializedArgs []string) {
+	const (
+		readOnly       = "ro"
+		readWrite      = "rw"
+		privateOverlay = "O"
+	)
+
+	volume := func(hostPath, containerPath, options string) string {
+		return fmt.Sprintf("--volume=%s:%s:%s", hostPath, containerPath, options)
+	}
+
+	containerInputFile := filepath.Join(containerInputDir, filepath.Base(inputFile))
+
+	serializedArgs = []string{
+		"run",
+		fmt.Sprintf("--name=%s", containerName),
+		"--env=USER=root",
+		"--env=HOME=/root",
+		"--env=PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+		volume(config.Program, containerProgram, readOnly),
+		volume(inputFile, containerInputFile, readOnly),
+		volume(config.RepoFile, containerRepoFile, readOnly),
+		volume(config.RpmDir, containerLocalRpmsDir, privateOverlay),
+		volume(config.CacheDir, containerLocalRpmsCache, readOnly),
+		volume(config.RpmDir, containerRpmOutputDir, readWrite),
+		volume(config.SrpmDir, containerSrpmOutputDir, readWrite),
+		volume(config.LogDir, containerLogDir, readWrite),
+	}
+
+	// Keep the container around for inspection if requested.
+	if !config.NoCleanup {
+		serializedArgs = append(serializedArgs, "--rm")
+	}
+
+	if config.RpmmacrosFile != "" {
+		serializedArgs = append(serializedArgs, volume(config.RpmmacrosFile, containerRpmmacrosFile, readOnly))
+	}
+
+	if config.DebugRpmDir != "" {
+		serializedArgs = append(serializedArgs, volume(config.DebugRpmDir, containerDebugRpmOutDir, readWrite))
+	}
+
+	if limits.CPUs != 0 {
+		serializedArgs = append(serializedArgs, fmt.Sprintf("--cpus=%g", limits.CPUs))
+	}
+
+	// Setting the swap limit to the memory limit prevents the build from swapping.
+	if limits.MemoryMB != 0 {
+		serializedArgs = append(serializedArgs,
+			fmt.Sprintf("--memory=%dm", limits.MemoryMB),
+			fmt.Sprintf("--memory-swap=%dm", limits.MemoryMB),
+		)
+	}
+
+	serializedArgs = append(serializedArgs,
+		image,
+		containerProgram,
+		"--no-chroot",
+		fmt.Sprintf("--input=%s", containerInputFile),
+		fmt.Sprintf("--repo-file=%s", containerRepoFile),
+		fmt.Sprintf("--rpm-dir=%s", containerRpmOutputDir),
+		fmt.Sprintf("--srpm-dir=%s", containerSrpmOutputDir),
+		fmt.Sprintf("--cache-dir=%s", containerLocalRpmsCache),
+		fmt.Sprintf("--dist-tag=%s", config.DistTag),
+		fmt.Sprintf("--distro-release-version=%s", config.DistroReleaseVersion),
+		fmt.Sprintf("--distro-build-number=%s", config.DistroBuildNumber),
+		fmt.Sprintf("--log-file=%s", filepath.Join(containerLogDir, logName)),
+		fmt.Sprintf("--log-level=%s", config.LogLevel),
+		fmt.Sprintf("--metrics-file=%s", filepath.Join(containerLogDir, buildMetricsName(logName))),
+	)
+
+	if config.RpmmacrosFile != "" {
+		serializedArgs = append(serializedArgs, fmt.Sprintf("--rpmmacros-file=%s", containerRpmmacrosFile))
+	}
+
+	if config.DebugRpmDir != "" {
+		serializedArgs = append(serializedArgs, fmt.Sprintf("--debug-rpm-dir=%s", containerDebugRpmOutDir))
+	}
+
+	if config.RunCheck {
+		serializedArgs = append(serializedArgs, "--run-check")
+	}
+
+	if allowCheckFailure {
+		serializedArgs = append(serializedArgs, "--allow-check-failure")
+	}
+
+	if bcond != "" {
+		serializedArgs = append(serializedArgs, fmt.Sprintf("--with=%s", bcond))
+	}
+
+	serializedArgs = append(serializedArgs, serializeBuildLimits(BuildLimits{TimeLimit: limits.TimeLimit})...)
+
+	// Dependencies are passed as host paths, pkgworker only uses their base names.
+	for _, dependency := range dependencies {
+		serializedArgs = append(serializedArgs, fmt.Sprintf("--install-package=%s", dependency))
+	}
+
+	return
+}
+
+// containerBuildLimitError converts the error of a container that was stopped for exceeding one of its limits into a BuildLimitError.
+func containerBuildLimitError(err error, limits BuildLimits) error {
+	// Container runtimes report a process killed by the kernel's OOM killer as exit code 128+SIGKILL.
+	const oomKilledExitCode = 137
+
+	var exitErr *exec.ExitError
+	if limits.MemoryMB != 0 && errors.As(err, &exitErr) && exitErr.ExitCode() == oomKilledExitCode {
+		return &BuildLimitError{Limit: ExceededMemoryLimit}
+	}
+
+	return buildLimitErrorFromExitCode(err)
+}
+
+// containerNameForBuild returns a container name unique to a single build of an SRPM.
+// The same SRPM may be built by several builds at once, e.g. by different agents checking if it builds reproducibly,
+// and containers kept around for inspection must not clash with later attempts.
+func containerNameForBuild(srpmFile, bcond string) string {
+	buildName := strings.TrimSuffix(filepath.Base(srpmFile), ".src.rpm")
+	if bcond != "" {
+		buildName = fmt.Sprintf("%s-%s", buildName, bcond)
+	}
+
+	buildNumber := atomic.AddUint64(&containerBuildCount, 1)
+	buildName = fmt.Sprintf("%s-%d-%d", buildName, os.Getpid(), buildNumber)
+
+	return fmt.Sprintf("pkgworker-%s", invalidContainerNameCharsRegex.ReplaceAllString(buildName, "_"))
+}
@@ -0,0 +1,224 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package buildagents
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// containerAgentTestConfig returns the configuration of a container agent using host paths under /host.
+func containerAgentTestConfig() *BuildAgentConfig {
+	return &BuildAgentConfig{
+		Program:              "/host/bin/pkgworker",
+		RepoFile:             "/host/local.repo",
+		RpmDir:               "/host/RPMS",
+		SrpmDir:              "/host/SRPMS",
+		CacheDir:             "/host/cache",
+		LogDir:               "/host/logs",
+		DistTag:              ".cm1",
+		DistroReleaseVersion: "1.0",
+		DistroBuildNumber:    "42",
+		LogLevel:             "info",
+	}
+}
+
+func TestSerializeContainerBuildAgentConfig(t *testing.T) {
+	tests := []struct {
+		name              string
+		changeConfig      func(config *BuildAgentConfig)
+		limits            BuildLimits
+		allowCheckFailure bool
+		bcond             string
+		dependencies      []string
+		expectedArgs      []string
+		unexpectedArgs    []string
+	}{
+		{
+			name: "defaults",
+			expectedArgs: []string{
+				"--volume=/host/bin/pkgworker:/usr/local/bin/pkgworker:ro",
+				"--volume=/host/SRPMS/A-1.0-1.src.rpm:/input/A-1.0-1.src.rpm:ro",
+				"--volume=/host/local.repo:/input/local.repo:ro",
+				"--volume=/host/cache:/upstream-cached-rpms:ro",
+				"--volume=/host/SRPMS:/output/SRPMS:rw",
+				"--volume=/host/logs:/output/logs:rw",
+				"--rm",
+				"--input=/input/A-1.0-1.src.rpm",
+				"--dist-tag=.cm1",
+				"--distro-release-version=1.0",
+				"--distro-build-number=42",
+				"--log-file=/output/logs/A-1.0-1.src.rpm.log",
+				"--metrics-file=/output/logs/" + buildMetricsName("A-1.0-1.src.rpm.log"),
+			},
+			unexpectedArgs: []string{"--run-check", "--allow-check-failure", "--debug-rpm-dir=/output/DEBUGRPMS", "--rpmmacros-file=/input/macros.override"},
+		},
+		{
+			name: "local RPMs",
+			expectedArgs: []string{
+				// Builds install dependencies from a private overlay of the local repo, but write built RPMs straight into it.
+				"--volume=/host/RPMS:/localrpms:O",
+				"--volume=/host/RPMS:/output/RPMS:rw",
+				"--rpm-dir=/output/RPMS",
+				"--cache-dir=/upstream-cached-rpms",
+			},
+		},
+		{
+			name:         "keep container",
+			changeConfig: func(config *BuildAgentConfig) { config.NoCleanup = true },
+			unexpectedArgs: []string{
+				"--rm",
+			},
+		},
+		{
+			name: "rpmmacros and debug RPMs",
+			changeConfig: func(config *BuildAgentConfig) {
+				config.RpmmacrosFile = "/host/macros.override"
+				config.DebugRpmDir = "/host/DEBUGRPMS"
+			},
+			expectedArgs: []string{
+				"--volume=/host/macros.override:/input/macros.override:ro",
+				"--rpmmacros-file=/input/macros.override",
+				"--volume=/host/DEBUGRPMS:/output/DEBUGRPMS:rw",
+				"--debug-rpm-dir=/output/DEBUGRPMS",
+			},
+		},
+		{
+			name:              "check",
+			changeConfig:      func(config *BuildAgentConfig) { config.RunCheck = true },
+			allowCheckFailure: true,
+			expectedArgs:      []string{"--run-check", "--allow-check-failure"},
+		},
+		{
+			name:         "bootstrap stage",
+			bcond:        "bootstrap",
+			expectedArgs: []string{"--with=bootstrap"},
+		},
+		{
+			name:   "limits",
+			limits: BuildLimits{CPUs: 1.5, MemoryMB: 2048, TimeLimit: time.Hour, Timeout: 2 * time.Hour},
+			expectedArgs: []string{
+				"--cpus=1.5",
+				"--memory=2048m",
+				"--memory-swap=2048m",
+				// Only the time limit is left to pkgworker, the container runtime enforces the others.
+				"--max-build-time=1h0m0s",
+			},
+			unexpectedArgs: []string{"--max-cpus=1.5", "--max-memory-mb=2048"},
+		},
+		{
+			name:         "dependencies",
+			dependencies: []string{"/host/RPMS/x86_64/B-1.0-1.x86_64.rpm"},
+			expectedArgs: []string{"--install-package=/host/RPMS/x86_64/B-1.0-1.x86_64.rpm"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := containerAgentTestConfig()
+			if test.changeConfig != nil {
+				test.changeConfig(config)
+			}
+
+			args := serializeContainerBuildAgentConfig(config, "localhost/pkgworker-chroot:0123456789ab", "pkgworker-A", test.limits, test.allowCheckFailure, "/host/SRPMS/A-1.0-1.src.rpm", test.bcond, "A-1.0-1.src.rpm.log", test.dependencies)
+
+			assert.Equal(t, []string{"run", "--name=pkgworker-A"}, args[:2])
+			for _, expectedArg := range test.expectedArgs {
+				assert.Contains(t, args, expectedArg)
+			}
+			for _, unexpectedArg := range test.unexpectedArgs {
+				assert.NotContains(t, args, unexpectedArg)
+			}
+
+			// Everything after the image is passed to pkgworker inside the container.
+			imageIndex := indexOf(args, "localhost/pkgworker-chroot:0123456789ab")
+			assert.True(t, imageIndex > 0)
+			assert.Equal(t, []string{containerProgram, "--no-chroot"}, args[imageIndex+1:imageIndex+3])
+			for _, arg := range args[:imageIndex] {
+				assert.False(t, strings.HasPrefix(arg, "--input="), "pkgworker argument (%s) passed to the container runtime", arg)
+			}
+			for _, arg := range args[imageIndex+1:] {
+				assert.False(t, strings.HasPrefix(arg, "--volume="), "container runtime argument (%s) passed to pkgworker", arg)
+			}
+		})
+	}
+}
+
+func TestHostRPMPath(t *testing.T) {
+	tests := []struct {
+		name          string
+		debugRpmDir   string
+		containerPath string
+		expectedPath  string
+	}{
+		{"built RPM", "", "/output/RPMS/x86_64/A-1.0-1.x86_64.rpm", "/host/RPMS/x86_64/A-1.0-1.x86_64.rpm"},
+		{"debug RPM", "/host/DEBUGRPMS", "/output/DEBUGRPMS/x86_64/A-debuginfo-1.0-1.x86_64.rpm", "/host/DEBUGRPMS/x86_64/A-debuginfo-1.0-1.x86_64.rpm"},
+		{"RPM in the local repo overlay", "", "/localrpms/x86_64/B-1.0-1.x86_64.rpm", "/localrpms/x86_64/B-1.0-1.x86_64.rpm"},
+		{"debug RPM without a debug RPM directory", "", "/output/DEBUGRPMS/x86_64/A-debuginfo-1.0-1.x86_64.rpm", "/output/DEBUGRPMS/x86_64/A-debuginfo-1.0-1.x86_64.rpm"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			agent := NewContainerAgent()
+			agent.config = containerAgentTestConfig()
+			agent.config.DebugRpmDir = test.debugRpmDir
+
+			assert.Equal(t, test.expectedPath, agent.hostRPMPath(test.containerPath))
+		})
+	}
+}
+
+func TestContainerNameForBuild(t *testing.T) {
+	name := containerNameForBuild("/host/SRPMS/A-1.0-1.src.rpm", "")
+	assert.True(t, strings.HasPrefix(name, "pkgworker-A-1.0-1-"), name)
+	assert.NotEqual(t, name, containerNameForBuild("/host/SRPMS/A-1.0-1.src.rpm", ""), "every build must get its own container")
+
+	name = containerNameForBuild("/host/SRPMS/gcc-c++-1.0-1.src.rpm", "bootstrap")
+	assert.True(t, strings.HasPrefix(name, "pkgworker-gcc-c__-1.0-1-bootstrap-"), name)
+	assert.Regexp(t, `^[a-zA-Z0-9_.-]+$`, name)
+}
+
+func TestContainerAgentCloseRemovesRunningContainers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "containeragent")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// A fake container runtime recording the commands it is run with.
+	commandsFile := filepath.Join(dir, "commands")
+	runtime := filepath.Join(dir, "runtime")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$@\" >> %s\n", commandsFile)
+	assert.NoError(t, ioutil.WriteFile(runtime, []byte(script), 0755))
+
+	agent := NewContainerAgent()
+	agent.config = containerAgentTestConfig()
+	agent.config.ContainerRuntime = runtime
+
+	agent.trackContainer("pkgworker-A", true)
+	agent.trackContainer("pkgworker-B", true)
+	agent.trackContainer("pkgworker-B", false)
+
+	assert.NoError(t, agent.Close())
+
+	commands, err := ioutil.ReadFile(commandsFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "rm --force --ignore pkgworker-A\n", string(commands))
+}
+
+// indexOf returns the index of the first occurrence of value in values, or -1.
+func indexOf(values []string, value string) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+
+	return -1
+}
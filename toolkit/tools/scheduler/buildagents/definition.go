@@ -9,20 +9,31 @@ import "fmt"
 type BuildAgentConfig struct {
 	Program string
 
-	WorkDir   string
-	WorkerTar string
-	RepoFile  string
-	RpmDir    string
-	SrpmDir   string
-	CacheDir  string
+	WorkDir       string
+	WorkerTar     string
+	WorkerTarHash string
+	ChrootPoolDir string
+	RepoFile      string
+	RpmDir        string
+	DebugRpmDir   string
+	SrpmDir       string
+	CacheDir      string
 
 	DistTag              string
 	DistroReleaseVersion string
 	DistroBuildNumber    string
 	RpmmacrosFile        string
 
-	NoCleanup bool
-	RunCheck  bool
+	NoCleanup         bool
+	RunCheck          bool
+	CacheDependencies bool
+	NonFatalChecks    map[string]bool
+
+	Limits        BuildLimits
+	PackageLimits map[string]BuildLimits
+
+	ContainerRuntime string
+	RemoteWorkers    []string
 
 	LogDir   string
 	LogLevel string
@@ -34,10 +45,13 @@ type BuildAgent interface {
 	Initialize(config *BuildAgentConfig) error
 
 	// BuildPackage builds a given file and returns the output files or error.
+	// If DebugRpmDir is set, the output files include any debug RPMs placed there.
+	// - basePackageName is the base name of the package's spec, used to look up any package specific limits.
 	// - inputFile is the SRPM to build.
+	// - bcond is an optional spec build conditional to enable, like rpmbuild's "--with" option. Used to build bootstrap stages.
 	// - logName is the file name to save the package build log to.
 	// - dependencies is a list of dependencies that need to be installed before building.
-	BuildPackage(inputFile, logName string, dependencies []string) ([]string, string, error)
+	BuildPackage(basePackageName, inputFile, bcond, logName string, dependencies []string) ([]string, string, error)
 
 	// Config returns a copy of the agent's configuration.
 	Config() BuildAgentConfig
@@ -53,6 +67,10 @@ func BuildAgentFactory(buildAgent string) (agent BuildAgent, err error) {
 		agent = NewTestAgent()
 	case ChrootAgentFlag:
 		agent = NewChrootAgent()
+	case ContainerAgentFlag:
+		agent = NewContainerAgent()
+	case RemoteAgentFlag:
+		agent = NewRemoteAgent()
 	default:
 		err = fmt.Errorf("unknown build agent type (%s)", buildAgent)
 	}
@@ -0,0 +1,636 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package buildagents
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"microsoft.com/pkggen/internal/file"
+	"microsoft.com/pkggen/internal/logger"
+	"microsoft.com/pkggen/internal/network"
+	"microsoft.com/pkggen/internal/shell"
+)
+
+// RemoteAgentFlag is the build-agent option for RemoteAgent.
+const RemoteAgentFlag = "remote-agent"
+
+// Remote build protocol shared by RemoteAgent and the remoteworker daemon.
+//
+// - GET  RemoteStatusPath returns a RemoteWorkerStatus.
+// - HEAD/GET/PUT RemoteFilesPath/<area>/<path> checks, downloads or uploads a file in one of the worker's areas.
+//   The SHA256 of the file is sent in the RemoteSHA256Header.
+// - DELETE RemoteFilesPath/RemoteDebugRpmsArea/<build> removes the debug RPMs of a build once they are downloaded.
+// - POST RemoteBuildPath with a RemoteBuildRequest builds an SRPM, the response is a newline delimited
+//   stream of RemoteBuildMessages. The last message has Done set.
+const (
+	RemoteStatusPath   = "/v1/status"
+	RemoteBuildPath    = "/v1/build"
+	RemoteFilesPath    = "/v1/files"
+	RemoteSHA256Header = "X-Content-Sha256"
+
+	// RemoteRpmsArea holds the worker's local RPM repository, including any RPMs it builds.
+	RemoteRpmsArea = "rpms"
+	// RemoteCacheArea holds the worker's copy of the upstream RPM cache.
+	RemoteCacheArea = "cache"
+	// RemoteInputsArea holds the SRPMs and other files needed for a build.
+	RemoteInputsArea = "inputs"
+	// RemoteDebugRpmsArea holds the debuginfo and debugsource RPMs built, in a directory for each build.
+	RemoteDebugRpmsArea = "debugrpms"
+)
+
+// RemoteWorkerStatus describes how busy a remote worker is.
+type RemoteWorkerStatus struct {
+	ActiveBuilds int
+	MaxBuilds    int
+}
+
+// RemoteBuildRequest asks a remote worker to build an SRPM. All files are paths inside the worker's areas.
+type RemoteBuildRequest struct {
+	BasePackageName string
+
+	SrpmFile      string
+	LogName       string
+	Dependencies  []string
+	RpmmacrosFile string
+	// Bcond is an optional spec build conditional to enable, used to build bootstrap stages.
+	Bcond string
+
+	DistTag              string
+	DistroReleaseVersion string
+	DistroBuildNumber    string
+
+	NoCleanup         bool
+	RunCheck          bool
+	AllowCheckFailure bool
+	// SeparateDebugRPMs requests debuginfo and debugsource RPMs to be kept apart from the worker's local RPM repository.
+	SeparateDebugRPMs bool
+
+	Limits BuildLimits
+}
+
+// RemoteBuildMessage is a single message streamed back while a remote worker builds an SRPM.
+type RemoteBuildMessage struct {
+	Log        string   `json:",omitempty"`
+	Done       bool     `json:",omitempty"`
+	BuiltFiles []string `json:",omitempty"`
+	// BuiltDebugFiles are the debug RPMs built if SeparateDebugRPMs was requested, as paths in the RemoteDebugRpmsArea.
+	BuiltDebugFiles []string `json:",omitempty"`
+	Err             string   `json:",omitempty"`
+	// ExceededLimit is set if the build failed because it exceeded one of its limits.
+	ExceededLimit string `json:",omitempty"`
+	// TimedOut is set if the build failed because it exceeded its timeout.
+	TimedOut bool `json:",omitempty"`
+}
+
+// remoteWorker tracks a remote worker daemon.
+type remoteWorker struct {
+	url          string
+	maxBuilds    int
+	activeBuilds int
+}
+
+// RemoteAgent implements the BuildAgent interface to build SRPMs on one or more remote worker daemons.
+// Dependencies are uploaded to the least busy worker before each build and any built RPMs are downloaded into RpmDir.
+// Once every worker runs as many builds as it allows, further builds wait for one of them to finish.
+type RemoteAgent struct {
+	config *BuildAgentConfig
+	client *http.Client
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// workersMutex guards the workers' active builds, workerFreed is signaled whenever a build slot is released.
+	workersMutex sync.Mutex
+	workerFreed  *sync.Cond
+	workers      []*remoteWorker
+
+	// buildsMutex guards closed and adding to activeBuilds.
+	buildsMutex  sync.Mutex
+	closed       bool
+	activeBuilds sync.WaitGroup
+}
+
+// NewRemoteAgent returns a new RemoteAgent.
+func NewRemoteAgent() *RemoteAgent {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &RemoteAgent{
+		client: &http.Client{},
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	r.workerFreed = sync.NewCond(&r.workersMutex)
+
+	return r
+}
+
+// Initialize initializes the remote agent with the given configuration, connecting to every remote worker.
+func (r *RemoteAgent) Initialize(config *BuildAgentConfig) (err error) {
+	r.config = config
+
+	if len(r.config.RemoteWorkers) == 0 {
+		return fmt.Errorf("%s requires at least one remote worker", RemoteAgentFlag)
+	}
+
+	for _, url := range r.config.RemoteWorkers {
+		worker := &remoteWorker{url: strings.TrimSuffix(url, "/")}
+
+		status := &RemoteWorkerStatus{}
+		err = r.getJSON(worker.url+RemoteStatusPath, status)
+		if err != nil {
+			return fmt.Errorf("unable to connect to remote worker (%s): %w", worker.url, err)
+		}
+
+		worker.maxBuilds = status.MaxBuilds
+		if worker.maxBuilds <= 0 {
+			worker.maxBuilds = 1
+		}
+
+		if r.config.RpmmacrosFile != "" {
+			err = r.uploadFile(worker, RemoteInputsArea, filepath.Base(r.config.RpmmacrosFile), r.config.RpmmacrosFile)
+			if err != nil {
+				return
+			}
+		}
+
+		logger.Log.Infof("Connected to remote worker (%s), running up to %d builds", worker.url, worker.maxBuilds)
+		r.workers = append(r.workers, worker)
+	}
+
+	return
+}
+
+// BuildPackage builds a given file and returns the output files or error.
+// - basePackageName is the base name of the package's spec, used to look up any package specific limits.
+// - inputFile is the SRPM to build.
+// - bcond is an optional spec build conditional to enable, like rpmbuild's "--with" option. Used to build bootstrap stages.
+// - logName is the file name to save the package build log to.
+// - dependencies is a list of dependencies that need to be installed before building.
+func (r *RemoteAgent) BuildPackage(basePackageName, inputFile, bcond, logName string, dependencies []string) (builtFiles []string, logFile string, err error) {
+	logFile = filepath.Join(r.config.LogDir, logName)
+
+	err = r.startBuild()
+	if err != nil {
+		return
+	}
+	defer r.activeBuilds.Done()
+
+	worker, err := r.acquireWorker()
+	if err != nil {
+		return
+	}
+	defer r.releaseWorker(worker)
+
+	logger.Log.Debugf("Building (%s) on remote worker (%s)", filepath.Base(inputFile), worker.url)
+
+	req := &RemoteBuildRequest{
+		BasePackageName:      basePackageName,
+		SrpmFile:             filepath.Join(RemoteInputsArea, filepath.Base(inputFile)),
+		LogName:              logName,
+		Bcond:                bcond,
+		DistTag:              r.config.DistTag,
+		DistroReleaseVersion: r.config.DistroReleaseVersion,
+		DistroBuildNumber:    r.config.DistroBuildNumber,
+		NoCleanup:            r.config.NoCleanup,
+		RunCheck:             r.config.RunCheck,
+		AllowCheckFailure:    r.config.CheckFailureAllowed(basePackageName),
+		SeparateDebugRPMs:    r.config.DebugRpmDir != "",
+		Limits:               r.config.PackageBuildLimits(basePackageName),
+	}
+
+	if r.config.RpmmacrosFile != "" {
+		req.RpmmacrosFile = filepath.Join(RemoteInputsArea, filepath.Base(r.config.RpmmacrosFile))
+	}
+
+	err = r.uploadFile(worker, RemoteInputsArea, filepath.Base(inputFile), inputFile)
+	if err != nil {
+		return
+	}
+
+	for _, dependency := range dependencies {
+		var area, relPath string
+		area, relPath, err = r.remotePath(dependency)
+		if err != nil {
+			return
+		}
+
+		err = r.uploadFile(worker, area, relPath, dependency)
+		if err != nil {
+			return
+		}
+
+		req.Dependencies = append(req.Dependencies, filepath.Join(area, relPath))
+	}
+
+	remoteBuiltFiles, remoteBuiltDebugFiles, err := r.runRemoteBuild(worker, req, logFile)
+	if err != nil {
+		return
+	}
+
+	debugBuilds := make(map[string]bool)
+	for _, remoteBuiltDebugFile := range remoteBuiltDebugFiles {
+		var build, localFile string
+		build, localFile, err = r.downloadDebugFile(worker, remoteBuiltDebugFile)
+		if err != nil {
+			return
+		}
+
+		debugBuilds[build] = true
+		builtFiles = append(builtFiles, localFile)
+	}
+
+	for build := range debugBuilds {
+		err = r.deleteRemoteFile(worker, RemoteDebugRpmsArea, build)
+		if err != nil {
+			logger.Log.Warnf("Failed to remove debug RPMs of (%s) from remote worker (%s), error: %s", build, worker.url, err)
+			err = nil
+		}
+	}
+
+	for _, remoteBuiltFile := range remoteBuiltFiles {
+		localFile := filepath.Join(r.config.RpmDir, remoteBuiltFile)
+		err = r.downloadFile(worker, RemoteRpmsArea, remoteBuiltFile, localFile)
+		if err != nil {
+			return
+		}
+
+		builtFiles = append(builtFiles, localFile)
+	}
+
+	// A local build would place the SRPM in the output directory as well.
+	err = file.Copy(inputFile, filepath.Join(r.config.SrpmDir, filepath.Base(inputFile)))
+
+	return
+}
+
+// Config returns a copy of the agent's configuration.
+func (r *RemoteAgent) Config() (config BuildAgentConfig) {
+	return *r.config
+}
+
+// Close closes the RemoteAgent, stopping any active builds and waiting for them to exit.
+// Cancelling a build's request makes the remote worker stop it. No further builds can be started.
+func (r *RemoteAgent) Close() (err error) {
+	r.buildsMutex.Lock()
+	r.closed = true
+	r.cancel()
+	r.buildsMutex.Unlock()
+
+	// Wake any builds waiting for a free worker, so they see the agent was closed.
+	r.workersMutex.Lock()
+	r.workerFreed.Broadcast()
+	r.workersMutex.Unlock()
+
+	r.activeBuilds.Wait()
+	return
+}
+
+// startBuild records a new active build, unless the agent was already closed.
+func (r *RemoteAgent) startBuild() (err error) {
+	r.buildsMutex.Lock()
+	defer r.buildsMutex.Unlock()
+
+	if r.closed {
+		err = fmt.Errorf("build agent is closed")
+		return
+	}
+
+	r.activeBuilds.Add(1)
+	return
+}
+
+// acquireWorker reserves a build slot on the least busy remote worker, waiting until one of the workers has a free slot.
+func (r *RemoteAgent) acquireWorker() (worker *remoteWorker, err error) {
+	r.workersMutex.Lock()
+	defer r.workersMutex.Unlock()
+
+	for {
+		if r.ctx.Err() != nil {
+			err = fmt.Errorf("build agent is closed")
+			return
+		}
+
+		for _, candidate := range r.workers {
+			if candidate.activeBuilds >= candidate.maxBuilds {
+				continue
+			}
+
+			if worker == nil || candidate.activeBuilds*worker.maxBuilds < worker.activeBuilds*candidate.maxBuilds {
+				worker = candidate
+			}
+		}
+
+		if worker != nil {
+			break
+		}
+
+		r.workerFreed.Wait()
+	}
+
+	worker.activeBuilds++
+	return
+}
+
+// releaseWorker frees a build slot reserved with acquireWorker.
+func (r *RemoteAgent) releaseWorker(worker *remoteWorker) {
+	r.workersMutex.Lock()
+	defer r.workersMutex.Unlock()
+
+	worker.activeBuilds--
+	r.workerFreed.Signal()
+}
+
+// remotePath maps a local dependency to its area and relative path on a remote worker.
+func (r *RemoteAgent) remotePath(localPath string) (area, relPath string, err error) {
+	areas := []struct {
+		name string
+		dir  string
+	}{
+		{RemoteRpmsArea, r.config.RpmDir},
+		{RemoteCacheArea, r.config.CacheDir},
+	}
+
+	for _, candidate := range areas {
+		if candidate.dir == "" {
+			continue
+		}
+
+		relPath, err = filepath.Rel(candidate.dir, localPath)
+		if err == nil && !strings.HasPrefix(relPath, "..") {
+			area = candidate.name
+			return
+		}
+	}
+
+	err = fmt.Errorf("dependency (%s) is not in the RPM or cache directory", localPath)
+	return
+}
+
+// runRemoteBuild submits a build request to a worker, writing the streamed build log to logFile.
+func (r *RemoteAgent) runRemoteBuild(worker *remoteWorker, req *RemoteBuildRequest, logFile string) (builtFiles, builtDebugFiles []string, err error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return
+	}
+
+	// The remote worker enforces the build's timeout itself, only give up early on a worker that stopped responding.
+	ctx := r.ctx
+	if req.Limits.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(r.ctx, req.Limits.Timeout+2*buildTimeoutGracePeriod)
+		defer cancel()
+	}
+
+	defer func() {
+		if err != nil && ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("remote worker (%s) stopped responding: %w", worker.url, shell.ErrTimedOut)
+		}
+	}()
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, worker.url+RemoteBuildPath, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+
+	resp, err := r.client.Do(httpReq)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err = remoteError(resp)
+		return
+	}
+
+	log, err := os.Create(logFile)
+	if err != nil {
+		return
+	}
+	defer log.Close()
+
+	decoder := json.NewDecoder(bufio.NewReader(resp.Body))
+	for {
+		msg := &RemoteBuildMessage{}
+		err = decoder.Decode(msg)
+		if err != nil {
+			if err == io.EOF {
+				err = fmt.Errorf("remote worker (%s) closed the connection before the build finished", worker.url)
+			}
+			return
+		}
+
+		if msg.Log != "" {
+			_, err = log.WriteString(msg.Log + "\n")
+			if err != nil {
+				return
+			}
+		}
+
+		if msg.Done {
+			if msg.ExceededLimit != "" {
+				err = &BuildLimitError{Limit: msg.ExceededLimit}
+				return
+			}
+
+			if msg.TimedOut {
+				err = fmt.Errorf("remote build on (%s) failed: %w", worker.url, shell.ErrTimedOut)
+				return
+			}
+
+			if msg.Err != "" {
+				err = fmt.Errorf("remote build on (%s) failed: %s", worker.url, msg.Err)
+				return
+			}
+
+			builtFiles = msg.BuiltFiles
+			builtDebugFiles = msg.BuiltDebugFiles
+			return
+		}
+	}
+}
+
+// downloadDebugFile downloads a debug RPM built on a worker into DebugRpmDir.
+// The worker keeps the debug RPMs of each build in their own directory, which is not part of the local path.
+func (r *RemoteAgent) downloadDebugFile(worker *remoteWorker, relPath string) (build, localFile string, err error) {
+	const pathSeparator = "/"
+
+	parts := strings.SplitN(filepath.ToSlash(relPath), pathSeparator, 2)
+	if len(parts) != 2 {
+		err = fmt.Errorf("invalid debug RPM path (%s) from remote worker (%s)", relPath, worker.url)
+		return
+	}
+
+	build = parts[0]
+	localFile = filepath.Join(r.config.DebugRpmDir, parts[1])
+	err = r.downloadFile(worker, RemoteDebugRpmsArea, relPath, localFile)
+	return
+}
+
+// deleteRemoteFile removes a file or directory from one of a worker's areas.
+func (r *RemoteAgent) deleteRemoteFile(worker *remoteWorker, area, relPath string) (err error) {
+	req, err := http.NewRequestWithContext(r.ctx, http.MethodDelete, remoteFileURL(worker, area, relPath), nil)
+	if err != nil {
+		return
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err = remoteError(resp)
+	}
+
+	return
+}
+
+// uploadFile uploads a local file to a worker, unless the worker already has an identical copy.
+func (r *RemoteAgent) uploadFile(worker *remoteWorker, area, relPath, localPath string) (err error) {
+	url := remoteFileURL(worker, area, relPath)
+
+	hash, err := file.GenerateSHA256(localPath)
+	if err != nil {
+		return
+	}
+
+	headReq, err := http.NewRequestWithContext(r.ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return
+	}
+
+	resp, err := r.client.Do(headReq)
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK && resp.Header.Get(RemoteSHA256Header) == hash {
+		return
+	}
+
+	localFile, err := os.Open(localPath)
+	if err != nil {
+		return
+	}
+	defer localFile.Close()
+
+	logger.Log.Tracef("Uploading (%s) to (%s)", localPath, url)
+
+	putReq, err := http.NewRequestWithContext(r.ctx, http.MethodPut, url, localFile)
+	if err != nil {
+		return
+	}
+	putReq.Header.Set(RemoteSHA256Header, hash)
+
+	resp, err = r.client.Do(putReq)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return remoteError(resp)
+	}
+
+	return
+}
+
+// downloadFile downloads a file from a worker to localPath, verifying its hash.
+func (r *RemoteAgent) downloadFile(worker *remoteWorker, area, relPath, localPath string) (err error) {
+	const tmpSuffix = ".download"
+
+	url := remoteFileURL(worker, area, relPath)
+
+	req, err := http.NewRequestWithContext(r.ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return remoteError(resp)
+	}
+
+	err = os.MkdirAll(filepath.Dir(localPath), os.ModePerm)
+	if err != nil {
+		return
+	}
+
+	// Download to a temporary file first so a partial download is never mistaken for a built RPM.
+	tmpPath := localPath + tmpSuffix
+	tmpFile, err := os.Create(tmpPath)
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmpPath)
+
+	_, err = io.Copy(tmpFile, resp.Body)
+	tmpFile.Close()
+	if err != nil {
+		return
+	}
+
+	hash, err := file.GenerateSHA256(tmpPath)
+	if err != nil {
+		return
+	}
+
+	expectedHash := resp.Header.Get(RemoteSHA256Header)
+	if hash != expectedHash {
+		return fmt.Errorf("downloaded (%s) has SHA256 %s, expected %s", url, hash, expectedHash)
+	}
+
+	return os.Rename(tmpPath, localPath)
+}
+
+// getJSON decodes the JSON response of a GET request.
+func (r *RemoteAgent) getJSON(url string, data interface{}) (err error) {
+	req, err := http.NewRequestWithContext(r.ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return remoteError(resp)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(data)
+}
+
+// remoteFileURL returns the URL of a file in one of a worker's areas.
+func remoteFileURL(worker *remoteWorker, area, relPath string) string {
+	return network.JoinURL(worker.url+RemoteFilesPath, area, filepath.ToSlash(relPath))
+}
+
+// remoteError converts an unsuccessful response into an error.
+func remoteError(resp *http.Response) error {
+	const maxErrorLength = 4096
+
+	message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorLength))
+	return fmt.Errorf("remote worker request (%s %s) failed with %s: %s", resp.Request.Method, resp.Request.URL, resp.Status, strings.TrimSpace(string(message)))
+}
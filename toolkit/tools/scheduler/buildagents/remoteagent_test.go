@@ -0,0 +1,123 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package buildagents
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"microsoft.com/pkggen/internal/logger"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitStderrLog()
+	os.Exit(m.Run())
+}
+
+// remoteAgentTestHelper returns a remote agent with the given workers, without connecting to them.
+func remoteAgentTestHelper(workers ...*remoteWorker) (r *RemoteAgent) {
+	r = NewRemoteAgent()
+	r.config = &BuildAgentConfig{RpmDir: "/local/RPMS", CacheDir: "/local/cache"}
+	r.workers = workers
+	return
+}
+
+func TestAcquireWorkerPicksLeastBusyWorker(t *testing.T) {
+	busy := &remoteWorker{url: "busy", maxBuilds: 2, activeBuilds: 1}
+	idle := &remoteWorker{url: "idle", maxBuilds: 2}
+	r := remoteAgentTestHelper(busy, idle)
+
+	worker, err := r.acquireWorker()
+	assert.NoError(t, err)
+	assert.Equal(t, idle, worker)
+	assert.Equal(t, 1, idle.activeBuilds)
+}
+
+func TestAcquireWorkerWaitsForFreeSlot(t *testing.T) {
+	const waitTimeout = 10 * time.Second
+
+	worker := &remoteWorker{url: "worker", maxBuilds: 1}
+	r := remoteAgentTestHelper(worker)
+
+	first, err := r.acquireWorker()
+	assert.NoError(t, err)
+
+	acquired := make(chan *remoteWorker, 1)
+	go func() {
+		second, _ := r.acquireWorker()
+		acquired <- second
+	}()
+
+	select {
+	case <-acquired:
+		assert.Fail(t, "acquired a slot on a worker running its maximum number of builds")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	r.releaseWorker(first)
+
+	select {
+	case second := <-acquired:
+		assert.Equal(t, worker, second)
+		assert.Equal(t, 1, worker.activeBuilds)
+	case <-time.After(waitTimeout):
+		assert.Fail(t, "did not acquire the released slot")
+	}
+}
+
+func TestAcquireWorkerFailsOnceClosed(t *testing.T) {
+	const waitTimeout = 10 * time.Second
+
+	worker := &remoteWorker{url: "worker", maxBuilds: 1}
+	r := remoteAgentTestHelper(worker)
+
+	_, err := r.acquireWorker()
+	assert.NoError(t, err)
+
+	acquireErr := make(chan error, 1)
+	go func() {
+		_, err := r.acquireWorker()
+		acquireErr <- err
+	}()
+
+	assert.NoError(t, r.Close())
+
+	select {
+	case err := <-acquireErr:
+		assert.Error(t, err)
+	case <-time.After(waitTimeout):
+		assert.Fail(t, "closing the agent did not stop waiting for a worker")
+	}
+}
+
+func TestRemotePath(t *testing.T) {
+	r := remoteAgentTestHelper()
+
+	tests := []struct {
+		localPath       string
+		expectedArea    string
+		expectedRelPath string
+	}{
+		{"/local/RPMS/x86_64/A.rpm", RemoteRpmsArea, "x86_64/A.rpm"},
+		{"/local/cache/B.rpm", RemoteCacheArea, "B.rpm"},
+		{"/elsewhere/C.rpm", "", ""},
+		{"/local/RPMS2/D.rpm", "", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.localPath, func(t *testing.T) {
+			area, relPath, err := r.remotePath(test.localPath)
+			if test.expectedArea == "" {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, test.expectedArea, area)
+			assert.Equal(t, test.expectedRelPath, relPath)
+		})
+	}
+}
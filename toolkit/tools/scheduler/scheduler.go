@@ -8,14 +8,17 @@ import (
 	"os"
 	"os/signal"
 	"runtime"
-	"sync"
 	"time"
 
 	"github.com/juliangruber/go-intersect"
 	"golang.org/x/sys/unix"
 	"gopkg.in/alecthomas/kingpin.v2"
+	"microsoft.com/pkggen/internal/buildhistory"
 	"microsoft.com/pkggen/internal/exe"
+	"microsoft.com/pkggen/internal/file"
 	"microsoft.com/pkggen/internal/logger"
+	"microsoft.com/pkggen/internal/metrics"
+	"microsoft.com/pkggen/internal/packagerepo/repomanager/rpmrepomanager"
 	"microsoft.com/pkggen/internal/pkggraph"
 	"microsoft.com/pkggen/internal/pkgjson"
 	"microsoft.com/pkggen/internal/shell"
@@ -27,6 +30,10 @@ const (
 	// default worker count to 0 to automatically scale with the number of logical CPUs.
 	defaultWorkerCount   = "0"
 	defaultBuildAttempts = "1"
+
+	// estimateInterval is the minimum time between estimates of the remaining build time.
+	// Every estimate walks the whole graph, so it is not refreshed after every build result.
+	estimateInterval = 30 * time.Second
 )
 
 // schedulerChannels represents the communication channels used by a build agent.
@@ -43,13 +50,15 @@ type schedulerChannels struct {
 var (
 	app = kingpin.New("scheduler", "A tool to schedule package builds from a dependency graph.")
 
-	inputGraphFile  = exe.InputFlag(app, "Path to the DOT graph file to build.")
-	outputGraphFile = exe.OutputFlag(app, "Path to save the built DOT graph file.")
+	inputGraphFile  = exe.InputFlag(app, "Path to the graph file to build. Files with a .json extension use the JSON graph format, others DOT.")
+	outputGraphFile = exe.OutputFlag(app, "Path to save the built graph file. Files with a .json extension use the JSON graph format, others DOT.")
 
 	workDir      = app.Flag("work-dir", "The directory to create the build folder").Required().String()
 	workerTar    = app.Flag("worker-tar", "Full path to worker_chroot.tar.gz").Required().ExistingFile()
+	chrootPool   = app.Flag("chroot-pool-dir", "Optional directory of reusable chroots for the chroot build agent to build in, instead of extracting the worker tar for every build").String()
 	repoFile     = app.Flag("repo-file", "Full path to local.repo").Required().ExistingFile()
 	rpmDir       = app.Flag("rpm-dir", "The directory to use as the local repo and to submit RPM packages to").Required().ExistingDir()
+	debugRpmDir  = app.Flag("debug-rpm-dir", "Optional directory to submit debuginfo and debugsource RPM packages to instead of --rpm-dir. A separate repository is created in it once the build finishes. Debug packages should be excluded from the input graph.").String()
 	srpmDir      = app.Flag("srpm-dir", "The output directory for source RPM packages").Required().String()
 	cacheDir     = app.Flag("cache-dir", "The cache directory containing downloaded dependency RPMS from Mariner Base").Required().ExistingDir()
 	buildLogsDir = app.Flag("build-logs-dir", "Directory to store package build logs").Required().ExistingDir()
@@ -63,14 +72,31 @@ var (
 	rpmmacrosFile        = app.Flag("rpmmacros-file", "Optional file path to an rpmmacros file for rpmbuild to use.").ExistingFile()
 	buildAttempts        = app.Flag("build-attempts", "Sets the number of times to try building a package.").Default(defaultBuildAttempts).Int()
 	runCheck             = app.Flag("run-check", "Run the check during package builds.").Bool()
+	nonFatalChecksFile   = app.Flag("non-fatal-checks-file", "Optional file listing specs, one per line, whose check failures should be reported but not fail their build. Requires --run-check.").ExistingFile()
 	noCleanup            = app.Flag("no-cleanup", "Whether or not to delete the chroot folder after the build is done").Bool()
+	cacheDependencies    = app.Flag("cache-dependencies", "Cache installed build dependencies as layers in the chroot pool, so builds requesting the same dependencies do not reinstall them. Requires --chroot-pool-dir.").Bool()
 	noCache              = app.Flag("no-cache", "Disables using prebuilt cached packages.").Bool()
-	stopOnFailure        = app.Flag("stop-on-failure", "Stop on failed build").Bool()
+	stopOnFailure        = app.Flag("stop-on-failure", "Stop on failed build, equivalent to --failure-policy=finish-active.").Bool()
+	failurePolicy        = app.Flag("failure-policy", "How to react to a failed build: stop-immediately cancels all active builds, finish-active waits for active builds to finish, build-all-unblocked builds every package not blocked by a failure.").Default(schedulerutils.FailurePolicyBuildAllUnblocked).Enum(schedulerutils.FailurePolicies...)
 	reservedFileListFile = app.Flag("reserved-file-list-file", "Path to a list of files which should not be generated during a build").ExistingFile()
-
-	validBuildAgentFlags = []string{buildagents.TestAgentFlag, buildagents.ChrootAgentFlag}
+	buildJournalFile     = app.Flag("build-journal-file", "Optional path to a file to checkpoint build results to while building, allowing an interrupted build to be resumed.").String()
+	resumeBuild          = app.Flag("resume", "Resume an interrupted build, restoring any results recorded in --build-journal-file instead of rebuilding them.").Bool()
+	buildHistoryFile     = app.Flag("build-history-file", "Optional path to a file recording how long each package took to build. Past build times are used to prioritize builds and estimate the remaining build time.").String()
+	buildCacheDir        = app.Flag("build-cache-dir", "Optional directory to cache built RPMs in, keyed on the SRPM, its installed dependencies and the build's defines. If set, RPMs are only reused if they were built from identical inputs.").String()
+	summaryFile          = app.Flag("summary-file", "Optional path to write a JSON summary of the final state of every SRPM to.").String()
+	junitSummaryFile     = app.Flag("junit-summary-file", "Optional path to write a JUnit XML summary of the final state of every SRPM to.").String()
+	statusAddress        = app.Flag("status-address", "Optional address, e.g. localhost:8080, to serve the build's progress on while building. Serves an HTML page on / and JSON on /status. Has no authentication, only listen on trusted networks.").String()
+
+	validBuildAgentFlags = []string{buildagents.TestAgentFlag, buildagents.ChrootAgentFlag, buildagents.ContainerAgentFlag, buildagents.RemoteAgentFlag}
 	buildAgent           = app.Flag("build-agent", "Type of build agent to build packages with.").PlaceHolder(exe.PlaceHolderize(validBuildAgentFlags)).Required().Enum(validBuildAgentFlags...)
 	buildAgentProgram    = app.Flag("build-agent-program", "Path to the build agent that will be invoked to build packages.").String()
+	containerRuntime     = app.Flag("container-runtime", fmt.Sprintf("Podman compatible container runtime used by the %s to run builds.", buildagents.ContainerAgentFlag)).Default(buildagents.DefaultContainerRuntime).String()
+	remoteWorkers        = app.Flag("remote-worker", fmt.Sprintf("URL of a remoteworker daemon used by the %s to run builds. May be repeated to build across several machines.", buildagents.RemoteAgentFlag)).Strings()
+	maxCPUs              = app.Flag("max-cpus", "Maximum number of CPUs a single package build may use, fractions are allowed. If set to 0, builds are not limited.").Float64()
+	maxMemoryMB          = app.Flag("max-memory-mb", "Maximum memory in MiB a single package build may use. If set to 0, builds are not limited.").Uint64()
+	maxBuildTime         = app.Flag("max-build-time", "Maximum time a single package build may take, e.g. 2h30m. If set to 0, builds are not limited.").Duration()
+	buildTimeout         = app.Flag("build-timeout", "Maximum time a build agent may take to build a single package before it is stopped, e.g. 6h. Catches builds which hang, such as a stuck %check. If set to 0, builds never time out.").Duration()
+	buildLimitsFile      = app.Flag("build-limits-file", "Optional JSON file overriding --max-cpus, --max-memory-mb, --max-build-time and --build-timeout for individual packages, keyed by spec name.").ExistingFile()
 	workers              = app.Flag("workers", "Number of concurrent build agents to spawn. If set to 0, will automatically set to the logical CPU count.").Default(defaultWorkerCount).Int()
 
 	ignoredPackages = app.Flag("ignored-packages", "Space separated list of specs ignoring rebuilds if their dependencies have been updated. Will still build if all of the spec's RPMs have not been built.").String()
@@ -78,8 +104,10 @@ var (
 	pkgsToBuild   = app.Flag("packages", "Space separated list of top-level packages that should be built. Omit this argument to build all packages.").String()
 	pkgsToRebuild = app.Flag("rebuild-packages", "Space separated list of base package names packages that should be rebuilt.").String()
 
-	logFile  = exe.LogFileFlag(app)
-	logLevel = exe.LogLevelFlag(app)
+	logFile        = exe.LogFileFlag(app)
+	logLevel       = exe.LogLevelFlag(app)
+	metricsFile    = exe.MetricsFileFlag(app)
+	metricsAddress = exe.MetricsAddressFlag(app)
 )
 
 func main() {
@@ -88,6 +116,12 @@ func main() {
 	kingpin.MustParse(app.Parse(os.Args[1:]))
 	logger.InitBestEffort(*logFile, *logLevel)
 
+	metricsExporter, err := metrics.StartExporter(*metricsFile, *metricsAddress)
+	if err != nil {
+		logger.Log.Fatalf("Unable to export metrics, error: %s", err)
+	}
+	defer metricsExporter.Close()
+
 	if *workers <= 0 {
 		*workers = runtime.NumCPU()
 		logger.Log.Debugf("No worker count supplied, discovered %d logical CPUs.", *workers)
@@ -97,6 +131,20 @@ func main() {
 		logger.Log.Fatalf("Value in --build-attempts must be greater than zero. Found %d", *buildAttempts)
 	}
 
+	if *resumeBuild && *buildJournalFile == "" {
+		logger.Log.Fatal("--resume requires --build-journal-file to be set")
+	}
+
+	buildFailurePolicy := *failurePolicy
+	if *stopOnFailure {
+		if buildFailurePolicy == schedulerutils.FailurePolicyStopImmediately {
+			logger.Log.Warn("--stop-on-failure is overridden by --failure-policy=stop-immediately")
+		} else {
+			buildFailurePolicy = schedulerutils.FailurePolicyFinishActive
+		}
+	}
+	logger.Log.Debugf("Using failure policy %s", buildFailurePolicy)
+
 	ignoredPackages := exe.ParseListArgument(*ignoredPackages)
 	reservedFileListFile := *reservedFileListFile
 
@@ -123,6 +171,30 @@ func main() {
 		}
 	}
 
+	if *maxCPUs < 0 || *maxBuildTime < 0 || *buildTimeout < 0 {
+		logger.Log.Fatal("Values in --max-cpus, --max-build-time and --build-timeout must not be negative")
+	}
+
+	var packageLimits map[string]buildagents.BuildLimits
+	if *buildLimitsFile != "" {
+		packageLimits, err = buildagents.ReadPackageBuildLimits(*buildLimitsFile)
+		if err != nil {
+			logger.Log.Fatalf("Unable to read build limits file %s: %s", *buildLimitsFile, err)
+		}
+	}
+
+	var nonFatalChecks map[string]bool
+	if *nonFatalChecksFile != "" {
+		if !*runCheck {
+			logger.Log.Fatal("--non-fatal-checks-file requires --run-check")
+		}
+
+		nonFatalChecks, err = buildagents.ReadNonFatalChecks(*nonFatalChecksFile)
+		if err != nil {
+			logger.Log.Fatalf("Unable to read non-fatal checks file %s: %s", *nonFatalChecksFile, err)
+		}
+	}
+
 	// Setup a build agent to handle build requests from the scheduler.
 	buildAgentConfig := &buildagents.BuildAgentConfig{
 		Program:   *buildAgentProgram,
@@ -133,18 +205,65 @@ func main() {
 		WorkDir:   *workDir,
 		WorkerTar: *workerTar,
 
+		ChrootPoolDir: *chrootPool,
+		DebugRpmDir:   *debugRpmDir,
+
 		DistTag:              *distTag,
 		DistroReleaseVersion: *distroReleaseVersion,
 		DistroBuildNumber:    *distroBuildNumber,
 		RpmmacrosFile:        *rpmmacrosFile,
 
-		NoCleanup: *noCleanup,
-		RunCheck:  *runCheck,
+		NoCleanup:         *noCleanup,
+		RunCheck:          *runCheck,
+		CacheDependencies: *cacheDependencies,
+		NonFatalChecks:    nonFatalChecks,
+
+		Limits: buildagents.BuildLimits{
+			CPUs:      *maxCPUs,
+			MemoryMB:  *maxMemoryMB,
+			TimeLimit: *maxBuildTime,
+			Timeout:   *buildTimeout,
+		},
+		PackageLimits: packageLimits,
+
+		ContainerRuntime: *containerRuntime,
+		RemoteWorkers:    *remoteWorkers,
 
 		LogDir:   *buildLogsDir,
 		LogLevel: *logLevel,
 	}
 
+	// Hash the worker tar once, rather than in every build leasing a chroot from the pool or looking up the build cache.
+	if *chrootPool != "" || *buildCacheDir != "" {
+		buildAgentConfig.WorkerTarHash, err = file.GenerateSHA256(*workerTar)
+		if err != nil {
+			logger.Log.Fatalf("Unable to hash worker tar %s: %s", *workerTar, err)
+		}
+	}
+
+	if *debugRpmDir != "" {
+		err = os.MkdirAll(*debugRpmDir, os.ModePerm)
+		if err != nil {
+			logger.Log.Fatalf("Unable to create debug RPM directory %s: %s", *debugRpmDir, err)
+		}
+	}
+
+	journal, err := schedulerutils.NewBuildJournal(*buildJournalFile, *resumeBuild)
+	if err != nil {
+		logger.Log.Fatalf("Unable to open build journal, error: %s", err)
+	}
+	defer journal.Close()
+
+	history, err := buildhistory.Load(*buildHistoryFile, buildhistory.DefaultMaxRecords)
+	if err != nil {
+		logger.Log.Fatalf("Unable to load build history, error: %s", err)
+	}
+
+	buildCache, err := schedulerutils.NewBuildCache(*buildCacheDir, *buildAgentConfig)
+	if err != nil {
+		logger.Log.Fatalf("Unable to open build cache, error: %s", err)
+	}
+
 	agent, err := buildagents.BuildAgentFactory(*buildAgent)
 	if err != nil {
 		logger.Log.Fatalf("Unable to select build agent, error: %s", err)
@@ -163,21 +282,43 @@ func main() {
 	signal.Notify(signals, unix.SIGINT, unix.SIGTERM)
 	go cancelBuildsOnSignal(signals, agent)
 
-	err = buildGraph(*inputGraphFile, *outputGraphFile, agent, *workers, *buildAttempts, *stopOnFailure, !*noCache, packageVersToBuild, packagesNamesToRebuild, ignoredPackages, reservedFiles)
+	status := schedulerutils.NewBuildStatus(*workers)
+	if *statusAddress != "" {
+		statusServer, err := schedulerutils.StartStatusServer(*statusAddress, status)
+		if err != nil {
+			logger.Log.Fatalf("Unable to serve build status, error: %s", err)
+		}
+		defer statusServer.Close()
+	}
+
+	err = buildGraph(*inputGraphFile, *outputGraphFile, *summaryFile, *junitSummaryFile, agent, buildCache, status, journal, history, *workers, *buildAttempts, buildFailurePolicy, !*noCache, packageVersToBuild, packagesNamesToRebuild, ignoredPackages, reservedFiles)
+
+	if *debugRpmDir != "" {
+		repoErr := rpmrepomanager.CreateRepo(*debugRpmDir)
+		if repoErr != nil {
+			logger.Log.Errorf("Unable to create debug RPM repository in %s, error: %s", *debugRpmDir, repoErr)
+		}
+	}
+
+	if *buildHistoryFile != "" {
+		historyErr := history.Save(*buildHistoryFile)
+		if historyErr != nil {
+			logger.Log.Errorf("Unable to save build history, error: %s", historyErr)
+		}
+	}
+
 	if err != nil {
 		logger.Log.Fatalf("Unable to build package graph.\nFor details see the build summary section above.\nError: %s", err)
 	}
 }
 
 // cancelOutstandingBuilds stops any builds that are currently running.
+// Only the agent's builds are stopped, the scheduler can still run other commands afterwards.
 func cancelOutstandingBuilds(agent buildagents.BuildAgent) {
 	err := agent.Close()
 	if err != nil {
 		logger.Log.Errorf("Unable to close build agent, error: %s", err)
 	}
-
-	// Issue a SIGINT to all children processes to allow them to gracefully exit.
-	shell.PermanentlyStopAllProcesses(unix.SIGINT)
 }
 
 // cancelBuildsOnSignal will stop any builds running on SIGINT/SIGTERM.
@@ -186,15 +327,15 @@ func cancelBuildsOnSignal(signals chan os.Signal, agent buildagents.BuildAgent)
 	logger.Log.Error(sig)
 
 	cancelOutstandingBuilds(agent)
+
+	// The scheduler is exiting, issue a SIGINT to all remaining children processes to allow them to gracefully exit.
+	shell.PermanentlyStopAllProcesses(unix.SIGINT)
 	os.Exit(1)
 }
 
 // buildGraph builds all packages in the dependency graph requested.
 // It will save the resulting graph to outputFile.
-func buildGraph(inputFile, outputFile string, agent buildagents.BuildAgent, workers, buildAttempts int, stopOnFailure, canUseCache bool, packagesToBuild []*pkgjson.PackageVer, packagesNamesToRebuild, ignoredPackages, reservedFiles []string) (err error) {
-	// graphMutex guards pkgGraph from concurrent reads and writes during build.
-	var graphMutex sync.RWMutex
-
+func buildGraph(inputFile, outputFile, summaryFile, junitSummaryFile string, agent buildagents.BuildAgent, buildCache *schedulerutils.BuildCache, status *schedulerutils.BuildStatus, journal *schedulerutils.BuildJournal, history *buildhistory.History, workers, buildAttempts int, failurePolicy string, canUseCache bool, packagesToBuild []*pkgjson.PackageVer, packagesNamesToRebuild, ignoredPackages, reservedFiles []string) (err error) {
 	isGraphOptimized, pkgGraph, goalNode, err := schedulerutils.InitializeGraph(inputFile, packagesToBuild)
 	if err != nil {
 		return
@@ -203,17 +344,20 @@ func buildGraph(inputFile, outputFile string, agent buildagents.BuildAgent, work
 	// Setup and start the worker pool and scheduler routine.
 	numberOfNodes := pkgGraph.Nodes().Len()
 
-	channels := startWorkerPool(agent, workers, buildAttempts, numberOfNodes, &graphMutex, ignoredPackages)
+	channels := startWorkerPool(agent, buildCache, status, workers, buildAttempts, numberOfNodes, ignoredPackages)
+	buildQueue := schedulerutils.NewCriticalPathQueue(workers)
 	logger.Log.Infof("Building %d nodes with %d workers", numberOfNodes, workers)
 
-	// After this call pkgGraph will be given to multiple routines and accessing it requires acquiring the mutex.
-	builtGraph, err := buildAllNodes(stopOnFailure, isGraphOptimized, canUseCache, packagesNamesToRebuild, pkgGraph, &graphMutex, goalNode, channels, reservedFiles)
+	// After this call pkgGraph will be given to multiple routines and accessing it requires locking it.
+	builtGraph, summary, err := buildAllNodes(failurePolicy, isGraphOptimized, canUseCache, packagesNamesToRebuild, pkgGraph, goalNode, agent, channels, buildQueue, status, journal, history, workers, reservedFiles)
+
+	writeBuildSummary(summary, summaryFile, junitSummaryFile)
 
 	if builtGraph != nil {
-		graphMutex.RLock()
-		defer graphMutex.RUnlock()
+		builtGraph.RLock()
+		defer builtGraph.RUnlock()
 
-		saveErr := pkggraph.WriteDOTGraphFile(builtGraph, outputFile)
+		saveErr := pkggraph.WriteGraphFile(builtGraph, outputFile)
 		if saveErr != nil {
 			logger.Log.Errorf("Failed to save built graph, error: %s", saveErr)
 		}
@@ -222,9 +366,26 @@ func buildGraph(inputFile, outputFile string, agent buildagents.BuildAgent, work
 	return
 }
 
+// writeBuildSummary writes the build summary to any requested summary files.
+func writeBuildSummary(summary *schedulerutils.BuildSummary, summaryFile, junitSummaryFile string) {
+	if summaryFile != "" {
+		err := summary.WriteJSONFile(summaryFile)
+		if err != nil {
+			logger.Log.Errorf("Failed to save build summary, error: %s", err)
+		}
+	}
+
+	if junitSummaryFile != "" {
+		err := summary.WriteJUnitFile(junitSummaryFile)
+		if err != nil {
+			logger.Log.Errorf("Failed to save JUnit build summary, error: %s", err)
+		}
+	}
+}
+
 // startWorkerPool starts the worker pool and returns the communication channels between the workers and the scheduler.
 // channelBufferSize controls how many entries in the channels can be buffered before blocking writes to them.
-func startWorkerPool(agent buildagents.BuildAgent, workers, buildAttempts, channelBufferSize int, graphMutex *sync.RWMutex, ignoredPackages []string) (channels *schedulerChannels) {
+func startWorkerPool(agent buildagents.BuildAgent, buildCache *schedulerutils.BuildCache, status *schedulerutils.BuildStatus, workers, buildAttempts, channelBufferSize int, ignoredPackages []string) (channels *schedulerChannels) {
 	channels = &schedulerChannels{
 		Requests:         make(chan *schedulerutils.BuildRequest, channelBufferSize),
 		PriorityRequests: make(chan *schedulerutils.BuildRequest, channelBufferSize),
@@ -245,7 +406,7 @@ func startWorkerPool(agent buildagents.BuildAgent, workers, buildAttempts, chann
 	// Start the workers now so they begin working as soon as a new job is queued.
 	for i := 0; i < workers; i++ {
 		logger.Log.Debugf("Starting worker #%d", i)
-		go schedulerutils.BuildNodeWorker(directionalChannels, agent, graphMutex, buildAttempts, ignoredPackages)
+		go schedulerutils.BuildNodeWorker(i, directionalChannels, agent, buildCache, status, buildAttempts, ignoredPackages)
 	}
 
 	return
@@ -255,34 +416,54 @@ func startWorkerPool(agent buildagents.BuildAgent, workers, buildAttempts, chann
 // This routine only contains control flow logic for build scheduling.
 // It iteratively:
 // - Calculates any unblocked nodes.
-// - Submits these nodes to the worker pool to be processed.
-// - Grabs a single build result from the worker pool.
+// - Submits these nodes to the worker pool to be processed, or restores their result from the build journal.
+//   Build nodes are held in a queue and released to the worker pool in order of their critical path weight.
+// - Grabs a single build result from the worker pool and checkpoints it to the build journal.
 // - Attempts to satisfy any unresolved dynamic dependencies with new implicit provides from the build result.
 // - Attempts to subgraph the graph to only contain the requested packages if possible.
 // - Repeat.
-func buildAllNodes(stopOnFailure, isGraphOptimized, canUseCache bool, packagesNamesToRebuild []string, pkgGraph *pkggraph.PkgGraph, graphMutex *sync.RWMutex, goalNode *pkggraph.PkgNode, channels *schedulerChannels, reservedFiles []string) (builtGraph *pkggraph.PkgGraph, err error) {
+// Once a build fails, failurePolicy decides if active builds are cancelled, allowed to finish, or if every
+// package which does not depend on the failed build is still built.
+func buildAllNodes(failurePolicy string, isGraphOptimized, canUseCache bool, packagesNamesToRebuild []string, pkgGraph *pkggraph.PkgGraph, goalNode *pkggraph.PkgNode, agent buildagents.BuildAgent, channels *schedulerChannels, buildQueue *schedulerutils.CriticalPathQueue, status *schedulerutils.BuildStatus, journal *schedulerutils.BuildJournal, history *buildhistory.History, workers int, reservedFiles []string) (builtGraph *pkggraph.PkgGraph, summary *schedulerutils.BuildSummary, err error) {
 	var (
 		// stopBuilding tracks if the build has entered a failed state and this routine should stop as soon as possible.
 		stopBuilding bool
+		// buildStopped tracks if the worker pool has been cancelled and its request channels drained.
+		buildStopped bool
+		// cancelledActiveBuilds tracks if active builds were cancelled, in which case their results will not be waited for.
+		cancelledActiveBuilds bool
 		// useCachedImplicit tracks if cached implicit provides can be used to satisfy unresolved dynamic dependencies.
 		// Local packages are preferred over cached remotes ones to satisfy these unresolved dependencies, however
 		// the scheduler does not know what packages provide which implicit provides until the packages have been built.
 		// Therefore the scheduler will attempt to build all possible packages without consuming any cached dynamic dependencies first.
 		useCachedImplicit bool
+		// lastEstimate tracks when the remaining build time was last estimated.
+		lastEstimate time.Time
 	)
 
 	// Start the build at the leaf nodes.
 	// The build will bubble up through the graph as it processes nodes.
 	buildState := schedulerutils.NewGraphBuildState(reservedFiles)
-	nodesToBuild := schedulerutils.LeafNodes(pkgGraph, graphMutex, goalNode, buildState, useCachedImplicit)
+	nodesToBuild := schedulerutils.LeafNodes(pkgGraph, goalNode, buildState, useCachedImplicit)
+	buildCost := schedulerutils.HistoricalBuildCost(history)
+	buildQueue.SetWeights(schedulerutils.CriticalPathWeights(pkgGraph, goalNode, buildCost))
+	status.SetEstimatedTimeRemaining(logEstimatedBuildTime(pkgGraph, goalNode, buildState, history, workers))
+	lastEstimate = time.Now()
 
 	for {
 		logger.Log.Debugf("Found %d unblocked nodes", len(nodesToBuild))
 
 		// Each node that is ready to build must be converted into a build request and submitted to the worker pool.
-		newRequests := schedulerutils.ConvertNodesToRequests(pkgGraph, graphMutex, nodesToBuild, packagesNamesToRebuild, buildState, canUseCache)
+		newRequests := schedulerutils.ConvertNodesToRequests(pkgGraph, nodesToBuild, packagesNamesToRebuild, buildState, canUseCache)
 		for _, req := range newRequests {
 			buildState.RecordBuildRequest(req)
+
+			// Nodes built by an earlier, interrupted run do not need to be sent to the worker pool.
+			if res, found := journal.RestoreBuildResult(req); found {
+				channels.Results <- res
+				continue
+			}
+
 			// Decide which priority the build should be. Generally we want to get any remote or prebuilt nodes out of the
 			// way as quickly as possible since they may help us optimize the graph early.
 			// Meta nodes may also be blocking something we want to examine and give higher priority (priority inheritance from
@@ -291,7 +472,10 @@ func buildAllNodes(stopOnFailure, isGraphOptimized, canUseCache bool, packagesNa
 			case pkggraph.TypePreBuilt:
 				channels.PriorityRequests <- req
 
-				// For now all build nodes are of equal priority
+			// Build nodes are prioritized by the longest chain of builds they are blocking.
+			case pkggraph.TypeBuild:
+				buildQueue.Push(req)
+
 			case pkggraph.TypeGoal:
 				fallthrough
 			case pkggraph.TypePureMeta:
@@ -300,14 +484,15 @@ func buildAllNodes(stopOnFailure, isGraphOptimized, canUseCache bool, packagesNa
 				fallthrough
 			case pkggraph.TypeRemote:
 				fallthrough
-			case pkggraph.TypeBuild:
-				fallthrough
 			default:
 				channels.Requests <- req
 			}
 		}
 		nodesToBuild = nil
 
+		buildQueue.Dispatch(channels.Requests)
+		status.Update(buildState, buildQueue.Len()+len(channels.Requests))
+
 		// If there are no active builds running try enabling cached packages for unresolved dynamic dependencies to unblocked more nodes.
 		// Otherwise there is nothing left that can be built.
 		if len(buildState.ActiveBuilds()) == 0 {
@@ -317,7 +502,7 @@ func buildAllNodes(stopOnFailure, isGraphOptimized, canUseCache bool, packagesNa
 			} else {
 				logger.Log.Warn("Enabling cached packages to satisfy unresolved dynamic dependencies.")
 				useCachedImplicit = true
-				nodesToBuild = schedulerutils.LeafNodes(pkgGraph, graphMutex, goalNode, buildState, useCachedImplicit)
+				nodesToBuild = schedulerutils.LeafNodes(pkgGraph, goalNode, buildState, useCachedImplicit)
 				continue
 			}
 		}
@@ -326,6 +511,14 @@ func buildAllNodes(stopOnFailure, isGraphOptimized, canUseCache bool, packagesNa
 		res := <-channels.Results
 		schedulerutils.PrintBuildResult(res)
 		buildState.RecordBuildResult(res)
+		buildQueue.RecordBuildResult(res)
+		schedulerutils.RecordBuildHistory(history, res)
+		schedulerutils.RecordBuildMetrics(res)
+
+		journalErr := journal.RecordBuildResult(res)
+		if journalErr != nil {
+			logger.Log.Warnf("Failed to record build result for (%s) in the build journal, error: %s", res.Node.FriendlyName(), journalErr)
+		}
 
 		if !stopBuilding {
 			if res.Err == nil {
@@ -337,27 +530,37 @@ func buildAllNodes(stopOnFailure, isGraphOptimized, canUseCache bool, packagesNa
 						newGraph    *pkggraph.PkgGraph
 						newGoalNode *pkggraph.PkgNode
 					)
-					didOptimize, newGraph, newGoalNode, err = updateGraphWithImplicitProvides(res, pkgGraph, graphMutex, useCachedImplicit)
+					didOptimize, newGraph, newGoalNode, err = updateGraphWithImplicitProvides(res, pkgGraph, useCachedImplicit)
 					if err != nil {
 						// Failures to manipulate the graph are fatal.
 						// There is no guarantee the graph is still a directed acyclic graph and is solvable.
 						stopBuilding = true
-						stopBuild(channels, buildState)
+						buildStopped = true
+						stopBuild(channels, buildQueue, buildState)
 					} else if didOptimize {
 						isGraphOptimized = true
 						// Replace the graph and goal node pointers.
 						// Any outstanding builds of nodes that are no longer in the graph will gracefully handle this.
 						// When querying their edges, the graph library will return an empty iterator (graph.Empty).
+						// Outstanding builds keep reading the graph they were requested with, which is no longer modified.
 						pkgGraph = newGraph
 						goalNode = newGoalNode
+						buildQueue.SetWeights(schedulerutils.CriticalPathWeights(pkgGraph, goalNode, buildCost))
 					}
 				}
 
-				nodesToBuild = schedulerutils.FindUnblockedNodesFromResult(res, pkgGraph, graphMutex, buildState)
-			} else if stopOnFailure {
+				nodesToBuild = schedulerutils.FindUnblockedNodesFromResult(res, pkgGraph, buildState)
+			} else if schedulerutils.StopsBuildingOnFailure(failurePolicy) {
 				stopBuilding = true
+				buildStopped = true
 				err = res.Err
-				stopBuild(channels, buildState)
+				stopBuild(channels, buildQueue, buildState)
+
+				if schedulerutils.CancelsActiveBuildsOnFailure(failurePolicy) {
+					logger.Log.Errorf("Cancelling %d active build(s)", len(buildState.ActiveSRPMs()))
+					cancelledActiveBuilds = true
+					cancelOutstandingBuilds(agent)
+				}
 			}
 		}
 
@@ -373,35 +576,47 @@ func buildAllNodes(stopOnFailure, isGraphOptimized, canUseCache bool, packagesNa
 		activeSRPMs := buildState.ActiveSRPMs()
 		activeSRPMsCount := len(activeSRPMs)
 		if stopBuilding {
-			if activeSRPMsCount == 0 {
+			if activeSRPMsCount == 0 || cancelledActiveBuilds {
 				break
 			}
 		}
 
 		if res.Node.Type == pkggraph.TypeBuild {
 			logger.Log.Infof("%d currently active build(s): %v.", activeSRPMsCount, activeSRPMs)
+			if time.Since(lastEstimate) >= estimateInterval {
+				status.SetEstimatedTimeRemaining(logEstimatedBuildTime(pkgGraph, goalNode, buildState, history, workers))
+				lastEstimate = time.Now()
+			}
 		}
 	}
 
-	// Let the workers know they are done
-	doneBuild(channels, buildState)
+	// Let the workers know they are done, a stopped build has already drained the request channels.
+	if buildStopped {
+		close(channels.Done)
+	} else {
+		doneBuild(channels, buildQueue, buildState)
+	}
 	// Give the workers time to finish so they don't mess up the summary we want to print.
 	// Some nodes may still be busy with long running builds we don't care about anymore, so we don't
 	// want to actually block here.
 	time.Sleep(time.Second)
 
 	builtGraph = pkgGraph
-	schedulerutils.PrintBuildSummary(builtGraph, graphMutex, buildState)
+	schedulerutils.SetBlockedBuildNodesStatus(builtGraph, buildState)
+	status.Update(buildState, 0)
+	status.Finish()
+	summary = schedulerutils.NewBuildSummary(builtGraph, buildState)
+	schedulerutils.PrintBuildSummary(summary)
 
 	return
 }
 
 // updateGraphWithImplicitProvides will update the graph with new implicit provides if available.
 // It will also attempt to subgraph the graph if it becomes solvable with the new implicit provides.
-func updateGraphWithImplicitProvides(res *schedulerutils.BuildResult, pkgGraph *pkggraph.PkgGraph, graphMutex *sync.RWMutex, useCachedImplicit bool) (didOptimize bool, newGraph *pkggraph.PkgGraph, newGoalNode *pkggraph.PkgNode, err error) {
+func updateGraphWithImplicitProvides(res *schedulerutils.BuildResult, pkgGraph *pkggraph.PkgGraph, useCachedImplicit bool) (didOptimize bool, newGraph *pkggraph.PkgGraph, newGoalNode *pkggraph.PkgNode, err error) {
 	// acquire a writer lock since this routine will collapse nodes
-	graphMutex.Lock()
-	defer graphMutex.Unlock()
+	pkgGraph.Lock()
+	defer pkgGraph.Unlock()
 
 	didInjectAny, err := schedulerutils.InjectMissingImplicitProvides(res, pkgGraph, useCachedImplicit)
 	if err != nil {
@@ -419,7 +634,18 @@ func updateGraphWithImplicitProvides(res *schedulerutils.BuildResult, pkgGraph *
 	return
 }
 
-func drainChannels(channels *schedulerChannels, buildState *schedulerutils.GraphBuildState) {
+// logEstimatedBuildTime logs an estimate of how much longer the build will take, if the build history allows for one.
+// The estimate is returned so it can also be reported elsewhere.
+func logEstimatedBuildTime(pkgGraph *pkggraph.PkgGraph, goalNode *pkggraph.PkgNode, buildState *schedulerutils.GraphBuildState, history *buildhistory.History, workers int) (remaining time.Duration, found bool) {
+	remaining, found = schedulerutils.EstimateRemainingBuildTime(pkgGraph, goalNode, buildState, history, workers)
+	if found {
+		logger.Log.Infof("Estimated time remaining based on past builds: %s", remaining.Round(time.Second))
+	}
+
+	return
+}
+
+func drainChannels(channels *schedulerChannels, buildQueue *schedulerutils.CriticalPathQueue, buildState *schedulerutils.GraphBuildState) {
 	// For any workers that are current parked with no buffered requests, close the
 	// requests channel to wake up any build workers waiting on a request to be buffered.
 	// Upon being woken up by a closed requests channel, the build worker will stop.
@@ -433,19 +659,22 @@ func drainChannels(channels *schedulerChannels, buildState *schedulerutils.Graph
 	for req := range channels.Requests {
 		buildState.RemoveBuildRequest(req)
 	}
+	for _, req := range buildQueue.Drain() {
+		buildState.RemoveBuildRequest(req)
+	}
 }
 
-func doneBuild(channels *schedulerChannels, buildState *schedulerutils.GraphBuildState) {
+func doneBuild(channels *schedulerChannels, buildQueue *schedulerutils.CriticalPathQueue, buildState *schedulerutils.GraphBuildState) {
 	// Close the done channel. The build workers will finish processing any work, then return
 	// upon seeing this channel is closed.
 	close(channels.Done)
 
-	drainChannels(channels, buildState)
+	drainChannels(channels, buildQueue, buildState)
 }
 
 // stopBuild will stop all future builds from being scheduled by sending a cancellation signal
 // to the worker pool and draining any outstanding build requests.
-func stopBuild(channels *schedulerChannels, buildState *schedulerutils.GraphBuildState) {
+func stopBuild(channels *schedulerChannels, buildQueue *schedulerutils.CriticalPathQueue, buildState *schedulerutils.GraphBuildState) {
 	logger.Log.Error("Stopping build")
 
 	// Close the cancel channel to prevent and buffered requests from being built.
@@ -453,5 +682,5 @@ func stopBuild(channels *schedulerChannels, buildState *schedulerutils.GraphBuil
 	// of processing a new request.
 	close(channels.Cancel)
 
-	drainChannels(channels, buildState)
+	drainChannels(channels, buildQueue, buildState)
 }
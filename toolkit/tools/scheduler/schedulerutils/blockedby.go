@@ -0,0 +1,96 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package schedulerutils
+
+import (
+	"sort"
+
+	"microsoft.com/pkggen/internal/pkggraph"
+)
+
+// SetBlockedBuildNodesStatus marks every unbuilt build node which depends on a failed build as blocked,
+// so the final graph records why it was never built.
+func SetBlockedBuildNodesStatus(pkgGraph *pkggraph.PkgGraph, buildState *GraphBuildState) {
+	pkgGraph.Lock()
+	defer pkgGraph.Unlock()
+
+	for id := range blockingFailures(pkgGraph, buildState) {
+		node := pkgGraph.Node(id).(*pkggraph.PkgNode)
+		if node.Type == pkggraph.TypeBuild {
+			node.State = pkggraph.StateBlocked
+		}
+	}
+}
+
+// blockingFailures maps every unprocessed node which depends on a failed build to the failed SRPMs blocking it.
+// It walks the dependents of every failed build, any unprocessed node reached is blocked by the failure.
+// The caller must hold the graph's read lock.
+func blockingFailures(pkgGraph *pkggraph.PkgGraph, buildState *GraphBuildState) (blockedBy map[int64]map[string]bool) {
+	blockedBy = make(map[int64]map[string]bool)
+
+	for _, failure := range buildState.BuildFailures() {
+		failedSRPM := failure.Node.SRPMFileName()
+
+		for _, blockedNode := range blockedDependents(pkgGraph, buildState, failure.AncillaryNodes) {
+			if blockedBy[blockedNode.ID()] == nil {
+				blockedBy[blockedNode.ID()] = make(map[string]bool)
+			}
+			blockedBy[blockedNode.ID()][failedSRPM] = true
+		}
+	}
+
+	return
+}
+
+// failedSRPMsBlocking returns the sorted names of the failed SRPMs blocking any of the given nodes.
+func failedSRPMsBlocking(blockedBy map[int64]map[string]bool, nodes []*pkggraph.PkgNode) (failedSRPMs []string) {
+	found := make(map[string]bool)
+	for _, node := range nodes {
+		for failedSRPM := range blockedBy[node.ID()] {
+			if !found[failedSRPM] {
+				found[failedSRPM] = true
+				failedSRPMs = append(failedSRPMs, failedSRPM)
+			}
+		}
+	}
+
+	sort.Strings(failedSRPMs)
+	return
+}
+
+// blockedDependents returns all unprocessed nodes which directly or transitively depend on the failed nodes.
+// Processed nodes have a result of their own, so the search does not continue past them.
+func blockedDependents(pkgGraph *pkggraph.PkgGraph, buildState *GraphBuildState, failedNodes []*pkggraph.PkgNode) (blockedNodes []*pkggraph.PkgNode) {
+	visited := make(map[int64]bool)
+	var queue []int64
+
+	for _, failedNode := range failedNodes {
+		// The graph may have been replaced by a subgraph since the failure, skip nodes that are no longer part of it.
+		if pkgGraph.Node(failedNode.ID()) == nil {
+			continue
+		}
+
+		visited[failedNode.ID()] = true
+		queue = append(queue, failedNode.ID())
+	}
+
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+
+		dependents := pkgGraph.To(id)
+		for dependents.Next() {
+			dependent := dependents.Node().(*pkggraph.PkgNode)
+			if visited[dependent.ID()] || buildState.IsNodeProcessed(dependent) {
+				continue
+			}
+			visited[dependent.ID()] = true
+
+			blockedNodes = append(blockedNodes, dependent)
+			queue = append(queue, dependent.ID())
+		}
+	}
+
+	return
+}
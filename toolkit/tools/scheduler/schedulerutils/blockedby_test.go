@@ -0,0 +1,180 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package schedulerutils
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"microsoft.com/pkggen/internal/pkggraph"
+	"microsoft.com/pkggen/internal/pkggraph/pkggraphtest"
+)
+
+// blockedByTestGraph holds a graph where C requires B to build, B requires A, C also requires E, and D is independent:
+//
+//	C -> B -> A
+//	C -> E
+//	D
+type blockedByTestGraph struct {
+	g          *pkggraph.PkgGraph
+	runNodes   map[string]*pkggraph.PkgNode
+	buildNodes map[string]*pkggraph.PkgNode
+}
+
+func newBlockedByTestGraph(t *testing.T) (b *blockedByTestGraph) {
+	b = &blockedByTestGraph{
+		g:          pkggraph.NewPkgGraph(),
+		runNodes:   make(map[string]*pkggraph.PkgNode),
+		buildNodes: make(map[string]*pkggraph.PkgNode),
+	}
+
+	for _, name := range []string{"A", "B", "C", "D", "E"} {
+		b.runNodes[name], b.buildNodes[name] = pkggraphtest.AddSRPM(t, b.g, name, "1")
+	}
+	assert.NoError(t, b.g.AddEdge(b.buildNodes["B"], b.runNodes["A"]))
+	assert.NoError(t, b.g.AddEdge(b.buildNodes["C"], b.runNodes["B"]))
+	assert.NoError(t, b.g.AddEdge(b.buildNodes["C"], b.runNodes["E"]))
+
+	return
+}
+
+// buildState returns the state of a build where the given SRPMs failed and the given SRPMs were built.
+func (b *blockedByTestGraph) buildState(failed, built []string) (buildState *GraphBuildState) {
+	buildState = NewGraphBuildState(nil)
+	record := func(name string, err error) {
+		node := b.buildNodes[name]
+		buildState.RecordBuildResult(&BuildResult{Node: node, AncillaryNodes: []*pkggraph.PkgNode{node}, Err: err})
+	}
+
+	for _, name := range built {
+		record(name, nil)
+		buildState.RecordBuildResult(&BuildResult{Node: b.runNodes[name], AncillaryNodes: []*pkggraph.PkgNode{b.runNodes[name]}})
+	}
+	for _, name := range failed {
+		record(name, fmt.Errorf("%s failed", name))
+	}
+
+	return
+}
+
+func TestBlockingFailures(t *testing.T) {
+	tests := []struct {
+		name   string
+		failed []string
+		built  []string
+		// expectedBlockedBy maps the blocked packages to the failed SRPMs blocking both their run and build node.
+		expectedBlockedBy map[string][]string
+	}{
+		{
+			name:   "start of the chain",
+			failed: []string{"A"},
+			expectedBlockedBy: map[string][]string{
+				"B": {"A.src.rpm"},
+				"C": {"A.src.rpm"},
+			},
+		},
+		{
+			name:   "middle of the chain",
+			failed: []string{"B"},
+			built:  []string{"A", "E"},
+			expectedBlockedBy: map[string][]string{
+				"C": {"B.src.rpm"},
+			},
+		},
+		{
+			name:   "multiple failures",
+			failed: []string{"A", "E"},
+			expectedBlockedBy: map[string][]string{
+				"B": {"A.src.rpm"},
+				"C": {"A.src.rpm", "E.src.rpm"},
+			},
+		},
+		{
+			name:   "failures along the chain",
+			failed: []string{"B", "E"},
+			built:  []string{"A"},
+			expectedBlockedBy: map[string][]string{
+				"C": {"B.src.rpm", "E.src.rpm"},
+			},
+		},
+		{
+			name:              "independent failure",
+			failed:            []string{"D"},
+			built:             []string{"A", "B", "E"},
+			expectedBlockedBy: map[string][]string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newBlockedByTestGraph(t)
+			buildState := b.buildState(test.failed, test.built)
+
+			blockedBy := blockingFailures(b.g, buildState)
+
+			// The run node of a failed package is blocked by its own failure, its build node and built packages are never blocked.
+			expectedBlocked := make(map[int64]bool)
+			for _, name := range test.failed {
+				node := b.runNodes[name]
+				expectedBlocked[node.ID()] = true
+				assert.Equal(t, []string{name + ".src.rpm"}, failedSRPMsBlocking(blockedBy, []*pkggraph.PkgNode{node}), node.FriendlyName())
+			}
+			for name, expectedFailures := range test.expectedBlockedBy {
+				for _, node := range []*pkggraph.PkgNode{b.runNodes[name], b.buildNodes[name]} {
+					expectedBlocked[node.ID()] = true
+					assert.Equal(t, expectedFailures, failedSRPMsBlocking(blockedBy, []*pkggraph.PkgNode{node}), node.FriendlyName())
+				}
+			}
+			for id := range blockedBy {
+				assert.True(t, expectedBlocked[id], "%s must not be blocked", b.g.Node(id).(*pkggraph.PkgNode).FriendlyName())
+			}
+		})
+	}
+}
+
+func TestBlockedDependentsStopsAtProcessedNodes(t *testing.T) {
+	b := newBlockedByTestGraph(t)
+
+	// B's run node was processed before A's failure was recorded, so C is not blocked by A.
+	buildState := b.buildState(nil, nil)
+	buildState.RecordBuildResult(&BuildResult{Node: b.runNodes["B"], AncillaryNodes: []*pkggraph.PkgNode{b.runNodes["B"]}})
+
+	blockedNodes := blockedDependents(b.g, buildState, []*pkggraph.PkgNode{b.buildNodes["A"]})
+	assert.ElementsMatch(t, []*pkggraph.PkgNode{b.runNodes["A"], b.buildNodes["B"]}, blockedNodes)
+}
+
+func TestBlockedDependentsSkipsNodesMissingFromGraph(t *testing.T) {
+	b := newBlockedByTestGraph(t)
+
+	// The graph was replaced by a subgraph without F since F failed.
+	otherGraph := newBlockedByTestGraph(t)
+	_, removedNode := pkggraphtest.AddSRPM(t, otherGraph.g, "F", "1")
+
+	blockedNodes := blockedDependents(b.g, b.buildState(nil, nil), []*pkggraph.PkgNode{removedNode, b.buildNodes["E"]})
+	assert.ElementsMatch(t, []*pkggraph.PkgNode{b.runNodes["E"], b.buildNodes["C"], b.runNodes["C"]}, blockedNodes)
+}
+
+func TestFailedSRPMsBlockingMergesFailures(t *testing.T) {
+	b := newBlockedByTestGraph(t)
+	blockedBy := blockingFailures(b.g, b.buildState([]string{"A", "E"}, nil))
+
+	failedSRPMs := failedSRPMsBlocking(blockedBy, []*pkggraph.PkgNode{b.buildNodes["C"], b.buildNodes["B"], b.runNodes["D"]})
+	assert.Equal(t, []string{"A.src.rpm", "E.src.rpm"}, failedSRPMs)
+}
+
+func TestSetBlockedBuildNodesStatus(t *testing.T) {
+	b := newBlockedByTestGraph(t)
+	buildState := b.buildState([]string{"A", "E"}, []string{"D"})
+
+	SetBlockedBuildNodesStatus(b.g, buildState)
+
+	assert.Equal(t, pkggraph.StateBlocked, b.buildNodes["B"].State)
+	assert.Equal(t, pkggraph.StateBlocked, b.buildNodes["C"].State)
+	assert.Equal(t, pkggraph.StateBuild, b.buildNodes["A"].State)
+	assert.Equal(t, pkggraph.StateBuild, b.buildNodes["D"].State)
+	assert.Equal(t, pkggraph.StateBuild, b.buildNodes["E"].State)
+	// Only build nodes are marked as blocked.
+	assert.Equal(t, pkggraph.StateMeta, b.runNodes["C"].State)
+}
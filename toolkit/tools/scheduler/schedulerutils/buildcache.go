@@ -0,0 +1,360 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package schedulerutils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"microsoft.com/pkggen/internal/file"
+	"microsoft.com/pkggen/internal/jsonutils"
+	"microsoft.com/pkggen/internal/logger"
+	"microsoft.com/pkggen/internal/rpm"
+	"microsoft.com/pkggen/scheduler/buildagents"
+)
+
+const (
+	// buildCacheKeyVersion is included in every cache key, bump it whenever the key's inputs change.
+	buildCacheKeyVersion = "2"
+	// buildCacheManifestFile is the name of the manifest stored with every cache entry.
+	buildCacheManifestFile = "manifest.json"
+	// buildCacheDebugDir is the directory of a cache entry holding its debug RPMs.
+	buildCacheDebugDir = "debug"
+)
+
+// buildCacheManifest lists the RPMs stored for a single cache key, relative to the RPM directory.
+// Debug RPMs kept apart from the other RPMs are listed relative to the debug RPM directory.
+type buildCacheManifest struct {
+	SrpmPath        string
+	BuiltFiles      []string
+	BuiltDebugFiles []string
+}
+
+// fileDigest is a memoized content hash of a file.
+type fileDigest struct {
+	size    int64
+	modTime time.Time
+	hash    string
+}
+
+// BuildCache is a content-addressed cache of built RPMs.
+//
+// Every SRPM build is keyed on everything which may change its output:
+// - The name and contents of the SRPM.
+// - The spec build conditional enabled for a bootstrap stage, if any.
+// - The NEVRA and contents of every RPM installed to build it.
+// - The defines passed to rpmbuild and the contents of the rpmmacros file.
+// If any input changes, so does the key, and the SRPM is rebuilt.
+//
+// The cache is stored as one directory per key holding a manifest and a copy of the built RPMs.
+// Copies are used instead of hard links so overwriting an RPM in the RPM directory can never corrupt the cache.
+type BuildCache struct {
+	dir         string
+	rpmDir      string
+	debugRpmDir string
+	configHash  string
+
+	digestsMutex sync.Mutex
+	digests      map[string]*fileDigest
+}
+
+// NewBuildCache returns a new BuildCache stored in cacheDir.
+// - If cacheDir is empty the cache will not store or restore anything.
+// - config is the build agent's configuration, used to key builds on the defines passed to rpmbuild and the worker chroot.
+func NewBuildCache(cacheDir string, config buildagents.BuildAgentConfig) (c *BuildCache, err error) {
+	c = &BuildCache{
+		rpmDir:      config.RpmDir,
+		debugRpmDir: config.DebugRpmDir,
+		digests:     make(map[string]*fileDigest),
+	}
+
+	if cacheDir == "" {
+		return
+	}
+
+	err = os.MkdirAll(cacheDir, os.ModePerm)
+	if err != nil {
+		return
+	}
+
+	c.configHash, err = hashBuildConfig(config)
+	if err != nil {
+		return
+	}
+
+	c.dir = cacheDir
+	logger.Log.Infof("Using build cache (%s)", cacheDir)
+
+	return
+}
+
+// Key returns the cache key of an SRPM built with the given dependencies installed.
+// - bcond is the spec build conditional the SRPM is built with, empty for regular builds.
+func (c *BuildCache) Key(srpmPath, bcond string, dependencies []string) (key string, err error) {
+	if c.dir == "" {
+		return
+	}
+
+	var keyInputs []string
+
+	srpmHash, err := c.digest(srpmPath)
+	if err != nil {
+		return
+	}
+	keyInputs = append(keyInputs, fmt.Sprintf("version %s", buildCacheKeyVersion))
+	keyInputs = append(keyInputs, fmt.Sprintf("config %s", c.configHash))
+	keyInputs = append(keyInputs, fmt.Sprintf("srpm %s %s", filepath.Base(srpmPath), srpmHash))
+
+	// Only bootstrap stages add the bcond, so the keys of regular builds are unchanged.
+	if bcond != "" {
+		keyInputs = append(keyInputs, fmt.Sprintf("bcond %s", bcond))
+	}
+
+	// Installed packages are keyed by their exact NEVRA, as well as their contents. A locally rebuilt
+	// dependency keeps its NEVRA, but may still change the output of anything built against it.
+	sortedDependencies := append([]string(nil), dependencies...)
+	sort.Strings(sortedDependencies)
+	for _, dependency := range sortedDependencies {
+		var dependencyHash string
+		dependencyHash, err = c.digest(dependency)
+		if err != nil {
+			return
+		}
+
+		nevra := strings.TrimSuffix(filepath.Base(dependency), ".rpm")
+		keyInputs = append(keyInputs, fmt.Sprintf("dependency %s %s", nevra, dependencyHash))
+	}
+
+	key = hashStrings(keyInputs)
+	return
+}
+
+// Restore copies the RPMs stored for a key into the RPM directory, and its debug RPMs into the debug RPM directory,
+// and returns their paths. If the key is not in the cache, found will be false.
+func (c *BuildCache) Restore(key string) (builtFiles, builtDebugFiles []string, found bool, err error) {
+	if c.dir == "" || key == "" {
+		return
+	}
+
+	defer func() {
+		if found {
+			buildCacheLookups.Inc(buildCacheLookupHit)
+		} else {
+			buildCacheLookups.Inc(buildCacheLookupMiss)
+		}
+	}()
+
+	entryDir := c.entryDir(key)
+	manifest := buildCacheManifest{}
+	err = jsonutils.ReadJSONFile(filepath.Join(entryDir, buildCacheManifestFile), &manifest)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	builtFiles, err = restoreBuiltFiles(entryDir, c.rpmDir, manifest.BuiltFiles)
+	if err != nil {
+		return
+	}
+
+	// Entries only hold debug RPMs if they were kept apart, which is part of the key.
+	builtDebugFiles, err = restoreBuiltFiles(filepath.Join(entryDir, buildCacheDebugDir), c.debugRpmDir, manifest.BuiltDebugFiles)
+	if err != nil {
+		return
+	}
+
+	found = true
+	return
+}
+
+// Store copies the RPMs built for a key into the cache.
+// - builtDebugFiles are the debug RPMs built into the debug RPM directory, if any.
+// Keys already present in the cache are left as they are.
+func (c *BuildCache) Store(key, srpmPath string, builtFiles, builtDebugFiles []string) (err error) {
+	if c.dir == "" || key == "" {
+		return
+	}
+
+	entryDir := c.entryDir(key)
+	exists, err := file.DirExists(entryDir)
+	if err != nil || exists {
+		return
+	}
+
+	// Populate the entry in a temporary directory first, so an interrupted store never leaves a partial entry behind.
+	tempDir, err := ioutil.TempDir(c.dir, "store-")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	manifest := buildCacheManifest{
+		SrpmPath: srpmPath,
+	}
+
+	manifest.BuiltFiles, err = storeBuiltFiles(tempDir, c.rpmDir, builtFiles)
+	if err != nil {
+		return
+	}
+
+	if len(builtDebugFiles) > 0 {
+		manifest.BuiltDebugFiles, err = storeBuiltFiles(filepath.Join(tempDir, buildCacheDebugDir), c.debugRpmDir, builtDebugFiles)
+		if err != nil {
+			return
+		}
+	}
+
+	err = jsonutils.WriteJSONFile(filepath.Join(tempDir, buildCacheManifestFile), manifest)
+	if err != nil {
+		return
+	}
+
+	err = os.MkdirAll(filepath.Dir(entryDir), os.ModePerm)
+	if err != nil {
+		return
+	}
+
+	err = os.Rename(tempDir, entryDir)
+	if os.IsExist(err) {
+		// Another build stored the same key first.
+		err = nil
+	}
+
+	return
+}
+
+// storeBuiltFiles copies files from rpmDir into storeDir and returns their paths relative to rpmDir.
+func storeBuiltFiles(storeDir, rpmDir string, builtFiles []string) (relativePaths []string, err error) {
+	for _, builtFile := range builtFiles {
+		var relativePath string
+		relativePath, err = filepath.Rel(rpmDir, builtFile)
+		if rpmDir == "" || err != nil || strings.HasPrefix(relativePath, "..") {
+			err = fmt.Errorf("built file (%s) is not in the RPM directory (%s)", builtFile, rpmDir)
+			return
+		}
+
+		err = file.Copy(builtFile, filepath.Join(storeDir, relativePath))
+		if err != nil {
+			return
+		}
+
+		relativePaths = append(relativePaths, relativePath)
+	}
+
+	return
+}
+
+// restoreBuiltFiles copies files stored with storeBuiltFiles back into rpmDir and returns their paths.
+func restoreBuiltFiles(storeDir, rpmDir string, relativePaths []string) (builtFiles []string, err error) {
+	for _, relativePath := range relativePaths {
+		builtFile := filepath.Join(rpmDir, relativePath)
+		err = file.Copy(filepath.Join(storeDir, relativePath), builtFile)
+		if err != nil {
+			return
+		}
+
+		builtFiles = append(builtFiles, builtFile)
+	}
+
+	return
+}
+
+// entryDir returns the directory a key is stored in.
+// Entries are spread across subdirectories to keep the size of any single directory manageable.
+func (c *BuildCache) entryDir(key string) string {
+	const prefixLength = 2
+
+	return filepath.Join(c.dir, key[:prefixLength], key)
+}
+
+// digest returns the SHA256 of a file, reusing earlier results if the file has not changed since.
+func (c *BuildCache) digest(path string) (hash string, err error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+
+	c.digestsMutex.Lock()
+	memoized, found := c.digests[path]
+	c.digestsMutex.Unlock()
+
+	if found && memoized.size == info.Size() && memoized.modTime.Equal(info.ModTime()) {
+		hash = memoized.hash
+		return
+	}
+
+	hash, err = file.GenerateSHA256(path)
+	if err != nil {
+		return
+	}
+
+	c.digestsMutex.Lock()
+	c.digests[path] = &fileDigest{
+		size:    info.Size(),
+		modTime: info.ModTime(),
+		hash:    hash,
+	}
+	c.digestsMutex.Unlock()
+
+	return
+}
+
+// hashBuildConfig hashes every part of the build agent's configuration which is passed on to rpmbuild, and the worker chroot it runs in.
+func hashBuildConfig(config buildagents.BuildAgentConfig) (hash string, err error) {
+	defines := rpm.DefaultDefines(config.RunCheck)
+	defines[rpm.DistTagDefine] = config.DistTag
+	defines[rpm.DistroReleaseVersionDefine] = config.DistroReleaseVersion
+	defines[rpm.DistroBuildNumberDefine] = config.DistroBuildNumber
+
+	var configInputs []string
+	for name, value := range defines {
+		configInputs = append(configInputs, fmt.Sprintf("define %s %s", name, value))
+	}
+	sort.Strings(configInputs)
+
+	configInputs = append(configInputs, fmt.Sprintf("run-check %t", config.RunCheck))
+
+	// The worker chroot provides the toolchain every package is built with.
+	workerTarHash := config.WorkerTarHash
+	if workerTarHash == "" && config.WorkerTar != "" {
+		workerTarHash, err = file.GenerateSHA256(config.WorkerTar)
+		if err != nil {
+			return
+		}
+	}
+	configInputs = append(configInputs, fmt.Sprintf("worker-tar %s", workerTarHash))
+
+	if config.DebugRpmDir != "" {
+		configInputs = append(configInputs, "separate-debug-rpms")
+	}
+
+	if config.RpmmacrosFile != "" {
+		var macrosHash string
+		macrosHash, err = file.GenerateSHA256(config.RpmmacrosFile)
+		if err != nil {
+			return
+		}
+
+		configInputs = append(configInputs, fmt.Sprintf("rpmmacros %s", macrosHash))
+	}
+
+	hash = hashStrings(configInputs)
+	return
+}
+
+// hashStrings returns the SHA256 of a list of strings, one per line.
+func hashStrings(inputs []string) string {
+	rawHash := sha256.Sum256([]byte(strings.Join(inputs, "\n")))
+	return hex.EncodeToString(rawHash[:])
+}
@@ -0,0 +1,164 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package schedulerutils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"microsoft.com/pkggen/scheduler/buildagents"
+)
+
+// buildCacheTestHelper creates a build cache and an RPM directory holding an SRPM and a dependency.
+func buildCacheTestHelper(t *testing.T, dir string, config buildagents.BuildAgentConfig) (cache *BuildCache, srpm, dependency string) {
+	config.RpmDir = filepath.Join(dir, "RPMS")
+	assert.NoError(t, os.MkdirAll(config.RpmDir, os.ModePerm))
+
+	cache, err := NewBuildCache(filepath.Join(dir, "cache"), config)
+	assert.NoError(t, err)
+
+	srpm = writeTestFile(t, dir, "A-1.0-1.src.rpm", "srpm")
+	dependency = writeTestFile(t, config.RpmDir, "B-1.0-1.x86_64.rpm", "dependency")
+	return
+}
+
+func TestBuildCacheKeyChangesWithInputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buildcache")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cache, srpm, dependency := buildCacheTestHelper(t, dir, buildagents.BuildAgentConfig{DistTag: ".cm1"})
+	key := func(bcond string, dependencies []string) string {
+		k, err := cache.Key(srpm, bcond, dependencies)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, k)
+		return k
+	}
+
+	baseKey := key("", []string{dependency})
+	assert.Equal(t, baseKey, key("", []string{dependency}), "key must be stable for the same inputs")
+
+	keys := map[string]string{
+		"bcond":           key("bootstrap", []string{dependency}),
+		"no dependencies": key("", nil),
+	}
+
+	writeTestFile(t, filepath.Dir(dependency), filepath.Base(dependency), "rebuilt dependency")
+	keys["dependency content"] = key("", []string{dependency})
+
+	writeTestFile(t, dir, filepath.Base(srpm), "changed srpm")
+	keys["srpm content"] = key("", []string{dependency})
+
+	for input, changedKey := range keys {
+		assert.NotEqual(t, baseKey, changedKey, "key must change with the %s", input)
+	}
+}
+
+func TestBuildCacheKeyChangesWithDefines(t *testing.T) {
+	tests := []struct {
+		name   string
+		config buildagents.BuildAgentConfig
+	}{
+		{"dist tag", buildagents.BuildAgentConfig{DistTag: ".cm2"}},
+		{"release version", buildagents.BuildAgentConfig{DistTag: ".cm1", DistroReleaseVersion: "1.0"}},
+		{"build number", buildagents.BuildAgentConfig{DistTag: ".cm1", DistroBuildNumber: "42"}},
+		{"run check", buildagents.BuildAgentConfig{DistTag: ".cm1", RunCheck: true}},
+		{"worker tar", buildagents.BuildAgentConfig{DistTag: ".cm1", WorkerTarHash: "0123456789abcdef"}},
+	}
+
+	dir, err := ioutil.TempDir("", "buildcache")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	baseCache, srpm, _ := buildCacheTestHelper(t, dir, buildagents.BuildAgentConfig{DistTag: ".cm1"})
+	baseKey, err := baseCache.Key(srpm, "", nil)
+	assert.NoError(t, err)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cache, err := NewBuildCache(filepath.Join(dir, "cache"), test.config)
+			assert.NoError(t, err)
+
+			key, err := cache.Key(srpm, "", nil)
+			assert.NoError(t, err)
+			assert.NotEqual(t, baseKey, key)
+		})
+	}
+}
+
+func TestBuildCacheStoreAndRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buildcache")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cache, srpm, dependency := buildCacheTestHelper(t, dir, buildagents.BuildAgentConfig{})
+	key, err := cache.Key(srpm, "", []string{dependency})
+	assert.NoError(t, err)
+
+	_, _, found, err := cache.Restore(key)
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	builtFile := writeTestFile(t, filepath.Dir(dependency), "A-1.0-1.x86_64.rpm", "built")
+	assert.NoError(t, cache.Store(key, srpm, []string{builtFile}, nil))
+	assert.NoError(t, os.Remove(builtFile))
+
+	builtFiles, _, found, err := cache.Restore(key)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []string{builtFile}, builtFiles)
+
+	contents, err := ioutil.ReadFile(builtFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "built", string(contents))
+}
+
+func TestBuildCacheStoreAndRestoreDebugFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buildcache")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := buildagents.BuildAgentConfig{DebugRpmDir: filepath.Join(dir, "DEBUGRPMS")}
+	cache, srpm, dependency := buildCacheTestHelper(t, dir, config)
+	key, err := cache.Key(srpm, "", []string{dependency})
+	assert.NoError(t, err)
+
+	withoutDebugCache, _, _ := buildCacheTestHelper(t, dir, buildagents.BuildAgentConfig{})
+	withoutDebugKey, err := withoutDebugCache.Key(srpm, "", []string{dependency})
+	assert.NoError(t, err)
+	assert.NotEqual(t, withoutDebugKey, key, "key must change when debug RPMs are kept apart")
+
+	builtFile := writeTestFile(t, filepath.Dir(dependency), "A-1.0-1.x86_64.rpm", "built")
+	assert.NoError(t, os.MkdirAll(filepath.Join(config.DebugRpmDir, "x86_64"), os.ModePerm))
+	builtDebugFile := writeTestFile(t, filepath.Join(config.DebugRpmDir, "x86_64"), "A-debuginfo-1.0-1.x86_64.rpm", "debug")
+	assert.NoError(t, cache.Store(key, srpm, []string{builtFile}, []string{builtDebugFile}))
+	assert.NoError(t, os.Remove(builtFile))
+	assert.NoError(t, os.Remove(builtDebugFile))
+
+	builtFiles, builtDebugFiles, found, err := cache.Restore(key)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []string{builtFile}, builtFiles)
+	assert.Equal(t, []string{builtDebugFile}, builtDebugFiles)
+
+	contents, err := ioutil.ReadFile(builtDebugFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "debug", string(contents))
+}
+
+func TestBuildCacheDisabled(t *testing.T) {
+	cache, err := NewBuildCache("", buildagents.BuildAgentConfig{})
+	assert.NoError(t, err)
+
+	key, err := cache.Key("A-1.0-1.src.rpm", "", nil)
+	assert.NoError(t, err)
+	assert.Empty(t, key)
+
+	_, _, found, err := cache.Restore(key)
+	assert.NoError(t, err)
+	assert.False(t, found)
+}
@@ -0,0 +1,100 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package schedulerutils
+
+import (
+	"time"
+
+	"microsoft.com/pkggen/internal/buildhistory"
+	"microsoft.com/pkggen/internal/pkggraph"
+)
+
+// HistoricalBuildCost returns a BuildCostFunc which estimates the cost of a build node as its expected build time in seconds.
+// Packages without a successful build on record are assumed to take as long as the average package.
+// If the history has no successful builds, every build node is treated as equally expensive.
+func HistoricalBuildCost(history *buildhistory.History) BuildCostFunc {
+	averageDuration, found := history.AverageDuration()
+	if !found {
+		return UniformBuildCost
+	}
+
+	return func(node *pkggraph.PkgNode) float64 {
+		if node.Type != pkggraph.TypeBuild {
+			return 0
+		}
+
+		duration, found := history.ExpectedDuration(node.SpecName())
+		if !found {
+			duration = averageDuration
+		}
+
+		return duration.Seconds()
+	}
+}
+
+// RecordBuildHistory adds the result of a build to the build history.
+// Only packages that were actually built are recorded, cached, skipped or restored results are ignored.
+func RecordBuildHistory(history *buildhistory.History, res *BuildResult) {
+	if res.Node.Type != pkggraph.TypeBuild || res.UsedCache || res.Skipped || res.StartTime.IsZero() {
+		return
+	}
+
+	history.AddRecord(res.Node.SpecName(), &buildhistory.Record{
+		SrpmName:  res.Node.SRPMFileName(),
+		StartTime: res.StartTime,
+		EndTime:   res.EndTime,
+		Attempts:  res.Attempts,
+		LogFile:   res.LogFile,
+		Succeeded: res.Err == nil,
+	})
+}
+
+// EstimateRemainingBuildTime estimates how long it will take to build all SRPMs which have not been processed yet
+// based on the build history. The estimate is the larger of the remaining work spread evenly across all workers
+// and the longest remaining chain of builds that must happen one after another.
+// - found will be false if the history has no successful builds to base an estimate on.
+func EstimateRemainingBuildTime(pkgGraph *pkggraph.PkgGraph, goalNode *pkggraph.PkgNode, buildState *GraphBuildState, history *buildhistory.History, workers int) (remaining time.Duration, found bool) {
+	if history.IsEmpty() {
+		return
+	}
+
+	buildCost := HistoricalBuildCost(history)
+	remainingBuildCost := func(node *pkggraph.PkgNode) float64 {
+		if buildState.IsNodeProcessed(node) {
+			return 0
+		}
+		return buildCost(node)
+	}
+
+	var longestChain float64
+	for _, weight := range CriticalPathWeights(pkgGraph, goalNode, remainingBuildCost) {
+		if weight > longestChain {
+			longestChain = weight
+		}
+	}
+
+	// Multiple build nodes may be built from the same SRPM, only count each SRPM once.
+	remainingSRPMs := make(map[string]float64)
+	pkgGraph.RLock()
+	for _, node := range pkgGraph.AllNodesFrom(goalNode) {
+		cost := remainingBuildCost(node)
+		key := srpmBuildKey(node.SrpmPath, node.Bcond)
+		if cost > remainingSRPMs[key] {
+			remainingSRPMs[key] = cost
+		}
+	}
+	pkgGraph.RUnlock()
+
+	var totalCost float64
+	for _, cost := range remainingSRPMs {
+		totalCost += cost
+	}
+
+	estimate := totalCost / float64(workers)
+	if longestChain > estimate {
+		estimate = longestChain
+	}
+
+	return time.Duration(estimate * float64(time.Second)), true
+}
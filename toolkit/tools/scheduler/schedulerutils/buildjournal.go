@@ -0,0 +1,229 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package schedulerutils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"microsoft.com/pkggen/internal/file"
+	"microsoft.com/pkggen/internal/logger"
+	"microsoft.com/pkggen/internal/pkggraph"
+	"microsoft.com/pkggen/scheduler/buildagents"
+)
+
+// journalEntry represents a single checkpointed build result.
+type journalEntry struct {
+	SrpmPath   string
+	Bcond      string `json:",omitempty"`
+	SrpmHash   string
+	BuiltFiles []string
+	LogFile    string
+	UsedCache  bool
+	Skipped    bool
+	Err        string
+	Check      *buildagents.CheckResult `json:",omitempty"`
+}
+
+// BuildJournal checkpoints build results to a file while the scheduler runs so an
+// interrupted build can be resumed without re-evaluating every node.
+//
+// Only results of build nodes are recorded. All other node types are cheap to process and
+// any implicit provides injected into the graph are recovered by replaying the restored results
+// through the scheduler.
+type BuildJournal struct {
+	file       *os.File
+	encoder    *json.Encoder
+	restorable map[string]*journalEntry // Keyed by srpmBuildKey
+}
+
+// NewBuildJournal returns a new BuildJournal backed by journalFile.
+// - If journalFile is empty the journal will not record or restore anything.
+// - If resume is set, any successful results already present in journalFile can be restored.
+//   Otherwise journalFile is truncated.
+func NewBuildJournal(journalFile string, resume bool) (j *BuildJournal, err error) {
+	const journalFilePermissions = 0664
+
+	j = &BuildJournal{
+		restorable: make(map[string]*journalEntry),
+	}
+
+	if journalFile == "" {
+		return
+	}
+
+	var entries []*journalEntry
+	if resume {
+		entries, err = readJournalEntries(journalFile)
+		if err != nil {
+			return
+		}
+	}
+
+	// Always rewrite the journal from scratch, an interrupted scheduler may have left a partially written entry at the end.
+	j.file, err = os.OpenFile(journalFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, journalFilePermissions)
+	if err != nil {
+		return
+	}
+	j.encoder = json.NewEncoder(j.file)
+
+	for _, entry := range entries {
+		err = j.encoder.Encode(entry)
+		if err != nil {
+			return
+		}
+
+		key := srpmBuildKey(entry.SrpmPath, entry.Bcond)
+		if entry.Err == "" {
+			j.restorable[key] = entry
+		} else {
+			delete(j.restorable, key)
+		}
+	}
+
+	if resume {
+		logger.Log.Infof("Resuming build, %d SRPM result(s) can be restored from (%s)", len(j.restorable), journalFile)
+	}
+
+	return
+}
+
+// RecordBuildResult appends a build result to the journal.
+// Results restored from the journal are not recorded again, their entries were already copied when the journal was opened.
+func (j *BuildJournal) RecordBuildResult(res *BuildResult) (err error) {
+	if j.file == nil || res.Node.Type != pkggraph.TypeBuild || res.Restored {
+		return
+	}
+
+	srpmHash, err := file.GenerateSHA256(res.Node.SrpmPath)
+	if err != nil {
+		return
+	}
+
+	entry := &journalEntry{
+		SrpmPath:   res.Node.SrpmPath,
+		Bcond:      res.Node.Bcond,
+		SrpmHash:   srpmHash,
+		BuiltFiles: res.BuiltFiles,
+		LogFile:    res.LogFile,
+		UsedCache:  res.UsedCache,
+		Skipped:    res.Skipped,
+		Check:      res.Check,
+	}
+
+	if res.Err != nil {
+		entry.Err = res.Err.Error()
+	}
+
+	err = j.encoder.Encode(entry)
+	if err != nil {
+		return
+	}
+
+	// Flush the entry to disk right away, the scheduler may be killed at any point.
+	return j.file.Sync()
+}
+
+// RestoreBuildResult returns the result of a previous, successful build of the request if one was recorded in the journal.
+// A result is only restored if the request can use the cache, the SRPM is unchanged since it was built and all files it built are still present.
+func (j *BuildJournal) RestoreBuildResult(req *BuildRequest) (res *BuildResult, found bool) {
+	if req.Node.Type != pkggraph.TypeBuild {
+		return
+	}
+
+	entry, found := j.restorable[srpmBuildKey(req.Node.SrpmPath, req.Node.Bcond)]
+	if !found {
+		return
+	}
+
+	// The package was requested to be rebuilt, or one of its dependencies was rebuilt by this run.
+	if !req.CanUseCache {
+		logger.Log.Infof("Can't restore %s from the build journal, it must be rebuilt", req.Node.SRPMFileName())
+		found = false
+		return
+	}
+
+	srpmHash, err := file.GenerateSHA256(req.Node.SrpmPath)
+	if err != nil || srpmHash != entry.SrpmHash {
+		logger.Log.Infof("Can't restore %s from the build journal, the SRPM changed since it was built", req.Node.SRPMFileName())
+		found = false
+		return
+	}
+
+	for _, builtFile := range entry.BuiltFiles {
+		exists, _ := file.IsFile(builtFile)
+		if !exists {
+			logger.Log.Infof("Can't restore %s from the build journal, (%s) is missing", req.Node.SRPMFileName(), builtFile)
+			found = false
+			return
+		}
+	}
+
+	logger.Log.Debugf("Restoring result for %s from the build journal", req.Node.SRPMFileName())
+
+	res = &BuildResult{
+		Node:           req.Node,
+		AncillaryNodes: req.AncillaryNodes,
+		BuiltFiles:     entry.BuiltFiles,
+		LogFile:        entry.LogFile,
+		UsedCache:      entry.UsedCache,
+		Skipped:        entry.Skipped,
+		Check:          entry.Check,
+		Restored:       true,
+	}
+
+	setAncillaryBuildNodesStatus(req, buildResultNodeState(res))
+
+	return
+}
+
+// Close closes the journal file.
+func (j *BuildJournal) Close() (err error) {
+	if j.file == nil {
+		return
+	}
+
+	return j.file.Close()
+}
+
+// readJournalEntries reads all complete entries from a journal file.
+func readJournalEntries(journalFile string) (entries []*journalEntry, err error) {
+	exists, err := file.PathExists(journalFile)
+	if err != nil || !exists {
+		logger.Log.Warnf("No build journal found at (%s), nothing to resume", journalFile)
+		return
+	}
+
+	f, err := os.Open(journalFile)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	decoder := json.NewDecoder(f)
+	for {
+		entry := &journalEntry{}
+		decodeErr := decoder.Decode(entry)
+		if decodeErr == io.EOF {
+			break
+		}
+
+		if decodeErr != nil {
+			// The last entry may have been cut short if the scheduler was killed mid-write.
+			logger.Log.Warnf("Ignoring malformed build journal entry after %d valid entries. Error: %s", len(entries), decodeErr)
+			break
+		}
+
+		if entry.SrpmPath == "" {
+			err = fmt.Errorf("build journal (%s) contains an entry without an SRPM", journalFile)
+			return
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return
+}
@@ -0,0 +1,224 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package schedulerutils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"microsoft.com/pkggen/internal/logger"
+	"microsoft.com/pkggen/internal/pkggraph"
+	"microsoft.com/pkggen/internal/pkggraph/pkggraphtest"
+	"microsoft.com/pkggen/internal/pkgjson"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitStderrLog()
+	os.Exit(m.Run())
+}
+
+// writeTestFile writes a file with the given contents to a directory and returns its path.
+func writeTestFile(t *testing.T, dir, name, contents string) string {
+	path := filepath.Join(dir, name)
+	assert.NoError(t, ioutil.WriteFile(path, []byte(contents), os.ModePerm))
+	return path
+}
+
+// buildNodeHelper returns a build node for an SRPM.
+func buildNodeHelper(srpmPath, bcond string) *pkggraph.PkgNode {
+	node := &pkggraph.PkgNode{
+		VersionedPkg: &pkgjson.PackageVer{Name: filepath.Base(srpmPath), Version: "1"},
+		Type:         pkggraph.TypeBuild,
+		State:        pkggraph.StateBuild,
+		SrpmPath:     srpmPath,
+		Bcond:        bcond,
+	}
+	node.This = node
+	return node
+}
+
+// recordJournalResult records a successful build of a node in a new journal and closes it.
+func recordJournalResult(t *testing.T, journalFile string, node *pkggraph.PkgNode, builtFiles []string) {
+	journal, err := NewBuildJournal(journalFile, false)
+	assert.NoError(t, err)
+	assert.NoError(t, journal.RecordBuildResult(&BuildResult{Node: node, BuiltFiles: builtFiles}))
+	assert.NoError(t, journal.Close())
+}
+
+// restoreJournalResult resumes a journal and tries to restore the result of a node, which can use the cache, from it.
+func restoreJournalResult(t *testing.T, journalFile string, node *pkggraph.PkgNode) (found bool) {
+	journal, err := NewBuildJournal(journalFile, true)
+	assert.NoError(t, err)
+	defer journal.Close()
+
+	_, found = journal.RestoreBuildResult(&BuildRequest{Node: node, AncillaryNodes: []*pkggraph.PkgNode{node}, CanUseCache: true})
+	return
+}
+
+func TestRestoreBuildResult(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buildjournal")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	srpm := writeTestFile(t, dir, "A.src.rpm", "srpm")
+	rpm := writeTestFile(t, dir, "A.rpm", "rpm")
+	journalFile := filepath.Join(dir, "journal.jsonl")
+
+	recordJournalResult(t, journalFile, buildNodeHelper(srpm, ""), []string{rpm})
+	assert.True(t, restoreJournalResult(t, journalFile, buildNodeHelper(srpm, "")))
+}
+
+func TestRestoreBuildResultFailsIfSRPMChanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buildjournal")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	srpm := writeTestFile(t, dir, "A.src.rpm", "srpm")
+	rpm := writeTestFile(t, dir, "A.rpm", "rpm")
+	journalFile := filepath.Join(dir, "journal.jsonl")
+
+	recordJournalResult(t, journalFile, buildNodeHelper(srpm, ""), []string{rpm})
+	writeTestFile(t, dir, "A.src.rpm", "changed srpm")
+	assert.False(t, restoreJournalResult(t, journalFile, buildNodeHelper(srpm, "")))
+}
+
+func TestRestoreBuildResultFailsIfBuiltFileIsMissing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buildjournal")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	srpm := writeTestFile(t, dir, "A.src.rpm", "srpm")
+	rpm := writeTestFile(t, dir, "A.rpm", "rpm")
+	journalFile := filepath.Join(dir, "journal.jsonl")
+
+	recordJournalResult(t, journalFile, buildNodeHelper(srpm, ""), []string{rpm})
+	assert.NoError(t, os.Remove(rpm))
+	assert.False(t, restoreJournalResult(t, journalFile, buildNodeHelper(srpm, "")))
+}
+
+func TestRestoreBuildResultKeepsBootstrapStagesApart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buildjournal")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	srpm := writeTestFile(t, dir, "A.src.rpm", "srpm")
+	rpm := writeTestFile(t, dir, "A.rpm", "rpm")
+	journalFile := filepath.Join(dir, "journal.jsonl")
+
+	recordJournalResult(t, journalFile, buildNodeHelper(srpm, "bootstrap"), []string{rpm})
+	assert.False(t, restoreJournalResult(t, journalFile, buildNodeHelper(srpm, "")))
+	assert.True(t, restoreJournalResult(t, journalFile, buildNodeHelper(srpm, "bootstrap")))
+}
+
+func TestRestoreBuildResultFailsIfDependencyWasRebuilt(t *testing.T) {
+	tests := []struct {
+		name            string
+		changeB         bool
+		expectRestoredA bool
+	}{
+		{"dependency restored", false, true},
+		{"dependency rebuilt", true, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "buildjournal")
+			assert.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			// A BuildRequires B, both were built before the build was interrupted.
+			g := pkggraph.NewPkgGraph()
+			_, aBuild := pkggraphtest.AddSRPM(t, g, "A", "1")
+			bRun, bBuild := pkggraphtest.AddSRPM(t, g, "B", "1")
+			assert.NoError(t, g.AddEdge(aBuild, bRun))
+
+			for _, node := range []*pkggraph.PkgNode{aBuild, bRun, bBuild} {
+				node.SrpmPath = writeTestFile(t, dir, node.SRPMFileName(), "srpm")
+			}
+			rpm := writeTestFile(t, dir, "A.rpm", "rpm")
+
+			journalFile := filepath.Join(dir, "journal.jsonl")
+			journal, err := NewBuildJournal(journalFile, false)
+			assert.NoError(t, err)
+			assert.NoError(t, journal.RecordBuildResult(&BuildResult{Node: bBuild, BuiltFiles: []string{rpm}}))
+			assert.NoError(t, journal.RecordBuildResult(&BuildResult{Node: aBuild, BuiltFiles: []string{rpm}}))
+			assert.NoError(t, journal.Close())
+
+			if test.changeB {
+				writeTestFile(t, dir, bBuild.SRPMFileName(), "changed srpm")
+			}
+
+			journal, err = NewBuildJournal(journalFile, true)
+			assert.NoError(t, err)
+			defer journal.Close()
+
+			// Process B's build and run nodes the way the scheduler would, then try to restore A.
+			buildState := NewGraphBuildState(nil)
+
+			bReq := ConvertNodesToRequests(g, []*pkggraph.PkgNode{bBuild}, nil, buildState, true)[0]
+			bRes, restoredB := journal.RestoreBuildResult(bReq)
+			assert.Equal(t, !test.changeB, restoredB)
+			if !restoredB {
+				bRes = &BuildResult{Node: bBuild, AncillaryNodes: bReq.AncillaryNodes, BuiltFiles: []string{rpm}}
+			}
+			buildState.RecordBuildResult(bRes)
+
+			bRunReq := ConvertNodesToRequests(g, []*pkggraph.PkgNode{bRun}, nil, buildState, true)[0]
+			buildState.RecordBuildResult(&BuildResult{Node: bRun, AncillaryNodes: bRunReq.AncillaryNodes, UsedCache: bRunReq.CanUseCache})
+
+			aReq := ConvertNodesToRequests(g, []*pkggraph.PkgNode{aBuild}, nil, buildState, true)[0]
+			_, restoredA := journal.RestoreBuildResult(aReq)
+			assert.Equal(t, test.expectRestoredA, restoredA)
+		})
+	}
+}
+
+func TestRestoreBuildResultFailsIfRebuildRequested(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buildjournal")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	srpm := writeTestFile(t, dir, "A.src.rpm", "srpm")
+	rpm := writeTestFile(t, dir, "A.rpm", "rpm")
+	journalFile := filepath.Join(dir, "journal.jsonl")
+
+	recordJournalResult(t, journalFile, buildNodeHelper(srpm, ""), []string{rpm})
+
+	journal, err := NewBuildJournal(journalFile, true)
+	assert.NoError(t, err)
+	defer journal.Close()
+
+	node := buildNodeHelper(srpm, "")
+	_, found := journal.RestoreBuildResult(&BuildRequest{Node: node, AncillaryNodes: []*pkggraph.PkgNode{node}, CanUseCache: false})
+	assert.False(t, found)
+}
+
+func TestRecordBuildResultSkipsRestoredResults(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buildjournal")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	srpm := writeTestFile(t, dir, "A.src.rpm", "srpm")
+	rpm := writeTestFile(t, dir, "A.rpm", "rpm")
+	journalFile := filepath.Join(dir, "journal.jsonl")
+
+	recordJournalResult(t, journalFile, buildNodeHelper(srpm, ""), []string{rpm})
+
+	journal, err := NewBuildJournal(journalFile, true)
+	assert.NoError(t, err)
+
+	node := buildNodeHelper(srpm, "")
+	res, found := journal.RestoreBuildResult(&BuildRequest{Node: node, AncillaryNodes: []*pkggraph.PkgNode{node}, CanUseCache: true})
+	assert.True(t, found)
+	assert.True(t, res.Restored)
+	assert.NoError(t, journal.RecordBuildResult(res))
+	assert.NoError(t, journal.Close())
+
+	entries, err := readJournalEntries(journalFile)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
@@ -80,7 +80,7 @@ func filterLocalPackagesOnly(packageVersionsInConfig []*pkgjson.PackageVer, inpu
 	logger.Log.Debug("Filtering out external packages from list of packages extracted from the image config file.")
 
 	dependencyGraph := pkggraph.NewPkgGraph()
-	err = pkggraph.ReadDOTGraphFile(dependencyGraph, inputGraph)
+	err = pkggraph.ReadGraphFile(dependencyGraph, inputGraph)
 	if err != nil {
 		return
 	}
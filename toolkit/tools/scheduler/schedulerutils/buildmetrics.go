@@ -0,0 +1,52 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package schedulerutils
+
+import (
+	"microsoft.com/pkggen/internal/metrics"
+	"microsoft.com/pkggen/internal/pkggraph"
+)
+
+// Values of the result label of the package build metrics.
+const (
+	buildMetricResultBuilt    = "built"
+	buildMetricResultFailed   = "failed"
+	buildMetricResultCached   = "cached"
+	buildMetricResultSkipped  = "skipped"
+	buildMetricResultRestored = "restored"
+)
+
+// Values of the result label of the build cache lookup metric.
+const (
+	buildCacheLookupHit  = "hit"
+	buildCacheLookupMiss = "miss"
+)
+
+var (
+	packageBuilds         = metrics.NewCounter("toolkit_package_builds", "Number of SRPMs processed by the scheduler, by result.", "result")
+	packageBuildDurations = metrics.NewHistogram("toolkit_package_build_duration_seconds", "Time taken to build an SRPM, including any retries, by result.", metrics.DurationBuckets, "result")
+	buildCacheLookups     = metrics.NewCounter("toolkit_build_cache_lookups", "Number of build cache lookups, by whether a cached build was found.", "result")
+)
+
+// RecordBuildMetrics adds the result of a build to the package build metrics.
+func RecordBuildMetrics(res *BuildResult) {
+	if res.Node.Type != pkggraph.TypeBuild {
+		return
+	}
+
+	switch {
+	case res.Restored:
+		packageBuilds.Inc(buildMetricResultRestored)
+	case res.Skipped:
+		packageBuilds.Inc(buildMetricResultSkipped)
+	case res.UsedCache:
+		packageBuilds.Inc(buildMetricResultCached)
+	case res.Err != nil:
+		packageBuilds.Inc(buildMetricResultFailed)
+		packageBuildDurations.Observe(res.EndTime.Sub(res.StartTime).Seconds(), buildMetricResultFailed)
+	default:
+		packageBuilds.Inc(buildMetricResultBuilt)
+		packageBuildDurations.Observe(res.EndTime.Sub(res.StartTime).Seconds(), buildMetricResultBuilt)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package schedulerutils
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"microsoft.com/pkggen/internal/pkggraph"
+)
+
+// WorkerStatus describes what a single build worker is currently doing.
+type WorkerStatus struct {
+	Worker    int
+	SRPM      string     `json:",omitempty"`
+	StartTime *time.Time `json:",omitempty"`
+}
+
+// BuildStatusReport is a point in time snapshot of the progress of a package build.
+type BuildStatusReport struct {
+	StartTime              time.Time
+	UpdateTime             time.Time
+	Finished               bool
+	ActiveSRPMs            []string
+	QueuedBuilds           int
+	CompletedSRPMs         int // Bootstrap stages are not counted, only the regular builds of SRPMs
+	FailedSRPMs            []string
+	EstimatedTimeRemaining string `json:",omitempty"`
+	Workers                []WorkerStatus
+}
+
+// BuildStatus tracks the progress of a package build so it can be reported while the build is running.
+// The scheduler updates the overall progress, while each build worker reports the SRPM it is building.
+type BuildStatus struct {
+	mutex  sync.RWMutex
+	report BuildStatusReport
+}
+
+// NewBuildStatus returns a new BuildStatus for a build using the given number of workers.
+func NewBuildStatus(workers int) (s *BuildStatus) {
+	s = &BuildStatus{
+		report: BuildStatusReport{
+			StartTime:   time.Now(),
+			ActiveSRPMs: []string{},
+			FailedSRPMs: []string{},
+			Workers:     make([]WorkerStatus, workers),
+		},
+	}
+
+	s.report.UpdateTime = s.report.StartTime
+	for i := range s.report.Workers {
+		s.report.Workers[i].Worker = i
+	}
+
+	return
+}
+
+// StartWorkerBuild records that a worker started building an SRPM.
+func (s *BuildStatus) StartWorkerBuild(worker int, node *pkggraph.PkgNode) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	startTime := time.Now()
+	s.report.Workers[worker].SRPM = srpmBuildName(node)
+	s.report.Workers[worker].StartTime = &startTime
+}
+
+// FinishWorkerBuild records that a worker is no longer building anything.
+func (s *BuildStatus) FinishWorkerBuild(worker int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.report.Workers[worker] = WorkerStatus{Worker: worker}
+}
+
+// Update refreshes the overall progress of the build.
+// Builds of bootstrap stages are labeled with their bcond, so they are not mistaken for the SRPM's regular build.
+// - queuedBuilds is the number of build requests waiting for a free worker.
+// Must only be called from the scheduler, since buildState is not safe for concurrent use.
+func (s *BuildStatus) Update(buildState *GraphBuildState, queuedBuilds int) {
+	activeSRPMs := buildState.ActiveSRPMs()
+	sort.Strings(activeSRPMs)
+
+	completedSRPMs := 0
+	failedSRPMs := []string{}
+	for _, res := range buildState.srpmResults {
+		switch {
+		case res.Err != nil:
+			failedSRPMs = append(failedSRPMs, srpmBuildName(res.Node))
+		case res.Node.Bcond == "":
+			completedSRPMs++
+		}
+	}
+	sort.Strings(failedSRPMs)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.report.UpdateTime = time.Now()
+	s.report.ActiveSRPMs = append([]string{}, activeSRPMs...)
+	s.report.QueuedBuilds = queuedBuilds
+	s.report.CompletedSRPMs = completedSRPMs
+	s.report.FailedSRPMs = failedSRPMs
+}
+
+// SetEstimatedTimeRemaining records the estimated time left to finish the build.
+// If estimated is false no estimate is available and none will be reported.
+func (s *BuildStatus) SetEstimatedTimeRemaining(remaining time.Duration, estimated bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.report.EstimatedTimeRemaining = ""
+	if estimated {
+		s.report.EstimatedTimeRemaining = remaining.Round(time.Second).String()
+	}
+}
+
+// Finish records that the build is over, no further updates are expected.
+func (s *BuildStatus) Finish() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.report.UpdateTime = time.Now()
+	s.report.Finished = true
+	s.report.EstimatedTimeRemaining = ""
+}
+
+// Report returns a snapshot of the build's progress.
+func (s *BuildStatus) Report() (report BuildStatusReport) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	report = s.report
+	report.ActiveSRPMs = append([]string{}, s.report.ActiveSRPMs...)
+	report.FailedSRPMs = append([]string{}, s.report.FailedSRPMs...)
+	report.Workers = append([]WorkerStatus{}, s.report.Workers...)
+
+	return
+}
@@ -0,0 +1,38 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package schedulerutils
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"microsoft.com/pkggen/internal/pkggraph"
+)
+
+func TestBuildStatusTellsBootstrapStagesApart(t *testing.T) {
+	buildState := NewGraphBuildState(nil)
+	record := func(node *pkggraph.PkgNode, err error) {
+		buildState.RecordBuildResult(&BuildResult{Node: node, AncillaryNodes: []*pkggraph.PkgNode{node}, Err: err})
+	}
+
+	record(buildNodeHelper("A.src.rpm", "bootstrap"), nil)
+	record(buildNodeHelper("A.src.rpm", ""), nil)
+	record(buildNodeHelper("B.src.rpm", "bootstrap"), nil)
+	record(buildNodeHelper("B.src.rpm", ""), fmt.Errorf("build failed"))
+	record(buildNodeHelper("C.src.rpm", "bootstrap"), fmt.Errorf("build failed"))
+
+	activeNode := buildNodeHelper("D.src.rpm", "bootstrap")
+	buildState.RecordBuildRequest(&BuildRequest{Node: activeNode})
+
+	status := NewBuildStatus(1)
+	status.StartWorkerBuild(0, activeNode)
+	status.Update(buildState, 0)
+
+	report := status.Report()
+	assert.Equal(t, 1, report.CompletedSRPMs)
+	assert.Equal(t, []string{"B.src.rpm", "C.src.rpm[bootstrap]"}, report.FailedSRPMs)
+	assert.Equal(t, []string{"D.src.rpm[bootstrap]"}, report.ActiveSRPMs)
+	assert.Equal(t, "D.src.rpm[bootstrap]", report.Workers[0].SRPM)
+}
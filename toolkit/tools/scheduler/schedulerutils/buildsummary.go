@@ -0,0 +1,419 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package schedulerutils
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"microsoft.com/pkggen/internal/jsonutils"
+	"microsoft.com/pkggen/internal/pkggraph"
+	"microsoft.com/pkggen/scheduler/buildagents"
+)
+
+// Final states of an SRPM, as reported in a BuildSummary.
+const (
+	SRPMStateBuilt   = "built"
+	SRPMStateCached  = "cached"
+	SRPMStateSkipped = "skipped"
+	SRPMStateFailed  = "failed"
+	SRPMStateBlocked = "blocked"
+	// SRPMStateCancelled marks an SRPM whose build was still active when the build was stopped.
+	SRPMStateCancelled = "cancelled"
+)
+
+// States of an SRPM's check, as reported in a BuildSummary.
+const (
+	CheckStatePassed = "passed"
+	CheckStateFailed = "failed"
+	// CheckStateFailedNonFatal marks a failed check which was not allowed to fail its build.
+	CheckStateFailedNonFatal = "failed-nonfatal"
+)
+
+// Final states of a requested package, as reported in a BuildSummary.
+const (
+	// GoalStateAvailable marks a requested package which was built or is available from a cache.
+	GoalStateAvailable = "available"
+	// GoalStateAchievable marks a requested package which was not built, but is not blocked by any failed build either.
+	GoalStateAchievable = "achievable"
+	// GoalStateBlocked marks a requested package which can not be built because it depends on a failed build.
+	GoalStateBlocked = "blocked"
+)
+
+// SRPMSummary describes the final state of a single SRPM.
+type SRPMSummary struct {
+	Name            string
+	Path            string
+	Bcond           string `json:",omitempty"` // Set for a bootstrap stage, which is summarized apart from the SRPM's regular build
+	State           string
+	FailureReason   string   `json:",omitempty"`
+	FailureCategory string   `json:",omitempty"`
+	FailureExcerpt  string   `json:",omitempty"`
+	Error           string   `json:",omitempty"`
+	LogFile         string   `json:",omitempty"`
+	Attempts        int      `json:",omitempty"`
+	BuildSeconds    float64  `json:",omitempty"`
+	BuiltFiles      []string `json:",omitempty"`
+	// BlockedBy lists the failed SRPMs which prevented a blocked SRPM from being built.
+	BlockedBy []string `json:",omitempty"`
+	// CheckState is the outcome of the SRPM's check, empty if the check was not run.
+	CheckState   string  `json:",omitempty"`
+	CheckError   string  `json:",omitempty"`
+	CheckSeconds float64 `json:",omitempty"`
+}
+
+// GoalSummary describes the final state of a single requested package.
+type GoalSummary struct {
+	Name  string
+	State string
+	// BlockedBy lists the failed SRPMs which prevent a blocked package from being built.
+	BlockedBy []string `json:",omitempty"`
+}
+
+// BuildSummary is a machine-readable summary of a package build.
+type BuildSummary struct {
+	SRPMs                  []*SRPMSummary
+	Goals                  []*GoalSummary
+	UnresolvedDependencies []string
+	ConflictingRPMs        []string
+	ConflictingSRPMs       []string
+}
+
+// NewBuildSummary summarizes the final state of every SRPM in a graph.
+func NewBuildSummary(pkgGraph *pkggraph.PkgGraph, buildState *GraphBuildState) (summary *BuildSummary) {
+	pkgGraph.RLock()
+	defer pkgGraph.RUnlock()
+
+	summary = &BuildSummary{
+		SRPMs:                  []*SRPMSummary{},
+		Goals:                  []*GoalSummary{},
+		UnresolvedDependencies: []string{},
+		ConflictingRPMs:        buildState.ConflictingRPMs(),
+		ConflictingSRPMs:       buildState.ConflictingSRPMs(),
+	}
+
+	blockedBy := blockingFailures(pkgGraph, buildState)
+
+	activeSRPMs := make(map[string]bool)
+	for _, req := range buildState.ActiveBuilds() {
+		activeSRPMs[srpmBuildKey(req.Node.SrpmPath, req.Node.Bcond)] = true
+	}
+
+	// An SRPM may be split across several build nodes, one for each RPM it produces.
+	// The build nodes of bootstrap stages are not indexed, so every node is checked.
+	srpmNodes := make(map[string][]*pkggraph.PkgNode)
+	for _, node := range pkgGraph.AllNodes() {
+		if node.Type != pkggraph.TypeBuild {
+			continue
+		}
+
+		key := srpmBuildKey(node.SrpmPath, node.Bcond)
+		srpmNodes[key] = append(srpmNodes[key], node)
+	}
+
+	for key, nodes := range srpmNodes {
+		srpm := summarizeSRPM(nodes[0], buildState)
+		if srpm.State == SRPMStateBlocked {
+			if activeSRPMs[key] {
+				srpm.State = SRPMStateCancelled
+			} else {
+				srpm.BlockedBy = failedSRPMsBlocking(blockedBy, nodes)
+			}
+		}
+
+		summary.SRPMs = append(summary.SRPMs, srpm)
+	}
+
+	sort.Slice(summary.SRPMs, func(i, j int) bool {
+		if summary.SRPMs[i].Name != summary.SRPMs[j].Name {
+			return summary.SRPMs[i].Name < summary.SRPMs[j].Name
+		}
+		return summary.SRPMs[i].Bcond < summary.SRPMs[j].Bcond
+	})
+
+	unresolvedDependencies := make(map[string]bool)
+	for _, node := range pkgGraph.AllRunNodes() {
+		if node.State == pkggraph.StateUnresolved {
+			unresolvedDependencies[node.VersionedPkg.Name] = true
+		}
+	}
+
+	for dependency := range unresolvedDependencies {
+		summary.UnresolvedDependencies = append(summary.UnresolvedDependencies, dependency)
+	}
+	sort.Strings(summary.UnresolvedDependencies)
+
+	summary.Goals = summarizeGoals(pkgGraph, buildState, blockedBy)
+
+	return
+}
+
+// summarizeGoals summarizes the final state of every package requested to be built.
+func summarizeGoals(pkgGraph *pkggraph.PkgGraph, buildState *GraphBuildState, blockedBy map[int64]map[string]bool) (goals []*GoalSummary) {
+	goals = []*GoalSummary{}
+
+	goalNode := pkgGraph.FindGoalNode(buildGoalNodeName)
+	if goalNode == nil {
+		return
+	}
+
+	requestedNodes := pkgGraph.From(goalNode.ID())
+	for requestedNodes.Next() {
+		node := requestedNodes.Node().(*pkggraph.PkgNode)
+		goal := &GoalSummary{
+			Name: node.VersionedPkg.Name,
+		}
+
+		// The build may have stopped after building a requested package, but before processing its run node.
+		res := buildState.SRPMBuildResult(node.SrpmPath, node.Bcond)
+
+		switch {
+		case buildState.IsNodeAvailable(node), res != nil && res.Err == nil:
+			goal.State = GoalStateAvailable
+		case len(blockedBy[node.ID()]) != 0:
+			goal.State = GoalStateBlocked
+			goal.BlockedBy = failedSRPMsBlocking(blockedBy, []*pkggraph.PkgNode{node})
+		default:
+			goal.State = GoalStateAchievable
+		}
+
+		goals = append(goals, goal)
+	}
+
+	sort.Slice(goals, func(i, j int) bool {
+		return goals[i].Name < goals[j].Name
+	})
+
+	return
+}
+
+// summarizeSRPM summarizes the final state of the SRPM a build node belongs to.
+func summarizeSRPM(node *pkggraph.PkgNode, buildState *GraphBuildState) (srpm *SRPMSummary) {
+	srpm = &SRPMSummary{
+		Name:  node.SRPMFileName(),
+		Path:  node.SrpmPath,
+		Bcond: node.Bcond,
+	}
+
+	res := buildState.SRPMBuildResult(node.SrpmPath, node.Bcond)
+	if res != nil {
+		srpm.LogFile = res.LogFile
+		srpm.Attempts = res.Attempts
+		srpm.BuiltFiles = res.BuiltFiles
+		if !res.StartTime.IsZero() {
+			srpm.BuildSeconds = res.EndTime.Sub(res.StartTime).Seconds()
+		}
+
+		if res.Check != nil {
+			srpm.CheckState = checkState(res.Check)
+			srpm.CheckError = res.Check.Err
+			srpm.CheckSeconds = res.Check.Seconds
+		}
+	}
+
+	switch {
+	case res != nil && res.Err != nil:
+		srpm.State = SRPMStateFailed
+		srpm.Error = res.Err.Error()
+		srpm.FailureReason = res.FailureReason
+		srpm.FailureCategory = res.FailureCategory
+		srpm.FailureExcerpt = res.FailureExcerpt
+	case res != nil && res.Skipped:
+		srpm.State = SRPMStateSkipped
+	case buildState.IsNodeCached(node):
+		srpm.State = SRPMStateCached
+	case buildState.IsNodeAvailable(node):
+		srpm.State = SRPMStateBuilt
+	default:
+		srpm.State = SRPMStateBlocked
+	}
+
+	return
+}
+
+// checkState returns the state of a check result.
+func checkState(check *buildagents.CheckResult) string {
+	switch {
+	case check.Passed:
+		return CheckStatePassed
+	case check.NonFatal:
+		return CheckStateFailedNonFatal
+	default:
+		return CheckStateFailed
+	}
+}
+
+// SRPMsInState returns all SRPMs in the given state.
+func (s *BuildSummary) SRPMsInState(state string) (srpms []*SRPMSummary) {
+	for _, srpm := range s.SRPMs {
+		if srpm.State == state {
+			srpms = append(srpms, srpm)
+		}
+	}
+
+	return
+}
+
+// SRPMsInCheckState returns all SRPMs whose check is in the given state.
+func (s *BuildSummary) SRPMsInCheckState(state string) (srpms []*SRPMSummary) {
+	for _, srpm := range s.SRPMs {
+		if srpm.CheckState == state {
+			srpms = append(srpms, srpm)
+		}
+	}
+
+	return
+}
+
+// GoalsInState returns all requested packages in the given state.
+func (s *BuildSummary) GoalsInState(state string) (goals []*GoalSummary) {
+	for _, goal := range s.Goals {
+		if goal.State == state {
+			goals = append(goals, goal)
+		}
+	}
+
+	return
+}
+
+// WriteJSONFile writes the summary to a JSON file.
+func (s *BuildSummary) WriteJSONFile(path string) error {
+	return jsonutils.WriteJSONFile(path, s)
+}
+
+// junitTestSuites is the root element of a JUnit XML report.
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr,omitempty"`
+	Text    string `xml:",chardata"`
+}
+
+// junitTestCaseName returns the name of an SRPM's test case, telling a bootstrap stage apart from the SRPM's regular build.
+func junitTestCaseName(srpm *SRPMSummary) string {
+	return srpmBuildKey(srpm.Name, srpm.Bcond)
+}
+
+// WriteJUnitFile writes the summary to a JUnit XML file, reporting every SRPM as a test case.
+// Failed SRPMs are reported as failures, blocked, cancelled and skipped SRPMs as skipped.
+// If any checks were run, they are reported in a separate test suite, so test health can be tracked apart from build health.
+func (s *BuildSummary) WriteJUnitFile(path string) (err error) {
+	const (
+		suiteName       = "pkggen"
+		checkSuiteName  = "pkggen-check"
+		filePermissions = 0664
+	)
+
+	suite := junitTestSuite{
+		Name:  suiteName,
+		Tests: len(s.SRPMs),
+	}
+
+	for _, srpm := range s.SRPMs {
+		testCase := junitTestCase{
+			Name:      junitTestCaseName(srpm),
+			ClassName: suiteName,
+			Time:      fmt.Sprintf("%.3f", srpm.BuildSeconds),
+			SystemOut: srpm.LogFile,
+		}
+
+		switch srpm.State {
+		case SRPMStateFailed:
+			suite.Failures++
+			testCase.Failure = &junitMessage{
+				Message: srpm.Error,
+				Type:    srpm.FailureReason,
+				Text:    fmt.Sprintf("for details see: %s", srpm.LogFile),
+			}
+			if testCase.Failure.Type == "" {
+				testCase.Failure.Type = srpm.FailureCategory
+			}
+			if srpm.FailureExcerpt != "" {
+				testCase.Failure.Text = fmt.Sprintf("%s\n\n%s", srpm.FailureExcerpt, testCase.Failure.Text)
+			}
+		case SRPMStateBlocked:
+			suite.Skipped++
+			testCase.Skipped = &junitMessage{
+				Message: srpm.State,
+			}
+			if len(srpm.BlockedBy) != 0 {
+				testCase.Skipped.Message = fmt.Sprintf("blocked by %s", strings.Join(srpm.BlockedBy, ", "))
+			}
+		case SRPMStateCancelled, SRPMStateSkipped:
+			suite.Skipped++
+			testCase.Skipped = &junitMessage{
+				Message: srpm.State,
+			}
+		}
+
+		suite.TestCases = append(suite.TestCases, testCase)
+	}
+
+	suites := junitTestSuites{Suites: []junitTestSuite{suite}}
+
+	checkSuite := junitTestSuite{
+		Name: checkSuiteName,
+	}
+
+	for _, srpm := range s.SRPMs {
+		if srpm.CheckState == "" {
+			continue
+		}
+
+		testCase := junitTestCase{
+			Name:      junitTestCaseName(srpm),
+			ClassName: checkSuiteName,
+			Time:      fmt.Sprintf("%.3f", srpm.CheckSeconds),
+			SystemOut: srpm.LogFile,
+		}
+
+		if srpm.CheckState != CheckStatePassed {
+			checkSuite.Failures++
+			testCase.Failure = &junitMessage{
+				Message: srpm.CheckError,
+				Type:    srpm.CheckState,
+				Text:    fmt.Sprintf("for details see: %s", srpm.LogFile),
+			}
+		}
+
+		checkSuite.Tests++
+		checkSuite.TestCases = append(checkSuite.TestCases, testCase)
+	}
+
+	if checkSuite.Tests != 0 {
+		suites.Suites = append(suites.Suites, checkSuite)
+	}
+
+	output, err := xml.MarshalIndent(suites, "", "  ")
+	if err != nil {
+		return
+	}
+
+	output = append([]byte(xml.Header), output...)
+	return ioutil.WriteFile(path, output, filePermissions)
+}
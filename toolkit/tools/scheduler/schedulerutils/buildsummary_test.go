@@ -0,0 +1,195 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package schedulerutils
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"microsoft.com/pkggen/internal/jsonutils"
+)
+
+// buildSummaryTestHelper returns a summary with an SRPM in every state, where A and B were checked.
+func buildSummaryTestHelper() *BuildSummary {
+	return &BuildSummary{
+		SRPMs: []*SRPMSummary{
+			{
+				Name:         "A.src.rpm",
+				Path:         "/SRPMS/A.src.rpm",
+				State:        SRPMStateBuilt,
+				LogFile:      "/logs/A.src.rpm.log",
+				Attempts:     1,
+				BuildSeconds: 12.5,
+				BuiltFiles:   []string{"/RPMS/A.rpm"},
+				CheckState:   CheckStatePassed,
+				CheckSeconds: 2,
+			},
+			{
+				Name:         "B.src.rpm",
+				Path:         "/SRPMS/B.src.rpm",
+				State:        SRPMStateBuilt,
+				LogFile:      "/logs/B.src.rpm.log",
+				CheckState:   CheckStateFailedNonFatal,
+				CheckError:   "check failed",
+				CheckSeconds: 3,
+			},
+			{
+				Name:            "C.src.rpm",
+				Path:            "/SRPMS/C.src.rpm",
+				Bcond:           "bootstrap",
+				State:           SRPMStateFailed,
+				FailureCategory: "missing-dependency",
+				FailureExcerpt:  "error: Failed build dependencies",
+				Error:           "build failed",
+				LogFile:         "/logs/C.src.rpm.log",
+			},
+			{
+				Name:      "D.src.rpm",
+				Path:      "/SRPMS/D.src.rpm",
+				State:     SRPMStateBlocked,
+				BlockedBy: []string{"C.src.rpm", "E.src.rpm"},
+			},
+			{
+				Name:  "F.src.rpm",
+				Path:  "/SRPMS/F.src.rpm",
+				State: SRPMStateCancelled,
+			},
+			{
+				Name:  "G.src.rpm",
+				Path:  "/SRPMS/G.src.rpm",
+				State: SRPMStateCached,
+			},
+		},
+		Goals: []*GoalSummary{
+			{Name: "A", State: GoalStateAvailable},
+			{Name: "D", State: GoalStateBlocked, BlockedBy: []string{"C.src.rpm", "E.src.rpm"}},
+			{Name: "F", State: GoalStateAchievable},
+		},
+		UnresolvedDependencies: []string{"H"},
+		ConflictingRPMs:        []string{},
+		ConflictingSRPMs:       []string{},
+	}
+}
+
+// writeJUnitTestHelper writes a summary to a JUnit file and reads it back.
+func writeJUnitTestHelper(t *testing.T, summary *BuildSummary) (suites junitTestSuites) {
+	dir, err := ioutil.TempDir("", "buildsummary")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "summary.xml")
+	assert.NoError(t, summary.WriteJUnitFile(path))
+
+	output, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.NoError(t, xml.Unmarshal(output, &suites))
+
+	return
+}
+
+func TestBuildSummaryWriteJSONFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buildsummary")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	summary := buildSummaryTestHelper()
+	path := filepath.Join(dir, "summary.json")
+	assert.NoError(t, summary.WriteJSONFile(path))
+
+	var readSummary BuildSummary
+	assert.NoError(t, jsonutils.ReadJSONFile(path, &readSummary))
+	assert.Equal(t, summary, &readSummary)
+
+	// Unset optional fields are left out.
+	output, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Contains(t, string(output), `"Bcond": "bootstrap"`)
+	assert.Equal(t, 1, strings.Count(string(output), `"Bcond"`))
+	assert.Equal(t, 2, strings.Count(string(output), `"BlockedBy"`))
+}
+
+func TestBuildSummaryWriteJUnitFile(t *testing.T) {
+	suites := writeJUnitTestHelper(t, buildSummaryTestHelper())
+	if !assert.Len(t, suites.Suites, 2) {
+		return
+	}
+
+	suite := suites.Suites[0]
+	assert.Equal(t, "pkggen", suite.Name)
+	assert.Equal(t, 6, suite.Tests)
+	assert.Equal(t, 1, suite.Failures)
+	assert.Equal(t, 2, suite.Skipped)
+	assert.Len(t, suite.TestCases, 6)
+
+	testCases := make(map[string]junitTestCase)
+	for _, testCase := range suite.TestCases {
+		assert.Equal(t, "pkggen", testCase.ClassName)
+		testCases[testCase.Name] = testCase
+	}
+
+	built := testCases["A.src.rpm"]
+	assert.Equal(t, "12.500", built.Time)
+	assert.Equal(t, "/logs/A.src.rpm.log", built.SystemOut)
+	assert.Nil(t, built.Failure)
+	assert.Nil(t, built.Skipped)
+
+	// A bootstrap stage is told apart from the SRPM's regular build.
+	failed := testCases["C.src.rpm[bootstrap]"]
+	if assert.NotNil(t, failed.Failure) {
+		assert.Equal(t, "build failed", failed.Failure.Message)
+		assert.Equal(t, "missing-dependency", failed.Failure.Type)
+		assert.Equal(t, "error: Failed build dependencies\n\nfor details see: /logs/C.src.rpm.log", failed.Failure.Text)
+	}
+
+	blocked := testCases["D.src.rpm"]
+	if assert.NotNil(t, blocked.Skipped) {
+		assert.Equal(t, "blocked by C.src.rpm, E.src.rpm", blocked.Skipped.Message)
+	}
+
+	cancelled := testCases["F.src.rpm"]
+	if assert.NotNil(t, cancelled.Skipped) {
+		assert.Equal(t, SRPMStateCancelled, cancelled.Skipped.Message)
+	}
+
+	cached := testCases["G.src.rpm"]
+	assert.Nil(t, cached.Failure)
+	assert.Nil(t, cached.Skipped)
+
+	// Only the checked SRPMs are reported in the check suite, a non-fatal check failure is still a failure.
+	checkSuite := suites.Suites[1]
+	assert.Equal(t, "pkggen-check", checkSuite.Name)
+	assert.Equal(t, 2, checkSuite.Tests)
+	assert.Equal(t, 1, checkSuite.Failures)
+	if assert.Len(t, checkSuite.TestCases, 2) {
+		passed := checkSuite.TestCases[0]
+		assert.Equal(t, "A.src.rpm", passed.Name)
+		assert.Equal(t, "pkggen-check", passed.ClassName)
+		assert.Equal(t, "2.000", passed.Time)
+		assert.Nil(t, passed.Failure)
+
+		failedCheck := checkSuite.TestCases[1]
+		assert.Equal(t, "B.src.rpm", failedCheck.Name)
+		if assert.NotNil(t, failedCheck.Failure) {
+			assert.Equal(t, "check failed", failedCheck.Failure.Message)
+			assert.Equal(t, CheckStateFailedNonFatal, failedCheck.Failure.Type)
+		}
+	}
+}
+
+func TestBuildSummaryWriteJUnitFileWithoutChecks(t *testing.T) {
+	summary := buildSummaryTestHelper()
+	for _, srpm := range summary.SRPMs {
+		srpm.CheckState = ""
+	}
+
+	suites := writeJUnitTestHelper(t, summary)
+	if assert.Len(t, suites.Suites, 1) {
+		assert.Equal(t, "pkggen", suites.Suites[0].Name)
+	}
+}
@@ -4,16 +4,20 @@
 package schedulerutils
 
 import (
+	"errors"
 	"fmt"
+	"os"
 	"path/filepath"
-	"sync"
+	"strings"
 	"time"
 
 	"gonum.org/v1/gonum/graph"
 	"gonum.org/v1/gonum/graph/traverse"
+	"microsoft.com/pkggen/internal/failureclassifier"
 	"microsoft.com/pkggen/internal/logger"
 	"microsoft.com/pkggen/internal/pkggraph"
 	"microsoft.com/pkggen/internal/retry"
+	"microsoft.com/pkggen/internal/shell"
 	"microsoft.com/pkggen/internal/sliceutils"
 	"microsoft.com/pkggen/scheduler/buildagents"
 )
@@ -35,15 +39,33 @@ type BuildRequest struct {
 	CanUseCache    bool
 }
 
+// Reasons a build may fail for, as reported in BuildResult.FailureReason.
+const (
+	FailureReasonMemoryLimit = "exceeded memory limit"
+	FailureReasonTimeLimit   = "exceeded time limit"
+	FailureReasonTimedOut    = "timed out"
+)
+
 // BuildResult represents the results of a build agent trying to build a given node.
+// A failed build's FailureCategory and FailureExcerpt describe the likely cause found in its log, if any.
+// Check is the outcome of the package's check, if it was run.
+// Restored is set if the result was restored from the build journal of an earlier run rather than processed by this one.
 type BuildResult struct {
-	AncillaryNodes []*pkggraph.PkgNode
-	BuiltFiles     []string
-	Err            error
-	LogFile        string
-	Node           *pkggraph.PkgNode
-	Skipped        bool
-	UsedCache      bool
+	AncillaryNodes  []*pkggraph.PkgNode
+	Attempts        int
+	BuiltFiles      []string
+	Check           *buildagents.CheckResult
+	EndTime         time.Time
+	Err             error
+	FailureCategory string
+	FailureExcerpt  string
+	FailureReason   string
+	LogFile         string
+	Node            *pkggraph.PkgNode
+	Restored        bool
+	Skipped         bool
+	StartTime       time.Time
+	UsedCache       bool
 }
 
 //selectNextBuildRequest selects a job based on priority:
@@ -87,7 +109,8 @@ func selectNextBuildRequest(channels *BuildChannels) (req *BuildRequest, finish
 }
 
 // BuildNodeWorker process all build requests, can be run concurrently with multiple instances.
-func BuildNodeWorker(channels *BuildChannels, agent buildagents.BuildAgent, graphMutex *sync.RWMutex, buildAttempts int, ignoredPackages []string) {
+// - workerID identifies the worker when reporting which SRPM it is building to status.
+func BuildNodeWorker(workerID int, channels *BuildChannels, agent buildagents.BuildAgent, buildCache *BuildCache, status *BuildStatus, buildAttempts int, ignoredPackages []string) {
 	for req, cancelled := selectNextBuildRequest(channels); !cancelled && req != nil; req, cancelled = selectNextBuildRequest(channels) {
 
 		res := &BuildResult{
@@ -97,12 +120,19 @@ func BuildNodeWorker(channels *BuildChannels, agent buildagents.BuildAgent, grap
 
 		switch req.Node.Type {
 		case pkggraph.TypeBuild:
-			res.UsedCache, res.Skipped, res.BuiltFiles, res.LogFile, res.Err = buildBuildNode(req.Node, req.PkgGraph, graphMutex, agent, req.CanUseCache, buildAttempts, ignoredPackages)
-			if res.Err == nil {
-				setAncillaryBuildNodesStatus(req, pkggraph.StateUpToDate)
-			} else {
-				setAncillaryBuildNodesStatus(req, pkggraph.StateBuildError)
+			status.StartWorkerBuild(workerID, req.Node)
+			res.StartTime = time.Now()
+			res.UsedCache, res.Skipped, res.BuiltFiles, res.LogFile, res.Attempts, res.Err = buildBuildNode(req.Node, req.PkgGraph, agent, buildCache, req.CanUseCache, buildAttempts, ignoredPackages)
+			res.EndTime = time.Now()
+			status.FinishWorkerBuild(workerID)
+			res.FailureReason = buildFailureReason(res.Err)
+			if res.Err != nil && res.LogFile != "" {
+				res.FailureCategory, res.FailureExcerpt = classifyBuildFailure(res.LogFile)
+			}
+			if agent.Config().RunCheck && !res.UsedCache && !res.Skipped && res.LogFile != "" {
+				res.Check = readCheckResult(res.LogFile)
 			}
+			setAncillaryBuildNodesStatus(req, buildResultNodeState(res))
 
 		case pkggraph.TypeRun, pkggraph.TypeGoal, pkggraph.TypeRemote, pkggraph.TypePureMeta, pkggraph.TypePreBuilt:
 			res.UsedCache = req.CanUseCache
@@ -121,11 +151,17 @@ func BuildNodeWorker(channels *BuildChannels, agent buildagents.BuildAgent, grap
 }
 
 // buildBuildNode builds a TypeBuild node, either used a cached copy if possible or building the corresponding SRPM.
-func buildBuildNode(node *pkggraph.PkgNode, pkgGraph *pkggraph.PkgGraph, graphMutex *sync.RWMutex, agent buildagents.BuildAgent, canUseCache bool, buildAttempts int, ignoredPackages []string) (usedCache, skipped bool, builtFiles []string, logFile string, err error) {
+// If the build cache is enabled, only RPMs built from identical inputs are reused. Otherwise any RPMs already present are reused.
+// The RPMs of a bootstrap stage are never reused by the SRPM's regular build.
+func buildBuildNode(node *pkggraph.PkgNode, pkgGraph *pkggraph.PkgGraph, agent buildagents.BuildAgent, buildCache *BuildCache, canUseCache bool, buildAttempts int, ignoredPackages []string) (usedCache, skipped bool, builtFiles []string, logFile string, attempts int, err error) {
 	var missingFiles []string
 
 	baseSrpmName := node.SRPMFileName()
-	usedCache, builtFiles, missingFiles = pkggraph.IsSRPMPrebuilt(node.SrpmPath, pkgGraph, graphMutex)
+	if node.Bcond != "" {
+		usedCache, builtFiles, missingFiles = pkggraph.IsBootstrapStagePrebuilt(node.SrpmPath, pkgGraph)
+	} else {
+		usedCache, builtFiles, missingFiles = pkggraph.IsSRPMPrebuilt(node.SrpmPath, pkgGraph)
+	}
 	skipped = sliceutils.Contains(ignoredPackages, node.SpecName(), sliceutils.StringMatch)
 
 	if skipped {
@@ -133,7 +169,35 @@ func buildBuildNode(node *pkggraph.PkgNode, pkgGraph *pkggraph.PkgGraph, graphMu
 		return
 	}
 
-	if canUseCache && usedCache {
+	dependencies := GetBuildDependencies(node, pkgGraph)
+
+	cacheKey, keyErr := buildCache.Key(node.SrpmPath, node.Bcond, dependencies)
+	if keyErr != nil {
+		logger.Log.Warnf("Unable to compute build cache key for %s, not using the build cache. Error: %s", baseSrpmName, keyErr)
+		cacheKey = ""
+	}
+
+	if cacheKey != "" {
+		if canUseCache {
+			var (
+				restoredFiles []string
+				restoreErr    error
+			)
+
+			restoredFiles, _, usedCache, restoreErr = buildCache.Restore(cacheKey)
+			if restoreErr != nil {
+				logger.Log.Warnf("Unable to restore %s from the build cache, rebuilding it. Error: %s", baseSrpmName, restoreErr)
+				usedCache = false
+			}
+
+			if usedCache {
+				logger.Log.Debugf("%s restored from the build cache (%s)", baseSrpmName, cacheKey)
+				builtFiles = restoredFiles
+				err = pkggraph.RecordRPMsStage(builtFiles, node.Bcond)
+				return
+			}
+		}
+	} else if canUseCache && usedCache {
 		logger.Log.Debugf("%s is prebuilt, skipping", baseSrpmName)
 		return
 	}
@@ -145,17 +209,51 @@ func buildBuildNode(node *pkggraph.PkgNode, pkgGraph *pkggraph.PkgGraph, graphMu
 
 	usedCache = false
 
-	dependencies := getBuildDependencies(node, pkgGraph, graphMutex)
+	if node.Bcond != "" {
+		logger.Log.Infof("Building %s with (%s) as a bootstrap stage", baseSrpmName, node.Bcond)
+	} else {
+		logger.Log.Infof("Building %s", baseSrpmName)
+	}
+	builtFiles, logFile, attempts, err = buildSRPMFile(agent, buildAttempts, node.SpecName(), node.SrpmPath, node.Bcond, dependencies)
+
+	// Debug RPMs kept apart are not part of the package graph, only the build cache keeps track of them.
+	builtFiles, builtDebugFiles := splitDebugFiles(builtFiles, agent.Config().DebugRpmDir)
+	if err != nil {
+		return
+	}
+
+	err = pkggraph.RecordRPMsStage(builtFiles, node.Bcond)
+	if err != nil {
+		return
+	}
+
+	if cacheKey != "" {
+		storeErr := buildCache.Store(cacheKey, node.SrpmPath, builtFiles, builtDebugFiles)
+		if storeErr != nil {
+			logger.Log.Warnf("Unable to store %s in the build cache. Error: %s", baseSrpmName, storeErr)
+		}
+	}
+
+	return
+}
+
+// splitDebugFiles separates the debug RPMs placed in debugRpmDir from the other built files.
+func splitDebugFiles(files []string, debugRpmDir string) (builtFiles, builtDebugFiles []string) {
+	for _, builtFile := range files {
+		if debugRpmDir != "" && strings.HasPrefix(builtFile, debugRpmDir+string(filepath.Separator)) {
+			builtDebugFiles = append(builtDebugFiles, builtFile)
+		} else {
+			builtFiles = append(builtFiles, builtFile)
+		}
+	}
 
-	logger.Log.Infof("Building %s", baseSrpmName)
-	builtFiles, logFile, err = buildSRPMFile(agent, buildAttempts, node.SrpmPath, dependencies)
 	return
 }
 
-// getBuildDependencies returns a list of all dependencies that need to be installed before the node can be built.
-func getBuildDependencies(node *pkggraph.PkgNode, pkgGraph *pkggraph.PkgGraph, graphMutex *sync.RWMutex) (dependencies []string) {
-	graphMutex.RLock()
-	defer graphMutex.RUnlock()
+// GetBuildDependencies returns a list of all dependencies that need to be installed before the node can be built.
+func GetBuildDependencies(node *pkggraph.PkgNode, pkgGraph *pkggraph.PkgGraph) (dependencies []string) {
+	pkgGraph.RLock()
+	defer pkgGraph.RUnlock()
 
 	// Use a map to avoid duplicate entries
 	dependencyLookup := make(map[string]bool)
@@ -190,20 +288,129 @@ func getBuildDependencies(node *pkggraph.PkgNode, pkgGraph *pkggraph.PkgGraph, g
 }
 
 // buildSRPMFile sends an SRPM to a build agent to build.
-func buildSRPMFile(agent buildagents.BuildAgent, buildAttempts int, srpmFile string, dependencies []string) (builtFiles []string, logFile string, err error) {
+// A bootstrap stage, built with a bcond, gets a log of its own so the final build does not overwrite it.
+func buildSRPMFile(agent buildagents.BuildAgent, buildAttempts int, basePackageName, srpmFile, bcond string, dependencies []string) (builtFiles []string, logFile string, attempts int, err error) {
 	const (
 		retryDuration = time.Second
 	)
 
 	logBaseName := filepath.Base(srpmFile) + ".log"
+	if bcond != "" {
+		logBaseName = fmt.Sprintf("%s.%s.log", filepath.Base(srpmFile), bcond)
+	}
+
+	// Start every attempt with a new log, so nothing read from the log, such as the check result, comes from an earlier attempt.
+	logDir := agent.Config().LogDir
+
 	err = retry.Run(func() (buildErr error) {
-		builtFiles, logFile, buildErr = agent.BuildPackage(srpmFile, logBaseName, dependencies)
+		attempts++
+
+		if logDir != "" {
+			buildErr = setAsideBuildLog(filepath.Join(logDir, logBaseName), attempts)
+			if buildErr != nil {
+				return
+			}
+		}
+
+		builtFiles, logFile, buildErr = agent.BuildPackage(basePackageName, srpmFile, bcond, logBaseName, dependencies)
 		return
 	}, buildAttempts, retryDuration)
 
 	return
 }
 
+// setAsideBuildLog makes way for the log of a new build attempt.
+// The log of the previous attempt is kept as <log>.attempt-<N>. Before the first attempt, any logs left by an earlier run are removed.
+// An attempt may fail before its build agent writes a log of its own.
+func setAsideBuildLog(logFile string, attempt int) (err error) {
+	if attempt > 1 {
+		err = os.Rename(logFile, fmt.Sprintf("%s.attempt-%d", logFile, attempt-1))
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	staleLogs, err := filepath.Glob(logFile + ".attempt-*")
+	if err != nil {
+		return
+	}
+
+	for _, staleLog := range append(staleLogs, logFile) {
+		err = os.Remove(staleLog)
+		if err != nil && !os.IsNotExist(err) {
+			return
+		}
+	}
+
+	err = nil
+	return
+}
+
+// buildFailureReason returns the FailureReason for a build error, or an empty string if the error has no distinct reason.
+func buildFailureReason(err error) (reason string) {
+	if errors.Is(err, shell.ErrTimedOut) {
+		reason = FailureReasonTimedOut
+		return
+	}
+
+	var limitErr *buildagents.BuildLimitError
+	if !errors.As(err, &limitErr) {
+		return
+	}
+
+	switch limitErr.Limit {
+	case buildagents.ExceededMemoryLimit:
+		reason = FailureReasonMemoryLimit
+	case buildagents.ExceededTimeLimit:
+		reason = FailureReasonTimeLimit
+	}
+
+	return
+}
+
+// classifyBuildFailure looks for the likely cause of a failed build in its log.
+// Returns empty strings if no known cause was found.
+func classifyBuildFailure(logFile string) (category, excerpt string) {
+	classification, err := failureclassifier.ClassifyFile(logFile)
+	if err != nil {
+		logger.Log.Warnf("Unable to classify build failure from log file (%s), error: %s", logFile, err)
+		return
+	}
+
+	if classification != nil {
+		category = classification.Category
+		excerpt = classification.Excerpt
+	}
+
+	return
+}
+
+// readCheckResult reads the outcome of a package's check from its build log.
+// Returns nil if the check was not run.
+func readCheckResult(logFile string) (result *buildagents.CheckResult) {
+	result, err := buildagents.ReadCheckResult(logFile)
+	if err != nil {
+		logger.Log.Warnf("Unable to read check result from log file (%s), error: %s", logFile, err)
+	}
+
+	return
+}
+
+// buildResultNodeState returns the state the build nodes of a finished build should be left in.
+func buildResultNodeState(res *BuildResult) pkggraph.NodeState {
+	switch {
+	case res.Skipped:
+		return pkggraph.StateSkipped
+	case res.FailureReason == FailureReasonTimedOut:
+		return pkggraph.StateTimedOut
+	case res.Err != nil:
+		return pkggraph.StateBuildError
+	default:
+		return pkggraph.StateUpToDate
+	}
+}
+
 // setAncillaryBuildNodesStatus sets the NodeState for all of the request's ancillary nodes.
 func setAncillaryBuildNodesStatus(req *BuildRequest, nodeState pkggraph.NodeState) {
 	for _, node := range req.AncillaryNodes {
@@ -0,0 +1,73 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package schedulerutils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"microsoft.com/pkggen/scheduler/buildagents"
+)
+
+// flakyAgent is a test agent which appends a line to the build log on every attempt and fails all but the last one.
+type flakyAgent struct {
+	*buildagents.TestAgent
+
+	failedAttempts int
+	attempts       int
+}
+
+func (a *flakyAgent) BuildPackage(basePackageName, inputFile, bcond, logName string, dependencies []string) (builtFiles []string, logFile string, err error) {
+	a.attempts++
+	logFile = filepath.Join(a.Config().LogDir, logName)
+
+	log, err := os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, os.ModePerm)
+	if err != nil {
+		return
+	}
+	defer log.Close()
+
+	_, err = fmt.Fprintf(log, "attempt %d\n", a.attempts)
+	if err != nil {
+		return
+	}
+
+	if a.attempts <= a.failedAttempts {
+		err = fmt.Errorf("attempt %d failed", a.attempts)
+	}
+
+	return
+}
+
+func TestBuildSRPMFileKeepsLogsOfFailedAttempts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buildworker")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	agent := &flakyAgent{TestAgent: buildagents.NewTestAgent(), failedAttempts: 1}
+	assert.NoError(t, agent.Initialize(&buildagents.BuildAgentConfig{LogDir: dir}))
+
+	// Logs left by an earlier run are removed.
+	writeTestFile(t, dir, "A.src.rpm.log", "earlier run\n")
+	writeTestFile(t, dir, "A.src.rpm.log.attempt-2", "earlier run\n")
+
+	_, logFile, attempts, err := buildSRPMFile(agent, 2, "A", "A.src.rpm", "", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, attempts)
+
+	log, err := ioutil.ReadFile(logFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "attempt 2\n", string(log))
+
+	log, err = ioutil.ReadFile(logFile + ".attempt-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "attempt 1\n", string(log))
+
+	_, err = os.Stat(logFile + ".attempt-2")
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,175 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package schedulerutils
+
+import (
+	"container/heap"
+
+	"microsoft.com/pkggen/internal/logger"
+	"microsoft.com/pkggen/internal/pkggraph"
+)
+
+// BuildCostFunc returns the relative cost of building a single node.
+type BuildCostFunc func(node *pkggraph.PkgNode) float64
+
+// UniformBuildCost treats every build node as equally expensive to build.
+func UniformBuildCost(node *pkggraph.PkgNode) float64 {
+	if node.Type == pkggraph.TypeBuild {
+		return 1
+	}
+
+	return 0
+}
+
+// CriticalPathWeights calculates the critical path weight of every node reachable from goalNode.
+// A node's weight is its own build cost plus the largest weight of any node that depends on it,
+// i.e. the total cost of the longest chain of builds blocked on the node.
+func CriticalPathWeights(pkgGraph *pkggraph.PkgGraph, goalNode *pkggraph.PkgNode, buildCost BuildCostFunc) (weights map[int64]float64) {
+	pkgGraph.RLock()
+	defer pkgGraph.RUnlock()
+
+	reachableNodes := make(map[int64]bool)
+	for _, node := range pkgGraph.AllNodesFrom(goalNode) {
+		reachableNodes[node.ID()] = true
+	}
+
+	weights = make(map[int64]float64, len(reachableNodes))
+	for id := range reachableNodes {
+		calculateNodeWeight(pkgGraph, id, reachableNodes, buildCost, weights)
+	}
+
+	logger.Log.Debugf("Calculated critical path weights for %d nodes", len(weights))
+
+	return
+}
+
+// calculateNodeWeight recursively calculates the critical path weight of a node, memoizing the results in weights.
+func calculateNodeWeight(pkgGraph *pkggraph.PkgGraph, id int64, reachableNodes map[int64]bool, buildCost BuildCostFunc, weights map[int64]float64) (weight float64) {
+	weight, found := weights[id]
+	if found {
+		return
+	}
+
+	var heaviestDependent float64
+	dependents := pkgGraph.To(id)
+	for dependents.Next() {
+		dependentID := dependents.Node().ID()
+
+		// Dependents outside of the goal's subgraph will never be built.
+		if !reachableNodes[dependentID] {
+			continue
+		}
+
+		dependentWeight := calculateNodeWeight(pkgGraph, dependentID, reachableNodes, buildCost, weights)
+		if dependentWeight > heaviestDependent {
+			heaviestDependent = dependentWeight
+		}
+	}
+
+	weight = buildCost(pkgGraph.Node(id).(*pkggraph.PkgNode)) + heaviestDependent
+	weights[id] = weight
+
+	return
+}
+
+// CriticalPathQueue holds build requests until a worker is available to build them.
+// Requests are released in order of their critical path weight, heaviest first, so that
+// long dependency chains start building as early as possible.
+type CriticalPathQueue struct {
+	pending     requestHeap
+	inFlight    map[int64]bool
+	maxInFlight int
+}
+
+// NewCriticalPathQueue returns a new CriticalPathQueue.
+// - maxInFlight is the maximum number of dispatched requests that may be unfinished at any given time.
+func NewCriticalPathQueue(maxInFlight int) *CriticalPathQueue {
+	return &CriticalPathQueue{
+		pending: requestHeap{
+			weights: make(map[int64]float64),
+		},
+		inFlight:    make(map[int64]bool),
+		maxInFlight: maxInFlight,
+	}
+}
+
+// SetWeights updates the critical path weights used to order the queue.
+func (q *CriticalPathQueue) SetWeights(weights map[int64]float64) {
+	q.pending.weights = weights
+	heap.Init(&q.pending)
+}
+
+// Push adds a build request to the queue.
+func (q *CriticalPathQueue) Push(req *BuildRequest) {
+	heap.Push(&q.pending, req)
+}
+
+// Len returns the number of requests waiting in the queue.
+func (q *CriticalPathQueue) Len() int {
+	return q.pending.Len()
+}
+
+// Dispatch sends the heaviest pending requests to the given channel until maxInFlight requests are unfinished.
+func (q *CriticalPathQueue) Dispatch(requests chan<- *BuildRequest) {
+	for q.pending.Len() > 0 && len(q.inFlight) < q.maxInFlight {
+		req := heap.Pop(&q.pending).(*BuildRequest)
+		logger.Log.Debugf("Dispatching %s with a critical path weight of %.2f", req.Node.FriendlyName(), q.pending.requestWeight(req))
+
+		q.inFlight[req.Node.ID()] = true
+		requests <- req
+	}
+}
+
+// RecordBuildResult marks the request that produced the result as finished, freeing its slot.
+func (q *CriticalPathQueue) RecordBuildResult(res *BuildResult) {
+	delete(q.inFlight, res.Node.ID())
+}
+
+// Drain removes and returns all requests still waiting in the queue.
+func (q *CriticalPathQueue) Drain() (requests []*BuildRequest) {
+	requests = q.pending.requests
+	q.pending.requests = nil
+	return
+}
+
+// requestHeap implements heap.Interface, ordering requests by their critical path weight.
+type requestHeap struct {
+	requests []*BuildRequest
+	weights  map[int64]float64
+}
+
+// requestWeight returns the critical path weight of a request, the heaviest weight of any of its ancillary nodes.
+func (h *requestHeap) requestWeight(req *BuildRequest) (weight float64) {
+	weight = h.weights[req.Node.ID()]
+	for _, node := range req.AncillaryNodes {
+		if h.weights[node.ID()] > weight {
+			weight = h.weights[node.ID()]
+		}
+	}
+
+	return
+}
+
+func (h requestHeap) Len() int {
+	return len(h.requests)
+}
+
+func (h requestHeap) Less(i, j int) bool {
+	return h.requestWeight(h.requests[i]) > h.requestWeight(h.requests[j])
+}
+
+func (h requestHeap) Swap(i, j int) {
+	h.requests[i], h.requests[j] = h.requests[j], h.requests[i]
+}
+
+func (h *requestHeap) Push(x interface{}) {
+	h.requests = append(h.requests, x.(*BuildRequest))
+}
+
+func (h *requestHeap) Pop() interface{} {
+	last := len(h.requests) - 1
+	req := h.requests[last]
+	h.requests = h.requests[:last]
+	return req
+}
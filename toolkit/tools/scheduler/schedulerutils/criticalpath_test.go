@@ -0,0 +1,89 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package schedulerutils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"microsoft.com/pkggen/internal/pkggraph"
+	"microsoft.com/pkggen/internal/pkggraph/pkggraphtest"
+	"microsoft.com/pkggen/internal/pkgjson"
+)
+
+// buildCriticalPathTestGraph builds a graph where A requires B to build, B requires C, and D is independent:
+//
+//	goal -> A -> B -> C
+//	goal -> D
+func buildCriticalPathTestGraph(t *testing.T) (g *pkggraph.PkgGraph, goalNode *pkggraph.PkgNode, buildNodes map[string]*pkggraph.PkgNode) {
+	g = pkggraph.NewPkgGraph()
+	runNodes := make(map[string]*pkggraph.PkgNode)
+	buildNodes = make(map[string]*pkggraph.PkgNode)
+
+	for _, name := range []string{"A", "B", "C", "D"} {
+		runNodes[name], buildNodes[name] = pkggraphtest.AddSRPM(t, g, name, "1")
+	}
+	assert.NoError(t, g.AddEdge(buildNodes["A"], runNodes["B"]))
+	assert.NoError(t, g.AddEdge(buildNodes["B"], runNodes["C"]))
+
+	goalNode, err := g.AddGoalNode("test", nil, false)
+	assert.NoError(t, err)
+
+	return
+}
+
+func TestCriticalPathWeights(t *testing.T) {
+	g, goalNode, buildNodes := buildCriticalPathTestGraph(t)
+
+	weights := CriticalPathWeights(g, goalNode, UniformBuildCost)
+
+	assert.Equal(t, 1.0, weights[buildNodes["A"].ID()])
+	assert.Equal(t, 2.0, weights[buildNodes["B"].ID()])
+	assert.Equal(t, 3.0, weights[buildNodes["C"].ID()])
+	assert.Equal(t, 1.0, weights[buildNodes["D"].ID()])
+	assert.Equal(t, 0.0, weights[goalNode.ID()])
+}
+
+func TestCriticalPathWeightsIgnoreUnreachableDependents(t *testing.T) {
+	g, _, buildNodes := buildCriticalPathTestGraph(t)
+
+	// Only B and C are needed to build B, A will never be built.
+	goalNode, err := g.AddGoalNode("partial", []*pkgjson.PackageVer{{Name: "B", Version: "1"}}, true)
+	assert.NoError(t, err)
+
+	weights := CriticalPathWeights(g, goalNode, UniformBuildCost)
+
+	assert.Equal(t, 1.0, weights[buildNodes["B"].ID()])
+	assert.Equal(t, 2.0, weights[buildNodes["C"].ID()])
+	assert.NotContains(t, weights, buildNodes["A"].ID())
+	assert.NotContains(t, weights, buildNodes["D"].ID())
+}
+
+func TestCriticalPathQueueDispatchesHeaviestFirst(t *testing.T) {
+	g, goalNode, buildNodes := buildCriticalPathTestGraph(t)
+
+	queue := NewCriticalPathQueue(1)
+	queue.SetWeights(CriticalPathWeights(g, goalNode, UniformBuildCost))
+
+	for _, name := range []string{"A", "C", "B"} {
+		queue.Push(&BuildRequest{Node: buildNodes[name]})
+	}
+
+	requests := make(chan *BuildRequest, len(buildNodes))
+	for _, expected := range []string{"C", "B", "A"} {
+		queue.Dispatch(requests)
+		assert.Len(t, requests, 1)
+
+		req := <-requests
+		assert.Equal(t, buildNodes[expected], req.Node)
+
+		// Nothing else is dispatched until the in-flight request finishes.
+		queue.Dispatch(requests)
+		assert.Empty(t, requests)
+
+		queue.RecordBuildResult(&BuildResult{Node: req.Node})
+	}
+
+	assert.Equal(t, 0, queue.Len())
+}
@@ -4,8 +4,6 @@
 package schedulerutils
 
 import (
-	"sync"
-
 	"gonum.org/v1/gonum/graph"
 	"gonum.org/v1/gonum/graph/traverse"
 	"microsoft.com/pkggen/internal/logger"
@@ -44,9 +42,9 @@ func CanSubGraph(pkgGraph *pkggraph.PkgGraph, node *pkggraph.PkgNode, useCachedI
 }
 
 // LeafNodes returns a slice of all leaf nodes in the graph.
-func LeafNodes(pkgGraph *pkggraph.PkgGraph, graphMutex *sync.RWMutex, goalNode *pkggraph.PkgNode, buildState *GraphBuildState, useCachedImplicit bool) (leafNodes []*pkggraph.PkgNode) {
-	graphMutex.RLock()
-	defer graphMutex.RUnlock()
+func LeafNodes(pkgGraph *pkggraph.PkgGraph, goalNode *pkggraph.PkgNode, buildState *GraphBuildState, useCachedImplicit bool) (leafNodes []*pkggraph.PkgNode) {
+	pkgGraph.RLock()
+	defer pkgGraph.RUnlock()
 
 	search := traverse.BreadthFirst{}
 
@@ -85,13 +83,13 @@ func LeafNodes(pkgGraph *pkggraph.PkgGraph, graphMutex *sync.RWMutex, goalNode *
 }
 
 // FindUnblockedNodesFromResult takes a package build result and returns a list of nodes that are now unblocked for building.
-func FindUnblockedNodesFromResult(res *BuildResult, pkgGraph *pkggraph.PkgGraph, graphMutex *sync.RWMutex, buildState *GraphBuildState) (unblockedNodes []*pkggraph.PkgNode) {
+func FindUnblockedNodesFromResult(res *BuildResult, pkgGraph *pkggraph.PkgGraph, buildState *GraphBuildState) (unblockedNodes []*pkggraph.PkgNode) {
 	if res.Err != nil {
 		return
 	}
 
-	graphMutex.RLock()
-	defer graphMutex.RUnlock()
+	pkgGraph.RLock()
+	defer pkgGraph.RUnlock()
 
 	// Since all the ancillary nodes are marked as available already, there may be duplicate nodes returned by the below loop.
 	// e.g. If a meta node requires two build nodes for the same SPEC, then that meta node will be reported twice.
@@ -0,0 +1,31 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package schedulerutils
+
+// Policies controlling how the scheduler reacts to a failed build.
+const (
+	// FailurePolicyStopImmediately stops scheduling new builds and cancels any active builds.
+	FailurePolicyStopImmediately = "stop-immediately"
+	// FailurePolicyFinishActive stops scheduling new builds but waits for any active builds to finish.
+	FailurePolicyFinishActive = "finish-active"
+	// FailurePolicyBuildAllUnblocked keeps building every package which does not depend on a failed build.
+	FailurePolicyBuildAllUnblocked = "build-all-unblocked"
+)
+
+// FailurePolicies lists all valid failure policies.
+var FailurePolicies = []string{
+	FailurePolicyStopImmediately,
+	FailurePolicyFinishActive,
+	FailurePolicyBuildAllUnblocked,
+}
+
+// StopsBuildingOnFailure returns true if no new builds are scheduled after a failed build under the given policy.
+func StopsBuildingOnFailure(policy string) bool {
+	return policy != FailurePolicyBuildAllUnblocked
+}
+
+// CancelsActiveBuildsOnFailure returns true if active builds are cancelled after a failed build under the given policy.
+func CancelsActiveBuildsOnFailure(policy string) bool {
+	return policy == FailurePolicyStopImmediately
+}
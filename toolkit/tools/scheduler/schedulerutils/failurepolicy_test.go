@@ -0,0 +1,100 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package schedulerutils
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"microsoft.com/pkggen/internal/pkggraph"
+	"microsoft.com/pkggen/internal/pkggraph/pkggraphtest"
+)
+
+// TestGoalStatesUnderFailurePolicies builds a graph where B requires A to build, while C and D are independent:
+//
+//	goal -> B -> A
+//	goal -> C
+//	goal -> D
+//
+// A fails while C is building and before D was scheduled, the final state of C and D depends on the failure policy.
+func TestGoalStatesUnderFailurePolicies(t *testing.T) {
+	type expectedStates struct {
+		goals map[string]string
+		srpms map[string]string
+	}
+
+	expected := map[string]expectedStates{
+		FailurePolicyStopImmediately: {
+			goals: map[string]string{"A": GoalStateBlocked, "B": GoalStateBlocked, "C": GoalStateAchievable, "D": GoalStateAchievable},
+			srpms: map[string]string{"A.src.rpm": SRPMStateFailed, "B.src.rpm": SRPMStateBlocked, "C.src.rpm": SRPMStateCancelled, "D.src.rpm": SRPMStateBlocked},
+		},
+		FailurePolicyFinishActive: {
+			goals: map[string]string{"A": GoalStateBlocked, "B": GoalStateBlocked, "C": GoalStateAvailable, "D": GoalStateAchievable},
+			srpms: map[string]string{"A.src.rpm": SRPMStateFailed, "B.src.rpm": SRPMStateBlocked, "C.src.rpm": SRPMStateBuilt, "D.src.rpm": SRPMStateBlocked},
+		},
+		FailurePolicyBuildAllUnblocked: {
+			goals: map[string]string{"A": GoalStateBlocked, "B": GoalStateBlocked, "C": GoalStateAvailable, "D": GoalStateAvailable},
+			srpms: map[string]string{"A.src.rpm": SRPMStateFailed, "B.src.rpm": SRPMStateBlocked, "C.src.rpm": SRPMStateBuilt, "D.src.rpm": SRPMStateBuilt},
+		},
+	}
+
+	for _, policy := range FailurePolicies {
+		t.Run(policy, func(t *testing.T) {
+			expectedStates, found := expected[policy]
+			if !assert.True(t, found, "no expected states for failure policy %s", policy) {
+				return
+			}
+
+			g := pkggraph.NewPkgGraph()
+			runNodes := make(map[string]*pkggraph.PkgNode)
+			buildNodes := make(map[string]*pkggraph.PkgNode)
+			for _, name := range []string{"A", "B", "C", "D"} {
+				runNodes[name], buildNodes[name] = pkggraphtest.AddSRPM(t, g, name, "1")
+			}
+			assert.NoError(t, g.AddEdge(buildNodes["B"], runNodes["A"]))
+
+			_, err := g.AddGoalNode(buildGoalNodeName, nil, false)
+			assert.NoError(t, err)
+
+			buildState := NewGraphBuildState(nil)
+			record := func(node *pkggraph.PkgNode, err error) {
+				buildState.RecordBuildResult(&BuildResult{Node: node, AncillaryNodes: []*pkggraph.PkgNode{node}, Err: err})
+			}
+
+			buildState.RecordBuildRequest(&BuildRequest{Node: buildNodes["C"]})
+			record(buildNodes["A"], fmt.Errorf("build failed"))
+
+			// The build stops once the active builds are done, before C's run node is processed.
+			if !CancelsActiveBuildsOnFailure(policy) {
+				record(buildNodes["C"], nil)
+			}
+
+			if !StopsBuildingOnFailure(policy) {
+				record(runNodes["C"], nil)
+				record(buildNodes["D"], nil)
+				record(runNodes["D"], nil)
+			}
+
+			summary := NewBuildSummary(g, buildState)
+
+			goalStates := make(map[string]string)
+			for _, goal := range summary.Goals {
+				goalStates[goal.Name] = goal.State
+				if goal.State == GoalStateBlocked {
+					assert.Equal(t, []string{"A.src.rpm"}, goal.BlockedBy, goal.Name)
+				} else {
+					assert.Empty(t, goal.BlockedBy, goal.Name)
+				}
+			}
+			assert.Equal(t, expectedStates.goals, goalStates)
+
+			srpmStates := make(map[string]string)
+			for _, srpm := range summary.SRPMs {
+				srpmStates[srpm.Name] = srpm.State
+			}
+			assert.Equal(t, expectedStates.srpms, srpmStates)
+		})
+	}
+}
@@ -4,6 +4,7 @@
 package schedulerutils
 
 import (
+	"fmt"
 	"path/filepath"
 	"sort"
 
@@ -22,6 +23,7 @@ type GraphBuildState struct {
 	activeBuilds     map[int64]*BuildRequest
 	nodeToState      map[*pkggraph.PkgNode]*nodeState
 	failures         []*BuildResult
+	srpmResults      map[string]*BuildResult // Keyed by srpmBuildKey
 	reservedFiles    map[string]bool
 	conflictingRPMs  map[string]bool
 	conflictingSRPMs map[string]bool
@@ -37,6 +39,7 @@ func NewGraphBuildState(reservedFiles []string) (g *GraphBuildState) {
 	return &GraphBuildState{
 		activeBuilds:     make(map[int64]*BuildRequest),
 		nodeToState:      make(map[*pkggraph.PkgNode]*nodeState),
+		srpmResults:      make(map[string]*BuildResult),
 		reservedFiles:    filesMap,
 		conflictingRPMs:  make(map[string]bool),
 		conflictingSRPMs: make(map[string]bool),
@@ -71,11 +74,11 @@ func (g *GraphBuildState) ActiveBuilds() map[int64]*BuildRequest {
 	return g.activeBuilds
 }
 
-// ActiveSRPMs returns a list of all SRPMs, which are currently being built.
+// ActiveSRPMs returns a list of all SRPMs, which are currently being built. Bootstrap stages are labeled with their bcond.
 func (g *GraphBuildState) ActiveSRPMs() (builtSRPMs []string) {
 	for _, buildRequest := range g.activeBuilds {
 		if buildRequest.Node.Type == pkggraph.TypeBuild {
-			builtSRPMs = append(builtSRPMs, buildRequest.Node.SRPMFileName())
+			builtSRPMs = append(builtSRPMs, srpmBuildName(buildRequest.Node))
 		}
 	}
 
@@ -87,6 +90,12 @@ func (g *GraphBuildState) BuildFailures() []*BuildResult {
 	return g.failures
 }
 
+// SRPMBuildResult returns the result of the last build of an SRPM, or nil if the SRPM has not been processed.
+// - bcond is the spec build conditional of a bootstrap stage, empty for the SRPM's regular build.
+func (g *GraphBuildState) SRPMBuildResult(srpmPath, bcond string) *BuildResult {
+	return g.srpmResults[srpmBuildKey(srpmPath, bcond)]
+}
+
 // ConflictingRPMs will return a list of *.rpm files which should not have been rebuilt.
 // This list is based on the manifest of pre-built toolchain rpms.
 func (g *GraphBuildState) ConflictingRPMs() (rpms []string) {
@@ -143,9 +152,14 @@ func (g *GraphBuildState) RecordBuildResult(res *BuildResult) {
 		g.failures = append(g.failures, res)
 	}
 
+	if res.Node.Type == pkggraph.TypeBuild {
+		g.srpmResults[srpmBuildKey(res.Node.SrpmPath, res.Node.Bcond)] = res
+	}
+
+	// Results restored from the build journal were not built by this run, so they do not force their dependents to be rebuilt.
 	state := &nodeState{
 		available: res.Err == nil,
-		cached:    res.UsedCache,
+		cached:    res.UsedCache || res.Restored,
 	}
 
 	for _, node := range res.AncillaryNodes {
@@ -165,3 +179,17 @@ func (g *GraphBuildState) RecordBuildResult(res *BuildResult) {
 
 	return
 }
+
+// srpmBuildKey identifies a build of an SRPM. A bootstrap stage, built with a bcond, is a different build than the SRPM's regular one.
+func srpmBuildKey(srpmPath, bcond string) string {
+	if bcond == "" {
+		return srpmPath
+	}
+
+	return fmt.Sprintf("%s[%s]", srpmPath, bcond)
+}
+
+// srpmBuildName returns the name of the build of a node's SRPM, labeling a bootstrap stage with its bcond.
+func srpmBuildName(node *pkggraph.PkgNode) string {
+	return srpmBuildKey(node.SRPMFileName(), node.Bcond)
+}
@@ -59,7 +59,8 @@ func replaceNodesWithProvides(res *BuildResult, pkgGraph *pkggraph.PkgGraph, pro
 	// Find a run node that is backed by the same rpm as the one providing the implicit provide.
 	// Make this node the parent node for the new implicit provide node.
 	// - By making a run node the parent node, it will inherit the identical runtime dependencies of the already setup node.
-	for _, node := range pkgGraph.AllRunNodes() {
+	// - The rpm was built from the result's SRPM, so only the run nodes of that SRPM are searched.
+	for _, node := range pkgGraph.RunNodesBySRPM(res.Node.SrpmPath) {
 		if rpmFileProviding == node.RpmPath {
 			logger.Log.Debugf("Linked implicit provide (%s) to run node (%s)", provides, node.FriendlyName())
 			parentNode = node
@@ -78,10 +79,8 @@ func replaceNodesWithProvides(res *BuildResult, pkgGraph *pkggraph.PkgGraph, pro
 	return
 }
 
-// implicitPackagesToUnresolvedNodesInGraph returns a map of package names to unresolved implicit nodes.
-func implicitPackagesToUnresolvedNodesInGraph(pkgGraph *pkggraph.PkgGraph, useCachedImplicit bool) (nameToNodes map[string][]*pkggraph.PkgNode) {
-	nameToNodes = make(map[string][]*pkggraph.PkgNode)
-
+// unresolvedImplicitNodes returns the unresolved implicit nodes of a package.
+func unresolvedImplicitNodes(pkgGraph *pkggraph.PkgGraph, pkgName string, useCachedImplicit bool) (nodes []*pkggraph.PkgNode) {
 	// Depending on the node order that the graph was created, there may be multiple unresolved nodes for a single package.
 	//
 	// Example:
@@ -100,7 +99,7 @@ func implicitPackagesToUnresolvedNodesInGraph(pkgGraph *pkggraph.PkgGraph, useCa
 	// --> foo >= 3.0 -- create unresolved node
 	// Unresolved nodes for foo: 3
 
-	for _, n := range pkgGraph.AllRunNodes() {
+	for _, n := range pkgGraph.RunNodesByName(pkgName) {
 		if !n.Implicit {
 			continue
 		}
@@ -116,7 +115,7 @@ func implicitPackagesToUnresolvedNodesInGraph(pkgGraph *pkggraph.PkgGraph, useCa
 			continue
 		}
 
-		nameToNodes[n.VersionedPkg.Name] = append(nameToNodes[n.VersionedPkg.Name], n)
+		nodes = append(nodes, n)
 	}
 
 	return
@@ -125,13 +124,12 @@ func implicitPackagesToUnresolvedNodesInGraph(pkgGraph *pkggraph.PkgGraph, useCa
 // matchProvidesToUnresolvedNodes matches a list of provides to unresolved nodes that they satisfy in the graph.
 func matchProvidesToUnresolvedNodes(provides []*pkgjson.PackageVer, pkgGraph *pkggraph.PkgGraph, useCachedImplicit bool) (matches map[*pkgjson.PackageVer][]*pkggraph.PkgNode, err error) {
 	matches = make(map[*pkgjson.PackageVer][]*pkggraph.PkgNode)
-	implicitPackagesToUnresolvedNodes := implicitPackagesToUnresolvedNodesInGraph(pkgGraph, useCachedImplicit)
 
 	// An unresolved node can only be satisfied by a single provide, prevent duplicate matching
 	nodeToSatisfier := make(map[*pkggraph.PkgNode]*pkgjson.PackageVer)
 
 	for _, provide := range provides {
-		for _, node := range implicitPackagesToUnresolvedNodes[provide.Name] {
+		for _, node := range unresolvedImplicitNodes(pkgGraph, provide.Name, useCachedImplicit) {
 			var (
 				provideInterval pkgjson.PackageVerInterval
 				nodeInterval    pkgjson.PackageVerInterval
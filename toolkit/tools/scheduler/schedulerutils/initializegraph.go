@@ -26,7 +26,7 @@ func InitializeGraph(inputFile string, packagesToBuild []*pkgjson.PackageVer) (i
 	)
 
 	pkgGraph = pkggraph.NewPkgGraph()
-	err = pkggraph.ReadDOTGraphFile(pkgGraph, inputFile)
+	err = pkggraph.ReadGraphFile(pkgGraph, inputFile)
 	if err != nil {
 		return
 	}
@@ -4,7 +4,7 @@
 package schedulerutils
 
 import (
-	"sync"
+	"fmt"
 
 	"microsoft.com/pkggen/internal/logger"
 	"microsoft.com/pkggen/internal/pkggraph"
@@ -14,17 +14,22 @@ import (
 // ConvertNodesToRequests converts a slice of nodes into a slice of build requests.
 // - It will determine if the cache can be used for prebuilt nodes.
 // - It will group similar build nodes together into AncillaryNodes.
-func ConvertNodesToRequests(pkgGraph *pkggraph.PkgGraph, graphMutex *sync.RWMutex, nodesToBuild []*pkggraph.PkgNode, packagesToRebuild []string, buildState *GraphBuildState, isCacheAllowed bool) (requests []*BuildRequest) {
-	graphMutex.RLock()
-	defer graphMutex.RUnlock()
+func ConvertNodesToRequests(pkgGraph *pkggraph.PkgGraph, nodesToBuild []*pkggraph.PkgNode, packagesToRebuild []string, buildState *GraphBuildState, isCacheAllowed bool) (requests []*BuildRequest) {
+	pkgGraph.RLock()
+	defer pkgGraph.RUnlock()
 
 	// Group build nodes together as they will be unblocked all at once for any given SRPM,
 	// and building a single build node will result in all of them becoming available.
+	// The bootstrap stage of an SRPM is a separate build, so its build nodes are grouped on their own.
 	buildNodes := make(map[string][]*pkggraph.PkgNode)
 
 	for _, node := range nodesToBuild {
 		if node.Type == pkggraph.TypeBuild {
-			buildNodes[node.SrpmPath] = append(buildNodes[node.SrpmPath], node)
+			groupKey := node.SrpmPath
+			if node.Bcond != "" {
+				groupKey = fmt.Sprintf("%s (%s)", node.SrpmPath, node.Bcond)
+			}
+			buildNodes[groupKey] = append(buildNodes[groupKey], node)
 			continue
 		}
 
@@ -4,8 +4,7 @@
 package schedulerutils
 
 import (
-	"path/filepath"
-	"sync"
+	"strings"
 
 	"microsoft.com/pkggen/internal/logger"
 	"microsoft.com/pkggen/internal/pkggraph"
@@ -16,10 +15,25 @@ func PrintBuildResult(res *BuildResult) {
 	baseSRPMName := res.Node.SRPMFileName()
 
 	if res.Err != nil {
-		logger.Log.Errorf("Failed to build %s, error: %s, for details see: %s", baseSRPMName, res.Err, res.LogFile)
+		switch {
+		case res.FailureReason != "":
+			logger.Log.Errorf("Failed to build %s (%s), for details see: %s", baseSRPMName, res.FailureReason, res.LogFile)
+		case res.FailureCategory != "":
+			logger.Log.Errorf("Failed to build %s (likely cause: %s), for details see: %s", baseSRPMName, res.FailureCategory, res.LogFile)
+		default:
+			logger.Log.Errorf("Failed to build %s, error: %s, for details see: %s", baseSRPMName, res.Err, res.LogFile)
+		}
+
+		if res.FailureExcerpt != "" {
+			logger.Log.Errorf("Excerpt from the build log of %s:\n%s", baseSRPMName, res.FailureExcerpt)
+		}
 		return
 	}
 
+	if res.Check != nil && !res.Check.Passed {
+		logger.Log.Warnf("The check of %s failed, but its failure is not fatal, for details see: %s", baseSRPMName, res.LogFile)
+	}
+
 	if res.Node.Type == pkggraph.TypeBuild {
 		if res.Skipped {
 			logger.Log.Warnf("Skipped build for '%s' per user request. RPMs expected to be present: %v", baseSRPMName, res.BuiltFiles)
@@ -34,44 +48,22 @@ func PrintBuildResult(res *BuildResult) {
 }
 
 // PrintBuildSummary prints the summary of the entire build to the logger.
-func PrintBuildSummary(pkgGraph *pkggraph.PkgGraph, graphMutex *sync.RWMutex, buildState *GraphBuildState) {
-	graphMutex.RLock()
-	defer graphMutex.RUnlock()
-
-	failedSRPMs := make(map[string]bool)
-	failures := buildState.BuildFailures()
-	for _, failure := range failures {
-		failedSRPMs[failure.Node.SrpmPath] = true
-	}
-
-	prebuiltSRPMs := make(map[string]bool)
-	builtSRPMs := make(map[string]bool)
-	unbuiltSRPMs := make(map[string]bool)
-	unresolvedDependencies := make(map[string]bool)
-	rpmConflicts := buildState.ConflictingRPMs()
-	srpmConflicts := buildState.ConflictingSRPMs()
-
-	buildNodes := pkgGraph.AllBuildNodes()
-	for _, node := range buildNodes {
-		if buildState.IsNodeCached(node) {
-			prebuiltSRPMs[node.SrpmPath] = true
-			continue
-		} else if buildState.IsNodeAvailable(node) {
-			builtSRPMs[node.SrpmPath] = true
-			continue
-		}
-
-		_, found := failedSRPMs[node.SrpmPath]
-		if !found {
-			unbuiltSRPMs[node.SrpmPath] = true
-		}
-	}
-
-	for _, node := range pkgGraph.AllRunNodes() {
-		if node.State == pkggraph.StateUnresolved {
-			unresolvedDependencies[node.VersionedPkg.Name] = true
-		}
-	}
+func PrintBuildSummary(summary *BuildSummary) {
+	builtSRPMs := summary.SRPMsInState(SRPMStateBuilt)
+	builtSRPMs = append(builtSRPMs, summary.SRPMsInState(SRPMStateSkipped)...)
+	prebuiltSRPMs := summary.SRPMsInState(SRPMStateCached)
+	failedSRPMs := summary.SRPMsInState(SRPMStateFailed)
+	unbuiltSRPMs := summary.SRPMsInState(SRPMStateBlocked)
+	cancelledSRPMs := summary.SRPMsInState(SRPMStateCancelled)
+	passedChecks := summary.SRPMsInCheckState(CheckStatePassed)
+	failedChecks := summary.SRPMsInCheckState(CheckStateFailed)
+	failedChecks = append(failedChecks, summary.SRPMsInCheckState(CheckStateFailedNonFatal)...)
+	availableGoals := summary.GoalsInState(GoalStateAvailable)
+	achievableGoals := summary.GoalsInState(GoalStateAchievable)
+	blockedGoals := summary.GoalsInState(GoalStateBlocked)
+	unresolvedDependencies := summary.UnresolvedDependencies
+	rpmConflicts := summary.ConflictingRPMs
+	srpmConflicts := summary.ConflictingSRPMs
 
 	logger.Log.Info("---------------------------")
 	logger.Log.Info("--------- Summary ---------")
@@ -79,9 +71,14 @@ func PrintBuildSummary(pkgGraph *pkggraph.PkgGraph, graphMutex *sync.RWMutex, bu
 
 	logger.Log.Infof("Number of built SRPMs:             %d", len(builtSRPMs))
 	logger.Log.Infof("Number of prebuilt SRPMs:          %d", len(prebuiltSRPMs))
-	logger.Log.Infof("Number of failed SRPMs:            %d", len(failures))
+	logger.Log.Infof("Number of failed SRPMs:            %d", len(failedSRPMs))
 	logger.Log.Infof("Number of blocked SRPMs:           %d", len(unbuiltSRPMs))
+	logger.Log.Infof("Number of cancelled SRPMs:         %d", len(cancelledSRPMs))
 	logger.Log.Infof("Number of unresolved dependencies: %d", len(unresolvedDependencies))
+	if len(passedChecks) > 0 || len(failedChecks) > 0 {
+		logger.Log.Infof("Number of passed checks:           %d", len(passedChecks))
+		logger.Log.Infof("Number of failed checks:           %d", len(failedChecks))
+	}
 	if len(rpmConflicts) > 0 || len(srpmConflicts) > 0 {
 		logger.Log.Errorf("Number of toolchain RPM conflicts: %d", len(rpmConflicts))
 		logger.Log.Errorf("Number of toolchain SRPM conflicts: %d", len(srpmConflicts))
@@ -92,35 +89,61 @@ func PrintBuildSummary(pkgGraph *pkggraph.PkgGraph, graphMutex *sync.RWMutex, bu
 
 	if len(builtSRPMs) != 0 {
 		logger.Log.Info("Built SRPMs:")
-		for srpm := range builtSRPMs {
-			logger.Log.Infof("--> %s", filepath.Base(srpm))
+		for _, srpm := range builtSRPMs {
+			logger.Log.Infof("--> %s", srpm.Name)
 		}
 	}
 
 	if len(prebuiltSRPMs) != 0 {
 		logger.Log.Info("Prebuilt SRPMs:")
-		for srpm := range prebuiltSRPMs {
-			logger.Log.Infof("--> %s", filepath.Base(srpm))
+		for _, srpm := range prebuiltSRPMs {
+			logger.Log.Infof("--> %s", srpm.Name)
 		}
 	}
 
-	if len(failures) != 0 {
+	if len(failedSRPMs) != 0 {
 		logger.Log.Info("Failed SRPMs:")
-		for _, failure := range failures {
-			logger.Log.Infof("--> %s , error: %s, for details see: %s", failure.Node.SRPMFileName(), failure.Err, failure.LogFile)
+		for _, srpm := range failedSRPMs {
+			if srpm.FailureCategory != "" {
+				logger.Log.Infof("--> %s , error: %s, likely cause: %s, for details see: %s", srpm.Name, srpm.Error, srpm.FailureCategory, srpm.LogFile)
+			} else {
+				logger.Log.Infof("--> %s , error: %s, for details see: %s", srpm.Name, srpm.Error, srpm.LogFile)
+			}
+		}
+	}
+
+	if len(failedChecks) != 0 {
+		logger.Log.Info("Failed checks:")
+		for _, srpm := range failedChecks {
+			if srpm.CheckState == CheckStateFailedNonFatal {
+				logger.Log.Infof("--> %s (non-fatal), for details see: %s", srpm.Name, srpm.LogFile)
+			} else {
+				logger.Log.Infof("--> %s , for details see: %s", srpm.Name, srpm.LogFile)
+			}
 		}
 	}
 
 	if len(unbuiltSRPMs) != 0 {
 		logger.Log.Info("Blocked SRPMs:")
-		for srpm := range unbuiltSRPMs {
-			logger.Log.Infof("--> %s", filepath.Base(srpm))
+		for _, srpm := range unbuiltSRPMs {
+			if len(srpm.BlockedBy) != 0 {
+				logger.Log.Infof("--> %s , blocked by: %s", srpm.Name, strings.Join(srpm.BlockedBy, ", "))
+			} else {
+				logger.Log.Infof("--> %s", srpm.Name)
+			}
+		}
+	}
+
+	if len(cancelledSRPMs) != 0 {
+		logger.Log.Info("Cancelled SRPMs:")
+		for _, srpm := range cancelledSRPMs {
+			logger.Log.Infof("--> %s", srpm.Name)
 		}
 	}
 
 	if len(unresolvedDependencies) != 0 {
 		logger.Log.Info("Unresolved dependencies:")
-		for dependency := range unresolvedDependencies {
+		for _, dependency := range unresolvedDependencies {
 			logger.Log.Infof("--> %s", dependency)
 		}
 	}
@@ -138,4 +161,22 @@ func PrintBuildSummary(pkgGraph *pkggraph.PkgGraph, graphMutex *sync.RWMutex, bu
 			logger.Log.Errorf("--> %s", conflict)
 		}
 	}
+
+	if len(summary.Goals) != 0 {
+		logger.Log.Infof("Requested packages available:      %d/%d", len(availableGoals), len(summary.Goals))
+	}
+
+	if len(achievableGoals) != 0 {
+		logger.Log.Info("Requested packages not built, but not blocked by a failure:")
+		for _, goal := range achievableGoals {
+			logger.Log.Infof("--> %s", goal.Name)
+		}
+	}
+
+	if len(blockedGoals) != 0 {
+		logger.Log.Info("Requested packages blocked by a failure:")
+		for _, goal := range blockedGoals {
+			logger.Log.Infof("--> %s , blocked by: %s", goal.Name, strings.Join(goal.BlockedBy, ", "))
+		}
+	}
 }
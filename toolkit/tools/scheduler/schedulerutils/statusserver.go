@@ -0,0 +1,147 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package schedulerutils
+
+import (
+	"encoding/json"
+	"html/template"
+	"net"
+	"net/http"
+	"time"
+
+	"microsoft.com/pkggen/internal/logger"
+)
+
+const (
+	// StatusPagePath serves a human readable page showing the build's progress.
+	StatusPagePath = "/"
+	// StatusJSONPath serves the build's progress as a JSON BuildStatusReport.
+	StatusJSONPath = "/status"
+
+	// statusPageRefreshSeconds is how often the status page reloads itself.
+	statusPageRefreshSeconds = 10
+)
+
+var statusPageTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"since": func(t time.Time) string {
+		return time.Since(t).Round(time.Second).String()
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+{{if not .Report.Finished}}<meta http-equiv="refresh" content="{{.RefreshSeconds}}">{{end}}
+<title>Package build status</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 2px 8px; text-align: left; }
+</style>
+</head>
+<body>
+<h1>Package build {{if .Report.Finished}}finished{{else}}in progress{{end}}</h1>
+<table>
+<tr><th>Elapsed</th><td>{{since .Report.StartTime}}</td></tr>
+<tr><th>Estimated time remaining</th><td>{{if .Report.EstimatedTimeRemaining}}{{.Report.EstimatedTimeRemaining}}{{else}}unknown{{end}}</td></tr>
+<tr><th>Completed SRPMs</th><td>{{.Report.CompletedSRPMs}}</td></tr>
+<tr><th>Failed SRPMs</th><td>{{len .Report.FailedSRPMs}}</td></tr>
+<tr><th>Queued builds</th><td>{{.Report.QueuedBuilds}}</td></tr>
+<tr><th>Active SRPMs</th><td>{{len .Report.ActiveSRPMs}}</td></tr>
+</table>
+<h2>Workers</h2>
+<table>
+<tr><th>Worker</th><th>SRPM</th><th>Building for</th></tr>
+{{range .Report.Workers}}<tr><td>{{.Worker}}</td>{{if .SRPM}}<td>{{.SRPM}}</td><td>{{since .StartTime}}</td>{{else}}<td>idle</td><td></td>{{end}}</tr>
+{{end}}</table>
+{{if .Report.FailedSRPMs}}<h2>Failed SRPMs</h2>
+<ul>
+{{range .Report.FailedSRPMs}}<li>{{.}}</li>
+{{end}}</ul>
+{{end}}<p><a href="{{.JSONPath}}">JSON</a></p>
+</body>
+</html>
+`))
+
+// StatusServer serves the progress of a package build over HTTP.
+type StatusServer struct {
+	status *BuildStatus
+	server *http.Server
+}
+
+// StartStatusServer starts serving the progress of a package build on address.
+// The server only exposes read-only information about the build and has no authentication.
+func StartStatusServer(address string, status *BuildStatus) (s *StatusServer, err error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return
+	}
+
+	s = &StatusServer{
+		status: status,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(StatusPagePath, s.handlePage)
+	mux.HandleFunc(StatusJSONPath, s.handleJSON)
+	s.server = &http.Server{Handler: mux}
+
+	logger.Log.Infof("Serving build status on http://%s", listener.Addr())
+
+	go func() {
+		serveErr := s.server.Serve(listener)
+		if serveErr != http.ErrServerClosed {
+			logger.Log.Warnf("Build status server stopped, error: %s", serveErr)
+		}
+	}()
+
+	return
+}
+
+// Close stops the server.
+func (s *StatusServer) Close() error {
+	return s.server.Close()
+}
+
+// handleJSON sends the build's progress as JSON.
+func (s *StatusServer) handleJSON(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(resp, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(resp).Encode(s.status.Report())
+	if err != nil {
+		logger.Log.Warnf("Failed to send build status, error: %s", err)
+	}
+}
+
+// handlePage sends the build's progress as an HTML page.
+func (s *StatusServer) handlePage(resp http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != StatusPagePath {
+		http.NotFound(resp, req)
+		return
+	}
+
+	if req.Method != http.MethodGet {
+		http.Error(resp, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	page := struct {
+		Report         BuildStatusReport
+		RefreshSeconds int
+		JSONPath       string
+	}{
+		Report:         s.status.Report(),
+		RefreshSeconds: statusPageRefreshSeconds,
+		JSONPath:       StatusJSONPath,
+	}
+
+	resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := statusPageTemplate.Execute(resp, page)
+	if err != nil {
+		logger.Log.Warnf("Failed to send build status page, error: %s", err)
+	}
+}
@@ -19,6 +19,7 @@ import (
 	"microsoft.com/pkggen/internal/file"
 	"microsoft.com/pkggen/internal/rpm"
 	"microsoft.com/pkggen/internal/safechroot"
+	"microsoft.com/pkggen/internal/sliceutils"
 
 	"github.com/jinzhu/copier"
 	"gopkg.in/alecthomas/kingpin.v2"
@@ -38,18 +39,22 @@ type parseResult struct {
 }
 
 var (
-	app       = kingpin.New("specreader", "A tool to parse spec dependencies into JSON")
-	specsDir  = exe.InputDirFlag(app, "Directory to scan for SPECS")
-	output    = exe.OutputFlag(app, "Output file to export the JSON")
-	workers   = app.Flag("workers", "Number of concurrent goroutines to parse with").Default(defaultWorkerCount).Int()
-	buildDir  = app.Flag("build-dir", "Directory to store temporary files while parsing.").String()
-	srpmsDir  = app.Flag("srpm-dir", "Directory containing SRPMs.").Required().ExistingDir()
-	rpmsDir   = app.Flag("rpm-dir", "Directory containing built RPMs.").Required().ExistingDir()
-	distTag   = app.Flag("dist-tag", "The distribution tag the SPEC will be built with.").Required().String()
-	workerTar = app.Flag("worker-tar", "Full path to worker_chroot.tar.gz.  If this argument is empty, specs will be parsed in the host environment.").ExistingFile()
-	runCheck  = app.Flag("run-check", "Whether or not to run the spec file's check section during package build.").Bool()
-	logFile   = exe.LogFileFlag(app)
-	logLevel  = exe.LogLevelFlag(app)
+	app                = kingpin.New("specreader", "A tool to parse spec dependencies into JSON")
+	specsDir           = exe.InputDirFlag(app, "Directory to scan for SPECS")
+	output             = exe.OutputFlag(app, "Output file to export the JSON")
+	workers            = app.Flag("workers", "Number of concurrent goroutines to parse with").Default(defaultWorkerCount).Int()
+	buildDir           = app.Flag("build-dir", "Directory to store temporary files while parsing.").String()
+	srpmsDir           = app.Flag("srpm-dir", "Directory containing SRPMs.").Required().ExistingDir()
+	rpmsDir            = app.Flag("rpm-dir", "Directory containing built RPMs.").Required().ExistingDir()
+	distTag            = app.Flag("dist-tag", "The distribution tag the SPEC will be built with.").Required().String()
+	workerTar          = app.Flag("worker-tar", "Full path to worker_chroot.tar.gz.  If this argument is empty, specs will be parsed in the host environment.").ExistingFile()
+	runCheck           = app.Flag("run-check", "Whether or not to run the spec file's check section during package build.").Bool()
+	noDebug            = app.Flag("exclude-debug-packages", "Leave debuginfo and debugsource packages out of the output, for builds which keep them in a separate repository.").Bool()
+	debugRpmsDir       = app.Flag("debug-rpm-dir", "Directory the debuginfo and debugsource RPMs are kept in. Required by --include-debug-package.").String()
+	debugPackages      = app.Flag("include-debug-package", "Keep a debuginfo or debugsource package excluded by --exclude-debug-packages, so it may be built as a goal. Its RPM is expected in --debug-rpm-dir. May be repeated.").Strings()
+	bootstrapSpecsFile = app.Flag("bootstrap-specs-file", "Optional file listing the specs which may be built in a bootstrap stage to break build cycles. Each line holds a spec name, optionally followed by the bcond enabling the stage (default: bootstrap).").ExistingFile()
+	logFile            = exe.LogFileFlag(app)
+	logLevel           = exe.LogLevelFlag(app)
 )
 
 func main() {
@@ -61,13 +66,64 @@ func main() {
 		logger.Log.Panicf("Value in --workers must be greater than zero. Found %d", *workers)
 	}
 
-	err := parseSPECsWrapper(*buildDir, *specsDir, *rpmsDir, *srpmsDir, *distTag, *output, *workerTar, *workers, *runCheck)
+	if len(*debugPackages) > 0 && (!*noDebug || *debugRpmsDir == "") {
+		logger.Log.Panicf("--include-debug-package requires --exclude-debug-packages and --debug-rpm-dir")
+	}
+
+	bootstrapSpecs, err := readBootstrapSpecsFile(*bootstrapSpecsFile)
+	logger.PanicOnError(err, "Failed to read the bootstrap specs file (%s)", *bootstrapSpecsFile)
+
+	err = parseSPECsWrapper(*buildDir, *specsDir, *rpmsDir, *debugRpmsDir, *srpmsDir, *distTag, *output, *workerTar, *workers, *runCheck, *noDebug, *debugPackages, bootstrapSpecs)
 	logger.PanicOnError(err)
 }
 
+// readBootstrapSpecsFile reads the specs which may be built in a bootstrap stage, mapping each spec name to the bcond enabling the stage.
+// Each line of the file holds a spec name, optionally followed by a bcond. Empty lines and lines starting with '#' are ignored.
+func readBootstrapSpecsFile(path string) (bootstrapSpecs map[string]string, err error) {
+	const (
+		defaultBcond   = "bootstrap"
+		commentPrefix  = "#"
+		specNameField  = 0
+		bcondField     = 1
+		maxFieldsCount = 2
+	)
+
+	bootstrapSpecs = make(map[string]string)
+	if path == "" {
+		return
+	}
+
+	lines, err := file.ReadLines(path)
+	if err != nil {
+		return
+	}
+
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[specNameField], commentPrefix) {
+			continue
+		}
+
+		if len(fields) > maxFieldsCount {
+			err = fmt.Errorf("invalid line (%s), expected a spec name and an optional bcond", line)
+			return
+		}
+
+		bcond := defaultBcond
+		if len(fields) > bcondField {
+			bcond = fields[bcondField]
+		}
+
+		logger.Log.Debugf("Spec (%s) may be built in a bootstrap stage with (%s)", fields[specNameField], bcond)
+		bootstrapSpecs[fields[specNameField]] = bcond
+	}
+
+	return
+}
+
 // parseSPECsWrapper wraps parseSPECs to conditionally run it inside a chroot.
 // If workerTar is non-empty, parsing will occur inside a chroot, otherwise it will run on the host system.
-func parseSPECsWrapper(buildDir, specsDir, rpmsDir, srpmsDir, distTag, outputFile, workerTar string, workers int, runCheck bool) (err error) {
+func parseSPECsWrapper(buildDir, specsDir, rpmsDir, debugRpmsDir, srpmsDir, distTag, outputFile, workerTar string, workers int, runCheck, excludeDebugPackages bool, includedDebugPackages []string, bootstrapSpecs map[string]string) (err error) {
 	var (
 		chroot      *safechroot.Chroot
 		packageRepo *pkgjson.PackageRepo
@@ -84,7 +140,7 @@ func parseSPECsWrapper(buildDir, specsDir, rpmsDir, srpmsDir, distTag, outputFil
 
 	doParse := func() error {
 		var parseError error
-		packageRepo, parseError = parseSPECs(specsDir, rpmsDir, srpmsDir, distTag, workers, runCheck)
+		packageRepo, parseError = parseSPECs(specsDir, rpmsDir, debugRpmsDir, srpmsDir, distTag, workers, runCheck, excludeDebugPackages, includedDebugPackages, bootstrapSpecs)
 		return parseError
 	}
 
@@ -161,7 +217,9 @@ func createChroot(workerTar, buildDir, specsDir, srpmsDir string) (chroot *safec
 }
 
 // parseSPECs will parse all specs in specsDir and return a summary of the SPECs.
-func parseSPECs(specsDir, rpmsDir, srpmsDir, distTag string, workers int, runCheck bool) (packageRepo *pkgjson.PackageRepo, err error) {
+// - includedDebugPackages are the debug packages kept despite excludeDebugPackages, with their RPMs in debugRpmsDir.
+// - bootstrapSpecs maps the names of specs which may be built in a bootstrap stage to the bcond enabling the stage.
+func parseSPECs(specsDir, rpmsDir, debugRpmsDir, srpmsDir, distTag string, workers int, runCheck, excludeDebugPackages bool, includedDebugPackages []string, bootstrapSpecs map[string]string) (packageRepo *pkgjson.PackageRepo, err error) {
 	var (
 		packageList []*pkgjson.Package
 		wg          sync.WaitGroup
@@ -187,7 +245,7 @@ func parseSPECs(specsDir, rpmsDir, srpmsDir, distTag string, workers int, runChe
 	// Start the workers now so they begin working as soon as a new job is buffered.
 	for i := 0; i < workers; i++ {
 		wg.Add(1)
-		go readSpecWorker(requests, results, cancel, &wg, distTag, rpmsDir, srpmsDir, runCheck)
+		go readSpecWorker(requests, results, cancel, &wg, distTag, rpmsDir, srpmsDir, runCheck, bootstrapSpecs)
 	}
 
 	for _, specFile := range specFiles {
@@ -214,12 +272,48 @@ func parseSPECs(specsDir, rpmsDir, srpmsDir, distTag string, workers int, runChe
 		return
 	}
 
+	if excludeDebugPackages {
+		packageList, err = removeDebugPackages(packageList, rpmsDir, debugRpmsDir, includedDebugPackages)
+		if err != nil {
+			return
+		}
+	}
+
 	packageRepo.Repo = packageList
 	sortPackages(packageRepo)
 
 	return
 }
 
+// removeDebugPackages removes every package provided by a debuginfo or debugsource RPM from a package list.
+// Packages provided by the RPMs of includedDebugPackages are kept instead, with their RPM moved from rpmsDir to debugRpmsDir.
+func removeDebugPackages(packageList []*pkgjson.Package, rpmsDir, debugRpmsDir string, includedDebugPackages []string) (filteredList []*pkgjson.Package, err error) {
+	for _, pkg := range packageList {
+		if !rpm.IsDebugRPMFile(pkg.RpmPath) {
+			filteredList = append(filteredList, pkg)
+			continue
+		}
+
+		packageName, _ := rpm.PackageNameFromRPMFile(pkg.RpmPath)
+		if !sliceutils.Contains(includedDebugPackages, packageName, sliceutils.StringMatch) {
+			logger.Log.Tracef("Excluding debug package (%s)", pkg.Provides)
+			continue
+		}
+
+		var relPath string
+		relPath, err = filepath.Rel(rpmsDir, pkg.RpmPath)
+		if err != nil {
+			return
+		}
+
+		logger.Log.Debugf("Keeping debug package (%s) from (%s)", pkg.Provides, packageName)
+		pkg.RpmPath = filepath.Join(debugRpmsDir, relPath)
+		filteredList = append(filteredList, pkg)
+	}
+
+	return
+}
+
 // sortPackages orders the package lists into reasonable and deterministic orders.
 // Sort the main package list by "Name", "Version", "SRPM"
 // Sort each nested Requires/BuildRequires by "Name", "Version"
@@ -241,13 +335,18 @@ func sortPackages(packageRepo *pkgjson.PackageRepo) {
 			jName := pkg.BuildRequires[j].Name + pkg.BuildRequires[j].Version
 			return strings.Compare(iName, jName) < 0
 		})
+		sort.Slice(pkg.BootstrapBuildRequires, func(i, j int) bool {
+			iName := pkg.BootstrapBuildRequires[i].Name + pkg.BootstrapBuildRequires[i].Version
+			jName := pkg.BootstrapBuildRequires[j].Name + pkg.BootstrapBuildRequires[j].Version
+			return strings.Compare(iName, jName) < 0
+		})
 	}
 }
 
 // readspec is a goroutine that takes a full filepath to a spec file and scrapes it into the Specdef structure
 // Concurrency is limited by the size of the semaphore channel passed in. Too many goroutines at once can deplete
 // available filehandles.
-func readSpecWorker(requests <-chan string, results chan<- *parseResult, cancel <-chan struct{}, wg *sync.WaitGroup, distTag, rpmsDir, srpmsDir string, runCheck bool) {
+func readSpecWorker(requests <-chan string, results chan<- *parseResult, cancel <-chan struct{}, wg *sync.WaitGroup, distTag, rpmsDir, srpmsDir string, runCheck bool, bootstrapSpecs map[string]string) {
 	const (
 		emptyQueryFormat      = ``
 		querySrpm             = `%{NAME}-%{VERSION}-%{RELEASE}.src.rpm`
@@ -318,6 +417,27 @@ func readSpecWorker(requests <-chan string, results chan<- *parseResult, cancel
 			}
 		}
 
+		// Specs which may be built in a bootstrap stage also record their BuildRequires with the stage's bcond enabled.
+		bootstrapBcond := bootstrapSpecs[strings.TrimSuffix(filepath.Base(specfile), ".spec")]
+		bootstrapBuildRequiresList := []*pkgjson.PackageVer{}
+		if bootstrapBcond != "" {
+			bootstrapDefines := make(map[string]string, len(defines)+1)
+			for define, value := range defines {
+				bootstrapDefines[define] = value
+			}
+			rpm.EnableBcond(bootstrapDefines, bootstrapBcond)
+
+			queryResults, err = rpm.QuerySPEC(specfile, sourcedir, emptyQueryFormat, bootstrapDefines, rpm.BuildRequiresArgument)
+			if err == nil && len(queryResults) != 0 {
+				bootstrapBuildRequiresList, err = parsePackageVersionList(queryResults)
+			}
+			if err != nil {
+				result.err = fmt.Errorf("failed to query the BuildRequires of (%s) with (%s):\n%w", specfile, bootstrapBcond, err)
+				results <- result
+				continue
+			}
+		}
+
 		// Every package provided by a spec will have the same BuildRequires and SrpmPath
 		for i := range providerList {
 			providerList[i].SpecPath = specfile
@@ -331,6 +451,14 @@ func readSpecWorker(requests <-chan string, results chan<- *parseResult, cancel
 			if err != nil {
 				break
 			}
+
+			if bootstrapBcond != "" {
+				providerList[i].BootstrapBcond = bootstrapBcond
+				providerList[i].BootstrapBuildRequires, err = condensePackageVersionArray(bootstrapBuildRequiresList, specfile)
+				if err != nil {
+					break
+				}
+			}
 		}
 
 		if err != nil {